@@ -3,6 +3,6 @@ module gitlab.engr.illinois.edu/asehgal4/cs425mps
 go 1.19
 
 require (
-	github.com/orcaman/concurrent-map/v2 v2.0.1 // indirect
-	github.com/wk8/go-ordered-map v1.0.0 // indirect
+	github.com/orcaman/concurrent-map/v2 v2.0.1
+	github.com/wk8/go-ordered-map v1.0.0
 )
@@ -1,10 +1,12 @@
 package maplejuice
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 
 	maplejuiceUtils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/mapleJuiceUtils"
 	mapleutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/mapleJuiceUtils"
@@ -13,11 +15,15 @@ import (
 	sdfsutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
-func InitiateJuicePhase(localExecFile string, nJuices uint32, sdfsPrefix string, sdfsDst string, deleteInput bool, partition maplejuiceUtils.PartitioningType) {
+func InitiateJuicePhase(localExecFile string, nJuices uint32, sdfsPrefix string, sdfsDst string, deleteInput bool, partition maplejuiceUtils.PartitioningType, outputTTL time.Duration) {
 	// Initiates the Juice phase via client command
 
 	// 1. GET all sdfs files' names associated with SdfsPrefix (1 file per unique key), call it SdfsPrefixKeys
-	sdfsPrefixKeys := sdfs_client.InitiateLsWithPrefix(sdfsPrefix)
+	sdfsPrefixKeys, err := sdfs_client.InitiateLsWithPrefix(context.Background(), sdfsPrefix)
+	if err != nil {
+		fmt.Println("Unable to list juice inputs. Aborting juice phase: ", err)
+		return
+	}
 	fmt.Println(sdfsPrefixKeys)
 
 	// 2. get an array of NJuices IPs from gossip memlist, call it JuiceDsts
@@ -34,7 +40,7 @@ func InitiateJuicePhase(localExecFile string, nJuices uint32, sdfsPrefix string,
 	for ipAddr, sdfsKeyFiles := range partitionedKeys {
 
 		// 5. SendJuiceTask(IpAddr, [sdfsKeyFiles])
-		err := SendJuiceTask(ipAddr, sdfsKeyFiles, i, localExecFile, sdfsPrefix, nJuices, sdfsDst)
+		err := SendJuiceTask(ipAddr, sdfsKeyFiles, i, localExecFile, sdfsPrefix, nJuices, sdfsDst, outputTTL)
 		if err != nil {
 			fmt.Printf("Error with sending juice task to ip addr %s, %v\n", ipAddr, err)
 		}
@@ -110,7 +116,7 @@ func PartitionKeys(sdfsPrefixKeys []string, juiceDsts []string, partition maplej
 	return rv
 }
 
-func SendJuiceTask(ipDest string, sdfsKeyFiles []string, nodeIdx uint32, localExecFile string, sdfsPrefix string, nJuices uint32, sdfsDst string) error {
+func SendJuiceTask(ipDest string, sdfsKeyFiles []string, nodeIdx uint32, localExecFile string, sdfsPrefix string, nJuices uint32, sdfsDst string, outputTTL time.Duration) error {
 	if ipDest == "" {
 		return errors.New("Ip destination was empty for sending juice task")
 	}
@@ -128,6 +134,7 @@ func SendJuiceTask(ipDest string, sdfsKeyFiles []string, nodeIdx uint32, localEx
 			SdfsExecFile:    localExecFile,
 			NumberOfMJTasks: nJuices,
 			SdfsDst:         sdfsDst,
+			OutputTTL:       outputTTL,
 		}
 
 		arr := Task.Marshal()
@@ -2,6 +2,7 @@ package maplejuice
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"fmt"
 	"hash/crc32"
@@ -10,6 +11,8 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"strings"
+	"time"
 
 	mapleutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/mapleJuiceUtils"
 	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
@@ -17,7 +20,7 @@ import (
 	sdfsutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
-func InitiateMaplePhase(localExecFile string, nMaples uint32, sdfsPrefix string, sdfsSrcDataset string, execFileArgs []string) {
+func InitiateMaplePhase(localExecFile string, nMaples uint32, sdfsPrefix string, sdfsSrcDataset string, execFileArgs []string, outputTTL time.Duration) {
 
 	// locations, locationErr := sdfsclient.SdfsClientMain(SdfsSrcDataset)
 	// if locationErr != nil {
@@ -35,22 +38,28 @@ func InitiateMaplePhase(localExecFile string, nMaples uint32, sdfsPrefix string,
 		SdfsExecFile:      localExecFile,
 		NumberOfMJTasks:   nMaples,
 		ExecFileArguments: execFileArgs,
+		OutputTTL:         outputTTL,
 	}
 
 	filesRead := make([]*os.File, 0)
 
-	sdfsFileNames := sdfsfuncs.InitiateLsWithPrefix(sdfsSrcDataset)
+	sdfsFileNames, err := sdfsfuncs.InitiateLsWithPrefix(context.Background(), sdfsSrcDataset)
+	if err != nil {
+		fmt.Println("Unable to list maple inputs. Aborting maple phase: ", err)
+		return
+	}
 	for _, sdfsFile := range sdfsFileNames {
-		blockLocations, locationErr := sdfsfuncs.SdfsClientMain(sdfsFile, true)
+		blockLocations, locationErr := sdfsfuncs.SdfsClientMain(context.Background(), sdfsFile, true)
 		if locationErr != nil {
 			fmt.Println("Error with sdfsclient main. Aborting Get command: ", locationErr)
 			return
 		}
 		log.Println(sdfsFile)
 		randomHash, _ := GenerateRandomHash()
-		sdfsfuncs.InitiateGetCommand(sdfsFile, randomHash+sdfsFile, blockLocations)
+		localCopy := randomHash + strings.ReplaceAll(sdfsFile, "/", "_") // Inputs can be in directories or snapshots
+		sdfsfuncs.InitiateGetCommand(context.Background(), sdfsFile, localCopy, blockLocations, sdfsutils.GetOptions{})
 
-		fp := mapleutils.OpenFile(randomHash+sdfsFile, os.O_RDONLY)
+		fp := mapleutils.OpenFile(localCopy, os.O_RDONLY)
 		if fp == nil {
 			continue
 		}
@@ -73,7 +82,7 @@ func InitiateMaplePhase(localExecFile string, nMaples uint32, sdfsPrefix string,
 			if err != nil {
 				mapleIps[ipIdx] = "redo"
 			}
-			sdfsutils.ReadSmallAck(conn)
+			sdfsutils.ReadStatus(conn)
 		}
 
 		ipsToConnections = sendAllLinesInAFile(mapleIps, ipsToConnections, fp, mapleTask)
@@ -170,7 +179,7 @@ func sendAllLinesInAFile(mapleIps []string, ipsToConnections map[string]net.Conn
 			if err != nil {
 				mapleIps[ipIdx] = "redo"
 			}
-			sdfsutils.ReadSmallAck(conn)
+			sdfsutils.ReadStatus(conn)
 		}
 		log.Printf("Connection exists")
 
@@ -2,11 +2,13 @@ package maplejuice
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"time"
 
 	maplejuiceutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/mapleJuiceUtils"
 	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
@@ -21,7 +23,7 @@ func HandleJuiceRequest(task *maplejuiceutils.MapleJuiceTask, conn *net.Conn) {
 	dstFile := task.SdfsDst
 
 	// CLI GET file locally
-	sdfs.CLIGet(sdfsFilename, sdfsFilename)
+	sdfs.CLIGet(sdfsFilename, sdfsFilename, sdfsutils.GetOptions{})
 	fmt.Println("Got file in juice follower: ", task.SdfsPrefix)
 
 	// Run exec file on input file
@@ -34,7 +36,7 @@ func HandleJuiceRequest(task *maplejuiceutils.MapleJuiceTask, conn *net.Conn) {
 		return
 	}
 
-	ParseOutput(task.NodeDesignation, string(output), dstFile, task.NumberOfMJTasks*uint32(sdfsutils.BLOCK_SIZE))
+	ParseOutput(task.NodeDesignation, string(output), dstFile, task.NumberOfMJTasks*uint32(sdfsutils.BLOCK_SIZE), task.OutputTTL)
 	fmt.Println("parsed output on juice task")
 
 	os.RemoveAll(sdfsFilename)
@@ -48,10 +50,15 @@ func HandleJuiceRequest(task *maplejuiceutils.MapleJuiceTask, conn *net.Conn) {
 
 }
 
-func ParseOutput(nodeIdx uint32, output string, dstSdfsFile string, fileSize uint32) error {
+func ParseOutput(nodeIdx uint32, output string, dstSdfsFile string, fileSize uint32, ttl time.Duration) error {
 	// Take the output, and append it to the dst sdfs file.
 	nodeIdxStr := strconv.FormatUint(uint64(nodeIdx), 10)
-	oFileName := sdfsutils.FILESYSTEM_ROOT + nodeIdxStr + "_" + dstSdfsFile
+	fileId, err := sdfs.CreateFile(context.Background(), dstSdfsFile, false, 0, int64(len(output)), sdfsutils.FileMetadata{UnevenBlocks: true}, ttl)
+	if err != nil {
+		fmt.Println("Unable to create juice output file: ", err)
+		return err
+	}
+	oFileName := sdfsutils.GetFileName(fileId, nodeIdxStr)
 
 	fmt.Println("Writing juice node to loacl fs: ", oFileName)
 	file := maplejuiceutils.OpenFile(oFileName, os.O_CREATE|os.O_APPEND|os.O_RDWR)
@@ -62,7 +69,7 @@ func ParseOutput(nodeIdx uint32, output string, dstSdfsFile string, fileSize uin
 	writer := bufio.NewWriter(file)
 
 	// Write data to the file
-	_, err := writer.WriteString(output)
+	_, err = writer.WriteString(output)
 	if err != nil {
 		fmt.Println("Error writing to file:", err)
 		return err
@@ -81,14 +88,21 @@ func ParseOutput(nodeIdx uint32, output string, dstSdfsFile string, fileSize uin
 		DataTargetIp:        sdfsutils.New19Byte(gossiputils.Ip),
 		AckTargetIp:         sdfsutils.New19Byte(gossiputils.Ip),
 		ConnectionOperation: sdfsutils.WRITE,
-		FileName:            sdfsutils.New1024Byte(dstSdfsFile),
+		FileName:            sdfsutils.New1024Byte(fileId),
 		OriginalFileSize:    int64(fileSize),
 		BlockIndex:          int64(nodeIdx),
 		DataSize:            int64(len(output)),
 		IsAck:               true,
+		Metadata:            sdfsutils.FileMetadata{UnevenBlocks: true},
 	}
 
-	sdfsutils.SendAckToMaster(SdfsAck)
+	err = sdfs.SendWriteAck(context.Background(), SdfsAck)
+	if err != nil {
+		// The leader never recorded the block, so don't leave it behind
+		fmt.Println("Juice output rejected: ", err)
+		os.Remove(oFileName)
+		return err
+	}
 	fmt.Println("Sent ack to master from juice follower")
 
 	return nil
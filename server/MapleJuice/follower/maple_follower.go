@@ -2,6 +2,7 @@ package maplejuice
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -9,9 +10,11 @@ import (
 	"os/exec"
 	"regexp"
 	"strconv"
+	"time"
 
 	maplejuiceutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/mapleJuiceUtils"
 	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	sdfs "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
 	sdfsutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
@@ -24,11 +27,15 @@ func HandleMapleRequest(task *maplejuiceutils.MapleJuiceTask, MapleConn net.Conn
 
 	log.Println("Block idx: ", blockIdx)
 
-	putAcksToSend := readAndStoreKeyValues(execOutputFp, blockIdx, task.SdfsPrefix, numMJTasks)
+	putAcksToSend := readAndStoreKeyValues(execOutputFp, blockIdx, task.SdfsPrefix, numMJTasks, task.OutputTTL)
 
 	for _, ack := range putAcksToSend {
-		masterConn := sdfsutils.SendAckToMaster(ack)
-		(*masterConn).Close()
+		err := sdfs.SendWriteAck(context.Background(), ack)
+		if err != nil {
+			// The leader never recorded the block, so don't leave it behind
+			fmt.Println("Maple output rejected: ", err)
+			os.Remove(sdfsutils.GetFileName(sdfsutils.BytesToString(ack.FileName[:]), strconv.FormatInt(ack.BlockIndex, 10)))
+		}
 	}
 
 	remoteAddr := MapleConn.RemoteAddr()
@@ -44,9 +51,10 @@ func HandleMapleRequest(task *maplejuiceutils.MapleJuiceTask, MapleConn net.Conn
 	// 4. send ack to sdfs master for locally created files.
 }
 
-func readAndStoreKeyValues(inputFp *os.File, blockIdx uint32, sdfsPrefix string, numberOfMJTasks uint32) []sdfsutils.Task {
+func readAndStoreKeyValues(inputFp *os.File, blockIdx uint32, sdfsPrefix string, numberOfMJTasks uint32, ttl time.Duration) []sdfsutils.Task {
 	// Create a scanner to read the file line by line
 	keyToFp := make(map[string]*os.File)
+	keyToFileId := make(map[string]string)
 	putAcksToSend := make([]sdfsutils.Task, 0)
 
 	scanner := bufio.NewScanner(inputFp)
@@ -55,7 +63,15 @@ func readAndStoreKeyValues(inputFp *os.File, blockIdx uint32, sdfsPrefix string,
 		key, value := getKeyValueFromLine(line)
 		_, exists := keyToFp[key]
 		if !exists {
-			blockToOpenPath := "server/sdfs/sdfsFileSystemRoot/" + strconv.Itoa(int(blockIdx)) + "_" + sdfsPrefix + "_" + key
+			// Every maple node producing this key gets the same storage id from the leader
+			fileId, err := sdfs.CreateFile(context.Background(), sdfsPrefix+"_"+key, false, 0, 0, sdfsutils.FileMetadata{}, ttl)
+			if err != nil {
+				fmt.Println("Unable to create intermediate file: ", err)
+				continue
+			}
+			keyToFileId[key] = fileId
+
+			blockToOpenPath := sdfsutils.GetFileName(fileId, strconv.Itoa(int(blockIdx)))
 			keyToFp[key] = maplejuiceutils.OpenFile(blockToOpenPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
 			defer keyToFp[key].Close()
 		}
@@ -68,8 +84,12 @@ func readAndStoreKeyValues(inputFp *os.File, blockIdx uint32, sdfsPrefix string,
 		fmt.Println("Error reading file:", err)
 	}
 
-	for key, _ := range keyToFp {
-		fileName := sdfsPrefix + "_" + key
+	for key, fp := range keyToFp {
+		fileName := keyToFileId[key]
+		var blockSize int64
+		if info, err := fp.Stat(); err == nil {
+			blockSize = info.Size()
+		}
 		task := sdfsutils.Task{
 			DataTargetIp:        sdfsutils.New19Byte(gossiputils.Ip),
 			AckTargetIp:         sdfsutils.New19Byte(gossiputils.Ip),
@@ -77,8 +97,9 @@ func readAndStoreKeyValues(inputFp *os.File, blockIdx uint32, sdfsPrefix string,
 			FileName:            sdfsutils.New1024Byte(fileName),
 			OriginalFileSize:    sdfsutils.BLOCK_SIZE * int64(numberOfMJTasks),
 			BlockIndex:          int64(blockIdx),
-			DataSize:            0,
+			DataSize:            blockSize,
 			IsAck:               true,
+			Metadata:            sdfsutils.FileMetadata{ReplicationFactor: 1, UnevenBlocks: true}, // Scratch intermediates only live on the node that produced them
 		}
 		putAcksToSend = append(putAcksToSend, task)
 	}
@@ -170,30 +191,33 @@ func ReplicateBlock(sdfsFilename string, blockIdx int64, ipDst string, originalF
 	}
 	fmt.Println("Got member from ip target")
 
-	conn, err := sdfsutils.OpenTCPConnection(ipDst, sdfsutils.SDFS_PORT)
+	connPtr, err := sdfsutils.SendTask(blockWritingTask, ipDst, false)
 	if err != nil {
 		fmt.Printf("error opening follower connection: %v\n", err)
 		return
 	}
-	fmt.Println("Opened connection to replication target")
+	conn := *connPtr
+	defer conn.Close()
+	fmt.Println("Sent write task to replication target")
 
-	marshalledBytesWritten, writeError := conn.Write(blockWritingTask.Marshal())
-	conn.Write([]byte{'\n'})
-	if writeError != nil {
-		fmt.Printf("Could not write struct to connection in client put: %v\n", writeError)
+	err = sdfsutils.ReadStatus(conn)
+	if err != nil {
+		fmt.Println("Replication target refused the block: ", err)
+		return
 	}
-
-	sdfsutils.ReadSmallAck(conn)
-	fmt.Println("Read small ack in put block")
+	fmt.Println("Read status in put block")
 
 	totalBytesWritten, writeErr := sdfsutils.BufferedWriteToConnection(conn, fp, int64(fileSize), 0)
 	fmt.Println("------BYTES_WRITTEN------: ", totalBytesWritten)
-	fmt.Println("------BYTES_WRITTEN marshalled------: ", marshalledBytesWritten)
 
 	if writeErr != nil { // If failure to write full block, redo loop
 		fmt.Println("connection broke early, rewrite block: ", writeErr)
 		return
 	}
-	sdfsutils.ReadSmallAck(conn)
-	fmt.Println("Read another small ack in put block")
+	err = sdfsutils.ReadStatus(conn)
+	if err != nil {
+		fmt.Println("Replication target failed to store the block: ", err)
+		return
+	}
+	fmt.Println("Read another status in put block")
 }
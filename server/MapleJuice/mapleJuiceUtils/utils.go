@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"time"
 )
 
 type MapleJuiceType int
@@ -25,6 +26,9 @@ const COMMAND_1 SQLCommandType = 0
 const COMMAND_2 SQLCommandType = 1
 const INVALID_COMMAND SQLCommandType = 2
 
+// Lifetime of the intermediate files the SQL and composition commands leave behind
+const INTERMEDIATE_OUTPUT_TTL = time.Hour
+
 const MAPLE_JUICE_PORT = "4000"
 const MAPLE_JUICE_ACK_PORT = "4001"
 
@@ -37,6 +41,7 @@ type MapleJuiceTask struct {
 	SdfsDst           string
 	SqlCommand        SQLCommandType
 	ExecFileArguments []string
+	OutputTTL         time.Duration // Lifetime of the sdfs files the task writes, forever if zero
 	// We also need to somehow track
 }
 
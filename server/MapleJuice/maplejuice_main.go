@@ -37,7 +37,7 @@ func MapleJuiceMainListener() {
 
 func HandleConnection(conn net.Conn) {
 	mapleJuiceTask, _ := maplejuiceutils.UnmarshalMapleJuiceTask(conn)
-	sdfsutils.SendSmallAck(conn) // TODO unsure
+	sdfsutils.SendStatus(conn, nil) // TODO unsure
 
 	if mapleJuiceTask.Type == maplejuiceutils.MAPLE {
 		followerutils.HandleMapleRequest(mapleJuiceTask, conn)
@@ -26,17 +26,17 @@ func ProcessSQLCommand(command string) {
 
 		randomHash, _ := maplejuiceclient.GenerateRandomHash()
 
-		maplejuiceclient.InitiateMaplePhase("sql_command_1_map_exec", 2, "command_1_map_out"+randomHash, parsedData["Dataset"], []string{"-p", parsedData["Pattern"]})
+		maplejuiceclient.InitiateMaplePhase("sql_command_1_map_exec", 2, "command_1_map_out"+randomHash, parsedData["Dataset"], []string{"-p", parsedData["Pattern"]}, maplejuiceutils.INTERMEDIATE_OUTPUT_TTL)
 		time.Sleep(time.Second * 2)
-		maplejuiceclient.InitiateJuicePhase("sql_command_1_reduce_exec", 2, "command_1_map_out"+randomHash, "command_1_reduce_out"+randomHash, false, maplejuiceutils.HASH)
+		maplejuiceclient.InitiateJuicePhase("sql_command_1_reduce_exec", 2, "command_1_map_out"+randomHash, "command_1_reduce_out"+randomHash, false, maplejuiceutils.HASH, 0)
 		// maplejuiceclient.InitiateJuicePhase()
 		fmt.Println("command_1_reduce_out" + randomHash)
 	} else if commandNumber == maplejuiceutils.COMMAND_2 {
-		maplejuiceclient.InitiateMaplePhase("sql_command_2_exec_1", 6, "command_2_M1", parsedData["D1"], []string{parsedData["LeftCondition"]})
-		maplejuiceclient.InitiateMaplePhase("sql_command_2_exec_1", 6, "command_2_M2", parsedData["D2"], []string{parsedData["RightCondition"]})
-		maplejuiceclient.InitiateJuicePhase("sql_command_2_reduce_exec_1", 6, "command_2_m1", "command_2_R", false, maplejuiceutils.HASH)
-		maplejuiceclient.InitiateJuicePhase("sql_command_2_reduce_exec_1", 6, "command_2_m1", "command_2_R", false, maplejuiceutils.HASH)
-		maplejuiceclient.InitiateMaplePhase("sql_command_2_exec_1", 6, "command_2_M1", parsedData["D1"], []string{parsedData["LeftCondition"]})
+		maplejuiceclient.InitiateMaplePhase("sql_command_2_exec_1", 6, "command_2_M1", parsedData["D1"], []string{parsedData["LeftCondition"]}, maplejuiceutils.INTERMEDIATE_OUTPUT_TTL)
+		maplejuiceclient.InitiateMaplePhase("sql_command_2_exec_1", 6, "command_2_M2", parsedData["D2"], []string{parsedData["RightCondition"]}, maplejuiceutils.INTERMEDIATE_OUTPUT_TTL)
+		maplejuiceclient.InitiateJuicePhase("sql_command_2_reduce_exec_1", 6, "command_2_m1", "command_2_R", false, maplejuiceutils.HASH, 0)
+		maplejuiceclient.InitiateJuicePhase("sql_command_2_reduce_exec_1", 6, "command_2_m1", "command_2_R", false, maplejuiceutils.HASH, 0)
+		maplejuiceclient.InitiateMaplePhase("sql_command_2_exec_1", 6, "command_2_M1", parsedData["D1"], []string{parsedData["LeftCondition"]}, maplejuiceutils.INTERMEDIATE_OUTPUT_TTL)
 
 	}
 }
@@ -78,8 +78,8 @@ func ProcessCompositionCommand(args []string) {
 	}
 	randomHash, _ := maplejuiceclient.GenerateRandomHash()
 	log.Printf("args: %s", args)
-	maplejuiceclient.InitiateMaplePhase("composition_map_exec", uint32(numMaples), "composition_map_out"+randomHash, srcDataset, []string{"-p", pattern})
+	maplejuiceclient.InitiateMaplePhase("composition_map_exec", uint32(numMaples), "composition_map_out"+randomHash, srcDataset, []string{"-p", pattern}, maplejuiceutils.INTERMEDIATE_OUTPUT_TTL)
 	time.Sleep(time.Second * 2)
-	maplejuiceclient.InitiateJuicePhase("composition_reduce_exec", uint32(numJuice), "composition_map_out"+randomHash, "composition_data_out", false, maplejuiceutils.HASH)
+	maplejuiceclient.InitiateJuicePhase("composition_reduce_exec", uint32(numJuice), "composition_map_out"+randomHash, "composition_data_out", false, maplejuiceutils.HASH, 0)
 
 }
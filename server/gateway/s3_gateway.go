@@ -0,0 +1,840 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// The S3 gateway lets S3 clients and SDKs use SDFS. Buckets are top level SDFS directories and keys are paths under
+// them, so the key 2023/vm1.log in bucket logs is the SDFS file logs/2023/vm1.log. Only path style requests
+// (http://<node>:4006/<bucket>/<key>) are understood, and request signatures are not checked. Objects go through
+// sdfs.Client, so they are written and read with the same leases and block paths as put and get.
+//
+// ETags are the MD5 of the object, or for a multipart upload the MD5 of its parts' MD5s, as S3 makes them. They are
+// stored with the version they tag, so gets, heads and listings return the same ETag the put did. Files written other
+// than through the gateway have none, and get an ETag made from the version's timestamp and size instead, with a "-"
+// in it so clients don't mistake it for an MD5.
+
+const S3_GATEWAY_PORT = "4006"
+const S3_GATEWAY_ENV = "SDFS_S3_GATEWAY"
+const S3_XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+const S3_MAX_KEYS = 1000
+const S3_MAX_PART_NUMBER = 10000
+const S3_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+type S3Gateway struct {
+	client    *sdfs.Client
+	uploadsMu sync.Mutex
+	uploads   map[string]*multipartUpload // upload id : upload
+}
+
+// A multipart upload in progress. Parts are spooled on this node until the upload completes.
+type multipartUpload struct {
+	mu     sync.Mutex // Held while a part is recorded or the upload completes
+	bucket string
+	key    string
+	dir    string         // Local directory holding the parts
+	parts  map[int][]byte // part number : MD5 of the part
+}
+
+func NewS3Gateway(client *sdfs.Client) *S3Gateway {
+	return &S3Gateway{client: client, uploads: make(map[string]*multipartUpload)}
+}
+
+// The gateway only runs on nodes started with SDFS_S3_GATEWAY=1, since it serves without checking credentials
+func S3GatewayEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(S3_GATEWAY_ENV))
+	return enabled
+}
+
+func InitializeS3Gateway() {
+	fmt.Println("S3 gateway is listening on port", S3_GATEWAY_PORT)
+	err := http.ListenAndServe(":"+S3_GATEWAY_PORT, NewS3Gateway(sdfs.NewClient()))
+	if err != nil {
+		fmt.Println("S3 gateway stopped: ", err)
+	}
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET is supported on the service")
+			return
+		}
+		g.listBuckets(w, r)
+		return
+	} else if !fs.ValidPath(bucket) {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidBucketName", "bucket names must be a single path element")
+		return
+	} else if key != "" && !fs.ValidPath(strings.TrimSuffix(key, "/")) {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "keys must be slash separated paths without empty, . or .. elements")
+		return
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodGet && query.Has("location"):
+			writeXML(w, http.StatusOK, locationConstraint{Xmlns: S3_XMLNS})
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			g.listObjectsV2(w, r, bucket)
+		case r.Method == http.MethodGet:
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 (list-type=2) is supported")
+		case r.Method == http.MethodPut:
+			g.createBucket(w, r, bucket)
+		case r.Method == http.MethodHead:
+			g.headBucket(w, r, bucket)
+		case r.Method == http.MethodDelete:
+			g.deleteBucket(w, r, bucket)
+		default:
+			writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported on buckets")
+		}
+		return
+	}
+
+	uploadId := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		g.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && uploadId != "":
+		g.completeMultipartUpload(w, r, bucket, key, uploadId)
+	case r.Method == http.MethodPut && uploadId != "":
+		g.uploadPart(w, r, bucket, key, uploadId)
+	case r.Method == http.MethodDelete && uploadId != "":
+		g.abortMultipartUpload(w, r, bucket, key, uploadId)
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported")
+	case r.Method == http.MethodPut:
+		g.putObject(w, r, bucket, key)
+	case r.Method == http.MethodGet:
+		g.getObject(w, r, bucket, key)
+	case r.Method == http.MethodHead:
+		g.headObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		g.deleteObject(w, r, bucket, key)
+	default:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported on objects")
+	}
+}
+
+func objectPath(bucket string, key string) string {
+	return bucket + "/" + strings.TrimSuffix(key, "/")
+}
+
+// Identifies a version of an object, see the note at the top of the file
+func objectETag(info *sdfs.FileInfo) string {
+	if etag := info.ETag(); etag != "" {
+		return etag
+	}
+	return fmt.Sprintf("\"%x-%d\"", info.ModTime().UnixNano(), info.Size())
+}
+
+func md5ETag(sum []byte) string {
+	return "\"" + hex.EncodeToString(sum) + "\""
+}
+
+// Responses
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
+
+type bucketInfo struct {
+	Name         string
+	CreationDate string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	Contents              []objectInfo
+	CommonPrefixes        []commonPrefix
+}
+
+type objectInfo struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	Parts []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status) // HEAD responses have no body
+		return
+	}
+	writeXML(w, status, s3Error{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+// Maps a Client error onto the closest S3 error. notFound is the code for a missing object or bucket.
+func writeSdfsError(w http.ResponseWriter, r *http.Request, err error, notFound string) {
+	switch {
+	case errors.Is(err, sdfs.ErrNotExist) || errors.Is(err, sdfs.ErrIsDir):
+		writeS3Error(w, r, http.StatusNotFound, notFound, err.Error())
+	case errors.Is(err, sdfs.ErrNotDir) || errors.Is(err, sdfs.ErrExist):
+		writeS3Error(w, r, http.StatusConflict, "InvalidRequest", err.Error())
+	case errors.Is(err, sdfs.ErrNotEmpty):
+		writeS3Error(w, r, http.StatusConflict, "BucketNotEmpty", err.Error())
+	case errors.Is(err, sdfs.ErrQuota):
+		writeS3Error(w, r, http.StatusForbidden, "QuotaExceeded", err.Error())
+	case errors.Is(err, sdfs.ErrUnavailable):
+		writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+	default:
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+// Replies NoSuchBucket and returns false unless bucket is an SDFS directory
+func (g *S3Gateway) checkBucket(w http.ResponseWriter, r *http.Request, bucket string) bool {
+	info, err := g.client.Stat(r.Context(), bucket)
+	if err == nil && !info.IsDir() {
+		err = sdfs.ErrNotExist
+	}
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchBucket")
+		return false
+	}
+	return true
+}
+
+// Buckets
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	infos, err := g.client.List(r.Context(), "")
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+
+	result := listAllMyBucketsResult{Xmlns: S3_XMLNS, Buckets: []bucketInfo{}}
+	for _, info := range infos {
+		if info.IsDir() {
+			result.Buckets = append(result.Buckets, bucketInfo{Name: info.Name(), CreationDate: info.ModTime().UTC().Format(S3_TIME_FORMAT)})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (g *S3Gateway) createBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	err := g.client.Mkdir(r.Context(), bucket)
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *S3Gateway) headBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if g.checkBucket(w, r, bucket) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Like S3, only an empty bucket can be deleted
+func (g *S3Gateway) deleteBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !g.checkBucket(w, r, bucket) {
+		return
+	}
+	err := g.client.RemoveDir(r.Context(), bucket, false)
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// A key or common prefix in a listing
+type listItem struct {
+	key      string
+	info     *sdfs.FileInfo // nil for a common prefix
+	isPrefix bool
+}
+
+// Keys in bucket starting with prefix, sorted, with the part of a key past the delimiter rolled up into a common
+// prefix. Directories that can't hold a matching key aren't listed, and with a "/" delimiter a directory is rolled up
+// without listing it at all.
+func (g *S3Gateway) collectKeys(r *http.Request, bucket string, prefix string, delimiter string) ([]listItem, error) {
+	var items []listItem
+	prefixes := make(map[string]bool)
+	addPrefix := func(p string) {
+		if !prefixes[p] {
+			prefixes[p] = true
+			items = append(items, listItem{key: p, isPrefix: true})
+		}
+	}
+
+	addKey := func(key string, info *sdfs.FileInfo) {
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				addPrefix(key[:len(prefix)+i+len(delimiter)])
+				return
+			}
+		}
+		items = append(items, listItem{key: key, info: info})
+	}
+
+	var walk func(dir string, keyDir string, dirInfo *sdfs.FileInfo) error
+	walk = func(dir string, keyDir string, dirInfo *sdfs.FileInfo) error {
+		infos, err := g.client.List(r.Context(), dir)
+		if err != nil {
+			return err
+		}
+
+		// An empty directory is what a folder marker put leaves, and is listed as one
+		if len(infos) == 0 && dirInfo != nil {
+			addKey(keyDir, dirInfo)
+		}
+
+		for _, info := range infos {
+			key := keyDir + info.Name()
+			if info.IsDir() {
+				dirKey := key + "/"
+				if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+					continue
+				} else if delimiter == "/" && strings.HasPrefix(dirKey, prefix) && len(dirKey) > len(prefix) {
+					addPrefix(dirKey)
+					continue
+				}
+				err := walk(dir+"/"+info.Name(), dirKey, info)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			addKey(key, info)
+		}
+		return nil
+	}
+
+	err := walk(bucket, "", nil)
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	return items, err
+}
+
+// Continuation tokens are the last key of the previous page
+func (g *S3Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	result := listBucketResult{
+		Xmlns:             S3_XMLNS,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           S3_MAX_KEYS,
+	}
+	if value := query.Get("max-keys"); value != "" {
+		maxKeys, err := strconv.Atoi(value)
+		if err != nil || maxKeys < 0 {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non negative integer")
+			return
+		}
+		if maxKeys < S3_MAX_KEYS {
+			result.MaxKeys = maxKeys
+		}
+	}
+
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		decoded, err := base64.URLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+			return
+		}
+		if string(decoded) > after {
+			after = string(decoded)
+		}
+	}
+
+	if !g.checkBucket(w, r, bucket) {
+		return
+	}
+	items, err := g.collectKeys(r, bucket, result.Prefix, result.Delimiter)
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+
+	start := sort.Search(len(items), func(i int) bool { return items[i].key > after })
+	items = items[start:]
+	if len(items) > result.MaxKeys {
+		items = items[:result.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(items[len(items)-1].key))
+	}
+
+	for _, item := range items {
+		if item.isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: item.key})
+			continue
+		}
+		etag := objectETag(item.info)
+		if item.info.IsDir() {
+			etag = md5ETag(md5.New().Sum(nil)) // Folder markers are empty
+		}
+		result.Contents = append(result.Contents, objectInfo{
+			Key:          item.key,
+			LastModified: item.info.ModTime().UTC().Format(S3_TIME_FORMAT),
+			ETag:         etag,
+			Size:         item.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(items)
+	writeXML(w, http.StatusOK, result)
+}
+
+// Objects
+
+// Request body with any aws-chunked framing removed
+func requestBody(r *http.Request) io.Reader {
+	if strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-") {
+		return &awsChunkedReader{reader: bufio.NewReader(r.Body)}
+	}
+	return r.Body
+}
+
+// SDKs that sign streaming uploads frame the body as "<hex size>;chunk-signature=<sig>\r\n<data>\r\n" chunks, ending
+// with a zero sized one. Signatures aren't checked, so only the data is kept.
+type awsChunkedReader struct {
+	reader    *bufio.Reader
+	remaining int64 // Bytes left in the current chunk
+	done      bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue // The line break after the previous chunk's data
+		}
+
+		sizeField, _, _ := strings.Cut(line, ";")
+		c.remaining, err = strconv.ParseInt(sizeField, 16, 64)
+		if err != nil || c.remaining < 0 {
+			return 0, fmt.Errorf("invalid aws-chunked chunk size %q", sizeField)
+		}
+		c.done = c.remaining == 0
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Digest the client sent in Content-MD5, nil if it sent none
+func contentMD5(r *http.Request) ([]byte, error) {
+	value := r.Header.Get("Content-MD5")
+	if value == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(sum) != md5.Size {
+		return nil, errBadDigest
+	}
+	return sum, nil
+}
+
+// Writes body to an SDFS file as a new version tagged with etag, or with its MD5 if etag is empty, and returns the
+// tag. If wantMD5 is set and the body doesn't match it, nothing reaches SDFS.
+func (g *S3Gateway) writeObject(r *http.Request, sdfsPath string, body io.Reader, wantMD5 []byte, etag string) (string, error) {
+	writer, err := g.client.Create(r.Context(), sdfsPath, utils.PutOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(writer, hash), body)
+	if err != nil {
+		writer.Abort()
+		return "", err
+	}
+	sum := hash.Sum(nil)
+	if wantMD5 != nil && !bytes.Equal(sum, wantMD5) {
+		writer.Abort()
+		return "", errBadDigest
+	}
+
+	if etag == "" {
+		etag = md5ETag(sum)
+	}
+	writer.SetETag(etag)
+	return etag, writer.Close()
+}
+
+var errBadDigest = errors.New("the Content-MD5 you specified did not match what was received")
+
+// A key ending in "/" is a folder marker, which becomes an SDFS directory
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	if !g.checkBucket(w, r, bucket) {
+		return
+	}
+
+	if strings.HasSuffix(key, "/") {
+		err := g.client.Mkdir(r.Context(), objectPath(bucket, key))
+		if err != nil {
+			writeSdfsError(w, r, err, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", md5ETag(md5.New().Sum(nil)))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var etag string
+	wantMD5, err := contentMD5(r)
+	if err == nil {
+		etag, err = g.writeObject(r, objectPath(bucket, key), requestBody(r), wantMD5, "")
+	}
+	if err == errBadDigest {
+		writeS3Error(w, r, http.StatusBadRequest, "BadDigest", err.Error())
+		return
+	} else if err != nil {
+		writeSdfsError(w, r, err, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func setObjectHeaders(w http.ResponseWriter, info *sdfs.FileInfo) {
+	w.Header().Set("ETag", objectETag(info))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "binary/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+// Ranges and conditional headers are handled by http.ServeContent, and only the blocks a range covers are fetched
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	reader, err := g.client.Open(r.Context(), objectPath(bucket, key))
+	if errors.Is(err, sdfs.ErrNotExist) && !g.checkBucket(w, r, bucket) {
+		return
+	} else if err != nil {
+		writeSdfsError(w, r, err, "NoSuchKey")
+		return
+	}
+	defer reader.Close()
+
+	info, _ := reader.Stat()
+	setObjectHeaders(w, info)
+	http.ServeContent(w, r, "", info.ModTime(), reader)
+}
+
+func (g *S3Gateway) headObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	info, err := g.client.Stat(r.Context(), objectPath(bucket, key))
+	if err == nil && info.IsDir() {
+		err = sdfs.ErrIsDir
+	}
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchKey")
+		return
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Deleted objects go to the SDFS trash. Like S3, deleting a missing key succeeds.
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	var err error
+	if strings.HasSuffix(key, "/") {
+		err = g.client.RemoveDir(r.Context(), objectPath(bucket, key), false)
+		if errors.Is(err, sdfs.ErrNotEmpty) {
+			err = nil // The keys under it keep the prefix alive, as they would in S3
+		}
+	} else {
+		err = g.client.Delete(r.Context(), objectPath(bucket, key))
+	}
+
+	if err != nil && !errors.Is(err, sdfs.ErrNotExist) {
+		writeSdfsError(w, r, err, "NoSuchKey")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Multipart uploads
+
+func newUploadId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	return hex.EncodeToString(id), err
+}
+
+func (g *S3Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	if !g.checkBucket(w, r, bucket) {
+		return
+	}
+
+	id, err := newUploadId()
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchUpload")
+		return
+	}
+	dir, err := os.MkdirTemp("", "s3-upload-")
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchUpload")
+		return
+	}
+
+	g.uploadsMu.Lock()
+	g.uploads[id] = &multipartUpload{bucket: bucket, key: key, dir: dir, parts: make(map[int][]byte)}
+	g.uploadsMu.Unlock()
+
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{Xmlns: S3_XMLNS, Bucket: bucket, Key: key, UploadId: id})
+}
+
+// An upload id is only good for the bucket and key the upload was created for, as in S3
+func (g *S3Gateway) getUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, id string) (*multipartUpload, bool) {
+	g.uploadsMu.Lock()
+	upload, ok := g.uploads[id]
+	g.uploadsMu.Unlock()
+	if ok && (upload.bucket != bucket || upload.key != key) {
+		ok = false
+	}
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "the upload does not exist, it may have been aborted or completed")
+	}
+	return upload, ok
+}
+
+func partPath(upload *multipartUpload, partNumber int) string {
+	return filepath.Join(upload.dir, fmt.Sprintf("part-%05d", partNumber))
+}
+
+// Uploading a part number again replaces the part
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket string, key string, id string) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > S3_MAX_PART_NUMBER {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("partNumber must be between 1 and %d", S3_MAX_PART_NUMBER))
+		return
+	}
+	upload, ok := g.getUpload(w, r, bucket, key, id)
+	if !ok {
+		return
+	}
+
+	// Parts are written next to their final name first, so a failed upload never replaces a good part
+	part, err := os.CreateTemp(upload.dir, "incoming-")
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchUpload")
+		return
+	}
+	defer os.Remove(part.Name())
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(part, hash), requestBody(r))
+	closeErr := part.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if wantMD5, err := contentMD5(r); err != nil || (wantMD5 != nil && !bytes.Equal(wantMD5, hash.Sum(nil))) {
+		writeS3Error(w, r, http.StatusBadRequest, "BadDigest", errBadDigest.Error())
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	err = os.Rename(part.Name(), partPath(upload, partNumber))
+	if err != nil {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "the upload was aborted or completed")
+		return
+	}
+	upload.parts[partNumber] = hash.Sum(nil)
+
+	w.Header().Set("ETag", md5ETag(upload.parts[partNumber]))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Joins the listed parts into one SDFS file, which is written like a put
+func (g *S3Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, id string) {
+	upload, ok := g.getUpload(w, r, bucket, key, id)
+	if !ok {
+		return
+	}
+
+	var request completeMultipartUpload
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil || len(request.Parts) == 0 {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedXML", "the request must list the parts to complete the upload with")
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	var partPaths []string
+	var digests []byte
+	for i, listed := range request.Parts {
+		if i > 0 && listed.PartNumber <= request.Parts[i-1].PartNumber {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+			return
+		}
+		sum, ok := upload.parts[listed.PartNumber]
+		if !ok || strings.Trim(listed.ETag, "\"") != hex.EncodeToString(sum) {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d was not uploaded or its ETag does not match", listed.PartNumber))
+			return
+		}
+		partPaths = append(partPaths, partPath(upload, listed.PartNumber))
+		digests = append(digests, sum...)
+	}
+
+	var parts []io.Reader
+	for _, partPath := range partPaths {
+		part, err := os.Open(partPath)
+		if err != nil {
+			writeSdfsError(w, r, err, "NoSuchUpload")
+			return
+		}
+		defer part.Close()
+		parts = append(parts, part)
+	}
+
+	etag := fmt.Sprintf("\"%x-%d\"", md5.Sum(digests), len(request.Parts)) // The way S3 tags multipart objects
+	_, err = g.writeObject(r, objectPath(bucket, key), io.MultiReader(parts...), nil, etag)
+	if err != nil {
+		writeSdfsError(w, r, err, "NoSuchKey")
+		return
+	}
+
+	g.uploadsMu.Lock()
+	delete(g.uploads, id)
+	g.uploadsMu.Unlock()
+	os.RemoveAll(upload.dir)
+
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:    S3_XMLNS,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag,
+	})
+}
+
+func (g *S3Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, id string) {
+	upload, ok := g.getUpload(w, r, bucket, key, id)
+	if !ok {
+		return
+	}
+
+	g.uploadsMu.Lock()
+	delete(g.uploads, id)
+	g.uploadsMu.Unlock()
+
+	upload.mu.Lock()
+	os.RemoveAll(upload.dir)
+	upload.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,296 @@
+package gateway
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfstest"
+)
+
+func newS3Server(t *testing.T) (*httptest.Server, *sdfstest.Cluster) {
+	t.Helper()
+	client, cluster := sdfstest.NewClient()
+	server := httptest.NewServer(NewS3Gateway(client))
+	t.Cleanup(server.Close)
+
+	response := s3Request(t, server, http.MethodPut, "/bucket", "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("creating the bucket: %s", response.Status)
+	}
+	return server, cluster
+}
+
+// Sends a request and reads its body into the returned response's Body
+func s3Request(t *testing.T, server *httptest.Server, method string, target string, body string, header http.Header) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body = io.NopCloser(strings.NewReader(string(data)))
+	return response
+}
+
+func readBody(t *testing.T, response *http.Response) string {
+	t.Helper()
+	data, _ := io.ReadAll(response.Body)
+	return string(data)
+}
+
+func errorCode(t *testing.T, response *http.Response) string {
+	t.Helper()
+	var s3Err s3Error
+	if err := xml.NewDecoder(response.Body).Decode(&s3Err); err != nil {
+		t.Fatalf("%s response has no S3 error: %v", response.Status, err)
+	}
+	return s3Err.Code
+}
+
+func TestS3Objects(t *testing.T) {
+	server, cluster := newS3Server(t)
+	const body = "hello, sdfs"
+	sum := md5.Sum([]byte(body))
+
+	response := s3Request(t, server, http.MethodPut, "/bucket/dir/object", body, nil)
+	if response.StatusCode != http.StatusOK || response.Header.Get("ETag") != md5ETag(sum[:]) {
+		t.Fatalf("PUT = %s, ETag %s", response.Status, response.Header.Get("ETag"))
+	} else if data, _ := cluster.ReadFile("bucket/dir/object"); string(data) != body {
+		t.Fatalf("PUT stored %q", data)
+	}
+
+	response = s3Request(t, server, http.MethodGet, "/bucket/dir/object", "", nil)
+	if got := readBody(t, response); response.StatusCode != http.StatusOK || got != body {
+		t.Errorf("GET = %s, %q", response.Status, got)
+	}
+
+	response = s3Request(t, server, http.MethodGet, "/bucket/dir/object", "", http.Header{"Range": {"bytes=7-"}})
+	if got := readBody(t, response); response.StatusCode != http.StatusPartialContent || got != "sdfs" {
+		t.Errorf("ranged GET = %s, %q", response.Status, got)
+	}
+
+	response = s3Request(t, server, http.MethodHead, "/bucket/dir/object", "", nil)
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Length") != fmt.Sprint(len(body)) {
+		t.Errorf("HEAD = %s, Content-Length %s", response.Status, response.Header.Get("Content-Length"))
+	} else if etag := response.Header.Get("ETag"); etag != md5ETag(sum[:]) {
+		t.Errorf("HEAD ETag = %s, want the PUT's %s", etag, md5ETag(sum[:]))
+	}
+
+	badDigest := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(make([]byte, md5.Size))}}
+	response = s3Request(t, server, http.MethodPut, "/bucket/dir/object", "replaced", badDigest)
+	if code := errorCode(t, response); code != "BadDigest" {
+		t.Errorf("PUT with a wrong Content-MD5 = %s", code)
+	} else if data, _ := cluster.ReadFile("bucket/dir/object"); string(data) != body {
+		t.Errorf("PUT with a wrong Content-MD5 replaced the object with %q", data)
+	}
+
+	response = s3Request(t, server, http.MethodDelete, "/bucket/dir/object", "", nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE = %s", response.Status)
+	} else if _, ok := cluster.ReadFile("bucket/dir/object"); ok {
+		t.Error("DELETE left the object")
+	}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/bucket/dir/object", http.StatusNotFound},
+		{http.MethodHead, "/bucket/dir/object", http.StatusNotFound},
+		{http.MethodDelete, "/bucket/dir/object", http.StatusNoContent},
+		{http.MethodGet, "/missing/object", http.StatusNotFound},
+		{http.MethodPut, "/missing/object", http.StatusNotFound},
+		{http.MethodGet, "/bucket/a/../b", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		response := s3Request(t, server, test.method, test.target, "", nil)
+		if response.StatusCode != test.status {
+			t.Errorf("%s %s = %s, want %d", test.method, test.target, response.Status, test.status)
+		}
+	}
+}
+
+func listObjects(t *testing.T, server *httptest.Server, query url.Values) listBucketResult {
+	t.Helper()
+	query.Set("list-type", "2")
+	response := s3Request(t, server, http.MethodGet, "/bucket?"+query.Encode(), "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("ListObjectsV2 %v = %s", query, response.Status)
+	}
+
+	var result listBucketResult
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func resultKeys(result listBucketResult) (keys []string, prefixes []string) {
+	for _, object := range result.Contents {
+		keys = append(keys, object.Key)
+	}
+	for _, prefix := range result.CommonPrefixes {
+		prefixes = append(prefixes, prefix.Prefix)
+	}
+	return keys, prefixes
+}
+
+func TestS3ListObjectsV2(t *testing.T) {
+	server, cluster := newS3Server(t)
+	keys := []string{"a", "b/1", "b/2", "b/c/3", "d", "e"}
+	for _, key := range keys {
+		cluster.WriteFile("bucket/"+key, []byte(key))
+	}
+	if response := s3Request(t, server, http.MethodPut, "/bucket/empty/", "", nil); response.StatusCode != http.StatusOK {
+		t.Fatalf("putting a folder marker: %s", response.Status)
+	}
+
+	tests := []struct {
+		name         string
+		query        url.Values
+		wantKeys     []string
+		wantPrefixes []string
+	}{
+		{"all", url.Values{}, []string{"a", "b/1", "b/2", "b/c/3", "d", "e", "empty/"}, nil},
+		{"prefix", url.Values{"prefix": {"b/"}}, []string{"b/1", "b/2", "b/c/3"}, nil},
+		{"delimiter", url.Values{"delimiter": {"/"}}, []string{"a", "d", "e"}, []string{"b/", "empty/"}},
+		{"prefix and delimiter", url.Values{"prefix": {"b/"}, "delimiter": {"/"}}, []string{"b/1", "b/2"}, []string{"b/c/"}},
+		{"folder marker", url.Values{"prefix": {"empty/"}, "delimiter": {"/"}}, []string{"empty/"}, nil},
+		{"start after", url.Values{"start-after": {"b/2"}}, []string{"b/c/3", "d", "e", "empty/"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, prefixes := resultKeys(listObjects(t, server, test.query))
+			if !reflect.DeepEqual(keys, test.wantKeys) || !reflect.DeepEqual(prefixes, test.wantPrefixes) {
+				t.Errorf("listed %q and prefixes %q, want %q and %q", keys, prefixes, test.wantKeys, test.wantPrefixes)
+			}
+		})
+	}
+
+	t.Run("paging", func(t *testing.T) {
+		var listed []string
+		query := url.Values{"max-keys": {"2"}, "delimiter": {"/"}}
+		for pages := 1; ; pages++ {
+			result := listObjects(t, server, query)
+			keys, prefixes := resultKeys(result)
+			if result.KeyCount != len(keys)+len(prefixes) || result.KeyCount > 2 {
+				t.Fatalf("page %d has %d keys and %d prefixes, KeyCount %d", pages, len(keys), len(prefixes), result.KeyCount)
+			}
+			listed = append(listed, keys...)
+			listed = append(listed, prefixes...)
+
+			if !result.IsTruncated {
+				break
+			} else if pages > 10 {
+				t.Fatal("listing never ends")
+			}
+			query.Set("continuation-token", result.NextContinuationToken)
+		}
+
+		want := []string{"a", "b/", "d", "e", "empty/"}
+		if !reflect.DeepEqual(listed, want) {
+			t.Errorf("pages listed %q, want %q", listed, want)
+		}
+	})
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	server, cluster := newS3Server(t)
+
+	create := func(key string) string {
+		response := s3Request(t, server, http.MethodPost, "/bucket/"+key+"?uploads", "", nil)
+		var result initiateMultipartUploadResult
+		if err := xml.NewDecoder(response.Body).Decode(&result); err != nil || result.UploadId == "" {
+			t.Fatalf("CreateMultipartUpload = %s, %v", response.Status, err)
+		}
+		return result.UploadId
+	}
+	uploadPart := func(key string, id string, number int, data string) string {
+		target := fmt.Sprintf("/bucket/%s?uploadId=%s&partNumber=%d", key, id, number)
+		response := s3Request(t, server, http.MethodPut, target, data, nil)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("UploadPart %d = %s", number, response.Status)
+		}
+		return response.Header.Get("ETag")
+	}
+	completeBody := func(etags ...string) string {
+		var request completeMultipartUpload
+		for i, etag := range etags {
+			request.Parts = append(request.Parts, completedPart{PartNumber: i + 1, ETag: etag})
+		}
+		body, _ := xml.Marshal(request)
+		return string(body)
+	}
+
+	id := create("big")
+	first := uploadPart("big", id, 1, "first part, ")
+	second := uploadPart("big", id, 2, "second part")
+	uploadPart("big", id, 2, "second part") // Uploading a part again replaces it
+
+	// An upload id is only good for its own key
+	response := s3Request(t, server, http.MethodPost, "/bucket/other?uploadId="+id, completeBody(first, second), nil)
+	if code := errorCode(t, response); code != "NoSuchUpload" {
+		t.Errorf("completing the upload on another key = %s, want NoSuchUpload", code)
+	} else if _, ok := cluster.ReadFile("bucket/other"); ok {
+		t.Error("completing the upload on another key wrote it")
+	}
+
+	response = s3Request(t, server, http.MethodPost, "/bucket/big?uploadId="+id, completeBody(second, first), nil)
+	if code := errorCode(t, response); code != "InvalidPart" {
+		t.Errorf("completing with mismatched ETags = %s, want InvalidPart", code)
+	}
+
+	response = s3Request(t, server, http.MethodPost, "/bucket/big?uploadId="+id, completeBody(first, second), nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("CompleteMultipartUpload = %s: %s", response.Status, readBody(t, response))
+	} else if data, _ := cluster.ReadFile("bucket/big"); string(data) != "first part, second part" {
+		t.Errorf("completed object holds %q", data)
+	}
+	var result completeMultipartUploadResult
+	if err := xml.Unmarshal([]byte(readBody(t, response)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if etag := s3Request(t, server, http.MethodHead, "/bucket/big", "", nil).Header.Get("ETag"); etag != result.ETag {
+		t.Errorf("HEAD ETag of the completed object = %s, want %s", etag, result.ETag)
+	}
+
+	response = s3Request(t, server, http.MethodPost, "/bucket/big?uploadId="+id, completeBody(first, second), nil)
+	if code := errorCode(t, response); code != "NoSuchUpload" {
+		t.Errorf("completing twice = %s, want NoSuchUpload", code)
+	}
+
+	id = create("aborted")
+	uploadPart("aborted", id, 1, "data")
+	if response := s3Request(t, server, http.MethodDelete, "/bucket/other?uploadId="+id, "", nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("aborting the upload on another key = %s", response.Status)
+	}
+	if response := s3Request(t, server, http.MethodDelete, "/bucket/aborted?uploadId="+id, "", nil); response.StatusCode != http.StatusNoContent {
+		t.Errorf("AbortMultipartUpload = %s", response.Status)
+	}
+	target := fmt.Sprintf("/bucket/aborted?uploadId=%s&partNumber=2", id)
+	if response := s3Request(t, server, http.MethodPut, target, "data", nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("UploadPart after abort = %s", response.Status)
+	}
+}
@@ -0,0 +1,434 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// WebHDFS lets tools that speak Hadoop's WebHDFS REST API use SDFS unchanged, with URLs like
+// http://<node>:4007/webhdfs/v1/<path>?op=<OP>. Metadata comes from the leader and data from the replicas, both
+// through sdfs.Client. Like HttpFS, the node serves the data itself: CREATE and APPEND redirect to the same URL with
+// data=true, which is where the data is then sent, and OPEN streams the file back directly. user.name, permission
+// and buffersize are accepted and ignored.
+
+const WEBHDFS_PORT = "4007"
+const WEBHDFS_ENV = "SDFS_WEBHDFS"
+const WEBHDFS_PREFIX = "/webhdfs/v1"
+const WEBHDFS_OWNER = "sdfs"
+const WEBHDFS_GROUP = "supergroup"
+
+type WebHDFS struct {
+	client *sdfs.Client
+}
+
+func NewWebHDFS(client *sdfs.Client) *WebHDFS {
+	return &WebHDFS{client: client}
+}
+
+// WebHDFS only runs on nodes started with SDFS_WEBHDFS=1, since it serves without checking user.name
+func WebHDFSEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(WEBHDFS_ENV))
+	return enabled
+}
+
+func InitializeWebHDFS() {
+	fmt.Println("WebHDFS is listening on port", WEBHDFS_PORT)
+	err := http.ListenAndServe(":"+WEBHDFS_PORT, NewWebHDFS(sdfs.NewClient()))
+	if err != nil {
+		fmt.Println("WebHDFS stopped: ", err)
+	}
+}
+
+func (h *WebHDFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WEBHDFS_PREFIX && !strings.HasPrefix(r.URL.Path, WEBHDFS_PREFIX+"/") {
+		writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", "java.io.FileNotFoundException", "paths must start with "+WEBHDFS_PREFIX)
+		return
+	}
+	hdfsPath := "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, WEBHDFS_PREFIX), "/")
+	sdfsPath := utils.CleanPath(hdfsPath)
+	op := strings.ToUpper(r.URL.Query().Get("op"))
+
+	switch {
+	case r.Method == http.MethodGet && op == "OPEN":
+		h.open(w, r, sdfsPath)
+	case r.Method == http.MethodGet && op == "GETFILESTATUS":
+		h.getFileStatus(w, r, sdfsPath)
+	case r.Method == http.MethodGet && op == "LISTSTATUS":
+		h.listStatus(w, r, sdfsPath)
+	case r.Method == http.MethodGet && op == "GETCONTENTSUMMARY":
+		h.getContentSummary(w, r, sdfsPath)
+	case r.Method == http.MethodGet && op == "GETHOMEDIRECTORY":
+		writeJSON(w, http.StatusOK, map[string]string{"Path": "/"}) // SDFS has no home directories
+	case r.Method == http.MethodPut && op == "CREATE":
+		h.create(w, r, hdfsPath, sdfsPath)
+	case r.Method == http.MethodPut && op == "MKDIRS":
+		h.mkdirs(w, r, sdfsPath)
+	case r.Method == http.MethodPut && op == "RENAME":
+		h.rename(w, r, sdfsPath)
+	case r.Method == http.MethodPost && op == "APPEND":
+		h.append(w, r, sdfsPath)
+	case r.Method == http.MethodDelete && op == "DELETE":
+		h.delete(w, r, sdfsPath)
+	default:
+		writeRemoteException(w, http.StatusBadRequest, "IllegalArgumentException", "java.lang.IllegalArgumentException",
+			fmt.Sprintf("Invalid value for webhdfs parameter \"op\": %s is not a supported %s operation", op, r.Method))
+	}
+}
+
+// Responses
+
+type remoteException struct {
+	Exception     string `json:"exception"`
+	JavaClassName string `json:"javaClassName"`
+	Message       string `json:"message"`
+}
+
+type fileStatus struct {
+	AccessTime       int64  `json:"accessTime"`
+	BlockSize        int64  `json:"blockSize"`
+	Group            string `json:"group"`
+	Length           int64  `json:"length"`
+	ModificationTime int64  `json:"modificationTime"` // Unix milliseconds
+	Owner            string `json:"owner"`
+	PathSuffix       string `json:"pathSuffix"`
+	Permission       string `json:"permission"`
+	Replication      int64  `json:"replication"`
+	Type             string `json:"type"`
+}
+
+type contentSummary struct {
+	DirectoryCount int64 `json:"directoryCount"`
+	FileCount      int64 `json:"fileCount"`
+	Length         int64 `json:"length"`
+	Quota          int64 `json:"quota"`
+	SpaceConsumed  int64 `json:"spaceConsumed"`
+	SpaceQuota     int64 `json:"spaceQuota"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeRemoteException(w http.ResponseWriter, status int, exception string, javaClassName string, message string) {
+	writeJSON(w, status, map[string]remoteException{
+		"RemoteException": {Exception: exception, JavaClassName: javaClassName, Message: message},
+	})
+}
+
+// Maps a Client error onto the exception HDFS throws in the same situation
+func writeHdfsError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sdfs.ErrNotExist):
+		writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", "java.io.FileNotFoundException", err.Error())
+	case errors.Is(err, sdfs.ErrExist):
+		writeRemoteException(w, http.StatusForbidden, "FileAlreadyExistsException", "org.apache.hadoop.fs.FileAlreadyExistsException", err.Error())
+	case errors.Is(err, sdfs.ErrIsDir):
+		writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", "java.io.FileNotFoundException", err.Error())
+	case errors.Is(err, sdfs.ErrNotDir):
+		writeRemoteException(w, http.StatusForbidden, "ParentNotDirectoryException", "org.apache.hadoop.fs.ParentNotDirectoryException", err.Error())
+	case errors.Is(err, sdfs.ErrNotEmpty):
+		writeRemoteException(w, http.StatusForbidden, "PathIsNotEmptyDirectoryException", "org.apache.hadoop.fs.PathIsNotEmptyDirectoryException", err.Error())
+	case errors.Is(err, sdfs.ErrQuota):
+		writeRemoteException(w, http.StatusForbidden, "DSQuotaExceededException", "org.apache.hadoop.hdfs.protocol.DSQuotaExceededException", err.Error())
+	case errors.Is(err, sdfs.ErrUnavailable):
+		writeRemoteException(w, http.StatusServiceUnavailable, "RetriableException", "org.apache.hadoop.ipc.RetriableException", err.Error())
+	default:
+		writeRemoteException(w, http.StatusInternalServerError, "IOException", "java.io.IOException", err.Error())
+	}
+}
+
+func writeIllegalArgument(w http.ResponseWriter, message string) {
+	writeRemoteException(w, http.StatusBadRequest, "IllegalArgumentException", "java.lang.IllegalArgumentException", message)
+}
+
+func toFileStatus(info *sdfs.FileInfo, pathSuffix string) fileStatus {
+	status := fileStatus{
+		Group:            WEBHDFS_GROUP,
+		ModificationTime: info.ModTime().UnixNano() / 1e6,
+		Owner:            WEBHDFS_OWNER,
+		PathSuffix:       pathSuffix,
+		Permission:       "755",
+		Type:             "DIRECTORY",
+	}
+	if info.ModTime().IsZero() {
+		status.ModificationTime = 0
+	}
+	if !info.IsDir() {
+		status.BlockSize = info.BlockSize()
+		status.Length = info.Size()
+		status.Permission = "644"
+		status.Replication = info.Replicas()
+		status.Type = "FILE"
+	}
+	return status
+}
+
+// Parses a non negative integer parameter, returning fallback if it is missing
+func int64Param(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("Invalid value for webhdfs parameter %q: %s", name, value)
+	}
+	return parsed, nil
+}
+
+// Reads
+
+func (h *WebHDFS) open(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	offset, err := int64Param(r, "offset", 0)
+	if err != nil {
+		writeIllegalArgument(w, err.Error())
+		return
+	}
+	length, err := int64Param(r, "length", -1)
+	if err != nil {
+		writeIllegalArgument(w, err.Error())
+		return
+	}
+
+	reader, err := h.client.Open(r.Context(), sdfsPath)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	defer reader.Close()
+
+	info, _ := reader.Stat()
+	if offset > info.Size() {
+		writeIllegalArgument(w, fmt.Sprintf("Offset=%d out of the range [0, %d]", offset, info.Size()))
+		return
+	}
+	if length < 0 || offset+length > info.Size() {
+		length = info.Size() - offset
+	}
+
+	reader.Seek(offset, io.SeekStart)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.CopyN(w, reader, length)
+	if err != nil {
+		fmt.Printf("WebHDFS OPEN of %s failed after the response started: %v\n", sdfsPath, err)
+	}
+}
+
+func (h *WebHDFS) getFileStatus(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	info, err := h.client.Stat(r.Context(), sdfsPath)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]fileStatus{"FileStatus": toFileStatus(info, "")})
+}
+
+// A file lists as itself, with an empty path suffix
+func (h *WebHDFS) listStatus(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	info, err := h.client.Stat(r.Context(), sdfsPath)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+
+	statuses := []fileStatus{}
+	if !info.IsDir() {
+		statuses = append(statuses, toFileStatus(info, ""))
+	} else {
+		infos, err := h.client.List(r.Context(), sdfsPath)
+		if err != nil {
+			writeHdfsError(w, err)
+			return
+		}
+		for _, child := range infos {
+			statuses = append(statuses, toFileStatus(child, child.Name()))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]map[string][]fileStatus{"FileStatuses": {"FileStatus": statuses}})
+}
+
+// SDFS quotas on the directory stand in for HDFS's, with -1 for none like HDFS
+func (h *WebHDFS) getContentSummary(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	summary, err := h.client.ContentSummary(r.Context(), sdfsPath)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+
+	result := contentSummary{
+		DirectoryCount: summary.Directories,
+		FileCount:      summary.Files,
+		Length:         summary.Length,
+		Quota:          -1,
+		SpaceConsumed:  summary.SpaceConsumed,
+		SpaceQuota:     -1,
+	}
+	if summary.Quota.MaxFiles > 0 {
+		result.Quota = summary.Quota.MaxFiles
+	}
+	if summary.Quota.MaxBytes > 0 {
+		result.SpaceQuota = summary.Quota.MaxBytes
+	}
+	writeJSON(w, http.StatusOK, map[string]contentSummary{"ContentSummary": result})
+}
+
+// Writes
+
+// Sends the client to the URL it should send the data to, which is this one with data=true. With noredirect=true
+// the URL comes back in the body instead, as in Hadoop 3.
+func redirectForData(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	if query.Get("data") == "true" {
+		return false
+	}
+
+	query.Set("data", "true")
+	location := "http://" + r.Host + r.URL.Path + "?" + query.Encode()
+	if query.Get("noredirect") == "true" {
+		writeJSON(w, http.StatusOK, map[string]string{"Location": location})
+		return true
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	return true
+}
+
+func (h *WebHDFS) create(w http.ResponseWriter, r *http.Request, hdfsPath string, sdfsPath string) {
+	var options utils.PutOptions
+	var err error
+	options.Metadata.ReplicationFactor, err = int64Param(r, "replication", 0)
+	if err == nil {
+		options.Metadata.BlockSize, err = int64Param(r, "blocksize", 0)
+	}
+	if err != nil {
+		writeIllegalArgument(w, err.Error())
+		return
+	}
+	if redirectForData(w, r) {
+		return
+	}
+
+	// Without overwrite, HDFS refuses to replace a file, and the leader does the check as it creates the version. With
+	// it, SDFS keeps the old contents as a version.
+	options.Exclusive = r.URL.Query().Get("overwrite") != "true"
+
+	writer, err := h.client.Create(r.Context(), sdfsPath, options)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	err = writeBody(writer, r.Body)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "webhdfs://"+r.Host+hdfsPath)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Unlike the append command, HDFS refuses to append to a missing file
+func (h *WebHDFS) append(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	if redirectForData(w, r) {
+		return
+	}
+
+	info, err := h.client.Stat(r.Context(), sdfsPath)
+	if err == nil && info.IsDir() {
+		err = &sdfs.Error{Op: "append", Path: sdfsPath, Kind: sdfs.ErrIsDir, Err: sdfs.ErrIsDir}
+	}
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+
+	writer, err := h.client.Append(r.Context(), sdfsPath)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	err = writeBody(writer, r.Body)
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Copies body into writer and closes it, or aborts it if the body couldn't be read
+func writeBody(writer *sdfs.Writer, body io.Reader) error {
+	_, err := io.Copy(writer, body)
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+func (h *WebHDFS) mkdirs(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	err := h.client.Mkdir(r.Context(), sdfsPath)
+	if errors.Is(err, sdfs.ErrNotDir) {
+		err = &sdfs.Error{Op: "mkdirs", Path: sdfsPath, Kind: sdfs.ErrExist, Err: err} // A file is in the way
+	}
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"boolean": true})
+}
+
+// Like HDFS, a rename that can't happen because of a missing source or an existing destination returns false
+func (h *WebHDFS) rename(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	destination := r.URL.Query().Get("destination")
+	if !strings.HasPrefix(destination, "/") {
+		writeIllegalArgument(w, "Invalid value for webhdfs parameter \"destination\": it must be an absolute path")
+		return
+	}
+
+	err := h.client.Rename(r.Context(), sdfsPath, utils.CleanPath(destination))
+	if errors.Is(err, sdfs.ErrNotExist) || errors.Is(err, sdfs.ErrExist) {
+		writeJSON(w, http.StatusOK, map[string]bool{"boolean": false})
+		return
+	} else if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"boolean": true})
+}
+
+// Deleted files go to the SDFS trash. Deleting a missing path returns false, and the root is never deleted.
+func (h *WebHDFS) delete(w http.ResponseWriter, r *http.Request, sdfsPath string) {
+	info, err := h.client.Stat(r.Context(), sdfsPath)
+	if errors.Is(err, sdfs.ErrNotExist) || sdfsPath == "" {
+		writeJSON(w, http.StatusOK, map[string]bool{"boolean": false})
+		return
+	} else if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+
+	if info.IsDir() {
+		err = h.client.RemoveDir(r.Context(), sdfsPath, r.URL.Query().Get("recursive") == "true")
+	} else {
+		err = h.client.Delete(r.Context(), sdfsPath)
+	}
+	if err != nil {
+		writeHdfsError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"boolean": true})
+}
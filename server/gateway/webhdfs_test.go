@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfstest"
+)
+
+func newWebHDFSServer(t *testing.T) (*httptest.Server, *sdfstest.Cluster) {
+	t.Helper()
+	client, cluster := sdfstest.NewClient()
+	server := httptest.NewServer(NewWebHDFS(client))
+	t.Cleanup(server.Close)
+	return server, cluster
+}
+
+// Sends a request without following redirects, and reads its body into the returned response's Body
+func webhdfsRequest(t *testing.T, server *httptest.Server, method string, target string, body string) *http.Response {
+	t.Helper()
+	if !strings.HasPrefix(target, "http") {
+		target = server.URL + target
+	}
+	request, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := *server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body = io.NopCloser(strings.NewReader(string(data)))
+	return response
+}
+
+// The exception a RemoteException response names, or "" if it isn't one
+func remoteExceptionOf(t *testing.T, response *http.Response) string {
+	t.Helper()
+	var body map[string]remoteException
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return ""
+	}
+	return body["RemoteException"].Exception
+}
+
+// Checks that the first step of a write redirects back to the same URL with data=true, and sends body there
+func writeThroughRedirect(t *testing.T, server *httptest.Server, method string, target string, body string) *http.Response {
+	t.Helper()
+	response := webhdfsRequest(t, server, method, target, "")
+	if response.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("%s %s = %s, want a redirect", method, target, response.Status)
+	}
+
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested, _ := url.Parse(target)
+	if location.Path != requested.Path || location.Query().Get("data") != "true" || location.Query().Get("op") != requested.Query().Get("op") {
+		t.Fatalf("%s %s redirected to %s", method, target, location)
+	}
+	return webhdfsRequest(t, server, method, location.String(), body)
+}
+
+func TestWebHDFSCreate(t *testing.T) {
+	server, cluster := newWebHDFSServer(t)
+
+	response := writeThroughRedirect(t, server, http.MethodPut, "/webhdfs/v1/logs/a.log?op=CREATE", "first")
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("CREATE = %s, want 201 Created", response.Status)
+	} else if data, _ := cluster.ReadFile("logs/a.log"); string(data) != "first" {
+		t.Errorf("created file holds %q", data)
+	}
+
+	response = writeThroughRedirect(t, server, http.MethodPut, "/webhdfs/v1/logs/a.log?op=CREATE", "second")
+	if response.StatusCode != http.StatusForbidden || remoteExceptionOf(t, response) != "FileAlreadyExistsException" {
+		t.Errorf("CREATE over a file without overwrite = %s, want 403 FileAlreadyExistsException", response.Status)
+	} else if data, _ := cluster.ReadFile("logs/a.log"); string(data) != "first" {
+		t.Errorf("refused CREATE changed the file to %q", data)
+	}
+
+	response = writeThroughRedirect(t, server, http.MethodPut, "/webhdfs/v1/logs/a.log?op=CREATE&overwrite=true", "second")
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("CREATE with overwrite = %s, want 201 Created", response.Status)
+	} else if data, _ := cluster.ReadFile("logs/a.log"); string(data) != "second" {
+		t.Errorf("overwritten file holds %q", data)
+	}
+
+	// Hadoop 3 clients ask for the data URL in the body instead
+	response = webhdfsRequest(t, server, http.MethodPut, "/webhdfs/v1/logs/b.log?op=CREATE&noredirect=true", "")
+	var body struct{ Location string }
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("CREATE with noredirect = %s, %v", response.Status, err)
+	}
+	location, _ := url.Parse(body.Location)
+	if location.Path != "/webhdfs/v1/logs/b.log" || location.Query().Get("data") != "true" {
+		t.Errorf("CREATE with noredirect gave location %s", body.Location)
+	}
+	if _, exists := cluster.ReadFile("logs/b.log"); exists {
+		t.Error("CREATE created the file before the data was sent")
+	}
+}
+
+func TestWebHDFSAppend(t *testing.T) {
+	server, cluster := newWebHDFSServer(t)
+	cluster.WriteFile("logs/a.log", []byte("old"))
+
+	response := writeThroughRedirect(t, server, http.MethodPost, "/webhdfs/v1/logs/a.log?op=APPEND", " and new")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("APPEND = %s, want 200 OK", response.Status)
+	} else if data, _ := cluster.ReadFile("logs/a.log"); string(data) != "old and new" {
+		t.Errorf("appended file holds %q", data)
+	}
+
+	// Unlike the append command, HDFS doesn't create a missing file
+	response = writeThroughRedirect(t, server, http.MethodPost, "/webhdfs/v1/logs/missing.log?op=APPEND", "data")
+	if response.StatusCode != http.StatusNotFound || remoteExceptionOf(t, response) != "FileNotFoundException" {
+		t.Errorf("APPEND to a missing file = %s, want 404 FileNotFoundException", response.Status)
+	} else if _, exists := cluster.ReadFile("logs/missing.log"); exists {
+		t.Error("APPEND created a missing file")
+	}
+}
+
+func TestWebHDFSOpen(t *testing.T) {
+	server, cluster := newWebHDFSServer(t)
+	cluster.WriteFile("file", []byte("0123456789"))
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"", http.StatusOK, "0123456789"},
+		{"&offset=3", http.StatusOK, "3456789"},
+		{"&offset=3&length=4", http.StatusOK, "3456"},
+		{"&length=0", http.StatusOK, ""},
+		{"&offset=8&length=5", http.StatusOK, "89"}, // Clamped to the end of the file
+		{"&offset=10", http.StatusOK, ""},
+		{"&offset=11", http.StatusBadRequest, "IllegalArgumentException"},
+		{"&offset=-1", http.StatusBadRequest, "IllegalArgumentException"},
+		{"&length=x", http.StatusBadRequest, "IllegalArgumentException"},
+	}
+
+	for _, test := range tests {
+		response := webhdfsRequest(t, server, http.MethodGet, "/webhdfs/v1/file?op=OPEN"+test.query, "")
+		if response.StatusCode != test.wantStatus {
+			t.Errorf("OPEN%s = %s, want %d", test.query, response.Status, test.wantStatus)
+			continue
+		}
+
+		got := readBody(t, response)
+		if test.wantStatus != http.StatusOK {
+			response.Body = io.NopCloser(strings.NewReader(got))
+			got = remoteExceptionOf(t, response)
+		} else if length := response.Header.Get("Content-Length"); length != fmt.Sprint(len(test.want)) {
+			t.Errorf("OPEN%s sent Content-Length %s, want %d", test.query, length, len(test.want))
+		}
+		if got != test.want {
+			t.Errorf("OPEN%s = %q, want %q", test.query, got, test.want)
+		}
+	}
+
+	response := webhdfsRequest(t, server, http.MethodGet, "/webhdfs/v1/missing?op=OPEN", "")
+	if response.StatusCode != http.StatusNotFound || remoteExceptionOf(t, response) != "FileNotFoundException" {
+		t.Errorf("OPEN of a missing file = %s, want 404 FileNotFoundException", response.Status)
+	}
+}
+
+func TestWebHDFSErrors(t *testing.T) {
+	tests := []struct {
+		err           error
+		wantStatus    int
+		wantException string
+	}{
+		{sdfs.ErrNotExist, http.StatusNotFound, "FileNotFoundException"},
+		{sdfs.ErrExist, http.StatusForbidden, "FileAlreadyExistsException"},
+		{sdfs.ErrIsDir, http.StatusNotFound, "FileNotFoundException"},
+		{sdfs.ErrNotDir, http.StatusForbidden, "ParentNotDirectoryException"},
+		{sdfs.ErrNotEmpty, http.StatusForbidden, "PathIsNotEmptyDirectoryException"},
+		{sdfs.ErrQuota, http.StatusForbidden, "DSQuotaExceededException"},
+		{sdfs.ErrUnavailable, http.StatusServiceUnavailable, "RetriableException"},
+		{nil, http.StatusInternalServerError, "IOException"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.wantException, func(t *testing.T) {
+			err := &sdfs.Error{Op: "create", Path: "a", Kind: test.err, Err: errors.New("failed")}
+			recorder := httptest.NewRecorder()
+			writeHdfsError(recorder, err)
+
+			var body map[string]remoteException
+			if e := json.NewDecoder(recorder.Body).Decode(&body); e != nil {
+				t.Fatal(e)
+			}
+			got := body["RemoteException"]
+			if recorder.Code != test.wantStatus || got.Exception != test.wantException || got.Message != err.Error() {
+				t.Errorf("%v mapped to %d %+v, want %d %s", test.err, recorder.Code, got, test.wantStatus, test.wantException)
+			}
+			if !strings.HasSuffix(got.JavaClassName, "."+test.wantException) {
+				t.Errorf("%s has Java class %s", test.wantException, got.JavaClassName)
+			}
+		})
+	}
+}
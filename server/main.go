@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -13,10 +14,12 @@ import (
 	maplejuiceclient "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/client"
 	maplejuiceutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/mapleJuiceUtils"
 	sqlcommands "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/MapleJuice/sqlCommands"
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gateway"
 	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip"
 	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
 	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
 	sdfsclient "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	sdfsutils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
 type CLICommand string
@@ -36,8 +39,55 @@ const (
 	MAPLE     CLICommand = "maple"
 	JUICE     CLICommand = "juice"
 	SELECT    CLICommand = "SELECT"
+	SETREP    CLICommand = "setrep"
+	CAT       CLICommand = "cat"
+	HEAD      CLICommand = "head"
+	TAIL      CLICommand = "tail"
+	APPEND    CLICommand = "append"
+	MKDIR     CLICommand = "mkdir"
+	RMDIR     CLICommand = "rmdir"
+	MV        CLICommand = "mv"
+	GET_VERS  CLICommand = "get-versions"
+	VERSIONS  CLICommand = "versions"
+	SNAPSHOT  CLICommand = "snapshot"
+	STAT      CLICommand = "stat"
+	ROTATE    CLICommand = "rotate-key"
+	PLACEMENT CLICommand = "placement"
+	BALANCER  CLICommand = "balancer"
+	QUOTA     CLICommand = "quota"
+	TRASH     CLICommand = "trash"
+	UNDELETE  CLICommand = "undelete"
 )
 
+// Parses "[-n <lines>] <sdfsFileName>" for head and tail, defaulting to 10 lines
+func parseLineCountArgs(args []string) (string, int64, error) {
+	numLines := int64(10)
+	if len(args) == 3 && strings.TrimSpace(args[0]) == "-n" {
+		n, err := strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+		if err != nil || n < 0 {
+			return "", 0, fmt.Errorf("invalid line count %s", args[1])
+		}
+		return strings.TrimSpace(args[2]), n, nil
+	} else if len(args) == 1 {
+		return strings.TrimSpace(args[0]), numLines, nil
+	}
+
+	return "", 0, fmt.Errorf("usage: [-n <lines>] <sdfsFileName>")
+}
+
+// Strips a trailing "-t <duration>" off args, the time to live of the files a job writes
+func parseTTLArgs(args []string) ([]string, time.Duration, error) {
+	if len(args) < 2 || args[len(args)-2] != "-t" {
+		return args, 0, nil
+	}
+
+	ttl, err := time.ParseDuration(args[len(args)-1])
+	if err != nil || ttl <= 0 {
+		return args, 0, fmt.Errorf("invalid time to live %s", args[len(args)-1])
+	}
+	return args[:len(args)-2], ttl, nil
+}
+
 // Send suspicion flip message to all machines
 func setSendingSuspicionFlip(enable bool) {
 	utils.ENABLE_SUSPICION = enable
@@ -83,38 +133,158 @@ func RunCLI() {
 			setSendingSuspicionFlip(true)
 		} else if strings.Contains(commandArgs[0], string(D_SUS)) && numArgs == 1 {
 			setSendingSuspicionFlip(false)
-		} else if strings.Contains(commandArgs[0], string(PUT)) && numArgs == 3 {
+		} else if strings.Contains(commandArgs[0], string(CAT)) && numArgs == 2 {
+			sdfsclient.CLICat(strings.TrimSpace(commandArgs[1]))
+		} else if strings.Contains(commandArgs[0], string(HEAD)) || strings.Contains(commandArgs[0], string(TAIL)) {
+			sdfsFileName, numLines, err := parseLineCountArgs(commandArgs[1:])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if strings.Contains(commandArgs[0], string(HEAD)) {
+				sdfsclient.CLIHead(sdfsFileName, numLines)
+			} else {
+				sdfsclient.CLITail(sdfsFileName, numLines)
+			}
+		} else if strings.Contains(commandArgs[0], string(SETREP)) && numArgs == 3 {
+			sdfsFileName := strings.TrimSpace(commandArgs[1])
+			replicationFactor, err := strconv.ParseInt(strings.TrimSpace(commandArgs[2]), 10, 64)
+			if err != nil {
+				fmt.Println("Invalid replication factor: ", err)
+				continue
+			}
+
+			err = sdfsclient.InitiateSetReplicationCommand(context.Background(), sdfsFileName, replicationFactor)
+			if err != nil {
+				fmt.Println("setrep failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(SNAPSHOT)) && numArgs >= 2 {
+			subcommand := strings.TrimSpace(commandArgs[1])
+
+			var err error
+			if subcommand == "create" && (numArgs == 3 || numArgs == 4) {
+				prefix := ""
+				if numArgs == 4 {
+					prefix = strings.TrimSpace(commandArgs[3])
+				}
+				err = sdfsclient.InitiateSnapshotCreateCommand(context.Background(), strings.TrimSpace(commandArgs[2]), prefix)
+			} else if subcommand == "delete" && numArgs == 3 {
+				err = sdfsclient.InitiateSnapshotDeleteCommand(context.Background(), strings.TrimSpace(commandArgs[2]))
+			} else if subcommand == "ls" && numArgs == 2 {
+				sdfsclient.CLISnapshotLs()
+			} else {
+				fmt.Println("usage: snapshot create <name> [<prefix>] | snapshot ls | snapshot delete <name>")
+			}
+
+			if err != nil {
+				fmt.Println("snapshot failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(TRASH)) && numArgs >= 2 {
+			subcommand := strings.TrimSpace(commandArgs[1])
+
+			var err error
+			if subcommand == "ls" && numArgs == 2 {
+				sdfsclient.CLITrashLs()
+			} else if subcommand == "purge" && numArgs <= 3 {
+				sdfsFileName := ""
+				if numArgs == 3 {
+					sdfsFileName = strings.TrimSpace(commandArgs[2])
+				}
+				err = sdfsclient.InitiateTrashPurgeCommand(context.Background(), sdfsFileName, "")
+			} else {
+				fmt.Println("usage: trash ls | trash purge [<sdfsFileName>]")
+			}
+
+			if err != nil {
+				fmt.Println("trash failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(UNDELETE)) && (numArgs == 2 || numArgs == 3) {
+			trashId := ""
+			if numArgs == 3 {
+				trashId = strings.TrimSpace(commandArgs[2])
+			}
+			err := sdfsclient.InitiateUndeleteCommand(context.Background(), strings.TrimSpace(commandArgs[1]), trashId)
+			if err != nil {
+				fmt.Println("undelete failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(QUOTA)) {
+			sdfsclient.CLIQuota(commandArgs[1:])
+		} else if strings.Contains(commandArgs[0], string(BALANCER)) {
+			sdfsclient.CLIBalancer(commandArgs[1:])
+		} else if strings.Contains(commandArgs[0], string(PLACEMENT)) && numArgs == 2 {
+			sdfsclient.CLIPlacement(strings.TrimSpace(commandArgs[1]))
+		} else if strings.Contains(commandArgs[0], string(ROTATE)) && numArgs == 1 {
+			sdfsclient.CLIRotateKey()
+		} else if strings.Contains(commandArgs[0], string(STAT)) && numArgs == 2 {
+			sdfsclient.CLIStat(strings.TrimSpace(commandArgs[1]))
+		} else if strings.Contains(commandArgs[0], string(MKDIR)) && numArgs == 2 {
+			err := sdfsclient.InitiateMkdirCommand(context.Background(), strings.TrimSpace(commandArgs[1]))
+			if err != nil {
+				fmt.Println("mkdir failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(RMDIR)) && (numArgs == 2 || numArgs == 3) {
+			recursive := numArgs == 3 && strings.TrimSpace(commandArgs[1]) == "-r"
+			if numArgs == 3 && !recursive {
+				fmt.Println("usage: rmdir [-r] <sdfsDir>")
+				continue
+			}
+
+			err := sdfsclient.InitiateRmdirCommand(context.Background(), strings.TrimSpace(commandArgs[numArgs-1]), recursive)
+			if err != nil {
+				fmt.Println("rmdir failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(MV)) && numArgs == 3 {
+			err := sdfsclient.InitiateRenameCommand(context.Background(), strings.TrimSpace(commandArgs[1]), strings.TrimSpace(commandArgs[2]))
+			if err != nil {
+				fmt.Println("mv failed: ", err)
+			}
+		} else if strings.Contains(commandArgs[0], string(GET_VERS)) && numArgs == 4 {
+			numVersions, err := strconv.ParseInt(strings.TrimSpace(commandArgs[2]), 10, 64)
+			if err != nil || numVersions <= 0 {
+				fmt.Println("Invalid number of versions: ", commandArgs[2])
+				continue
+			}
+
+			sdfsclient.CLIGetVersions(strings.TrimSpace(commandArgs[1]), numVersions, strings.TrimSpace(commandArgs[3]))
+		} else if strings.Contains(commandArgs[0], string(VERSIONS)) && numArgs == 2 {
+			sdfsclient.CLIVersions(strings.TrimSpace(commandArgs[1]))
+		} else if strings.Contains(commandArgs[0], string(APPEND)) && numArgs == 3 {
 			localfilename := strings.TrimSpace(commandArgs[1])
 			sdfsFileName := strings.TrimSpace(commandArgs[2])
 
-			sdfsclient.CLIPut(localfilename, sdfsFileName)
-		} else if strings.Contains(commandArgs[0], string(GET)) && numArgs == 3 {
+			sdfsclient.CLIAppend(localfilename, sdfsFileName)
+		} else if strings.Contains(commandArgs[0], string(PUT)) && numArgs >= 3 {
 			localfilename := strings.TrimSpace(commandArgs[1])
 			sdfsFileName := strings.TrimSpace(commandArgs[2])
 
-			sdfs.CLIGet(sdfsFileName, localfilename)
-		} else if strings.Contains(commandArgs[0], string(DELETE)) && numArgs == 2 {
-			sdfsFileName := strings.TrimSpace(commandArgs[1])
-
-			mappings, mappingsErr := sdfsclient.SdfsClientMain(sdfsFileName, true)
-			if mappingsErr != nil {
-				fmt.Println("Error with sdfsclient main. Aborting Get command: ", mappingsErr)
-				return
+			options, err := sdfsutils.ParsePutOptions(commandArgs[3:])
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
-			fmt.Println("FOUND MAPPING: ", mappings)
 
-			sdfsclient.InitiateDeleteCommand(sdfsFileName, mappings)
+			sdfsclient.CLIPut(localfilename, sdfsFileName, options)
+		} else if strings.Contains(commandArgs[0], string(GET)) && numArgs >= 3 {
+			localfilename := strings.TrimSpace(commandArgs[1])
+			sdfsFileName := strings.TrimSpace(commandArgs[2])
 
-		} else if strings.Contains(commandArgs[0], string(LS)) && numArgs == 2 {
-			sdfsFileName := strings.TrimSpace(commandArgs[1])
+			options, err := sdfsutils.ParseGetOptions(commandArgs[3:])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
 
-			mappings, mappingsErr := sdfsclient.SdfsClientMain(sdfsFileName, true)
-			if mappingsErr != nil {
-				fmt.Println("Error with sdfsclient main. Aborting Get command: ", mappingsErr)
-				return
+			sdfs.CLIGet(sdfsFileName, localfilename, options)
+		} else if strings.Contains(commandArgs[0], string(DELETE)) && numArgs == 2 {
+			sdfsclient.CLIDelete(strings.TrimSpace(commandArgs[1]))
+		} else if strings.Contains(commandArgs[0], string(LS)) && numArgs <= 2 {
+			sdfsFileName := ""
+			if numArgs == 2 {
+				sdfsFileName = strings.TrimSpace(commandArgs[1])
 			}
 
-			sdfsclient.InitiateLsCommand(mappings)
+			sdfsclient.CLILs(sdfsFileName)
 
 		} else if strings.Contains(commandArgs[0], string(STORE)) && numArgs == 1 {
 			sdfsclient.InitiateStoreCommand()
@@ -124,21 +294,31 @@ func RunCLI() {
 				commandArgs[i] = part
 			}
 			sdfsclient.InitiateMultiRead(commandArgs[1], commandArgs[2:])
-		} else if strings.Contains(commandArgs[0], string(MAPLE)) && numArgs == 5 {
+		} else if strings.Contains(commandArgs[0], string(MAPLE)) && (numArgs == 5 || numArgs == 7) {
 			fmt.Println("GOT MAPLE")
 			for i, part := range commandArgs {
 				part = strings.TrimSpace(part)
 				commandArgs[i] = part
 			}
+			commandArgs, outputTTL, err := parseTTLArgs(commandArgs)
+			if err != nil || len(commandArgs) != 5 {
+				fmt.Println("usage: maple <local_exec_file> <N maples> <sdfs prefix> <sdfs src dataset> [-t <ttl>]", err)
+				continue
+			}
 			numMapleTasks, _ := strconv.ParseUint(commandArgs[2], 10, 32)
-			maplejuiceclient.InitiateMaplePhase(commandArgs[1], uint32(numMapleTasks), commandArgs[3], commandArgs[4], make([]string, 0))
+			maplejuiceclient.InitiateMaplePhase(commandArgs[1], uint32(numMapleTasks), commandArgs[3], commandArgs[4], make([]string, 0), outputTTL)
 			// func InitiateMaplePhase(LocalExecFile string, NMaples uint32, SdfsPrefix string, SdfsSrcDataset string) {
 
-		} else if strings.Contains(command, string(JUICE)) && numArgs == 7 {
+		} else if strings.Contains(command, string(JUICE)) && (numArgs == 7 || numArgs == 9) {
 			for i, part := range commandArgs {
 				part = strings.TrimSpace(part)
 				commandArgs[i] = part
 			}
+			commandArgs, outputTTL, err := parseTTLArgs(commandArgs)
+			if err != nil || len(commandArgs) != 7 {
+				fmt.Println("usage: juice <local_exec_file> <N juices> <sdfs prefix> <sdfs dst dataset> <delete input 0 | 1> <HASH | RANGE> [-t <ttl>]", err)
+				continue
+			}
 			numJuiceTasks, _ := strconv.ParseUint(commandArgs[2], 10, 32)
 			deleteInput := commandArgs[5] == string(0)
 
@@ -149,7 +329,7 @@ func RunCLI() {
 				pt = maplejuiceutils.RANGE
 			}
 
-			maplejuiceclient.InitiateJuicePhase(commandArgs[1], uint32(numJuiceTasks), commandArgs[3], commandArgs[4], deleteInput, pt)
+			maplejuiceclient.InitiateJuicePhase(commandArgs[1], uint32(numJuiceTasks), commandArgs[3], commandArgs[4], deleteInput, pt, outputTTL)
 		} else if strings.Contains(commandArgs[0], string(SELECT)) {
 			sqlcommands.ProcessSQLCommand(command)
 		} else if strings.Contains(commandArgs[0], "composition") {
@@ -169,16 +349,38 @@ func RunCLI() {
 				_____________________________________________________
 				_____________________________________________________
 				SDFS COMMANDS:
-				put <localfilename> <sdfsFileName> # put a file from your local machine into sdfs
-				get <sdfsFileName> <localfilename> # get a file from sdfs and write it to local machine
-				delete <sdfsFileName> # delete a file from sdfs
-				ls sdfsFileName # list all vm addresses where the file is stored
+				put <localfilename> <sdfsFileName> [replicated | ec | rs-<k>-<m>] [-r <replication factor>] [-b <block size>] [-p] [-v <versions to keep>] [-c one|quorum|all] [-z gzip|flate] [-e] [-t <ttl>] # put a file from your local machine into sdfs
+				snapshot create <name> [<prefix>] # freeze the current version of every file under prefix, read them back as @<name>/<path>
+				snapshot ls # list snapshots
+				snapshot delete <name> # delete a snapshot, freeing blocks no live file still uses
+				mkdir <sdfsDir> # create a directory, and any missing parents
+				rmdir [-r] <sdfsDir> # remove an empty directory, or with -r move everything under it to the trash
+				mv <src> <dst> # move or rename a file or directory, without copying any data
+				append <localfilename> <sdfsFileName> # append a local file to the end of an sdfs file, creating it if needed
+				setrep <sdfsFileName> <n> # change how many replicas the leader keeps of a file
+				cat <sdfsFileName> # print a file without downloading it
+				head [-n <lines>] <sdfsFileName> # print the first lines of a file
+				tail [-n <lines>] <sdfsFileName> # print the last lines of a file, only fetching the end of it
+				versions <sdfsFileName> # list the stored versions of a file
+				get-versions <sdfsFileName> <n> <localfilename> # get the latest n versions of a file, concatenated with delimiters
+				get <sdfsFileName> <localfilename> [-j <parallel blocks>] [--version <v>] [-c one|quorum|all] # get a file from sdfs and write it to local machine
+				delete <sdfsFileName> # move a file to the trash, its blocks are deleted once the trash retention runs out
+				undelete <sdfsFileName> [trash id] # restore the most recently deleted file at a path, or a specific trash entry
+				trash ls # list deleted files with their trash ids and when they will be purged
+				trash purge [sdfsFileName] # delete trashed files for good now, all of them without a name
+				ls [sdfsPath] # list a directory with logical and stored sizes and remaining lifetimes, or all vm addresses where a file is stored
+				stat <sdfsFileName> # show a file's size, stored size, storage policy and storage id
+				placement <random | least-used | round-robin | topology-spread> # choose how the leader places new replicas
+				quota set <prefix> [-files <n>] [-bytes <size>] # limit the files and bytes (counting replicas) under a prefix, no limits removes the quota
+				quota get [prefix] # show quotas and how much of them is used
+				balancer [on | off] [-bw <bytes per second, e.g. 20MB>] # move replicas from full nodes to empty ones, once or in the background
+				rotate-key # rewrap the data keys of encrypted files with the newest master key in the keyfile
 				store # at this machine, list all files paritally or fully stored at this machine
 				_____________________________________________________
 				_____________________________________________________
 				MAPLEJUICE COMMANDS:
-				maple <local_exec_file> <N maples> <sdfs prefix> <sdfs src dataset>
-				juice <local_exec_file> <N juices> <sdfs prefix> <sdfs dst dataset> <delete input 0 | 1> <HASH | RANGE>
+				maple <local_exec_file> <N maples> <sdfs prefix> <sdfs src dataset> [-t <ttl>] # -t deletes the intermediate files after e.g. 1h
+				juice <local_exec_file> <N juices> <sdfs prefix> <sdfs dst dataset> <delete input 0 | 1> <HASH | RANGE> [-t <ttl>] # -t deletes the output after e.g. 1h
 				_____________________________________________________
 			`
 			float, err_parse := strconv.ParseFloat(command[:len(command)-1], 32)
@@ -196,6 +398,12 @@ func main() {
 	go gossip.InitializeGossip()
 	go sdfs.InitializeSdfsProcess()
 	go maplejuice.MapleJuiceMainListener()
+	if gateway.S3GatewayEnabled() {
+		go gateway.InitializeS3Gateway()
+	}
+	if gateway.WebHDFSEnabled() {
+		go gateway.InitializeWebHDFS()
+	}
 
 	RunCLI()
 }
@@ -0,0 +1,131 @@
+package sdfsutils
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Block compression codecs. Each block of a compressed file is compressed on its own by the writer, so a reader can
+// decompress any block without the ones before it. New codecs only need to be registered under a name.
+
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var codecs = make(map[string]Codec) // name : codec
+
+func init() {
+	RegisterCodec("gzip", gzipCodec{})
+	RegisterCodec("flate", flateCodec{})
+}
+
+func RegisterCodec(name string, codec Codec) {
+	codecs[strings.ToLower(name)] = codec
+}
+
+func GetCodec(name string) (Codec, error) {
+	codec, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %s, expected one of %s", name, strings.Join(CodecNames(), ", "))
+	}
+	return codec, nil
+}
+
+func CodecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	return buf.Bytes(), err
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	return buf.Bytes(), err
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Turns block blockIdx of a file's data into the bytes stored on the replicas: compressed first, then encrypted
+func EncodeBlock(metadata FileMetadata, blockIdx int64, data []byte) ([]byte, error) {
+	var err error
+	if metadata.Compression != "" {
+		codec, err := GetCodec(metadata.Compression)
+		if err != nil {
+			return nil, err
+		}
+		data, err = codec.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if metadata.IsEncrypted() {
+		data, err = encryptBlock(metadata, blockIdx, data)
+	}
+	return data, err
+}
+
+// Reverses EncodeBlock
+func DecodeBlock(metadata FileMetadata, blockIdx int64, stored []byte) ([]byte, error) {
+	var err error
+	if metadata.IsEncrypted() {
+		stored, err = decryptBlock(metadata, blockIdx, stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if metadata.Compression == "" {
+		return stored, nil
+	}
+	codec, err := GetCodec(metadata.Compression)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(stored)
+}
@@ -0,0 +1,148 @@
+package sdfsutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+// How long a request may take from being sent to its last frame. Block transfers get longer, and requests the
+// leader holds while another client finishes get long enough to outlast the leader's own wait.
+const (
+	REQUEST_TIMEOUT      = 30 * time.Second
+	BLOCK_TIMEOUT        = 5 * time.Minute
+	LEADER_WAIT_TIMEOUT  = 6 * time.Minute  // LEASE_ACQUIRE and APPEND_BEGIN, the leader gives up after 5
+	REQUEST_READ_TIMEOUT = 10 * time.Second // Time a new connection has to send its request frame
+)
+
+// Bounded retries of failed network calls, waiting BACKOFF_BASE, then twice that and so on up to BACKOFF_MAX
+const (
+	MAX_ATTEMPTS = 4
+	BACKOFF_BASE = 100 * time.Millisecond
+	BACKOFF_MAX  = 5 * time.Second
+)
+
+func OpTimeout(op BlockOperation) time.Duration {
+	switch op {
+	case READ, WRITE, RECONSTRUCT:
+		return BLOCK_TIMEOUT
+	case LEASE_ACQUIRE, APPEND_BEGIN:
+		return LEADER_WAIT_TIMEOUT
+	default:
+		return REQUEST_TIMEOUT
+	}
+}
+
+// Deadline of a request for op made under ctx, whichever of the two comes first
+func OpDeadline(ctx context.Context, op BlockOperation) time.Time {
+	deadline := time.Now().Add(OpTimeout(op))
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// Wait before retry number attempt (from 1), with jitter so clients that failed together don't retry together
+func Backoff(attempt int) time.Duration {
+	wait := BACKOFF_BASE << (attempt - 1)
+	if wait <= 0 || wait > BACKOFF_MAX {
+		wait = BACKOFF_MAX
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// Sleeps for the backoff of attempt, or until ctx ends
+func SleepBackoff(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(Backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Calls attempt up to attempts times, backing off between calls, until it succeeds or ctx ends. Returns the last
+// error.
+func Retry(ctx context.Context, attempts int, attempt func() error) error {
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				return ctxErr
+			}
+			return fmt.Errorf("%w, last error: %v", ctxErr, err)
+		}
+
+		err = attempt()
+		if err == nil {
+			return nil
+		}
+
+		if i < attempts {
+			SleepBackoff(ctx, i)
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+}
+
+// Dials ipAddr, giving up when ctx ends or after REQUEST_TIMEOUT
+func OpenTCPConnectionContext(ctx context.Context, ipAddr string, port string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: REQUEST_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", ipAddr+":"+port)
+	if err != nil {
+		log.Println("Error:", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Puts the connection of a request under its deadline, and cuts it short if ctx ends first. The watch stops when the
+// connection is closed.
+func (rc *RequestConn) Watch(ctx context.Context, deadline time.Time) {
+	rc.ctx = ctx
+	rc.Conn.SetDeadline(deadline)
+	if ctx.Done() == nil {
+		return
+	}
+
+	rc.closed = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			rc.Conn.SetDeadline(time.Now())
+		case <-rc.closed:
+		}
+	}()
+}
+
+func (rc *RequestConn) Close() error {
+	if rc.closed != nil {
+		rc.closeOnce.Do(func() { close(rc.closed) })
+	}
+	return rc.Conn.Close()
+}
+
+// Names the request in an error from its connection, and tells a missed deadline apart from other failures
+func requestError(conn net.Conn, err error) error {
+	rc, ok := conn.(*RequestConn)
+	if !ok || err == nil || err == io.EOF {
+		return err
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if rc.ctx != nil && rc.ctx.Err() == context.Canceled {
+			return fmt.Errorf("request %d to %s: %w", rc.RequestId, rc.RemoteAddr(), rc.ctx.Err())
+		}
+		return fmt.Errorf("request %d to %s timed out after %s: %w", rc.RequestId, rc.RemoteAddr(), OpTimeout(rc.Op), err)
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package sdfsutils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Encryption at rest. Every encrypted file gets its own random data key, which is stored in the file's metadata
+// wrapped (AES-GCM encrypted) by a cluster master key. Master keys are read from a local keyfile that every node
+// has a copy of, one "<key id> <64 hex digits>" per line, and the last key in the file is used to wrap new data keys.
+// Blocks are encrypted by the writer and decrypted by the reader, so replicas only ever hold ciphertext.
+
+const DEFAULT_MASTER_KEY_FILE = "server/sdfs/master.key"
+const MASTER_KEY_FILE_ENV = "SDFS_MASTER_KEY_FILE" // Overrides DEFAULT_MASTER_KEY_FILE
+const DATA_KEY_SIZE = 32                           // AES-256
+
+var masterKeysMu sync.Mutex
+var masterKeys map[string][]byte // key id : key, nil until the keyfile is first read
+var currentMasterKeyId string
+
+func MasterKeyFile() string {
+	if path := os.Getenv(MASTER_KEY_FILE_ENV); path != "" {
+		return path
+	}
+	return DEFAULT_MASTER_KEY_FILE
+}
+
+// Rereads the keyfile, picking up keys added for a rotation
+func LoadMasterKeys() error {
+	path := MasterKeyFile()
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read master keyfile %s: %v", path, err)
+	}
+	defer file.Close()
+
+	keys := make(map[string][]byte)
+	var currentId string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("malformed line in master keyfile %s, expected <key id> <hex key>", path)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != DATA_KEY_SIZE {
+			return fmt.Errorf("master key %s in %s is not %d hex encoded bytes", fields[0], path, DATA_KEY_SIZE)
+		}
+		keys[fields[0]] = key
+		currentId = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	} else if currentId == "" {
+		return fmt.Errorf("master keyfile %s has no keys", path)
+	}
+
+	masterKeysMu.Lock()
+	masterKeys, currentMasterKeyId = keys, currentId
+	masterKeysMu.Unlock()
+	return nil
+}
+
+// Looks up a master key by id, or the current one if id is empty. The keyfile is reread for a key that isn't known
+// yet, so nodes pick up keys added for a rotation on their own.
+func getMasterKey(id string) (string, []byte, error) {
+	currentId, key, ok := lookupMasterKey(id)
+	if !ok {
+		if err := LoadMasterKeys(); err != nil {
+			return "", nil, err
+		}
+		currentId, key, ok = lookupMasterKey(id)
+	}
+
+	if !ok {
+		return "", nil, fmt.Errorf("master key %s is not in %s", id, MasterKeyFile())
+	}
+	return currentId, key, nil
+}
+
+func lookupMasterKey(id string) (string, []byte, bool) {
+	masterKeysMu.Lock()
+	defer masterKeysMu.Unlock()
+
+	if masterKeys == nil {
+		return "", nil, false
+	}
+	if id == "" {
+		id = currentMasterKeyId
+	}
+	key, ok := masterKeys[id]
+	return id, key, ok
+}
+
+// Generates a data key for a new file and returns it wrapped by the current master key
+func NewDataKey() (string, []byte, error) {
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, err
+	}
+	return wrapKey("", dataKey)
+}
+
+// Rewraps a data key with the current master key. Returns the old values if it already is.
+func RewrapDataKey(masterKeyId string, wrappedKey []byte) (string, []byte, error) {
+	currentId, _, err := getMasterKey("")
+	if err != nil || currentId == masterKeyId {
+		return masterKeyId, wrappedKey, err
+	}
+
+	dataKey, err := unwrapKey(masterKeyId, wrappedKey)
+	if err != nil {
+		return masterKeyId, wrappedKey, err
+	}
+	return wrapKey(currentId, dataKey)
+}
+
+func wrapKey(masterKeyId string, dataKey []byte) (string, []byte, error) {
+	masterKeyId, masterKey, err := getMasterKey(masterKeyId)
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err := sealGCM(masterKey, dataKey, []byte(masterKeyId))
+	return masterKeyId, wrapped, err
+}
+
+func unwrapKey(masterKeyId string, wrappedKey []byte) ([]byte, error) {
+	_, masterKey, err := getMasterKey(masterKeyId)
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(masterKey, wrappedKey, []byte(masterKeyId))
+}
+
+// Encrypts with a random nonce, which is prepended to the ciphertext
+func sealGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The block index is authenticated with each block, so blocks can't be swapped around without being detected
+func blockAdditionalData(blockIdx int64) []byte {
+	additionalData := make([]byte, 8)
+	binary.BigEndian.PutUint64(additionalData, uint64(blockIdx))
+	return additionalData
+}
+
+func encryptBlock(metadata FileMetadata, blockIdx int64, data []byte) ([]byte, error) {
+	dataKey, err := unwrapKey(metadata.MasterKeyId, metadata.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return sealGCM(dataKey, data, blockAdditionalData(blockIdx))
+}
+
+func decryptBlock(metadata FileMetadata, blockIdx int64, stored []byte) ([]byte, error) {
+	dataKey, err := unwrapKey(metadata.MasterKeyId, metadata.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(dataKey, stored, blockAdditionalData(blockIdx))
+}
@@ -0,0 +1,259 @@
+package sdfsutils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coder over GF(2^8). A stripe is made of DataShards equally sized data shards followed by
+// ParityShards parity shards, and any DataShards of the pieces are enough to rebuild the rest.
+
+var ErrTooFewShards = errors.New("not enough shards present to reconstruct stripe")
+var ErrShardSize = errors.New("shards in a stripe must all be the same size")
+
+var gfExp [512]byte
+var gfLog [256]byte
+var gfMulTable [256][256]byte
+
+func init() {
+	// Build log/exp tables for the 0x11d reducing polynomial
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// Inverts a square matrix with Gauss-Jordan elimination. Returns an error if the matrix is singular.
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		inv := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], inv)
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
+
+func gfMultiplyMatrices(a, b [][]byte) [][]byte {
+	rv := make([][]byte, len(a))
+	for i := range a {
+		rv[i] = make([]byte, len(b[0]))
+		for j := range b[0] {
+			var sum byte
+			for k := range b {
+				sum ^= gfMul(a[i][k], b[k][j])
+			}
+			rv[i][j] = sum
+		}
+	}
+	return rv
+}
+
+// out = sum(coefficients[i] * inputs[i]), byte by byte
+func gfLinearCombination(coefficients []byte, inputs [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for i, c := range coefficients {
+		if c == 0 {
+			continue
+		}
+		row := &gfMulTable[c]
+		for j, b := range inputs[i] {
+			out[j] ^= row[b]
+		}
+	}
+}
+
+type ErasureCoder struct {
+	DataShards   int
+	ParityShards int
+	encodeMatrix [][]byte // (DataShards + ParityShards) x DataShards, identity on top so data shards are stored as is
+}
+
+func NewErasureCoder(dataShards int, parityShards int) (*ErasureCoder, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, fmt.Errorf("invalid erasure code RS(%d,%d)", dataShards, parityShards)
+	}
+	if dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("RS(%d,%d) needs more than 256 shards", dataShards, parityShards)
+	}
+
+	total := dataShards + parityShards
+	vandermonde := make([][]byte, total)
+	for r := 0; r < total; r++ {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := 0; c < dataShards; c++ {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	// Make the code systematic: multiplying by the inverse of the top square keeps any k rows invertible
+	topInverse, err := gfInvertMatrix(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+
+	return &ErasureCoder{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		encodeMatrix: gfMultiplyMatrices(vandermonde, topInverse),
+	}, nil
+}
+
+// Fills shards[DataShards:] with parity computed from shards[:DataShards]. Parity slices are allocated if nil.
+func (c *ErasureCoder) Encode(shards [][]byte) error {
+	if len(shards) != c.DataShards+c.ParityShards {
+		return fmt.Errorf("expected %d shards, got %d", c.DataShards+c.ParityShards, len(shards))
+	}
+
+	shardSize := len(shards[0])
+	for i := 0; i < c.DataShards; i++ {
+		if len(shards[i]) != shardSize {
+			return ErrShardSize
+		}
+	}
+
+	for i := c.DataShards; i < len(shards); i++ {
+		if len(shards[i]) != shardSize {
+			shards[i] = make([]byte, shardSize)
+		}
+		gfLinearCombination(c.encodeMatrix[i], shards[:c.DataShards], shards[i])
+	}
+
+	return nil
+}
+
+// Rebuilds every nil shard in place, as long as at least DataShards shards are present.
+func (c *ErasureCoder) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.DataShards+c.ParityShards {
+		return fmt.Errorf("expected %d shards, got %d", c.DataShards+c.ParityShards, len(shards))
+	}
+
+	shardSize := -1
+	present := make([]int, 0, c.DataShards)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if shardSize == -1 {
+			shardSize = len(shard)
+		} else if len(shard) != shardSize {
+			return ErrShardSize
+		}
+		if len(present) < c.DataShards {
+			present = append(present, i)
+		}
+	}
+
+	if len(present) < c.DataShards {
+		return ErrTooFewShards
+	}
+
+	// Recover missing data shards by inverting the rows of the encoding matrix we still have pieces for
+	dataMissing := false
+	for i := 0; i < c.DataShards; i++ {
+		if shards[i] == nil {
+			dataMissing = true
+			break
+		}
+	}
+
+	if dataMissing {
+		subMatrix := make([][]byte, c.DataShards)
+		inputs := make([][]byte, c.DataShards)
+		for i, idx := range present {
+			subMatrix[i] = c.encodeMatrix[idx]
+			inputs[i] = shards[idx]
+		}
+
+		decodeMatrix, err := gfInvertMatrix(subMatrix)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < c.DataShards; i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, shardSize)
+				gfLinearCombination(decodeMatrix[i], inputs, shards[i])
+			}
+		}
+	}
+
+	// Missing parity is simply re-encoded from the (now complete) data shards
+	for i := c.DataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+			gfLinearCombination(c.encodeMatrix[i], shards[:c.DataShards], shards[i])
+		}
+	}
+
+	return nil
+}
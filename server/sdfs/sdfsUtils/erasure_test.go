@@ -0,0 +1,94 @@
+package sdfsutils
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func encodedStripe(t *testing.T, coder *ErasureCoder, shardSize int) [][]byte {
+	t.Helper()
+	random := rand.New(rand.NewSource(int64(coder.DataShards*100 + coder.ParityShards)))
+	shards := make([][]byte, coder.DataShards+coder.ParityShards)
+	for i := 0; i < coder.DataShards; i++ {
+		shards[i] = make([]byte, shardSize)
+		random.Read(shards[i])
+	}
+	if err := coder.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+// The shards left after dropping the ones whose bit is set in missing
+func dropShards(shards [][]byte, missing int) [][]byte {
+	left := make([][]byte, len(shards))
+	for i, shard := range shards {
+		if missing&(1<<i) == 0 {
+			left[i] = append([]byte{}, shard...)
+		}
+	}
+	return left
+}
+
+// Any ParityShards pieces of a stripe can be lost, and one more can't
+func TestErasureCoderReconstruct(t *testing.T) {
+	for _, code := range []struct{ data, parity int }{{1, 1}, {2, 1}, {4, 2}, {6, 3}, {10, 4}} {
+		coder, err := NewErasureCoder(code.data, code.parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := encodedStripe(t, coder, 37)
+		total := code.data + code.parity
+
+		for missing := 0; missing < 1<<total; missing++ {
+			lost := bits.OnesCount(uint(missing))
+			if lost > code.parity+1 {
+				continue
+			}
+
+			left := dropShards(shards, missing)
+			err := coder.Reconstruct(left)
+			if lost == code.parity+1 {
+				if !errors.Is(err, ErrTooFewShards) {
+					t.Fatalf("RS(%d,%d) without shards %b: got %v, want ErrTooFewShards", code.data, code.parity, missing, err)
+				}
+				continue
+			} else if err != nil {
+				t.Fatalf("RS(%d,%d) without shards %b: %v", code.data, code.parity, missing, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(left[i], shards[i]) {
+					t.Fatalf("RS(%d,%d) without shards %b rebuilt shard %d wrong", code.data, code.parity, missing, i)
+				}
+			}
+		}
+	}
+}
+
+func TestErasureCoderErrors(t *testing.T) {
+	for _, code := range []struct{ data, parity int }{{0, 2}, {4, 0}, {-1, 1}, {200, 57}} {
+		if _, err := NewErasureCoder(code.data, code.parity); err == nil {
+			t.Errorf("NewErasureCoder(%d, %d) succeeded", code.data, code.parity)
+		}
+	}
+
+	coder, err := NewErasureCoder(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := coder.Encode([][]byte{{1}, {2}, {3}, {4, 5}, nil, nil}); !errors.Is(err, ErrShardSize) {
+		t.Errorf("Encode with uneven shards = %v, want ErrShardSize", err)
+	}
+	if err := coder.Encode(make([][]byte, 5)); err == nil {
+		t.Error("Encode with too few shards succeeded")
+	}
+
+	shards := encodedStripe(t, coder, 8)
+	shards[1] = shards[1][:4]
+	if err := coder.Reconstruct(shards); !errors.Is(err, ErrShardSize) {
+		t.Errorf("Reconstruct with uneven shards = %v, want ErrShardSize", err)
+	}
+}
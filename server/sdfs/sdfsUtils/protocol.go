@@ -0,0 +1,767 @@
+package sdfsutils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every message on an SDFS connection is a frame: a fixed header followed by a payload of the length it gives. A
+// connection carries a single request, and every frame sent in either direction repeats the request's id and
+// operation. Frames are read with exact reads, so nothing past the frame is consumed from the connection.
+//
+//	magic   uint16  PROTOCOL_MAGIC
+//	version uint8   PROTOCOL_VERSION
+//	type    uint8   FRAME_REQUEST, FRAME_STATUS, FRAME_REPLY, FRAME_DATA or FRAME_DATA_END
+//	id      uint32  request id, picked by the sender of the request
+//	op      uint16  the request's BlockOperation
+//	length  uint32  bytes of payload that follow
+const (
+	PROTOCOL_MAGIC      uint16 = 0x5344 // "SD"
+	PROTOCOL_VERSION    uint8  = 1
+	FRAME_HEADER_SIZE          = 14
+	MAX_FRAME_PAYLOAD          = 64 * 1024 * 1024 // Largest payload of a data frame
+	MAX_CONTROL_PAYLOAD        = 1024 * 1024      // Largest payload of a request, status or reply frame
+	DATA_FRAME_SIZE            = 1024 * 1024      // Largest payload a DataWriter puts in one frame
+)
+
+type FrameType uint8
+
+const (
+	FRAME_REQUEST  FrameType = 1 // An encoded Task
+	FRAME_STATUS   FrameType = 2 // A status code, and an error message if it isn't STATUS_OK
+	FRAME_REPLY    FrameType = 3 // A JSON encoded reply to the request
+	FRAME_DATA     FrameType = 4 // A piece of a block
+	FRAME_DATA_END FrameType = 5 // Closes a run of data frames, with no payload
+)
+
+const (
+	STATUS_OK    uint8 = 0
+	STATUS_ERROR uint8 = 1 // Any higher status is an ErrorCode saying what kind of failure it was
+)
+
+// Kinds of failure a status or a leader's reply can report, so the receiver can act on one without parsing its
+// message. In a status frame the code is the status itself.
+type ErrorCode uint8
+
+const (
+	ERR_NONE      ErrorCode = ErrorCode(STATUS_OK)
+	ERR_UNKNOWN   ErrorCode = ErrorCode(STATUS_ERROR) // Any failure without a code of its own
+	ERR_NOT_EXIST ErrorCode = 2
+	ERR_EXIST     ErrorCode = 3
+	ERR_IS_DIR    ErrorCode = 4
+	ERR_NOT_DIR   ErrorCode = 5
+	ERR_NOT_EMPTY ErrorCode = 6
+	ERR_QUOTA     ErrorCode = 7
+)
+
+// An error with a code, made where the failure happened and rebuilt from the status or reply on the other end
+type CodedError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *CodedError) Error() string {
+	return e.Message
+}
+
+func Errorf(code ErrorCode, format string, args ...any) error {
+	return &CodedError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Code to send for err: ERR_NONE for nil, and ERR_UNKNOWN for an error without one
+func ErrorCodeOf(err error) ErrorCode {
+	var coded *CodedError
+	if err == nil {
+		return ERR_NONE
+	} else if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return ERR_UNKNOWN
+}
+
+// Error described by a reply's Error and Code fields, nil if the reply reports success
+func ReplyError(message string, code ErrorCode) error {
+	if message == "" {
+		return nil
+	} else if code == ERR_NONE {
+		code = ERR_UNKNOWN
+	}
+	return &CodedError{Code: code, Message: message}
+}
+
+type FrameHeader struct {
+	Type      FrameType
+	RequestId uint32
+	Op        BlockOperation
+	Length    uint32
+}
+
+type Frame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// A connection a request was sent or received on. Frames written through it carry the request's id and operation,
+// and frames read from it must carry the same id.
+type RequestConn struct {
+	net.Conn
+	RequestId uint32
+	Op        BlockOperation
+	ctx       context.Context // Request the connection was opened for, nil on the receiving side
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var lastRequestId atomic.Uint32
+
+// Request ids only need to tell apart the requests a node has in flight, so a counter seeded from the clock is enough
+func init() {
+	lastRequestId.Store(uint32(time.Now().UnixNano()))
+}
+
+func NextRequestId() uint32 {
+	return lastRequestId.Add(1)
+}
+
+func NewRequestConn(conn net.Conn, task *Task) *RequestConn {
+	return &RequestConn{Conn: conn, RequestId: task.RequestId, Op: task.ConnectionOperation}
+}
+
+// Id and operation of the request carried by conn, zero for connections outside the SDFS protocol
+func requestOf(conn net.Conn) (uint32, BlockOperation) {
+	if rc, ok := conn.(*RequestConn); ok {
+		return rc.RequestId, rc.Op
+	}
+	return 0, 0
+}
+
+func appendFrameHeader(buf []byte, header FrameHeader) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, PROTOCOL_MAGIC)
+	buf = append(buf, PROTOCOL_VERSION, byte(header.Type))
+	buf = binary.BigEndian.AppendUint32(buf, header.RequestId)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(header.Op))
+	return binary.BigEndian.AppendUint32(buf, header.Length)
+}
+
+// Writes a frame of the given type for conn's request in a single write
+func WriteFrame(conn net.Conn, frameType FrameType, payload []byte) error {
+	id, op := requestOf(conn)
+	err := writeFrame(conn, FrameHeader{Type: frameType, RequestId: id, Op: op, Length: uint32(len(payload))}, payload)
+	return requestError(conn, err)
+}
+
+// Only data frames carry file contents, so the others are held to a limit that keeps a bad length from having a
+// node allocate more than a request could need
+func maxPayload(frameType FrameType) int {
+	if frameType == FRAME_DATA || frameType == FRAME_DATA_END {
+		return MAX_FRAME_PAYLOAD
+	}
+	return MAX_CONTROL_PAYLOAD
+}
+
+func writeFrame(w io.Writer, header FrameHeader, payload []byte) error {
+	if limit := maxPayload(header.Type); len(payload) > limit {
+		return fmt.Errorf("frame payload of %d bytes is over the %d byte limit", len(payload), limit)
+	}
+	buf := make([]byte, 0, FRAME_HEADER_SIZE+len(payload))
+	buf = appendFrameHeader(buf, header)
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func ParseFrameHeader(buf []byte) (FrameHeader, error) {
+	var header FrameHeader
+	if len(buf) < FRAME_HEADER_SIZE {
+		return header, io.ErrUnexpectedEOF
+	}
+	if magic := binary.BigEndian.Uint16(buf[0:2]); magic != PROTOCOL_MAGIC {
+		return header, fmt.Errorf("not an SDFS frame, magic %#04x", magic)
+	}
+	if version := buf[2]; version != PROTOCOL_VERSION {
+		return header, fmt.Errorf("unsupported protocol version %d, want %d", version, PROTOCOL_VERSION)
+	}
+
+	header.Type = FrameType(buf[3])
+	header.RequestId = binary.BigEndian.Uint32(buf[4:8])
+	header.Op = BlockOperation(binary.BigEndian.Uint16(buf[8:10]))
+	header.Length = binary.BigEndian.Uint32(buf[10:14])
+
+	if header.Type < FRAME_REQUEST || header.Type > FRAME_DATA_END {
+		return header, fmt.Errorf("unknown frame type %d", header.Type)
+	} else if limit := maxPayload(header.Type); header.Length > uint32(limit) {
+		return header, fmt.Errorf("frame payload of %d bytes is over the %d byte limit", header.Length, limit)
+	}
+	return header, nil
+}
+
+// Reads the next frame header, and checks that it belongs to conn's request
+func ReadFrameHeader(conn net.Conn) (FrameHeader, error) {
+	buf := make([]byte, FRAME_HEADER_SIZE)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return FrameHeader{}, requestError(conn, err)
+	}
+
+	header, err := ParseFrameHeader(buf)
+	if err != nil {
+		return header, err
+	}
+	if id, _ := requestOf(conn); id != 0 && header.Type != FRAME_REQUEST && header.RequestId != id {
+		return header, fmt.Errorf("frame for request %d on the connection of request %d", header.RequestId, id)
+	}
+	return header, nil
+}
+
+// Reads the next frame along with its payload
+func ReadFrame(conn net.Conn) (Frame, error) {
+	header, err := ReadFrameHeader(conn)
+	if err != nil {
+		return Frame{}, err
+	}
+	return readFramePayload(conn, header)
+}
+
+// Reads the payload that follows header
+func readFramePayload(conn net.Conn, header FrameHeader) (Frame, error) {
+	payload := make([]byte, header.Length)
+	_, err := io.ReadFull(conn, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return Frame{FrameHeader: header, Payload: payload}, requestError(conn, err)
+}
+
+// Error carried by a status frame, nil for STATUS_OK
+func statusError(frame Frame) error {
+	if len(frame.Payload) == 0 {
+		return errors.New("empty status frame")
+	} else if frame.Payload[0] == STATUS_OK {
+		return nil
+	}
+
+	code := ErrorCode(frame.Payload[0])
+	if len(frame.Payload) == 1 {
+		return Errorf(code, "request failed with status %d", code)
+	}
+	return &CodedError{Code: code, Message: string(frame.Payload[1:])}
+}
+
+func unexpectedFrame(frame Frame, want FrameType) error {
+	if frame.Type == FRAME_STATUS {
+		if err := statusError(frame); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("expected frame type %d, got %d", want, frame.Type)
+}
+
+// Tells the other end whether the request succeeded so far. A nil err sends STATUS_OK, and an error is sent with its
+// code as the status.
+func SendStatus(conn net.Conn, err error) error {
+	if err == nil {
+		return WriteFrame(conn, FRAME_STATUS, []byte{STATUS_OK})
+	}
+	return WriteFrame(conn, FRAME_STATUS, append([]byte{byte(ErrorCodeOf(err))}, err.Error()...))
+}
+
+// Waits for a status frame, and returns the error it carries
+func ReadStatus(conn net.Conn) error {
+	frame, err := ReadFrame(conn)
+	if err != nil {
+		return err
+	} else if frame.Type != FRAME_STATUS {
+		return unexpectedFrame(frame, FRAME_STATUS)
+	}
+	return statusError(frame)
+}
+
+// Sends a JSON encoded reply to the request on conn
+func SendReply(conn net.Conn, reply any) error {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(conn, FRAME_REPLY, payload)
+}
+
+// Decodes the reply to the request on conn into reply. An error status in its place is returned as an error.
+func ReadReply(conn net.Conn, reply any) error {
+	frame, err := ReadFrame(conn)
+	if err != nil {
+		return err
+	} else if frame.Type != FRAME_REPLY {
+		return unexpectedFrame(frame, FRAME_REPLY)
+	}
+	return json.Unmarshal(frame.Payload, reply)
+}
+
+// Splits what is written to it into data frames. Close ends the data with a FRAME_DATA_END, and Abort ends it with an
+// error status instead, so the reader doesn't wait for data that will never come.
+type DataWriter struct {
+	conn   net.Conn
+	writer *bufio.Writer
+	header FrameHeader
+}
+
+func NewDataWriter(conn net.Conn) *DataWriter {
+	id, op := requestOf(conn)
+	return &DataWriter{
+		conn:   conn,
+		writer: bufio.NewWriterSize(conn, DATA_FRAME_SIZE+FRAME_HEADER_SIZE),
+		header: FrameHeader{Type: FRAME_DATA, RequestId: id, Op: op},
+	}
+}
+
+func (dw *DataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > DATA_FRAME_SIZE {
+			chunk = chunk[:DATA_FRAME_SIZE]
+		}
+
+		dw.header.Length = uint32(len(chunk))
+		_, err := dw.writer.Write(appendFrameHeader(nil, dw.header))
+		if err == nil {
+			_, err = dw.writer.Write(chunk)
+		}
+		if err != nil {
+			return written, requestError(dw.conn, err)
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (dw *DataWriter) Close() error {
+	header := dw.header
+	header.Type, header.Length = FRAME_DATA_END, 0
+	err := writeFrame(dw.writer, header, nil)
+	if err == nil {
+		err = dw.writer.Flush()
+	}
+	return requestError(dw.conn, err)
+}
+
+func (dw *DataWriter) Abort(cause error) error {
+	err := dw.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return SendStatus(dw.conn, cause)
+}
+
+// Reads the payloads of the data frames on a connection, which must add up to exactly size bytes. Returns io.EOF once
+// the FRAME_DATA_END has been read, and the error of an error status sent in place of data.
+type DataReader struct {
+	conn      net.Conn
+	size      int64
+	read      int64
+	remaining int64 // Payload bytes of the current frame still on the connection
+	done      bool
+}
+
+func NewDataReader(conn net.Conn, size int64) *DataReader {
+	return &DataReader{conn: conn, size: size}
+}
+
+func (dr *DataReader) Read(p []byte) (int, error) {
+	for dr.remaining == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+
+		header, err := ReadFrameHeader(dr.conn)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch header.Type {
+		case FRAME_DATA:
+			if dr.read+int64(header.Length) > dr.size {
+				return 0, fmt.Errorf("sent more than the %d bytes of data announced", dr.size)
+			}
+			dr.remaining = int64(header.Length)
+		case FRAME_DATA_END:
+			if dr.read < dr.size {
+				return 0, fmt.Errorf("data ended after %d of %d bytes: %w", dr.read, dr.size, io.ErrUnexpectedEOF)
+			}
+			dr.done = true
+		default:
+			payload := make([]byte, header.Length)
+			_, err = io.ReadFull(dr.conn, payload)
+			if err != nil {
+				return 0, err
+			}
+			return 0, unexpectedFrame(Frame{FrameHeader: header, Payload: payload}, FRAME_DATA)
+		}
+	}
+
+	if int64(len(p)) > dr.remaining {
+		p = p[:dr.remaining]
+	}
+	n, err := dr.conn.Read(p)
+	dr.remaining -= int64(n)
+	dr.read += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, requestError(dr.conn, err)
+}
+
+// Sends size bytes of r as data frames
+func WriteData(conn net.Conn, r io.Reader, size int64) (int64, error) {
+	writer := NewDataWriter(conn)
+	n, err := io.CopyN(writer, r, size)
+	if err != nil {
+		writer.Abort(fmt.Errorf("sender failed after %d of %d bytes: %v", n, size, err))
+		return n, err
+	}
+	return n, writer.Close()
+}
+
+// Field tags of an encoded Task. The operation is in the frame header. Each field is a tag byte, the uvarint length of
+// its value, and the value: integers as varints, strings and byte slices as is, booleans as a single 1 byte, and
+// structs as fields of their own. List elements repeat the tag. Zero values are left out, and unknown tags skipped,
+// so fields can be added without a new protocol version.
+const (
+	taskDataTargetIp     = 1
+	taskAckTargetIp      = 2
+	taskFileName         = 3
+	taskOriginalFileSize = 4
+	taskBlockIndex       = 5
+	taskDataSize         = 6
+	taskIsAck            = 7
+	taskMetadata         = 8
+	taskReplicaChain     = 9
+	taskChainIndex       = 10
+	taskRangeOffset      = 11
+	taskRangeLength      = 12
+	taskIsAppend         = 13
+	taskFileId           = 14
+	taskTargetName       = 15
+	taskOverwrite        = 16
+	taskRecursive        = 17
+	taskVersions         = 18
+	taskTimestamp        = 19
+	taskLeaseMode        = 20
+	taskLeaseId          = 21
+	taskCount            = 22
+	taskExclude          = 23
+	taskMoveFrom         = 24
+	taskQuota            = 25
+	taskTTL              = 26
+	taskExclusive        = 27
+)
+
+const (
+	metadataReplicationFactor = 1
+	metadataBlockSize         = 2
+	metadataDataShards        = 3
+	metadataParityShards      = 4
+	metadataUnevenBlocks      = 5
+	metadataCompression       = 6
+	metadataEncrypted         = 7
+	metadataMasterKeyId       = 8
+	metadataWrappedKey        = 9
+	metadataETag              = 10
+)
+
+const (
+	quotaMaxFiles = 1
+	quotaMaxBytes = 2
+)
+
+type fieldEncoder struct {
+	buf []byte
+}
+
+func (e *fieldEncoder) field(tag byte, value []byte) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+func (e *fieldEncoder) bytes(tag byte, value []byte) {
+	if len(value) > 0 {
+		e.field(tag, value)
+	}
+}
+
+func (e *fieldEncoder) string(tag byte, value string) {
+	e.bytes(tag, []byte(value))
+}
+
+func (e *fieldEncoder) strings(tag byte, values []string) {
+	for _, value := range values {
+		e.field(tag, []byte(value))
+	}
+}
+
+func (e *fieldEncoder) int(tag byte, value int64) {
+	if value != 0 {
+		e.field(tag, binary.AppendVarint(nil, value))
+	}
+}
+
+func (e *fieldEncoder) bool(tag byte, value bool) {
+	if value {
+		e.field(tag, []byte{1})
+	}
+}
+
+type fieldDecoder struct {
+	data []byte
+}
+
+func (d *fieldDecoder) done() bool {
+	return len(d.data) == 0
+}
+
+func (d *fieldDecoder) next() (byte, []byte, error) {
+	tag := d.data[0]
+	length, n := binary.Uvarint(d.data[1:])
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("bad length for field %d", tag)
+	}
+	rest := d.data[1+n:]
+	if length > uint64(len(rest)) {
+		return 0, nil, fmt.Errorf("field %d is %d bytes, only %d left", tag, length, len(rest))
+	}
+
+	d.data = rest[length:]
+	return tag, rest[:length], nil
+}
+
+func decodeInt(tag byte, value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n != len(value) {
+		return 0, fmt.Errorf("bad integer in field %d", tag)
+	}
+	return v, nil
+}
+
+func decodeBool(tag byte, value []byte) (bool, error) {
+	if len(value) != 1 || value[0] > 1 {
+		return false, fmt.Errorf("bad boolean in field %d", tag)
+	}
+	return value[0] == 1, nil
+}
+
+// Copies a variable length string into one of the Task's fixed size fields
+func decodeFixed(tag byte, value []byte, dst []byte) error {
+	if len(value) > len(dst) {
+		return fmt.Errorf("field %d is %d bytes, over the %d byte limit", tag, len(value), len(dst))
+	}
+	copy(dst, value)
+	return nil
+}
+
+func (task Task) Marshal() []byte {
+	var e fieldEncoder
+	e.string(taskDataTargetIp, BytesToString(task.DataTargetIp[:]))
+	e.string(taskAckTargetIp, BytesToString(task.AckTargetIp[:]))
+	e.string(taskFileName, BytesToString(task.FileName[:]))
+	e.int(taskOriginalFileSize, task.OriginalFileSize)
+	e.int(taskBlockIndex, task.BlockIndex)
+	e.int(taskDataSize, task.DataSize)
+	e.bool(taskIsAck, task.IsAck)
+	e.bytes(taskMetadata, task.Metadata.marshal())
+	e.strings(taskReplicaChain, task.ReplicaChain)
+	e.int(taskChainIndex, int64(task.ChainIndex))
+	e.int(taskRangeOffset, task.RangeOffset)
+	e.int(taskRangeLength, task.RangeLength)
+	e.bool(taskIsAppend, task.IsAppend)
+	e.string(taskFileId, task.FileId)
+	e.string(taskTargetName, task.TargetName)
+	e.bool(taskOverwrite, task.Overwrite)
+	e.bool(taskRecursive, task.Recursive)
+	e.int(taskVersions, task.Versions)
+	e.int(taskTimestamp, task.Timestamp)
+	e.int(taskLeaseMode, int64(task.LeaseMode))
+	e.string(taskLeaseId, task.LeaseId)
+	e.int(taskCount, task.Count)
+	e.strings(taskExclude, task.Exclude)
+	e.string(taskMoveFrom, task.MoveFrom)
+	e.bytes(taskQuota, task.Quota.marshal())
+	e.int(taskTTL, int64(task.TTL))
+	e.bool(taskExclusive, task.Exclusive)
+	return e.buf
+}
+
+// Decodes a request frame into the Task it carries
+func UnmarshalTask(frame Frame) (*Task, error) {
+	if frame.Type != FRAME_REQUEST {
+		return nil, unexpectedFrame(frame, FRAME_REQUEST)
+	}
+
+	task := Task{ConnectionOperation: frame.Op, RequestId: frame.RequestId}
+	d := fieldDecoder{data: frame.Payload}
+	for !d.done() {
+		tag, value, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		var n int64
+		switch tag {
+		case taskDataTargetIp:
+			err = decodeFixed(tag, value, task.DataTargetIp[:])
+		case taskAckTargetIp:
+			err = decodeFixed(tag, value, task.AckTargetIp[:])
+		case taskFileName:
+			err = decodeFixed(tag, value, task.FileName[:])
+		case taskOriginalFileSize:
+			task.OriginalFileSize, err = decodeInt(tag, value)
+		case taskBlockIndex:
+			task.BlockIndex, err = decodeInt(tag, value)
+		case taskDataSize:
+			task.DataSize, err = decodeInt(tag, value)
+		case taskIsAck:
+			task.IsAck, err = decodeBool(tag, value)
+		case taskMetadata:
+			err = task.Metadata.unmarshal(value)
+		case taskReplicaChain:
+			task.ReplicaChain = append(task.ReplicaChain, string(value))
+		case taskChainIndex:
+			n, err = decodeInt(tag, value)
+			task.ChainIndex = int(n)
+		case taskRangeOffset:
+			task.RangeOffset, err = decodeInt(tag, value)
+		case taskRangeLength:
+			task.RangeLength, err = decodeInt(tag, value)
+		case taskIsAppend:
+			task.IsAppend, err = decodeBool(tag, value)
+		case taskFileId:
+			task.FileId = string(value)
+		case taskTargetName:
+			task.TargetName = string(value)
+		case taskOverwrite:
+			task.Overwrite, err = decodeBool(tag, value)
+		case taskRecursive:
+			task.Recursive, err = decodeBool(tag, value)
+		case taskVersions:
+			task.Versions, err = decodeInt(tag, value)
+		case taskTimestamp:
+			task.Timestamp, err = decodeInt(tag, value)
+		case taskLeaseMode:
+			n, err = decodeInt(tag, value)
+			task.LeaseMode = LeaseMode(n)
+		case taskLeaseId:
+			task.LeaseId = string(value)
+		case taskCount:
+			task.Count, err = decodeInt(tag, value)
+		case taskExclude:
+			task.Exclude = append(task.Exclude, string(value))
+		case taskMoveFrom:
+			task.MoveFrom = string(value)
+		case taskQuota:
+			err = task.Quota.unmarshal(value)
+		case taskTTL:
+			n, err = decodeInt(tag, value)
+			task.TTL = time.Duration(n)
+		case taskExclusive:
+			task.Exclusive, err = decodeBool(tag, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &task, nil
+}
+
+func (metadata FileMetadata) marshal() []byte {
+	var e fieldEncoder
+	e.int(metadataReplicationFactor, metadata.ReplicationFactor)
+	e.int(metadataBlockSize, metadata.BlockSize)
+	e.int(metadataDataShards, metadata.DataShards)
+	e.int(metadataParityShards, metadata.ParityShards)
+	e.bool(metadataUnevenBlocks, metadata.UnevenBlocks)
+	e.string(metadataCompression, metadata.Compression)
+	e.bool(metadataEncrypted, metadata.Encrypted)
+	e.string(metadataMasterKeyId, metadata.MasterKeyId)
+	e.bytes(metadataWrappedKey, metadata.WrappedKey)
+	e.string(metadataETag, metadata.ETag)
+	return e.buf
+}
+
+func (metadata *FileMetadata) unmarshal(data []byte) error {
+	d := fieldDecoder{data: data}
+	for !d.done() {
+		tag, value, err := d.next()
+		if err != nil {
+			return err
+		}
+
+		switch tag {
+		case metadataReplicationFactor:
+			metadata.ReplicationFactor, err = decodeInt(tag, value)
+		case metadataBlockSize:
+			metadata.BlockSize, err = decodeInt(tag, value)
+		case metadataDataShards:
+			metadata.DataShards, err = decodeInt(tag, value)
+		case metadataParityShards:
+			metadata.ParityShards, err = decodeInt(tag, value)
+		case metadataUnevenBlocks:
+			metadata.UnevenBlocks, err = decodeBool(tag, value)
+		case metadataCompression:
+			metadata.Compression = string(value)
+		case metadataEncrypted:
+			metadata.Encrypted, err = decodeBool(tag, value)
+		case metadataMasterKeyId:
+			metadata.MasterKeyId = string(value)
+		case metadataWrappedKey:
+			metadata.WrappedKey = append([]byte(nil), value...)
+		case metadataETag:
+			metadata.ETag = string(value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (quota Quota) marshal() []byte {
+	var e fieldEncoder
+	e.int(quotaMaxFiles, quota.MaxFiles)
+	e.int(quotaMaxBytes, quota.MaxBytes)
+	return e.buf
+}
+
+func (quota *Quota) unmarshal(data []byte) error {
+	d := fieldDecoder{data: data}
+	for !d.done() {
+		tag, value, err := d.next()
+		if err != nil {
+			return err
+		}
+
+		switch tag {
+		case quotaMaxFiles:
+			quota.MaxFiles, err = decodeInt(tag, value)
+		case quotaMaxBytes:
+			quota.MaxBytes, err = decodeInt(tag, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package sdfsutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requestFrame(op BlockOperation, payload []byte) []byte {
+	header := FrameHeader{Type: FRAME_REQUEST, RequestId: 1, Op: op, Length: uint32(len(payload))}
+	return append(appendFrameHeader(nil, header), payload...)
+}
+
+// Whatever a connection starts with, decoding its request must fail with an error rather than take the node down.
+// A request that does decode must survive being encoded and decoded again.
+func FuzzUnmarshal(f *testing.F) {
+	task := Task{
+		DataTargetIp:     New19Byte("172.22.156.162"),
+		AckTargetIp:      New19Byte("172.22.158.162"),
+		FileName:         New1024Byte("dir/file.txt"),
+		OriginalFileSize: 3 * MB,
+		BlockIndex:       2,
+		DataSize:         -1,
+		IsAck:            true,
+		Metadata:         FileMetadata{ReplicationFactor: 4, DataShards: 4, ParityShards: 2, Compression: "gzip", WrappedKey: []byte{1, 2, 3}},
+		ReplicaChain:     []string{"172.22.156.162", "172.22.158.162"},
+		ChainIndex:       1,
+		LeaseId:          "lease",
+		Quota:            Quota{MaxFiles: 10, MaxBytes: 10 * MB},
+		TTL:              time.Hour,
+	}
+	full := requestFrame(WRITE, task.Marshal())
+
+	f.Add(full)
+	f.Add(full[:len(full)-1])
+	f.Add(full[:FRAME_HEADER_SIZE])
+	f.Add(requestFrame(READ, nil))
+	f.Add(requestFrame(GET_2D, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server, client := net.Pipe()
+		defer server.Close()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		decoded, _, err := Unmarshal(server)
+		if err != nil {
+			return
+		}
+
+		payload := decoded.Marshal()
+		header := FrameHeader{Type: FRAME_REQUEST, RequestId: decoded.RequestId, Op: decoded.ConnectionOperation, Length: uint32(len(payload))}
+		again, err := UnmarshalTask(Frame{FrameHeader: header, Payload: payload})
+		if err != nil {
+			t.Fatalf("re-decoding a decoded request: %v", err)
+		}
+		if !bytes.Equal(again.Marshal(), payload) {
+			t.Fatalf("request changed between decodes: %+v != %+v", again, decoded)
+		}
+	})
+}
+
+// Both ends of a connection carrying request id, as the sender and receiver of a WRITE would see it
+func requestPipe(senderId uint32, receiverId uint32) (net.Conn, net.Conn) {
+	sender, receiver := net.Pipe()
+	return NewRequestConn(sender, &Task{RequestId: senderId, ConnectionOperation: WRITE}),
+		NewRequestConn(receiver, &Task{RequestId: receiverId, ConnectionOperation: WRITE})
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, DATA_FRAME_SIZE, 2*DATA_FRAME_SIZE + 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		sender, receiver := requestPipe(7, 7)
+		sent := make(chan error, 1)
+		go func() {
+			_, err := WriteData(sender, bytes.NewReader(data), int64(size))
+			sent <- err
+		}()
+
+		got, err := io.ReadAll(NewDataReader(receiver, int64(size)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read %d bytes, %v", size, len(got), err)
+		}
+		if err := <-sent; err != nil {
+			t.Errorf("%d bytes: sending: %v", size, err)
+		}
+		sender.Close()
+		receiver.Close()
+	}
+}
+
+func TestDataReaderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		senderId uint32
+		size     int64
+		send     func(w *DataWriter) error
+		want     string
+	}{
+		{"other request", 8, 4, func(w *DataWriter) error { w.Write([]byte("data")); return w.Close() }, "frame for request 8 on the connection of request 7"},
+		{"short", 7, 10, func(w *DataWriter) error { w.Write([]byte("data")); return w.Close() }, "data ended after 4 of 10 bytes"},
+		{"long", 7, 2, func(w *DataWriter) error { w.Write([]byte("data")); return w.Close() }, "sent more than the 2 bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender, receiver := requestPipe(test.senderId, 7)
+			defer sender.Close()
+			defer receiver.Close()
+			go test.send(NewDataWriter(sender))
+
+			_, err := io.ReadAll(NewDataReader(receiver, test.size))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestDataWriterAbort(t *testing.T) {
+	sender, receiver := requestPipe(7, 7)
+	defer sender.Close()
+	defer receiver.Close()
+	go func() {
+		writer := NewDataWriter(sender)
+		writer.Write([]byte("partial"))
+		writer.Abort(Errorf(ERR_QUOTA, "quota of logs/ exceeded"))
+	}()
+
+	// The data sent before the abort is still delivered, then the reader gets the sender's error with its code
+	reader := NewDataReader(receiver, 100)
+	got, err := io.ReadAll(reader)
+	if string(got) != "partial" {
+		t.Errorf("read %q before the abort, want %q", got, "partial")
+	}
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Code != ERR_QUOTA || coded.Message != "quota of logs/ exceeded" {
+		t.Errorf("aborted read = %#v, want the sender's ERR_QUOTA error", err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	tests := []struct {
+		frameType FrameType
+		length    uint32
+		ok        bool
+	}{
+		{FRAME_REQUEST, MAX_CONTROL_PAYLOAD, true},
+		{FRAME_REQUEST, MAX_CONTROL_PAYLOAD + 1, false},
+		{FRAME_STATUS, MAX_CONTROL_PAYLOAD + 1, false},
+		{FRAME_REPLY, MAX_CONTROL_PAYLOAD + 1, false},
+		{FRAME_DATA, MAX_FRAME_PAYLOAD, true},
+		{FRAME_DATA, MAX_FRAME_PAYLOAD + 1, false},
+	}
+
+	for _, test := range tests {
+		header := FrameHeader{Type: test.frameType, RequestId: 1, Op: WRITE, Length: test.length}
+		_, err := ParseFrameHeader(appendFrameHeader(nil, header))
+		if (err == nil) != test.ok {
+			t.Errorf("frame type %d with %d bytes of payload: %v", test.frameType, test.length, err)
+		}
+	}
+
+	if err := writeFrame(io.Discard, FrameHeader{Type: FRAME_REPLY}, make([]byte, MAX_CONTROL_PAYLOAD+1)); err == nil {
+		t.Error("writing a reply over the limit succeeded")
+	}
+}
+
+// A connection opening with a data frame is refused on its header, without waiting for the payload it announces
+func TestUnmarshalRefusesData(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go client.Write(appendFrameHeader(nil, FrameHeader{Type: FRAME_DATA, RequestId: 1, Op: WRITE, Length: MAX_FRAME_PAYLOAD}))
+
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := Unmarshal(server)
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Errorf("Unmarshal of a data frame = %v, want it refused on the header", err)
+	}
+}
@@ -1,15 +1,18 @@
 package sdfsutils
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"strings"
-	"sync"
+	"time"
 
 	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
 )
@@ -18,13 +21,45 @@ type BlockOperation int
 
 // Potentially use send, receive, write, delete types instead types instead
 const (
-	READ           BlockOperation = 0
-	WRITE          BlockOperation = 1
-	DELETE         BlockOperation = 2
-	GET_2D         BlockOperation = 3
-	FORCE_GET      BlockOperation = 4
-	GET_PREFIX     BlockOperation = 5
-	SIZE_BY_PREFIX BlockOperation = 6
+	READ            BlockOperation = 0
+	WRITE           BlockOperation = 1
+	DELETE          BlockOperation = 2
+	GET_2D          BlockOperation = 3
+	FORCE_GET       BlockOperation = 4
+	GET_PREFIX      BlockOperation = 5
+	SIZE_BY_PREFIX  BlockOperation = 6
+	RECONSTRUCT     BlockOperation = 7
+	GET_METADATA    BlockOperation = 8
+	SET_REPLICATION BlockOperation = 9
+	APPEND_BEGIN    BlockOperation = 10
+	APPEND_END      BlockOperation = 11
+	CREATE_FILE     BlockOperation = 12
+	MKDIR           BlockOperation = 13
+	RMDIR           BlockOperation = 14
+	RENAME          BlockOperation = 15
+	LIST_DIR        BlockOperation = 16
+	REMOVE_FILE     BlockOperation = 17
+	LIST_VERSIONS   BlockOperation = 18
+	SNAPSHOT_CREATE BlockOperation = 19
+	SNAPSHOT_LIST   BlockOperation = 20
+	SNAPSHOT_DELETE BlockOperation = 21
+	BLOCK_DIGEST    BlockOperation = 22
+	LEASE_ACQUIRE   BlockOperation = 23
+	LEASE_RENEW     BlockOperation = 24
+	LEASE_RELEASE   BlockOperation = 25
+	ROTATE_KEY      BlockOperation = 26
+	PLACE_REPLICAS  BlockOperation = 27
+	SET_PLACEMENT   BlockOperation = 28
+	BALANCE         BlockOperation = 29
+	QUOTA_SET       BlockOperation = 30
+	QUOTA_GET       BlockOperation = 31
+	UNDELETE        BlockOperation = 32
+	TRASH_LIST      BlockOperation = 33
+	TRASH_PURGE     BlockOperation = 34
+	GLOB            BlockOperation = 35
+	CONTENT_SUMMARY BlockOperation = 36
+	ABORT_CREATE    BlockOperation = 37
+	APPEND_RENEW    BlockOperation = 38
 )
 
 const (
@@ -41,21 +76,259 @@ type Task struct {
 	BlockIndex          int64
 	DataSize            int64 // TODO change me to int64
 	IsAck               bool
+	Metadata            FileMetadata
+	ReplicaChain        []string      // Pipelined writes: every replica in the chain, in order. Empty for direct writes
+	ChainIndex          int           // Position of the receiving node in ReplicaChain
+	RangeOffset         int64         // READ: first byte of the block to send
+	RangeLength         int64         // READ: bytes to send, 0 for the rest of the block, BLOCK_LENGTH_ONLY for none. BLOCK_DIGEST: bytes to hash, 0 for all
+	IsAppend            bool          // WRITE: part of an append or a repair, the leader commits the size elsewhere
+	FileId              string        // CREATE_FILE: proposed storage id for the file. REMOVE_FILE, RMDIR: trash id, set by the leader
+	TargetName          string        // RENAME: destination path. SNAPSHOT_CREATE: prefix to snapshot. UNDELETE, TRASH_PURGE: trash id
+	Overwrite           bool          // CREATE_FILE: point the path at FileId even if it already names a file. APPEND_BEGIN: the grant is for an upload writing a new version, in its own encoding
+	Exclusive           bool          // CREATE_FILE: fail with ERR_EXIST if the path already names a file
+	Recursive           bool          // RMDIR: also remove everything under the directory
+	Versions            int64         // CREATE_FILE: how many versions of the file to keep, zero leaves it unchanged
+	Timestamp           int64         // CREATE_FILE, SNAPSHOT_CREATE, REMOVE_FILE, RMDIR: time in unix nanoseconds. Set by the leader
+	LeaseMode           LeaseMode     // LEASE_ACQUIRE: shared read or exclusive write lease
+	LeaseId             string        // LEASE_RENEW, LEASE_RELEASE: lease being renewed or released. APPEND_RENEW, APPEND_END: id of the append grant
+	Count               int64         // PLACE_REPLICAS: number of targets wanted. BALANCE: bandwidth budget in bytes per second
+	Exclude             []string      // PLACE_REPLICAS: nodes to avoid, because they already hold the data
+	MoveFrom            string        // WRITE: the copy is a balancer move and replaces this node's replica
+	Quota               Quota         // QUOTA_SET: limits to put on the FileName prefix
+	TTL                 time.Duration // CREATE_FILE: lifetime of the file from Timestamp. Zero clears it on overwrite, else keeps it
+	RequestId           uint32        // Set by SendTask and read from the frame header. New fields also need a tag in protocol.go
+}
+
+type GetOptions struct {
+	Parallelism int              // Blocks downloaded at once, DEFAULT_GET_PARALLELISM if zero
+	Version     int64            // Version to read, the latest if zero
+	Consistency ConsistencyLevel // Replicas that must agree on each block, ONE if CONSISTENCY_DEFAULT
+}
+
+// Options given to a put that are not stored with the file
+type PutOptions struct {
+	Metadata    FileMetadata
+	Pipelined   bool             // Stream each block once down a replica chain instead of to every replica from the client
+	Versions    int64            // How many versions of the file to keep from now on, unchanged if zero
+	Consistency ConsistencyLevel // Replicas that must ack each block before the put moves on, ALL if CONSISTENCY_DEFAULT
+	TTL         time.Duration    // How long the file lives before the leader deletes it, forever if zero
+	Exclusive   bool             // Fail with ERR_EXIST instead of adding a version if the file exists
+}
+
+// How many replicas of a block a put waits for, or a get compares, before it goes on
+type ConsistencyLevel int
+
+const (
+	CONSISTENCY_DEFAULT ConsistencyLevel = 0 // ALL for writes, ONE for reads
+	ONE                 ConsistencyLevel = 1
+	QUORUM              ConsistencyLevel = 2
+	ALL                 ConsistencyLevel = 3
+)
+
+// Reply to BLOCK_DIGEST: the length of the block on the replica and a checksum of the requested bytes
+type BlockDigest struct {
+	Error    string
+	Length   int64
+	Checksum string
+}
+
+// Replica's reply to READ: the size of the whole block, and how many of its bytes follow as data frames
+type BlockReadReply struct {
+	BlockLength int64
+	DataSize    int64
+}
+
+// Per-file storage policy, chosen at put time. Zero DataShards means the file is plainly replicated, and zero
+// ReplicationFactor or BlockSize fall back to the cluster defaults.
+type FileMetadata struct {
+	ReplicationFactor int64
+	BlockSize         int64
+	DataShards        int64
+	ParityShards      int64
+	UnevenBlocks      bool   // Blocks were written independently (MapleJuice outputs), so they aren't BlockSize aligned
+	Compression       string // Codec each block is compressed with, uncompressed if empty
+	Encrypted         bool   // Blocks are AES-GCM encrypted with the file's data key
+	MasterKeyId       string // Master key that WrappedKey is wrapped with
+	WrappedKey        []byte // The file's data key, wrapped by the master key
+	ETag              string // Entity tag the writer gave the version's contents, such as the S3 gateway's MD5
+}
+
+// Limits on the files under a path prefix. Zero means no limit.
+type Quota struct {
+	MaxFiles int64
+	MaxBytes int64 // Counts every replica, and every kept version
+}
+
+// A quota and how much of it is used
+type QuotaUsage struct {
+	Prefix string
+	Quota  Quota
+	Files  int64
+	Bytes  int64
+}
+
+// Leader's reply to QUOTA_GET
+type QuotaReply struct {
+	Error  string
+	Quotas []QuotaUsage
+}
+
+// Generic reply to leader requests that change metadata. An empty Error means the request succeeded, otherwise Code
+// says what kind of failure it was.
+type LeaderReply struct {
+	Error  string
+	Code   ErrorCode
+	FileId string // CREATE_FILE: storage id the path now refers to
+}
+
+// One entry of a directory listing
+type DirEntry struct {
+	Name       string
+	IsDir      bool
+	Size       int64
+	StoredSize int64 // Bytes one copy of the file takes on disk, less than Size if it is compressed
+	Expires    int64 // Unix nanoseconds when the leader deletes the file, zero for never
+	ModTime    int64 // Unix nanoseconds when the current version was written
+	Replicas   int64 // Copies of each block, 1 for erasure coded files
+	BlockSize  int64
+	ETag       string // Entity tag the current version was written with, empty if none
+}
+
+// Leader's reply to a LIST_DIR request. A file is listed as a single entry with IsFile set.
+type ListReply struct {
+	Error   string
+	Code    ErrorCode
+	IsFile  bool
+	Entries []DirEntry
+}
+
+// Leader's reply to a CONTENT_SUMMARY request: totals for everything under a path, counting the path itself
+type ContentSummary struct {
+	Error         string
+	Code          ErrorCode
+	Directories   int64
+	Files         int64
+	Length        int64 // Bytes in the current versions of the files
+	SpaceConsumed int64 // Bytes every replica and kept version takes on disk
+	Quota         Quota // Quota set on the path as a directory prefix, if any
+}
+
+// Leader's reply to a GLOB request, with the matching paths in lexical order
+type GlobReply struct {
+	Error   string
+	Matches []string
+}
+
+// One version of a file. Every version is stored separately under its own storage id.
+type VersionInfo struct {
+	Version   int64
+	FileId    string
+	Timestamp int64 // Unix nanoseconds
+	Size      int64
+}
+
+type VersionsReply struct {
+	Error    string
+	Code     ErrorCode
+	Versions []VersionInfo
+}
+
+type SnapshotInfo struct {
+	Name     string
+	Prefix   string
+	Created  int64 // Unix nanoseconds
+	NumFiles int
+	Bytes    int64
+}
+
+type SnapshotsReply struct {
+	Error     string
+	Snapshots []SnapshotInfo
+}
+
+// A deleted file waiting in the trash
+type TrashInfo struct {
+	Id       string
+	Path     string
+	Deleted  int64 // Unix nanoseconds
+	Expires  int64 // Unix nanoseconds, when its blocks are deleted for good
+	Versions int
+	Size     int64 // Size of the current version
+}
+
+type TrashReply struct {
+	Error   string
+	Entries []TrashInfo
+}
+
+// Leader's reply to APPEND_BEGIN. The appender has the file to itself until it sends APPEND_END or the grant expires,
+// Duration after it was granted or last renewed.
+type AppendGrant struct {
+	Error             string
+	GrantId           string
+	Duration          time.Duration
+	FileId            string // Storage id to write the appended blocks under
+	Offset            int64  // Current size of the file, where the appended data starts
+	Metadata          FileMetadata
+	NumBlocks         int64    // Rows in the file's block locations
+	LastBlockReplicas []string // Live replicas of the block holding Offset, if that block is partially filled
+}
+
+type LeaseMode int
+
+const (
+	READ_LEASE  LeaseMode = 1 // Shared with other readers
+	WRITE_LEASE LeaseMode = 2 // Exclusive
+)
+
+// Leader's reply to LEASE_ACQUIRE. The lease lapses Duration after it was granted or last renewed.
+type LeaseGrant struct {
+	Error    string
+	LeaseId  string
+	Duration time.Duration
+}
+
+// Leader's reply to PLACE_REPLICAS, the nodes to write to in order of preference
+type PlacementReply struct {
+	Error   string
+	Targets []string
+}
+
+// Leader's reply to a GET_METADATA request
+type FileStat struct {
+	Exists     bool
+	Size       int64
+	Metadata   FileMetadata
+	FileId     string // Name of the file's blocks in the block store
+	StoredSize int64  // Bytes one copy of the file takes on disk
 }
 
 const KB = int64(1024)
 const MB = int64(KB * 1024)
 const SDFS_PORT = "4005"
 const FILESYSTEM_ROOT = "server/sdfs/sdfsFileSystemRoot/"
+const BLOCK_TEMP_DIR = FILESYSTEM_ROOT + "tmp/" // Blocks being received, moved into FILESYSTEM_ROOT once complete
 const BLOCK_SIZE = int64(20 * MB)
 const REPLICATION_FACTOR = int64(4)
+const EC_DATA_SHARDS = int64(6)
+const EC_PARITY_SHARDS = int64(3)
+const DEFAULT_GET_PARALLELISM = 8
+const BLOCK_LENGTH_ONLY = int64(-1)
 
-var FileSet map[string]bool
-
-var MuLocalFs sync.Mutex
-var CondLocalFs = sync.NewCond(&MuLocalFs)
 var LEADER_IP string = "172.22.158.162"
 
+// Writes sequentially into a file starting at Offset, so concurrent writers can fill disjoint ranges of it
+type OffsetWriter struct {
+	File   *os.File
+	Offset int64
+}
+
+func (ow *OffsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.File.WriteAt(p, ow.Offset)
+	ow.Offset += int64(n)
+	return n, err
+}
+
 type LimitedWriter struct {
 	Writer  io.Writer
 	Limit   int64
@@ -90,7 +363,7 @@ func OpenTCPConnection(ipAddr string, port string) (net.Conn, error) {
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		// Handle error if connection fails
-		fmt.Println("Error:", err)
+		log.Println("Error:", err)
 		return nil, err
 	}
 
@@ -113,7 +386,7 @@ func GetFileSize(filePath string) (int64, error) {
 	// Get file information
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.Println("Error:", err)
 		return 0, err
 	}
 
@@ -138,26 +411,25 @@ func CeilDivide(a, b int64) int64 {
 	return quotient
 }
 
-func GetFileName(sdfsFilename string, blockidx string) string {
-	return fmt.Sprintf("%s%s_%s", FILESYSTEM_ROOT, blockidx, sdfsFilename)
+// Local path of a block. Blocks are stored under their file's storage id, escaped so no id can leave the root.
+func GetFileName(fileId string, blockidx string) string {
+	return fmt.Sprintf("%s%s_%s", FILESYSTEM_ROOT, blockidx, url.PathEscape(fileId))
 }
 
 func GetFilePtr(sdfsFilename string, blockidx string, flags int) (string, int, *os.File, error) {
 	// Specify the file path
 	filePath := GetFileName(sdfsFilename, blockidx)
 	fileSize, _ := GetFileSize(filePath)
-	fmt.Printf("File path to block %s", filePath)
 	file, err := os.OpenFile(filePath, flags, 0666)
-	if err != nil {
-		// Handle the error if the file cannot be opened
-		if os.IsNotExist(err) {
-			fmt.Println("File does not exist.")
-		}
-	}
-
 	return filePath, int(fileSize), file, err
 }
 
+// Opens a new file to receive a block into. Renaming it to the block's name replaces the block atomically.
+func CreateBlockTempFile() (*os.File, error) {
+	return os.CreateTemp(BLOCK_TEMP_DIR, "block")
+}
+
+// Sends size bytes of fp, starting at startIdx, as data frames
 func BufferedWriteToConnection(conn net.Conn, fp *os.File, size, startIdx int64) (int64, error) {
 	// Seek to the starting index in the source file
 	_, err := fp.Seek(startIdx, io.SeekStart)
@@ -165,97 +437,87 @@ func BufferedWriteToConnection(conn net.Conn, fp *os.File, size, startIdx int64)
 		return 0, err
 	}
 
-	// Create a LimitedReader to copy a specific number of bytes
-	limitedReader := &io.LimitedReader{
-		R: fp,
-		N: size,
-	}
-
-	// Use io.CopyN to copy the specified number of bytes to the connection
-	n, err := io.CopyN(bufio.NewWriter(conn), limitedReader, size)
+	n, err := WriteData(conn, fp, size)
 	if err != nil {
-		fmt.Println("Error in buffered write to connection:", err)
+		log.Println("Error in buffered write to connection:", err)
 	}
 	return n, err
 }
 
+// Receives size bytes of data frames into fp
 func BufferedReadFromConnection(conn net.Conn, fp *os.File, size int64) (int64, error) {
-	// Create a custom writer to limit the number of bytes copied
-	limitedWriter := &LimitedWriter{
-		Writer: fp,
-		Limit:  size,
-	}
-
-	// Use io.Copy to copy data, respecting the limit
-	n, err := io.Copy(limitedWriter, conn)
-	if err != nil && err != io.EOF {
-		panic(err)
-	}
+	n, err := io.Copy(fp, NewDataReader(conn, size))
 	log.Printf("Size: %d, Read: %d", size, n)
-	if n < size {
+	if err != nil {
+		return n, err
+	} else if n < size {
 		log.Printf("didn't read enough data from connection")
+		return n, io.ErrUnexpectedEOF
 	}
 	return n, nil
 }
 
+// Opens a connection to ipAddr and sends the task on it as a new request. Frames on the returned connection belong
+// to that request, and fail once its deadline passes.
 func SendTask(task Task, ipAddr string, ack bool) (*net.Conn, error) {
-	conn, tcpOpenError := OpenTCPConnection(ipAddr, SDFS_PORT)
+	return SendTaskContext(context.Background(), task, ipAddr, ack)
+}
+
+// SendTask, with the request cut short if ctx ends before its deadline
+func SendTaskContext(ctx context.Context, task Task, ipAddr string, ack bool) (*net.Conn, error) {
+	conn, tcpOpenError := OpenTCPConnectionContext(ctx, ipAddr, SDFS_PORT)
 	if tcpOpenError != nil {
 		return nil, tcpOpenError
 	}
 
-	bufferConn := bufio.NewWriter(conn)
-
 	task.IsAck = ack
-	arr := task.Marshal()
-	bytesWritten, err := bufferConn.Write(arr)
+	task.RequestId = NextRequestId()
+	requestConn := NewRequestConn(conn, &task)
+	requestConn.Watch(ctx, OpDeadline(ctx, task.ConnectionOperation))
+
+	err := WriteFrame(requestConn, FRAME_REQUEST, task.Marshal())
 	if err != nil {
+		requestConn.Close()
 		return nil, err
-	} else if bytesWritten != len(arr) {
-		return nil, io.ErrShortWrite
 	}
-	bufferConn.Write([]byte{'\n'})
-	bufferConn.Flush()
 
-	fmt.Println("Sent task to leader ip:", ipAddr)
+	log.Println("Sent task to ip:", ipAddr)
 
-	return &conn, nil
+	var netConn net.Conn = requestConn
+	return &netConn, nil
 }
 
-func SendTaskOnExistingConnection(task Task, conn net.Conn) error {
-	arr := task.Marshal()
-	bytesWritten, err := conn.Write(arr)
-	if err != nil {
+// Sends a request to the leader, retrying with backoff while it can't be reached. The leader is looked up again
+// before each attempt, in case it failed over.
+func SendAckToMasterContext(ctx context.Context, task Task) (*net.Conn, error) {
+	task.AckTargetIp = New19Byte(gossiputils.Ip)
+
+	var conn *net.Conn
+	err := Retry(ctx, MAX_ATTEMPTS, func() error {
+		leaderIp := gossiputils.GetLeader()
+		log.Printf("detected Leader ip: %s\n", leaderIp)
+
+		var err error
+		conn, err = SendTaskContext(ctx, task, leaderIp, true)
 		return err
-	} else if bytesWritten != len(arr) {
-		return io.ErrShortWrite
+	})
+	if err != nil {
+		return nil, &LeaderUnreachableError{Err: err}
 	}
-	conn.Write([]byte{'\n'})
-
-	return nil
+	return conn, nil
 }
 
-func SendAckToMaster(task Task) *net.Conn {
-	leaderIp := gossiputils.GetLeader()
-
-	fmt.Printf("detected Leader ip: %s\n", leaderIp)
-	task.AckTargetIp = New19Byte(gossiputils.Ip)
-	val, ok := gossiputils.MembershipMap.Get(leaderIp)
-	if ok && (val.State == gossiputils.ALIVE || val.State == gossiputils.SUSPECTED) {
-		conn, connectionError := SendTask(task, leaderIp, true)
-
-		if connectionError != nil {
-			log.Println("Pick")
-			return SendAckToMaster(task)
-		}
+// Returned when no attempt to send a request reached the leader, wrapping the last attempt's error
+type LeaderUnreachableError struct {
+	Err error
+}
 
-		return conn
-	} else {
-		newLeader := gossiputils.GetLeader()
-		conn, _ := SendTask(task, newLeader, true)
+func (e *LeaderUnreachableError) Error() string {
+	return "unable to reach leader: " + e.Err.Error()
+}
 
-		return conn
-	}
+func (e *LeaderUnreachableError) Unwrap() error {
+	return e.Err
 }
 
 func New19Byte(data string) [19]byte {
@@ -274,11 +536,11 @@ func BytesToString(data []byte) string {
 	return strings.TrimRight(string(data), "\x00")
 }
 
-func GetBlockPosition(blockNumber int64, fileSize int64) (int64, int64) {
-	currentByteIdx := blockNumber * int64(BLOCK_SIZE)
+func GetBlockPosition(blockNumber int64, fileSize int64, blockSize int64) (int64, int64) {
+	currentByteIdx := blockNumber * blockSize
 
-	if BLOCK_SIZE < fileSize-currentByteIdx {
-		return currentByteIdx, BLOCK_SIZE
+	if blockSize < fileSize-currentByteIdx {
+		return currentByteIdx, blockSize
 	} else {
 		return currentByteIdx, fileSize - currentByteIdx
 	}
@@ -291,74 +553,407 @@ func GetMinInt64(a int64, b int64) int64 {
 	return b
 }
 
-func (task Task) Marshal() []byte {
-	marshaledTask, err := json.Marshal(task)
-	if err != nil {
-		log.Fatalf("error marshaling task: %v\n", err)
+func GetMaxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
 	}
-	return marshaledTask
+	return b
 }
 
-func Unmarshal(conn net.Conn) (*Task, int64) {
-	var task Task
+// Leader operations that only read metadata, or that the leader forwards itself once it has accepted them, and so
+// are not routed to the submasters on arrival
+func IsLeaderQuery(op BlockOperation) bool {
+	return op == GET_2D || op == GET_PREFIX || op == SIZE_BY_PREFIX || op == GET_METADATA || op == APPEND_BEGIN ||
+		op == APPEND_RENEW || op == APPEND_END || op == PLACE_REPLICAS || op == BALANCE || op == QUOTA_GET || IsLeaseOp(op) || IsNamespaceOp(op)
+}
 
-	buffConn := bufio.NewReader(conn)
+// Namespace changes are applied by the leader first, which then forwards them to the submasters itself. This way
+// every submaster sees the same outcome, such as the storage id chosen for a new file.
+func IsNamespaceOp(op BlockOperation) bool {
+	return op == CREATE_FILE || op == MKDIR || op == RMDIR || op == RENAME || op == LIST_DIR || op == REMOVE_FILE ||
+		op == LIST_VERSIONS || op == SNAPSHOT_CREATE || op == SNAPSHOT_LIST || op == SNAPSHOT_DELETE || op == UNDELETE ||
+		op == TRASH_LIST || op == TRASH_PURGE || op == GLOB ||
+		op == CONTENT_SUMMARY || op == ABORT_CREATE
+}
 
-	// Read from the connection until a newline is encountered
-	data, err := buffConn.ReadBytes('\n')
-	if err != nil {
-		log.Fatalf("Error reading from connection: %v\n", err)
+// Leases are only tracked by the leader, so these are never forwarded to the submasters
+func IsLeaseOp(op BlockOperation) bool {
+	return op == LEASE_ACQUIRE || op == LEASE_RENEW || op == LEASE_RELEASE
+}
+
+// Normalizes a user visible SDFS path to the form the namespace uses: no leading or trailing slash, no empty, "." or
+// ".." components. The root directory is "".
+func CleanPath(name string) string {
+	cleaned := path.Clean("/" + strings.TrimSpace(name))
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+// Picks a new random storage id. Blocks are stored under a file's id, never under its path.
+func NewFileId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Parses the optional arguments of put: a storage policy, "-r <replication factor>", "-b <block size>",
+// "-v <versions>", "-c <consistency level>", "-z <compression codec>", "-e" to encrypt and "-p" for a pipelined write.
+func ParsePutOptions(args []string) (PutOptions, error) {
+	var options PutOptions
+	var err error
+	metadata := &options.Metadata
+
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimSpace(args[i])
+		if arg == "" {
+			continue
+		}
+
+		if arg == "-p" {
+			options.Pipelined = true
+			continue
+		}
+
+		if arg == "-c" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			options.Consistency, err = ParseConsistencyLevel(args[i])
+			if err != nil {
+				return options, err
+			}
+			continue
+		}
+
+		if arg == "-e" {
+			metadata.Encrypted = true
+			continue
+		}
+
+		if arg == "-z" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			metadata.Compression = strings.ToLower(strings.TrimSpace(args[i]))
+			_, err = GetCodec(metadata.Compression)
+			if err != nil {
+				return options, err
+			}
+			continue
+		}
+
+		if arg == "-t" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			options.TTL, err = time.ParseDuration(strings.TrimSpace(args[i]))
+			if err != nil || options.TTL <= 0 {
+				return options, fmt.Errorf("invalid time to live %s, expected a duration like 30m or 2h", args[i])
+			}
+			continue
+		}
+
+		if arg == "-v" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			_, err = fmt.Sscanf(strings.TrimSpace(args[i]), "%d", &options.Versions)
+			if err != nil || options.Versions <= 0 {
+				return options, fmt.Errorf("invalid number of versions %s", args[i])
+			}
+			continue
+		}
+
+		if arg == "-r" || arg == "-b" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			value := strings.TrimSpace(args[i])
+
+			if arg == "-r" {
+				_, err = fmt.Sscanf(value, "%d", &metadata.ReplicationFactor)
+				if err != nil || metadata.ReplicationFactor <= 0 {
+					return options, fmt.Errorf("invalid replication factor %s", value)
+				}
+			} else {
+				metadata.BlockSize, err = ParseByteSize(value)
+				if err != nil {
+					return options, err
+				}
+			}
+			continue
+		}
+
+		policy, err := ParseStoragePolicy(arg)
+		if err != nil {
+			return options, err
+		}
+		metadata.DataShards, metadata.ParityShards = policy.DataShards, policy.ParityShards
 	}
-	data = data[:len(data)-1]
 
-	err = json.Unmarshal([]byte(data), &task)
+	if metadata.IsErasureCoded() && (metadata.ReplicationFactor != 0 || options.Pipelined || metadata.HasEncodedBlocks()) {
+		return options, fmt.Errorf("erasure coded files can't also set a replication factor, be pipelined, compressed or encrypted")
+	}
 
-	if err != nil {
-		log.Fatalf("Error unmarshalling task: %v\n", err)
+	return options, nil
+}
+
+// Parses the optional arguments of get: "-j <parallelism>", "--version <version>" and "-c <consistency level>"
+func ParseGetOptions(args []string) (GetOptions, error) {
+	var options GetOptions
+
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimSpace(args[i])
+		if arg == "" {
+			continue
+		}
+
+		if arg == "-j" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			value := strings.TrimSpace(args[i])
+			_, err := fmt.Sscanf(value, "%d", &options.Parallelism)
+			if err != nil || options.Parallelism <= 0 {
+				return options, fmt.Errorf("invalid parallelism %s", value)
+			}
+			continue
+		}
+
+		if arg == "--version" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			value := strings.TrimSpace(args[i])
+			_, err := fmt.Sscanf(value, "%d", &options.Version)
+			if err != nil || options.Version <= 0 {
+				return options, fmt.Errorf("invalid version %s", value)
+			}
+			continue
+		}
+
+		if arg == "-c" {
+			if i+1 >= len(args) {
+				return options, fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			level, err := ParseConsistencyLevel(args[i])
+			if err != nil {
+				return options, err
+			}
+			options.Consistency = level
+			continue
+		}
+
+		return options, fmt.Errorf("unknown get option %s", arg)
 	}
 
-	return &task, int64(len(data))
+	return options, nil
 }
 
-func MarshalBlockLocationArr(array [][]string) []byte {
-	jsonData, err := json.Marshal(array)
-	if err != nil {
-		log.Fatalf("error marshaling 2d arr: %v\n", err)
+func ParseConsistencyLevel(level string) (ConsistencyLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "one":
+		return ONE, nil
+	case "quorum":
+		return QUORUM, nil
+	case "all":
+		return ALL, nil
 	}
-	return jsonData
+	return CONSISTENCY_DEFAULT, fmt.Errorf("unknown consistency level %s, expected one, quorum or all", level)
 }
 
-func UnmarshalBlockLocationArr(conn net.Conn) ([][]string, error) {
-	var locations [][]string
+// Number of the n replicas of a block that must take part in a write or read at this level
+func (level ConsistencyLevel) Required(n int, isWrite bool) int {
+	if level == CONSISTENCY_DEFAULT {
+		level = ONE
+		if isWrite {
+			level = ALL
+		}
+	}
 
-	decoder := json.NewDecoder(conn)
-	err := decoder.Decode(&locations)
+	switch level {
+	case ONE:
+		if n == 0 {
+			return 0
+		}
+		return 1
+	case QUORUM:
+		return n/2 + 1
+	}
+	return n
+}
 
-	if err != nil {
-		log.Fatalf("Error unmarshalling 2d arr: %v\n", err)
-		return nil, err
+func (level ConsistencyLevel) String() string {
+	switch level {
+	case ONE:
+		return "ONE"
+	case QUORUM:
+		return "QUORUM"
+	case ALL:
+		return "ALL"
+	}
+	return "DEFAULT"
+}
+
+// Parses sizes like "4096", "512KB" or "64MB"
+func ParseByteSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+
+	if strings.HasSuffix(size, "MB") {
+		multiplier = MB
+		size = strings.TrimSuffix(size, "MB")
+	} else if strings.HasSuffix(size, "KB") {
+		multiplier = KB
+		size = strings.TrimSuffix(size, "KB")
+	} else if strings.HasSuffix(size, "B") {
+		size = strings.TrimSuffix(size, "B")
 	}
 
-	return locations, nil
+	var n int64
+	if _, err := fmt.Sscanf(size, "%d", &n); err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+
+	return n * multiplier, nil
+}
+
+// Parses the storage policy given to put: "replicated" (default), "ec" for RS(6,3), or "rs-<k>-<m>".
+func ParseStoragePolicy(policy string) (FileMetadata, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+
+	if policy == "" || policy == "replicated" {
+		return FileMetadata{}, nil
+	} else if policy == "ec" {
+		return FileMetadata{DataShards: EC_DATA_SHARDS, ParityShards: EC_PARITY_SHARDS}, nil
+	}
+
+	var k, m int64
+	if _, err := fmt.Sscanf(policy, "rs-%d-%d", &k, &m); err != nil {
+		return FileMetadata{}, fmt.Errorf("unknown storage policy %s", policy)
+	}
+	if k <= 0 || m <= 0 || k+m > 256 {
+		return FileMetadata{}, fmt.Errorf("invalid erasure code RS(%d,%d)", k, m)
+	}
+
+	return FileMetadata{DataShards: k, ParityShards: m}, nil
+}
+
+func (metadata FileMetadata) IsErasureCoded() bool {
+	return metadata.DataShards > 0
+}
+
+// Number of copies kept of each block. Erasure coded pieces are stored once.
+func (metadata FileMetadata) Replicas() int64 {
+	if metadata.IsErasureCoded() {
+		return 1
+	} else if metadata.ReplicationFactor > 0 {
+		return metadata.ReplicationFactor
+	}
+	return REPLICATION_FACTOR
+}
+
+// Bytes size bytes of data take across all of their replicas, or data and parity pieces
+func (metadata FileMetadata) ReplicatedSize(size int64) int64 {
+	if metadata.IsErasureCoded() {
+		return CeilDivide(size*metadata.StripeWidth(), metadata.DataShards)
+	}
+	return size * metadata.Replicas()
+}
+
+func (metadata FileMetadata) BlockBytes() int64 {
+	if metadata.BlockSize > 0 {
+		return metadata.BlockSize
+	}
+	return BLOCK_SIZE
+}
+
+// Number of pieces (data + parity) per stripe. Stripe s, piece p lives at block index s*StripeWidth()+p.
+func (metadata FileMetadata) StripeWidth() int64 {
+	return metadata.DataShards + metadata.ParityShards
+}
+
+// Maps the index of a logical data block onto the block index it is stored under
+func (metadata FileMetadata) StoredBlockIndex(dataBlockIdx int64) int64 {
+	if metadata.IsErasureCoded() {
+		return (dataBlockIdx/metadata.DataShards)*metadata.StripeWidth() + dataBlockIdx%metadata.DataShards
+	}
+	return dataBlockIdx
 }
 
-func SendSmallAck(conn net.Conn) {
-	_, err := conn.Write([]byte("A"))
+func (metadata FileMetadata) NumStripes(fileSize int64) int64 {
+	return CeilDivide(CeilDivide(fileSize, metadata.BlockBytes()), metadata.DataShards)
+}
+
+// Rows and columns of the file's entry in the leader's BlockLocations
+func (metadata FileMetadata) BlockLocationsShape(fileSize int64) (int64, int64) {
+	if metadata.IsErasureCoded() {
+		return metadata.NumStripes(fileSize) * metadata.StripeWidth(), 1
+	}
+	return CeilDivide(fileSize, metadata.BlockBytes()), metadata.Replicas()
+}
+
+// Stored blocks differ from the file's data, so a block can only be read whole and decoded with DecodeBlock
+func (metadata FileMetadata) HasEncodedBlocks() bool {
+	return metadata.Compression != "" || metadata.IsEncrypted()
+}
+
+func (metadata FileMetadata) IsEncrypted() bool {
+	return metadata.Encrypted
+}
+
+func (metadata FileMetadata) String() string {
+	description := fmt.Sprintf("replicated x%d, %d byte blocks", metadata.Replicas(), metadata.BlockBytes())
+	if metadata.IsErasureCoded() {
+		description = fmt.Sprintf("RS(%d,%d), %d byte blocks", metadata.DataShards, metadata.ParityShards, metadata.BlockBytes())
+	}
+	if metadata.Compression != "" {
+		description += ", " + metadata.Compression + " compressed"
+	}
+	if metadata.IsEncrypted() {
+		description += ", encrypted with master key " + metadata.MasterKeyId
+	}
+	return description
+}
+
+// Reads the request frame a connection starts with. Anything else is refused on its header, so a connection can't
+// make the node allocate a data frame's worth of memory before saying anything valid.
+func Unmarshal(conn net.Conn) (*Task, int64, error) {
+	header, err := ReadFrameHeader(conn)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading request: %w", err)
+	} else if header.Type != FRAME_REQUEST {
+		return nil, 0, fmt.Errorf("error reading request: expected frame type %d, got %d", FRAME_REQUEST, header.Type)
+	}
+
+	frame, err := readFramePayload(conn, header)
 	if err != nil {
-		log.Fatalln("err: ", err)
+		return nil, 0, fmt.Errorf("error reading request: %w", err)
 	}
+
+	task, err := UnmarshalTask(frame)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error unmarshalling task: %w", err)
+	}
+
+	return task, int64(len(frame.Payload)), nil
 }
 
-func ReadSmallAck(conn net.Conn) {
-	buffer := make([]byte, 1)
-	for {
-		n, err := conn.Read(buffer)
-		if err != nil {
-			log.Print("Error reading from connection: ", err)
-			break
-		}
-		if n > 0 {
-			break
-		}
+func UnmarshalBlockLocationArr(conn net.Conn) ([][]string, error) {
+	var locations [][]string
+
+	err := ReadReply(conn, &locations)
+
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling 2d arr: %w", err)
 	}
+
+	return locations, nil
 }
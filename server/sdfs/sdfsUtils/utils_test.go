@@ -0,0 +1,34 @@
+package sdfsutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGetOptions(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    GetOptions
+		wantErr string
+	}{
+		{"", GetOptions{}, ""},
+		{"-j 4 --version 2", GetOptions{Parallelism: 4, Version: 2}, ""},
+		{"-j", GetOptions{}, "missing value for -j"},
+		{"--version 2 -j", GetOptions{Version: 2}, "missing value for -j"},
+		{"--version", GetOptions{}, "missing value for --version"},
+		{"-c", GetOptions{}, "missing value for -c"},
+		{"-j 0", GetOptions{}, "invalid parallelism 0"},
+		{"-x", GetOptions{}, "unknown get option -x"},
+	}
+
+	for _, test := range tests {
+		got, err := ParseGetOptions(strings.Fields(test.args))
+		if test.wantErr == "" {
+			if err != nil || got != test.want {
+				t.Errorf("ParseGetOptions(%q) = %+v, %v, want %+v", test.args, got, err, test.want)
+			}
+		} else if err == nil || err.Error() != test.wantErr {
+			t.Errorf("ParseGetOptions(%q) error = %v, want %q", test.args, err, test.wantErr)
+		}
+	}
+}
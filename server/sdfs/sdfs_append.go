@@ -0,0 +1,199 @@
+package sdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	gossipUtils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Appends hold an exclusive grant from the leader for the whole operation. The appender first tops up the file's last
+// partial block in place on each of its replicas, then writes the rest as new blocks, and finally commits the new size
+// with APPEND_END. Readers keep seeing the old size until then, and an aborted append has the leader delete the blocks
+// it added. The data is sent through an Upload, a block at a time.
+
+// The append is committed only while lease, the write lease on sdfsFilename, is still held
+func InitiateAppendCommand(ctx context.Context, lease *Lease, localFilename string, sdfsFilename string) error {
+	start := time.Now()
+
+	file, err := os.Open(localFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	upload, err := BeginAppendUpload(ctx, sdfsFilename)
+	if err != nil {
+		return err
+	}
+	upload.lease = lease
+
+	appendSize, err := io.Copy(upload, file)
+	if err != nil {
+		upload.Abort()
+		return err
+	}
+
+	err = upload.Commit()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Appended %d bytes to %s, new size %d\n", appendSize, sdfsFilename, upload.Size())
+	fmt.Println("APPEND COMMAND TOOK :", time.Since(start).Seconds())
+	return nil
+}
+
+// Blocks until the leader grants this node the right to append to the file
+func RequestAppendGrant(ctx context.Context, sdfsFilename string, newVersion bool) (utils.AppendGrant, error) {
+	var grant utils.AppendGrant
+	task := utils.Task{
+		ConnectionOperation: utils.APPEND_BEGIN,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		Overwrite:           newVersion,
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return grant, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &grant)
+	if err != nil {
+		return grant, err
+	} else if grant.Error != "" {
+		return grant, errors.New(grant.Error)
+	}
+
+	return grant, nil
+}
+
+// Releases an append grant. A non negative newSize commits the appended data as the file's new size, and a negative
+// one aborts the append. The leader replies once it has done so, and refuses if the grant has lapsed.
+func SendAppendEnd(ctx context.Context, grant utils.AppendGrant, newSize int64, etag string) error {
+	return SendLeaderRequest(ctx, utils.Task{
+		ConnectionOperation: utils.APPEND_END,
+		FileName:            utils.New1024Byte(grant.FileId),
+		LeaseId:             grant.GrantId,
+		OriginalFileSize:    newSize,
+		Metadata:            utils.FileMetadata{ETag: etag},
+		IsAck:               true,
+	})
+}
+
+// Renews an append grant well before it lapses, until stop is closed or the leader refuses
+func renewAppendGrant(grant utils.AppendGrant, stop chan struct{}) {
+	ticker := time.NewTicker(grant.Duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := SendLeaderRequest(context.Background(), utils.Task{
+			ConnectionOperation: utils.APPEND_RENEW,
+			FileName:            utils.New1024Byte(grant.FileId),
+			LeaseId:             grant.GrantId,
+			IsAck:               true,
+		})
+		if err != nil {
+			log.Printf("Lost the append grant on %s: %v\n", grant.FileId, err)
+			return
+		}
+	}
+}
+
+// Sends an ack that the leader doesn't reply to
+func SendLeaderAck(ctx context.Context, task utils.Task) error {
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return err
+	}
+	(*conn).Close()
+	return nil
+}
+
+// Writes a new block of appended data to the file's replica count of nodes. It succeeds if any of them took it.
+func appendBlock(ctx context.Context, data io.ReaderAt, n int64, blockIdx int64, newSize int64, grant utils.AppendGrant) error {
+	task := utils.Task{
+		AckTargetIp:         utils.New19Byte(utils.LEADER_IP),
+		ConnectionOperation: utils.WRITE,
+		FileName:            utils.New1024Byte(grant.FileId),
+		OriginalFileSize:    newSize,
+		BlockIndex:          blockIdx,
+		DataSize:            n,
+		IsAck:               false,
+		Metadata:            grant.Metadata,
+		IsAppend:            true,
+	}
+
+	placed := 0
+	err := fmt.Errorf("no alive nodes to write appended block %d to", blockIdx)
+	for _, ip := range PickChain(ctx, int(grant.Metadata.Replicas()), map[string]bool{gossipUtils.Ip: true}) {
+		task.DataTargetIp = utils.New19Byte(ip)
+		sendErr := SendBlockToReplica(ctx, ip, task, io.NewSectionReader(data, 0, n))
+		if sendErr != nil {
+			log.Printf("Failed to write appended block %d to %s: %v\n", blockIdx, ip, sendErr)
+			err = fmt.Errorf("appended block %d could not be written to any node: %w", blockIdx, sendErr)
+			continue
+		}
+		placed++
+	}
+
+	if placed == 0 {
+		return err
+	}
+	return nil
+}
+
+// Writes the first n appended bytes onto the end of the file's last block on every replica. A replica that misses the
+// update drops its copy, so it can never serve the block without the appended bytes.
+func fillLastBlock(ctx context.Context, data io.ReaderAt, n int64, blockIdx int64, blockOffset int64, grant utils.AppendGrant) error {
+	task := utils.Task{
+		AckTargetIp:         utils.New19Byte(utils.LEADER_IP),
+		ConnectionOperation: utils.WRITE,
+		FileName:            utils.New1024Byte(grant.FileId),
+		OriginalFileSize:    grant.Offset + n,
+		BlockIndex:          blockIdx,
+		DataSize:            n,
+		IsAck:               false,
+		Metadata:            grant.Metadata,
+		RangeOffset:         blockOffset,
+		IsAppend:            true,
+	}
+
+	updated := 0
+	for _, ip := range grant.LastBlockReplicas {
+		task.DataTargetIp = utils.New19Byte(ip)
+		err := SendBlockToReplica(ctx, ip, task, io.NewSectionReader(data, 0, n))
+		if err == nil {
+			updated++
+			continue
+		}
+
+		log.Printf("Failed to extend block %d on %s, dropping that replica: %v\n", blockIdx, ip, err)
+		deleteTask := task
+		deleteTask.ConnectionOperation = utils.DELETE
+		deleteTask.DataSize = 0
+		conn, err := utils.SendTask(deleteTask, ip, false)
+		if err == nil {
+			(*conn).Close()
+		}
+	}
+
+	if updated == 0 {
+		return fmt.Errorf("no replica of block %d could be extended", blockIdx)
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package sdfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// The balancer evens out how many bytes each node stores, so nodes that joined after the data was loaded take their
+// share. It repeatedly moves one block replica off the fullest node, to a node the placement policy picks among those
+// storing less, until every node is within BALANCE_THRESHOLD of the mean. A move copies the block to the new node, swaps it for the old one in BlockLocations
+// once the copy is acked, and only then deletes the old copy. Moves are paced to stay under a bandwidth budget.
+
+const BALANCE_THRESHOLD = 0.1 // Fraction of the mean a node may be above or below it
+const BALANCER_INTERVAL = time.Minute
+const DEFAULT_BALANCER_BANDWIDTH = 10 * utils.MB // Bytes per second
+const MOVE_TIMEOUT = 2 * time.Minute
+
+type BlockMove struct {
+	FileName string
+	BlockIdx int64
+	From     string
+	To       string
+	Bytes    int64
+}
+
+var balancerMu sync.Mutex // Held for the duration of a run
+var backgroundMu sync.Mutex
+var backgroundStop chan struct{} // Closes to stop background balancing, nil when it isn't running
+
+var pendingMovesMu sync.Mutex
+var pendingMoves = make(map[string]chan struct{}) // move key : closed once the move's copy is swapped in
+
+func moveKey(fileName string, blockIdx int64, to string) string {
+	return fmt.Sprintf("%s/%d/%s", fileName, blockIdx, to)
+}
+
+// Runs the balancer until the cluster is balanced or no move helps. Only one run happens at a time.
+func RunBalancer(bandwidth int64) {
+	if !balancerMu.TryLock() {
+		fmt.Println("Balancer is already running")
+		return
+	}
+	defer balancerMu.Unlock()
+
+	if bandwidth <= 0 {
+		bandwidth = DEFAULT_BALANCER_BANDWIDTH
+	}
+
+	start := time.Now()
+	var moved, movedBytes int64
+	for {
+		move, ok := NextBlockMove()
+		if !ok {
+			break
+		}
+
+		fmt.Printf("Balancer moving block %d of %s (%d bytes) from %s to %s\n", move.BlockIdx, move.FileName, move.Bytes, move.From, move.To)
+		err := MoveBlock(move)
+		if err != nil {
+			fmt.Println("Balancer move failed, stopping: ", err)
+			break
+		}
+		moved++
+		movedBytes += move.Bytes
+
+		// Wait until the bytes moved so far fit in the budget
+		earliest := start.Add(time.Duration(float64(movedBytes) / float64(bandwidth) * float64(time.Second)))
+		time.Sleep(time.Until(earliest))
+	}
+
+	fmt.Printf("Balancer moved %d blocks (%d bytes) in %.1fs\n", moved, movedBytes, time.Since(start).Seconds())
+}
+
+// Picks the next move: a block on the fullest node, sent where the placement policy would put a new replica of it. The
+// policy's pick is only taken if the move narrows the gap between the two nodes. Returns false once every node is
+// within BALANCE_THRESHOLD of the mean.
+func NextBlockMove() (BlockMove, bool) {
+	usages := NodeUsages()
+	var alive []string
+	var total int64
+	for _, ip := range gossiputils.MembershipMap.Keys() {
+		member, ok := gossiputils.MembershipMap.Get(ip)
+		if ok && member.State == gossiputils.ALIVE {
+			alive = append(alive, ip)
+			total += usages[ip].Bytes
+		}
+	}
+	if len(alive) < 2 {
+		return BlockMove{}, false
+	}
+
+	fullest, emptiest := alive[0], alive[0]
+	for _, ip := range alive {
+		if usages[ip].Bytes > usages[fullest].Bytes {
+			fullest = ip
+		}
+		if usages[ip].Bytes < usages[emptiest].Bytes {
+			emptiest = ip
+		}
+	}
+
+	mean := float64(total) / float64(len(alive))
+	over := float64(usages[fullest].Bytes) > mean*(1+BALANCE_THRESHOLD)
+	under := float64(usages[emptiest].Bytes) < mean*(1-BALANCE_THRESHOLD)
+	if !over && !under {
+		return BlockMove{}, false
+	}
+
+	blocks, _ := FileToBlocks.Get(fullest)
+	for _, block := range blocks {
+		blockIdx, _ := block[0].(int64)
+		fileName, _ := block[1].(string)
+
+		size := blockStoredSize(fileName, blockIdx)
+		holders, ok := movableBlockHolders(fileName, blockIdx)
+		if size == 0 || !ok {
+			continue
+		}
+
+		targets := PlaceReplicas(1, fullest, holders, false)
+		if len(targets) == 0 || 2*size > usages[fullest].Bytes-usages[targets[0]].Bytes {
+			continue
+		}
+		return BlockMove{FileName: fileName, BlockIdx: blockIdx, From: fullest, To: targets[0], Bytes: size}, true
+	}
+
+	return BlockMove{}, false
+}
+
+func blockStoredSize(fileName string, blockIdx int64) int64 {
+	sizes, _ := BlockStoredSizes.Get(fileName)
+	if blockIdx < int64(len(sizes)) {
+		return sizes[blockIdx]
+	}
+	return 0
+}
+
+// The nodes holding a block, which a move must not go to. A block can only move while none of its replicas are being
+// written, and no append to its file is running, since an append tops up the last block in place on the replicas it
+// was given. Erasure coded pieces stay put, since moving one could land two pieces of a stripe on the same node.
+func movableBlockHolders(fileName string, blockIdx int64) (map[string]bool, bool) {
+	metadata, ok := FileToMetadata.Get(fileName)
+	if !ok || metadata.IsErasureCoded() {
+		return nil, false
+	}
+
+	appendMu.Lock()
+	_, appending := appendingFiles[fileName]
+	appendMu.Unlock()
+	if appending {
+		return nil, false
+	}
+
+	blockMap, _ := BlockLocations.Get(fileName)
+	if blockIdx >= int64(len(blockMap)) {
+		return nil, false
+	}
+	holders := make(map[string]bool)
+	for _, ip := range blockMap[blockIdx] {
+		if ip == utils.WRITE_OP {
+			return nil, false
+		}
+		holders[ip] = true
+	}
+	return holders, true
+}
+
+// Copies a block replica to move.To and waits until it has been swapped in for move.From
+func MoveBlock(move BlockMove) error {
+	key := moveKey(move.FileName, move.BlockIdx, move.To)
+	done := make(chan struct{})
+	pendingMovesMu.Lock()
+	pendingMoves[key] = done
+	pendingMovesMu.Unlock()
+	defer func() {
+		pendingMovesMu.Lock()
+		delete(pendingMoves, key)
+		pendingMovesMu.Unlock()
+	}()
+
+	ogFileSize, _ := FileToSize.Get(move.FileName)
+	metadata, _ := FileToMetadata.Get(move.FileName)
+	task := utils.Task{
+		DataTargetIp:        utils.New19Byte(move.To),
+		AckTargetIp:         utils.New19Byte(gossiputils.Ip),
+		ConnectionOperation: utils.WRITE,
+		FileName:            utils.New1024Byte(move.FileName),
+		OriginalFileSize:    ogFileSize,
+		BlockIndex:          move.BlockIdx,
+		IsAck:               false,
+		Metadata:            metadata,
+		MoveFrom:            move.From,
+	}
+
+	conn, err := utils.SendTask(task, move.From, false)
+	if err != nil {
+		return err
+	}
+	(*conn).Close()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(MOVE_TIMEOUT):
+		return fmt.Errorf("block %d of %s was not copied to %s in time", move.BlockIdx, move.FileName, move.To)
+	}
+}
+
+// Finishes a move once its copy is acked: the new replica takes the old one's place in the block's row in a single
+// update, and the old copy is deleted. Every master applies the swap, only the leader sends the delete.
+func CompleteBlockMove(fileName string, blockIdx int64, from string, to string) {
+	swapped := false
+	BlockLocations.Upsert(fileName, nil, func(exists bool, blockMap [][]string, _ [][]string) [][]string {
+		if !exists || blockIdx >= int64(len(blockMap)) {
+			return blockMap
+		}
+		for i, ip := range blockMap[blockIdx] {
+			if ip == from {
+				blockMap[blockIdx][i] = to
+				swapped = true
+				break
+			}
+		}
+		return blockMap
+	})
+	if !swapped {
+		fmt.Printf("Move of block %d of %s no longer applies, %s lost its replica\n", blockIdx, fileName, from)
+		return
+	}
+
+	removeFromFileToBlocks(from, fileName, blockIdx)
+	FileToBlocks.Upsert(to, nil, func(exists bool, mapping [][2]interface{}, _ [][2]interface{}) [][2]interface{} {
+		return append(mapping, [2]interface{}{blockIdx, fileName})
+	})
+
+	if gossiputils.MachineType() != gossiputils.LEADER {
+		return
+	}
+
+	pendingMovesMu.Lock()
+	if done, ok := pendingMoves[moveKey(fileName, blockIdx, to)]; ok {
+		close(done)
+		delete(pendingMoves, moveKey(fileName, blockIdx, to))
+	}
+	pendingMovesMu.Unlock()
+
+	// The old replica is already out of BlockLocations, so its delete ack changes nothing
+	deleteTask := utils.Task{
+		ConnectionOperation: utils.DELETE,
+		FileName:            utils.New1024Byte(fileName),
+		BlockIndex:          blockIdx,
+		IsAck:               false,
+	}
+	conn, err := utils.SendTask(deleteTask, from, false)
+	if err != nil {
+		fmt.Println("Unable to delete moved replica: ", err)
+		return
+	}
+	(*conn).Close()
+}
+
+func removeFromFileToBlocks(ip string, fileName string, blockIdx int64) {
+	FileToBlocks.Upsert(ip, nil, func(exists bool, mapping [][2]interface{}, _ [][2]interface{}) [][2]interface{} {
+		for i, pair := range mapping {
+			if pair[0] == blockIdx && pair[1] == fileName {
+				return append(mapping[:i], mapping[i+1:]...)
+			}
+		}
+		return mapping
+	})
+}
+
+// Starts or stops balancing every BALANCER_INTERVAL
+func SetBackgroundBalancer(enabled bool, bandwidth int64) {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	if backgroundStop != nil {
+		close(backgroundStop)
+		backgroundStop = nil
+	}
+	if !enabled {
+		fmt.Println("Background balancer stopped")
+		return
+	}
+
+	stop := make(chan struct{})
+	backgroundStop = stop
+	go func() {
+		ticker := time.NewTicker(BALANCER_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				RunBalancer(bandwidth)
+			}
+		}
+	}()
+	fmt.Println("Background balancer started")
+}
+
+// Modes are "run" for a single pass, "on" and "off" for background balancing
+func HandleBalanceRequest(mode string, bandwidth int64, conn *net.Conn) error {
+	var reply utils.LeaderReply
+
+	switch strings.ToLower(mode) {
+	case "run":
+		go RunBalancer(bandwidth)
+	case "on":
+		SetBackgroundBalancer(true, bandwidth)
+	case "off":
+		SetBackgroundBalancer(false, bandwidth)
+	default:
+		reply.Error = fmt.Sprintf("unknown balancer mode %s, expected run, on or off", mode)
+	}
+	return utils.SendReply(*conn, reply)
+}
+
+// Client side
+
+// Parses "[on | off] [-bw <bytes per second, e.g. 20MB>]"
+func CLIBalancer(args []string) {
+	mode := "run"
+	var bandwidth int64
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimSpace(args[i])
+		if arg == "-bw" && i+1 < len(args) {
+			i++
+			var err error
+			bandwidth, err = utils.ParseByteSize(args[i])
+			if err != nil {
+				fmt.Println("balancer failed: ", err)
+				return
+			}
+		} else if arg == "on" || arg == "off" {
+			mode = arg
+		} else if arg != "" {
+			fmt.Printf("balancer failed: unknown argument %s\n", arg)
+			return
+		}
+	}
+
+	_, err := sendNamespaceRequest(context.Background(), utils.Task{
+		ConnectionOperation: utils.BALANCE,
+		FileName:            utils.New1024Byte(mode),
+		Count:               bandwidth,
+	})
+	if err != nil {
+		fmt.Println("balancer failed: ", err)
+		return
+	}
+	fmt.Printf("Balancer %s sent to the leader\n", mode)
+}
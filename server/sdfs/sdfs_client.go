@@ -1,16 +1,17 @@
 package sdfs
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"os"
+	"sync"
 	"time"
 
 	gossipUtils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
@@ -18,7 +19,7 @@ import (
 	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
-func GetFileSizeByPrefix(prefix string) (uint32, error) {
+func GetFileSizeByPrefix(ctx context.Context, prefix string) (uint32, error) {
 
 	var task utils.Task
 	task.DataTargetIp = utils.New19Byte("127.0.0.1")
@@ -31,22 +32,22 @@ func GetFileSizeByPrefix(prefix string) (uint32, error) {
 	task.IsAck = true
 	task.AckTargetIp = utils.New19Byte("127.0.0.1")
 
-	conn := utils.SendAckToMaster(task)
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return 0, err
+	}
 	defer (*conn).Close()
 
-	buf := make([]byte, 4)
-	_, err := (*conn).Read(buf)
+	var totalSize uint32
+	err = utils.ReadReply(*conn, &totalSize)
 	if err != nil {
 		return 0, err
 	}
 
-	// Convert the byte slice to a uint32
-	totalSize := binary.BigEndian.Uint32(buf)
-
 	return totalSize, nil
 }
 
-func RequestBlockMappings(fileName string) ([][]string, error) {
+func RequestBlockMappings(ctx context.Context, fileName string) ([][]string, error) {
 	// 1. Create a task with the GET_2D block operation, and send to current master. If timeout/ doesn't work, send to 1st submaster, second, and so on.
 	// 2. Listen for 2d array on responding connection. Read 2d array and return it.
 
@@ -61,7 +62,10 @@ func RequestBlockMappings(fileName string) ([][]string, error) {
 	task.IsAck = true
 	task.AckTargetIp = utils.New19Byte("127.0.0.1")
 
-	conn := utils.SendAckToMaster(task)
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
 	defer (*conn).Close()
 	locations, err := utils.UnmarshalBlockLocationArr(*conn)
 
@@ -72,210 +76,549 @@ func RequestBlockMappings(fileName string) ([][]string, error) {
 	return locations, nil
 }
 
-// Client main function, becomes the entry point for all client operations. This function continuously requests from the master until an operation is finished
-func SdfsClientMain(sdfsFilename string, waitForUpdate bool) ([][]string, error) {
-	var blockLocationArr [][]string
-	workInProgress := true
-	var blockErr error
+// Longest SdfsClientMain waits for the writes and deletes of a file to finish
+const SETTLE_TIMEOUT = 2 * time.Minute
 
-	for workInProgress {
-		blockLocationArr, blockErr = RequestBlockMappings(sdfsFilename)
+// Client main function, becomes the entry point for all client operations. With waitForUpdate, this polls the master
+// with growing waits until no write or delete of the file is in progress, for up to SETTLE_TIMEOUT.
+func SdfsClientMain(ctx context.Context, sdfsFilename string, waitForUpdate bool) ([][]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, SETTLE_TIMEOUT)
+	defer cancel()
 
-		if blockErr != nil {
-			fmt.Println("Could not fetch block locations from master in client main")
+	for attempt := 1; ; attempt++ {
+		blockLocationArr, blockErr := RequestBlockMappings(ctx, sdfsFilename)
+
+		if blockErr != nil || len(blockLocationArr) == 0 {
 			return blockLocationArr, blockErr
-		} else if len(blockLocationArr) == 0 {
-			fmt.Println("File name dne. Returning empty array")
-			return blockLocationArr, nil
 		}
 
-		workInProgress = false
+		workInProgress := false
 		for i := range blockLocationArr {
 			for j := range blockLocationArr[i] {
 				if blockLocationArr[i][j] == utils.WRITE_OP || blockLocationArr[i][j] == utils.DELETE_OP {
-					fmt.Printf("Found WIP Op here: %d %d \n", i, j)
 					workInProgress = waitForUpdate
 					break
 				}
 			}
 		}
 
-		if workInProgress {
-			time.Sleep(time.Millisecond * 250)
-			fmt.Println("WAITING DURING UPDATE")
-		} else {
-			break
+		if !workInProgress {
+			return blockLocationArr, nil
+		}
+
+		log.Printf("Waiting for writes or deletes of %s to finish\n", sdfsFilename)
+		err := utils.SleepBackoff(ctx, attempt)
+		if err != nil {
+			return nil, fmt.Errorf("writes or deletes of %s still in progress: %w", sdfsFilename, err)
 		}
 	}
+}
+
+// Asks the leader for a file's size and storage policy
+func RequestFileMetadata(ctx context.Context, fileName string) (utils.FileStat, error) {
+	var stat utils.FileStat
+	var task utils.Task
+	task.ConnectionOperation = utils.GET_METADATA
+	task.FileName = utils.New1024Byte(fileName)
+	task.IsAck = true
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return stat, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &stat)
+	return stat, err
+}
+
+func InitiatePutCommand(localFilename string, sdfsFilename string, options utils.PutOptions) {
+	fmt.Printf("localFilename: %s sdfs: %s\n", localFilename, sdfsFilename)
+	start := time.Now() // Record the start time
+
+	_, err := PutFile(context.Background(), localFilename, sdfsFilename, options)
+	if err != nil {
+		fmt.Println("Put failed: ", err)
+		return
+	}
 
-	return blockLocationArr, nil
+	fmt.Println("INIT PUT COMMAND TOOK :", time.Since(start).Seconds())
 }
 
-func InitiatePutCommand(localFilename string, sdfsFilename string) {
+// Writes localFilename to SDFS as the new version of sdfsFilename. Below ALL consistency it returns before every
+// replica has its copy, the returned group is done once they all do and the local file is no longer read. Those
+// writes still run under ctx. A put that fails takes its version back out, so the path refers to the file it had
+// before.
+func PutFile(ctx context.Context, localFilename string, sdfsFilename string, options utils.PutOptions) (*sync.WaitGroup, error) {
 	// 1. Determine the number of blocks that need to be created
 	// 2. Randomly select four replica servers for each block
 	// 3. Shard the block and send the data to each replica
-	fmt.Printf("localFilename: %s sdfs: %s\n", localFilename, sdfsFilename)
+	var pendingWrites sync.WaitGroup
 
-	start := time.Now() // Record the start time
+	fileSize, err := utils.GetFileSize(localFilename)
+	if err != nil {
+		return &pendingWrites, fmt.Errorf("unable to read local file: %w", err)
+	}
+
+	// A put always gets a fresh storage id, so it never writes over blocks of the file it replaces
+	fileId, err := CreateVersion(ctx, sdfsFilename, fileSize, options)
+	if err != nil {
+		return &pendingWrites, fmt.Errorf("unable to create file: %w", err)
+	}
+
+	err = putFileBlocks(ctx, localFilename, fileId, fileSize, options, &pendingWrites)
+	if err != nil {
+		// Sent even when ctx has ended, once no write is left in flight to land after the blocks are deleted
+		pendingWrites.Wait()
+		if abortErr := AbortCreateFile(context.Background(), sdfsFilename, fileId); abortErr != nil {
+			err = fmt.Errorf("%w, and the new version could not be removed: %v", err, abortErr)
+		}
+	}
+	return &pendingWrites, err
+}
+
+func putFileBlocks(ctx context.Context, localFilename string, fileId string, fileSize int64, options utils.PutOptions, pendingWrites *sync.WaitGroup) error {
+	var err error
+	metadata := options.Metadata
+	if metadata.IsEncrypted() {
+		metadata.MasterKeyId, metadata.WrappedKey, err = utils.NewDataKey()
+		if err != nil {
+			return fmt.Errorf("unable to create a data key: %w", err)
+		}
+	}
+
+	if metadata.IsErasureCoded() {
+		err := InitiateErasureCodedPut(ctx, localFilename, fileId, metadata)
+		if err != nil {
+			return fmt.Errorf("erasure coded put failed: %w", err)
+		}
+		return nil
+	}
 
 	// IF CONNECTION CLOSES WHILE WRITING, WE NEED TO REPICK AN IP ADDR. Can have a seperate function to handle this on failure cases.
 	// Ask master when its ok to start writing
 
-	fileSize, _ := utils.GetFileSize(localFilename)
+	file, err := os.Open(localFilename)
+	if err != nil {
+		return fmt.Errorf("error opening local file: %w", err)
+	}
+
+	// Below ALL consistency the put returns before every replica has its copy, so the file stays open for them
+	defer func() {
+		go func() {
+			pendingWrites.Wait()
+			file.Close()
+		}()
+	}()
 
-	numberBlocks := utils.CeilDivide(fileSize, utils.BLOCK_SIZE)
+	blockSize := metadata.BlockBytes()
+	numberBlocks := utils.CeilDivide(fileSize, blockSize)
 
-	fmt.Println("Num blocks:", numberBlocks)
-	fmt.Println("file size:", fileSize)
-	fmt.Println("block size:", int64(utils.BLOCK_SIZE))
+	log.Println("Num blocks:", numberBlocks)
+	log.Println("file size:", fileSize)
+	log.Println("block size:", blockSize)
 	for currentBlock := int64(0); currentBlock < numberBlocks; currentBlock++ {
-		allMemberIps := gossipUtils.MembershipMap.Keys()
-		remainingIps := utils.CreateConcurrentStringSlice(allMemberIps)
-
-		file, err := os.Open(localFilename)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("put stopped at block %d of %d: %w", currentBlock, numberBlocks, err)
+		}
 
-		if err != nil {
-			log.Fatalf("error opening local file: %v\n", err)
+		startIdx, lengthToWrite := utils.GetBlockPosition(currentBlock, fileSize, blockSize)
+		blockWritingTask := utils.Task{
+			AckTargetIp:         utils.New19Byte(utils.LEADER_IP),
+			ConnectionOperation: utils.WRITE,
+			FileName:            utils.New1024Byte(fileId),
+			OriginalFileSize:    fileSize,
+			BlockIndex:          currentBlock,
+			DataSize:            lengthToWrite,
+			IsAck:               false,
+			Metadata:            metadata,
 		}
-		startIdx, lengthToWrite := utils.GetBlockPosition(currentBlock, fileSize)
 
-		for currentReplica := int64(0); currentReplica < utils.REPLICATION_FACTOR; currentReplica++ {
-			fmt.Printf("start index: %d length to write: %d\n", startIdx, lengthToWrite)
+		var blockData io.ReaderAt = file
+		if metadata.HasEncodedBlocks() {
+			encoded, err := readEncodedBlock(file, currentBlock, startIdx, lengthToWrite, metadata)
+			if err != nil {
+				return fmt.Errorf("unable to encode block: %w", err)
+			}
+			blockData, startIdx = bytes.NewReader(encoded), 0
+			blockWritingTask.DataSize = int64(len(encoded))
+		}
 
-			for {
-				if remainingIps.Size() == 0 {
-					break
-				}
+		err := writeBlock(ctx, blockWritingTask, blockData, startIdx, options, pendingWrites)
+		if err != nil {
+			return err
+		}
+	}
 
-				if ip, ok := remainingIps.PopRandomElement().(string); ok {
-					member, _ := gossipUtils.MembershipMap.Get(ip)
-
-					if ip == gossipUtils.Ip || member.State == gossipUtils.DOWN {
-						continue
-					}
-
-					connIp, err := utils.OpenTCPConnection(ip, utils.SDFS_PORT)
-					if err != nil {
-						log.Fatalf("error opening follower connection: %v\n", err)
-						continue
-					}
-					blockWritingTask := utils.Task{
-						DataTargetIp:        utils.New19Byte(ip),
-						AckTargetIp:         utils.New19Byte(utils.LEADER_IP),
-						ConnectionOperation: utils.WRITE,
-						FileName:            utils.New1024Byte(sdfsFilename),
-						OriginalFileSize:    fileSize,
-						BlockIndex:          currentBlock,
-						DataSize:            lengthToWrite,
-						IsAck:               false,
-					}
-					fmt.Printf("start index: %d length to write: %d\n", startIdx, lengthToWrite)
-					fmt.Printf("Expecting size of: %d\n", blockWritingTask.DataSize)
-
-					marshalledBytesWritten, writeError := connIp.Write(blockWritingTask.Marshal())
-					connIp.Write([]byte{'\n'})
-					if writeError != nil {
-						log.Fatalf("Could not write struct to connection in client put: %v\n", writeError)
-					}
-
-					utils.ReadSmallAck(connIp)
-
-					totalBytesWritten, writeErr := utils.BufferedWriteToConnection(connIp, file, lengthToWrite, startIdx)
-					fmt.Println("------BYTES_WRITTEN------: ", totalBytesWritten)
-					fmt.Println("------BYTES_WRITTEN marshalled------: ", marshalledBytesWritten)
-
-					if writeErr != nil { // If failure to write full block, redo loop
-						fmt.Println("connection broke early, rewrite block: ", writeErr)
-						continue
-					}
-					utils.ReadSmallAck(connIp)
+	return nil
+}
 
-					break
-				}
-			}
+// Writes one block of a put to its replicas, the block's data being task.DataSize bytes of data from offset
+func writeBlock(ctx context.Context, task utils.Task, data io.ReaderAt, offset int64, options utils.PutOptions, pendingWrites *sync.WaitGroup) error {
+	// A chain only acks once its tail has committed, so pipelined puts are always ALL
+	if options.Pipelined {
+		err := PutBlockPipelined(ctx, task, io.NewSectionReader(data, offset, task.DataSize))
+		if err != nil {
+			return fmt.Errorf("pipelined put failed: %w", err)
 		}
-		file.Close()
+		return nil
 	}
-	elapsed := time.Since(start) // Calculate the elapsed time
 
-	fmt.Println("INIT PUT COMMAND TOOK :", elapsed.Seconds())
+	log.Printf("start index: %d length to write: %d\n", offset, task.DataSize)
+	return WriteBlockReplicas(ctx, task, data, offset, options.Consistency, pendingWrites)
 }
 
-func InitiateGetCommand(sdfsFilename string, localFilename string, blockLocationArr [][]string) {
+// Reads one block of a local file and encodes it the way the file's blocks are stored
+func readEncodedBlock(file *os.File, blockIdx int64, offset int64, length int64, metadata utils.FileMetadata) ([]byte, error) {
+	data := make([]byte, length)
+	_, err := file.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	return utils.EncodeBlock(metadata, blockIdx, data)
+}
+
+func InitiateGetCommand(ctx context.Context, sdfsFilename string, localFilename string, blockLocationArr [][]string, options utils.GetOptions) {
 	// 1. Get the locations of all the blocks for a file from the master
 	// 2. Open a tcp connection between the client and a random replica storing each block
 	// 3. Get the data for each block and store it in the local file
 	fmt.Printf("localFilename: %s sdfs: %s\n", localFilename, sdfsFilename)
 
-	var fp *os.File = nil
+	stat, statErr := RequestFileMetadata(ctx, sdfsFilename)
+	fileId := sdfsFilename
+	if statErr == nil && stat.FileId != "" {
+		fileId = stat.FileId
+	}
+
+	if statErr == nil && stat.Metadata.IsErasureCoded() {
+		err := InitiateErasureCodedGet(ctx, fileId, localFilename, blockLocationArr, stat)
+		if err != nil {
+			fmt.Println("Erasure coded get failed: ", err)
+		}
+		return
+	}
 
 	log.Println("Unmarshalled block location arr: ", blockLocationArr)
 
-	sdfsFileDataExists := false
-	for blockIdx, replicas := range blockLocationArr {
-		for {
-			randomReplicaIp, err := PopRandomElementInArray(&replicas)
-			if err != nil {
-				// log.Fatalf("All replicas down ):")
-				break
+	if len(blockLocationArr) == 0 {
+		log.Printf("sdfs file doesn't exist")
+		return
+	}
+
+	err := ParallelGet(ctx, fileId, localFilename, blockLocationArr, stat, options)
+	if err != nil {
+		fmt.Println("Get failed: ", err)
+		return
+	}
+
+	// Blocks can hold bytes past the committed size, left behind by an unfinished append
+	if statErr == nil && stat.Exists && !stat.Metadata.UnevenBlocks {
+		os.Truncate(localFilename, stat.Size)
+	}
+}
+
+// Downloads the blocks of a replicated file concurrently, each from a random replica, retrying a failed block on
+// the block's other replicas. Evenly sized blocks are written straight to their offset in the local file. Uneven
+// blocks (MapleJuice outputs) are spooled to part files and stitched together in order at the end. Above ONE
+// consistency, each block is only read from replicas that agree on its contents.
+func ParallelGet(ctx context.Context, sdfsFilename string, localFilename string, blockLocationArr [][]string, stat utils.FileStat, options utils.GetOptions) error {
+	metadata := stat.Metadata
+	parallelism := options.Parallelism
+	if parallelism <= 0 {
+		parallelism = utils.DEFAULT_GET_PARALLELISM
+	}
+	start := time.Now()
+
+	fp, err := os.OpenFile(localFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	numberBlocks := len(blockLocationArr)
+	blockErrors := make([]error, numberBlocks)
+	blockIdxs := make(chan int, numberBlocks)
+	for i := range blockLocationArr {
+		blockIdxs <- i
+	}
+	close(blockIdxs)
+
+	var progressMu sync.Mutex
+	var blocksDone int
+	var bytesDone int64
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < parallelism && worker < numberBlocks; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for blockIdx := range blockIdxs {
+				if len(blockLocationArr[blockIdx]) == 0 && metadata.UnevenBlocks {
+					continue // MapleJuice outputs only have blocks from the nodes that produced data
+				}
+
+				replicas := blockLocationArr[blockIdx]
+				var err error
+				if options.Consistency.Required(len(replicas), false) > 1 {
+					replicas, err = QuorumReplicas(ctx, sdfsFilename, int64(blockIdx), replicas, committedBlockLength(int64(blockIdx), stat), stat.Size, metadata, options.Consistency)
+				}
+
+				var n int64
+				if err == nil {
+					n, err = fetchBlockWithRetry(ctx, sdfsFilename, localFilename, int64(blockIdx), replicas, metadata, fp)
+				}
+				blockErrors[blockIdx] = err
+
+				progressMu.Lock()
+				blocksDone++
+				bytesDone += n
+				fmt.Printf("\rDownloaded %d/%d blocks (%.1f MB)", blocksDone, numberBlocks, float64(bytesDone)/float64(utils.MB))
+				progressMu.Unlock()
 			}
-			if randomReplicaIp == "w" {
+		}()
+	}
+	wg.Wait()
+	fmt.Println()
+
+	for _, err := range blockErrors {
+		if err != nil {
+			return err
+		}
+	}
+
+	if metadata.UnevenBlocks {
+		for blockIdx := 0; blockIdx < numberBlocks; blockIdx++ {
+			partFilename := getPartFileName(localFilename, int64(blockIdx))
+			part, err := os.Open(partFilename)
+			if os.IsNotExist(err) {
 				continue
+			} else if err != nil {
+				return err
 			}
-			if fp == nil {
-				fp, err = os.OpenFile(localFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-				if err != nil {
-					log.Fatalln("unable to open local file, ", err)
-				}
-			}
-			sdfsFileDataExists = true
-			task := utils.Task{
-				DataTargetIp:        utils.New19Byte(randomReplicaIp),
-				AckTargetIp:         utils.New19Byte(gossipUtils.Ip),
-				ConnectionOperation: utils.READ,
-				FileName:            utils.New1024Byte(sdfsFilename),
-				OriginalFileSize:    0,
-				BlockIndex:          int64(blockIdx),
-				DataSize:            0,
-				IsAck:               false,
+
+			_, err = io.Copy(fp, part)
+			part.Close()
+			os.Remove(partFilename)
+			if err != nil {
+				return err
 			}
-			replicaConn, err := utils.OpenTCPConnection(randomReplicaIp, utils.SDFS_PORT)
+		}
+	}
+
+	fmt.Println("GET COMMAND TOOK :", time.Since(start).Seconds())
+	return nil
+}
+
+// Bytes of a block that the file's committed size covers, zero when that isn't known
+func committedBlockLength(blockIdx int64, stat utils.FileStat) int64 {
+	if !stat.Exists || stat.Metadata.UnevenBlocks || stat.Metadata.HasEncodedBlocks() {
+		return 0
+	}
+	_, length := utils.GetBlockPosition(blockIdx, stat.Size, stat.Metadata.BlockBytes())
+	return length
+}
+
+// Tries each replica of a block in random order. When all of them fail, they are tried again after a backoff, up to
+// MAX_ATTEMPTS rounds.
+func fetchBlockWithRetry(ctx context.Context, sdfsFilename string, localFilename string, blockIdx int64, replicas []string, metadata utils.FileMetadata, fp *os.File) (int64, error) {
+	var n int64
+	err := utils.Retry(ctx, utils.MAX_ATTEMPTS, func() error {
+		remaining := append([]string{}, replicas...)
+
+		for {
+			ip, err := PopRandomElementInArray(&remaining)
 			if err != nil {
-				log.Printf("unable to connect to replica, ", err)
+				return fmt.Errorf("no replica of block %d could be read", blockIdx)
+			}
+			if ip == utils.WRITE_OP || ip == utils.DELETE_OP {
 				continue
 			}
-			err = utils.SendTaskOnExistingConnection(task, replicaConn)
+
+			if metadata.HasEncodedBlocks() {
+				n, err = fetchEncodedBlock(ctx, ip, sdfsFilename, blockIdx, metadata, fp)
+			} else if metadata.UnevenBlocks {
+				n, err = streamBlockToFile(ctx, ip, sdfsFilename, blockIdx, getPartFileName(localFilename, blockIdx))
+			} else {
+				offsetWriter := &utils.OffsetWriter{File: fp, Offset: blockIdx * metadata.BlockBytes()}
+				n, err = StreamBlockFromReplica(ctx, ip, sdfsFilename, blockIdx, offsetWriter)
+			}
+
+			if err == nil {
+				return nil
+			}
+			log.Printf("Block %d failed on %s, retrying on another replica: %v\n", blockIdx, ip, err)
+		}
+	})
+	return n, err
+}
+
+// Reads a whole stored block, decodes it and writes the data at the block's offset in fp
+func fetchEncodedBlock(ctx context.Context, ip string, sdfsFilename string, blockIdx int64, metadata utils.FileMetadata, fp *os.File) (int64, error) {
+	stored, err := FetchBlockFromReplica(ctx, ip, sdfsFilename, blockIdx)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := utils.DecodeBlock(metadata, blockIdx, stored)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := fp.WriteAt(data, blockIdx*metadata.BlockBytes())
+	return int64(n), err
+}
+
+func streamBlockToFile(ctx context.Context, ip string, sdfsFilename string, blockIdx int64, path string) (int64, error) {
+	fp, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	return StreamBlockFromReplica(ctx, ip, sdfsFilename, blockIdx, fp)
+}
+
+func getPartFileName(localFilename string, blockIdx int64) string {
+	return fmt.Sprintf("%s.part%d", localFilename, blockIdx)
+}
+
+// Streams one block to a replica over the WRITE protocol: request, status, data frames, status.
+func SendBlockToReplica(ctx context.Context, ip string, task utils.Task, data io.Reader) error {
+	connPtr, err := utils.SendTaskContext(ctx, task, ip, false)
+	if err != nil {
+		return err
+	}
+	conn := *connPtr
+	defer conn.Close()
+
+	err = utils.ReadStatus(conn)
+	if err != nil {
+		return err
+	}
+
+	n, err := utils.WriteData(conn, data, task.DataSize)
+	if err != nil {
+		return fmt.Errorf("wrote %d of %d bytes to %s: %v", n, task.DataSize, ip, err)
+	}
+
+	return utils.ReadStatus(conn)
+}
+
+// Streams a block once to the head of a replica chain. Each replica writes it and forwards it to the next one, and
+// the head acks the leader for the whole chain once the tail has committed. A broken chain is retried on new nodes.
+func PutBlockPipelined(ctx context.Context, task utils.Task, data *io.SectionReader) error {
+	const maxChainAttempts = 3
+	exclude := make(map[string]bool)
+	exclude[gossipUtils.Ip] = true
+
+	for attempt := 0; attempt < maxChainAttempts; attempt++ {
+		if attempt > 0 {
+			err := utils.SleepBackoff(ctx, attempt)
 			if err != nil {
-				log.Printf("unable to send task to replica, ", err)
-				continue
+				return fmt.Errorf("block %d: %w", task.BlockIndex, err)
 			}
+		}
 
-			utils.ReadSmallAck(replicaConn)
-			log.Printf("Unmarshaling task\n")
+		chain := PickChain(ctx, int(task.Metadata.Replicas()), exclude)
+		if len(chain) == 0 {
+			return errors.New("no alive nodes to write to")
+		}
 
-			blockMetadata, _ := utils.Unmarshal(replicaConn)
-			utils.SendSmallAck(replicaConn)
+		task.ReplicaChain = chain
+		task.ChainIndex = 0
+		task.DataTargetIp = utils.New19Byte(chain[0])
+		data.Seek(0, io.SeekStart)
 
-			log.Printf("Number of bytes to read from connection: ", blockMetadata.DataSize)
-			utils.BufferedReadFromConnection(replicaConn, fp, blockMetadata.DataSize)
-			replicaConn.Close()
-			// utils.BufferedReadAndWrite(replicaConnBuf, fp, blockMetadata.DataSize, false, 0)
-			break
+		err := SendBlockToReplica(ctx, chain[0], task, data)
+		if err == nil {
+			return nil
+		}
+
+		// We can't tell which link broke, so avoid the whole chain on the retry when the cluster is big enough
+		log.Printf("Chain %v failed for block %d: %v\n", chain, task.BlockIndex, err)
+		for _, ip := range chain {
+			exclude[ip] = true
 		}
 	}
 
-	if sdfsFileDataExists == false {
-		log.Printf("sdfs file doesn't exist")
+	return fmt.Errorf("block %d could not be written after %d chains", task.BlockIndex, maxChainAttempts)
+}
+
+// Asks the leader's placement policy for up to n distinct alive nodes other than this one, avoiding the nodes in
+// exclude unless there aren't enough others
+func PickChain(ctx context.Context, n int, exclude map[string]bool) []string {
+	chain, err := RequestPlacement(ctx, n, exclude)
+	if err != nil {
+		log.Println("Unable to get replica targets from the leader: ", err)
+		return nil
+	}
+	return chain
+}
+
+// Reads one whole block from a replica into memory over the READ protocol.
+func FetchBlockFromReplica(ctx context.Context, ip string, sdfsFilename string, blockIdx int64) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := StreamBlockFromReplica(ctx, ip, sdfsFilename, blockIdx, &buf)
+	if err != nil {
+		return nil, err
 	}
+
+	return buf.Bytes(), nil
 }
 
-func PutBlock(sdfsFilename string, blockIdx int64, ipDst string, originalFileSize int64) {
-	fmt.Println("Entering put block")
+// Streams one whole block from a replica into dst over the READ protocol, and returns the block's size.
+func StreamBlockFromReplica(ctx context.Context, ip string, sdfsFilename string, blockIdx int64, dst io.Writer) (int64, error) {
+	_, n, err := StreamBlockRangeFromReplica(ctx, ip, sdfsFilename, blockIdx, 0, 0, dst)
+	return n, err
+}
+
+// Streams length bytes starting at offset within a block (0 for the rest of the block) into dst. Returns the size of
+// the whole block on the replica along with the number of bytes copied.
+func StreamBlockRangeFromReplica(ctx context.Context, ip string, sdfsFilename string, blockIdx int64, offset int64, length int64, dst io.Writer) (int64, int64, error) {
+	task := utils.Task{
+		DataTargetIp:        utils.New19Byte(ip),
+		AckTargetIp:         utils.New19Byte(gossipUtils.Ip),
+		ConnectionOperation: utils.READ,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		BlockIndex:          blockIdx,
+		RangeOffset:         offset,
+		RangeLength:         length,
+	}
+
+	connPtr, err := utils.SendTaskContext(ctx, task, ip, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	conn := *connPtr
+	defer conn.Close()
+
+	err = utils.ReadStatus(conn)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var blockMetadata utils.BlockReadReply
+	err = utils.ReadReply(conn, &blockMetadata)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = utils.SendStatus(conn, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, err := io.Copy(dst, utils.NewDataReader(conn, blockMetadata.DataSize))
+	return blockMetadata.BlockLength, n, err
+}
+
+func PutBlock(ctx context.Context, sdfsFilename string, blockIdx int64, ipDst string, originalFileSize int64, metadata utils.FileMetadata, moveFrom string, isAppend bool) error {
+	log.Println("Entering put block")
 	_, fileSize, fp, err := utils.GetFilePtr(sdfsFilename, fmt.Sprint(blockIdx), os.O_RDONLY)
 	if err != nil {
-		fmt.Println("Couldn't get file pointer", err)
+		return fmt.Errorf("couldn't get file pointer: %w", err)
 	}
+	defer fp.Close()
 
 	blockWritingTask := utils.Task{
 		DataTargetIp:        utils.New19Byte(ipDst),
@@ -286,53 +629,56 @@ func PutBlock(sdfsFilename string, blockIdx int64, ipDst string, originalFileSiz
 		BlockIndex:          blockIdx,
 		DataSize:            int64(fileSize),
 		IsAck:               false,
+		IsAppend:            isAppend,
+		Metadata:            metadata,
+		MoveFrom:            moveFrom,
 	}
 
 	member, ok := gossipUtils.MembershipMap.Get(ipDst)
 	if ipDst == gossipUtils.Ip || !ok || member.State == gossipUtils.DOWN {
-		return
+		return nil
 	}
-	fmt.Println("Got member from ip target")
+	log.Println("Got member from ip target")
 
-	conn, err := utils.OpenTCPConnection(ipDst, utils.SDFS_PORT)
+	connPtr, err := utils.SendTaskContext(ctx, blockWritingTask, ipDst, false)
 	if err != nil {
-		fmt.Printf("error opening follower connection: %v\n", err)
-		return
+		return fmt.Errorf("error opening follower connection: %w", err)
 	}
-	fmt.Println("Opened connection to replication target")
+	conn := *connPtr
+	defer conn.Close()
+	log.Println("Sent write task to replication target")
 
-	marshalledBytesWritten, writeError := conn.Write(blockWritingTask.Marshal())
-	conn.Write([]byte{'\n'})
-	if writeError != nil {
-		fmt.Printf("Could not write struct to connection in client put: %v\n", writeError)
+	err = utils.ReadStatus(conn)
+	if err != nil {
+		return fmt.Errorf("replication target refused the block: %w", err)
 	}
+	log.Println("Read status in put block")
 
-	utils.ReadSmallAck(conn)
-	fmt.Println("Read small ack in put block")
+	// The local block file holds just this block, so copy it from the start
+	totalBytesWritten, writeErr := utils.BufferedWriteToConnection(conn, fp, int64(fileSize), 0)
+	log.Println("------BYTES_WRITTEN------: ", totalBytesWritten)
 
-	startIdx := blockIdx * utils.BLOCK_SIZE
-	totalBytesWritten, writeErr := utils.BufferedWriteToConnection(conn, fp, int64(fileSize), startIdx)
-	fmt.Println("------BYTES_WRITTEN------: ", totalBytesWritten)
-	fmt.Println("------BYTES_WRITTEN marshalled------: ", marshalledBytesWritten)
-
-	if writeErr != nil { // If failure to write full block, redo loop
-		fmt.Println("connection broke early, rewrite block: ", writeErr)
-		return
+	if writeErr != nil {
+		return fmt.Errorf("connection broke early: %w", writeErr)
+	}
+	err = utils.ReadStatus(conn)
+	if err != nil {
+		return fmt.Errorf("replication target failed to store the block: %w", err)
 	}
-	utils.ReadSmallAck(conn)
-	fmt.Println("Read another small ack in put block")
+	log.Println("Read another status in put block")
+	return nil
 }
 
-func InitiateDeleteCommand(sdfsFilename string, mappings [][]string) {
+func InitiateDeleteCommand(fileId string, mappings [][]string) {
 	// 1. Get location of all blocks from leader
-	// 2. Send delete requests to each replica
-	fmt.Printf("sdfs: %s\n", sdfsFilename)
+	// 2. Send delete requests to each replica, naming the blocks by the file's storage id
+	fmt.Printf("sdfs: %s\n", fileId)
 	// IF CONNECTION CLOSES WHILE READING, its all good. We can assume memory was wiped
 
 	var task utils.Task
 	task.IsAck = false
 	task.ConnectionOperation = utils.DELETE
-	task.FileName = utils.New1024Byte(sdfsFilename)
+	task.FileName = utils.New1024Byte(fileId)
 
 	for i := 0; i < len(mappings); i++ {
 		for j := 0; j < len(mappings[i]); j++ {
@@ -351,31 +697,51 @@ func InitiateDeleteCommand(sdfsFilename string, mappings [][]string) {
 
 			task.BlockIndex = int64(i)
 
-			conn, err := utils.OpenTCPConnection(blockIp, utils.SDFS_PORT)
+			conn, err := utils.SendTask(task, blockIp, false)
 			if err != nil {
-				log.Fatalf("Couldn't open tcp conn to leader %v\n", err)
-			}
-			buffConn := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-
-			data := task.Marshal()
-			_, errMWrite := buffConn.Write(data)
-			buffConn.Write([]byte{'\n'})
-			buffConn.Flush()
-
-			if errMWrite != nil {
-				log.Fatalf("Couldn't write marshalled delete task %v\n", errMWrite)
+				fmt.Printf("Couldn't send delete task to %s: %v\n", blockIp, err)
+				continue
 			}
+			(*conn).Close()
 
 			fmt.Println("Finished delete task")
 		}
 	}
 }
 
+// Changes a file's replication factor. The leader adds or trims replicas in the background.
+func InitiateSetReplicationCommand(ctx context.Context, sdfsFilename string, replicationFactor int64) error {
+	var task utils.Task
+	task.ConnectionOperation = utils.SET_REPLICATION
+	task.FileName = utils.New1024Byte(sdfsFilename)
+	task.Metadata.ReplicationFactor = replicationFactor
+	task.IsAck = true
+
+	return SendLeaderRequest(ctx, task)
+}
+
+// Sends a metadata changing request to the leader and waits for its LeaderReply
+func SendLeaderRequest(ctx context.Context, task utils.Task) error {
+	var reply utils.LeaderReply
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return err
+	}
+	return utils.ReplyError(reply.Error, reply.Code)
+}
+
 func InitiateLsCommand(mappings [][]string) {
 	fmt.Println(mappings)
 }
 
-func InitiateLsWithPrefix(sdfsPrefix string) []string {
+func InitiateLsWithPrefix(ctx context.Context, sdfsPrefix string) ([]string, error) {
 	// Returns a list of files with the matching prefix
 	var recvData []string
 	var task utils.Task
@@ -383,15 +749,18 @@ func InitiateLsWithPrefix(sdfsPrefix string) []string {
 	task.FileName = utils.New1024Byte(sdfsPrefix)
 	task.IsAck = true
 
-	conn := utils.SendAckToMaster(task)
-	decoder := json.NewDecoder(*conn)
-	err := decoder.Decode(&recvData)
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &recvData)
 	if err != nil {
-		fmt.Println("Error decoding data:", err)
-		return recvData
+		return nil, fmt.Errorf("error decoding data: %w", err)
 	}
 
-	return recvData
+	return recvData, nil
 }
 
 func InitiateStoreCommand() {
@@ -436,7 +805,7 @@ func InitiateMultiRead(fileName string, ipsToInitiate []string) {
 
 		_, err := utils.SendTask(task, ip, false)
 		if err != nil {
-			log.Printf("Failed to send task on multiread with error: ", err)
+			log.Printf("Failed to send task on multiread with error: %v", err)
 		}
 	}
 }
@@ -0,0 +1,245 @@
+package sdfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	gossipUtils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Consistency levels trade latency for safety on replicated files. A write at ONE or QUORUM returns once that many
+// replicas have stored the block, while the rest finish in the background. A read above ONE asks every replica for a
+// digest of the block first and only reads from replicas that agree, repairing the ones that don't.
+//
+// Every put writes a new storage id, so a block never holds data from two versions. Blocks only change by having
+// bytes appended, which makes a block's length its version: a replica shorter than the committed size missed an append.
+// Pipelined and erasure coded files ignore the level, a chain only acks once its tail has the block.
+
+// Writes one block to its replicas concurrently and returns once the level's number of them have acked. A replica
+// that fails is replaced by a node that doesn't have the block yet. Writes still running on return are tracked in
+// pending, so the caller can keep the data around until they finish.
+func WriteBlockReplicas(ctx context.Context, task utils.Task, data io.ReaderAt, offset int64, level utils.ConsistencyLevel, pending *sync.WaitGroup) error {
+	var usedMu sync.Mutex
+	used := map[string]bool{gossipUtils.Ip: true}
+
+	targets := PickChain(ctx, int(task.Metadata.Replicas()), used)
+	if len(targets) == 0 {
+		return errors.New("no alive nodes to write to")
+	}
+	for _, ip := range targets {
+		used[ip] = true
+	}
+	required := level.Required(len(targets), true)
+
+	results := make(chan error, len(targets))
+	for _, ip := range targets {
+		pending.Add(1)
+		go func(ip string) {
+			defer pending.Done()
+
+			for attempt := 1; ; attempt++ {
+				replicaTask := task
+				replicaTask.DataTargetIp = utils.New19Byte(ip)
+				err := SendBlockToReplica(ctx, ip, replicaTask, io.NewSectionReader(data, offset, task.DataSize))
+				if err == nil {
+					results <- nil
+					return
+				}
+				log.Printf("Failed to write block %d to %s: %v\n", task.BlockIndex, ip, err)
+
+				if attempt == utils.MAX_ATTEMPTS {
+					results <- fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+					return
+				} else if backoffErr := utils.SleepBackoff(ctx, attempt); backoffErr != nil {
+					results <- fmt.Errorf("%w, last error: %v", backoffErr, err)
+					return
+				}
+
+				usedMu.Lock()
+				spare, ok := pickSpare(ctx, used)
+				if ok {
+					used[spare] = true
+				}
+				usedMu.Unlock()
+
+				if !ok {
+					results <- err
+					return
+				}
+				ip = spare
+			}
+		}(ip)
+	}
+
+	acked, failed := 0, 0
+	for acked < required {
+		err := <-results
+		if err == nil {
+			acked++
+			continue
+		}
+
+		failed++
+		if len(targets)-failed < required {
+			return fmt.Errorf("block %d reached %d of the %d replicas %s needs: %v", task.BlockIndex, acked, required, level, err)
+		}
+	}
+
+	return nil
+}
+
+// Picks an alive node that isn't in used
+func pickSpare(ctx context.Context, used map[string]bool) (string, bool) {
+	for _, ip := range PickChain(ctx, 1, used) {
+		if !used[ip] {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// Replies with the block's length and a checksum of its first RangeLength bytes (all of it if zero)
+func HandleDigestConnection(task utils.Task, conn net.Conn) error {
+	defer conn.Close()
+
+	var digest utils.BlockDigest
+	fileName := utils.BytesToString(task.FileName[:])
+
+	_, fileSize, fp, err := utils.GetFilePtr(fileName, strconv.FormatInt(task.BlockIndex, 10), os.O_RDONLY)
+	if err != nil {
+		digest.Error = err.Error()
+		return utils.SendReply(conn, digest)
+	}
+	defer fp.Close()
+
+	length := int64(fileSize)
+	if task.RangeLength > 0 {
+		length = utils.GetMinInt64(length, task.RangeLength)
+	}
+
+	hasher := sha256.New()
+	_, err = io.CopyN(hasher, fp, length)
+	if err != nil {
+		digest.Error = err.Error()
+	}
+	digest.Length = int64(fileSize)
+	digest.Checksum = hex.EncodeToString(hasher.Sum(nil))
+
+	return utils.SendReply(conn, digest)
+}
+
+func RequestBlockDigest(ctx context.Context, ip string, fileId string, blockIdx int64, length int64) (utils.BlockDigest, error) {
+	var digest utils.BlockDigest
+	task := utils.Task{
+		DataTargetIp:        utils.New19Byte(ip),
+		AckTargetIp:         utils.New19Byte(gossipUtils.Ip),
+		ConnectionOperation: utils.BLOCK_DIGEST,
+		FileName:            utils.New1024Byte(fileId),
+		BlockIndex:          blockIdx,
+		RangeLength:         length,
+	}
+
+	conn, err := utils.SendTaskContext(ctx, task, ip, false)
+	if err != nil {
+		return digest, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &digest)
+	if err != nil {
+		return digest, err
+	} else if digest.Error != "" {
+		return digest, errors.New(digest.Error)
+	}
+	return digest, nil
+}
+
+// Compares the digests of a block's replicas and returns the ones that agree, or an error if fewer than the level
+// needs do. Replicas that answered with a different or too short block are repaired from an agreeing one.
+// committedLength is the number of the block's bytes the file's size covers, zero if unknown.
+func QuorumReplicas(ctx context.Context, fileId string, blockIdx int64, replicas []string, committedLength int64, fileSize int64, metadata utils.FileMetadata, level utils.ConsistencyLevel) ([]string, error) {
+	live := make([]string, 0, len(replicas))
+	for _, ip := range replicas {
+		if ip != utils.WRITE_OP && ip != utils.DELETE_OP {
+			live = append(live, ip)
+		}
+	}
+	required := level.Required(len(live), false)
+
+	digests := make([]utils.BlockDigest, len(live))
+	digestErrors := make([]error, len(live))
+	var wg sync.WaitGroup
+	for i, ip := range live {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			digests[i], digestErrors[i] = RequestBlockDigest(ctx, ip, fileId, blockIdx, committedLength)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	groups := make(map[string][]string) // checksum : replicas holding it
+	var best string
+	for i, ip := range live {
+		if digestErrors[i] != nil {
+			log.Printf("No digest of block %d from %s: %v\n", blockIdx, ip, digestErrors[i])
+			continue
+		}
+		if digests[i].Length < committedLength {
+			continue
+		}
+
+		checksum := digests[i].Checksum
+		groups[checksum] = append(groups[checksum], ip)
+		if len(groups[checksum]) > len(groups[best]) {
+			best = checksum
+		}
+	}
+
+	agreeing := groups[best]
+	if len(agreeing) < required || len(agreeing) == 0 {
+		return nil, fmt.Errorf("only %d of the %d replicas of block %d %s needs agree", len(agreeing), required, blockIdx, level)
+	}
+
+	for i, ip := range live {
+		if digestErrors[i] == nil && (digests[i].Length < committedLength || digests[i].Checksum != best) {
+			log.Printf("Replica of block %d on %s is out of date, repairing it from %s\n", blockIdx, ip, agreeing[0])
+			go RepairReplica(agreeing[0], ip, fileId, blockIdx, fileSize, metadata)
+		}
+	}
+
+	return agreeing, nil
+}
+
+// Has source overwrite target's copy of a block with its own, the same way re-replication copies a block. The repair
+// is sent as part of an append so its ack only records the replica, since fileSize may be stale by the time it lands.
+func RepairReplica(source string, target string, fileId string, blockIdx int64, fileSize int64, metadata utils.FileMetadata) {
+	task := utils.Task{
+		DataTargetIp:        utils.New19Byte(target),
+		AckTargetIp:         utils.New19Byte(gossipUtils.Ip),
+		ConnectionOperation: utils.WRITE,
+		FileName:            utils.New1024Byte(fileId),
+		OriginalFileSize:    fileSize,
+		BlockIndex:          blockIdx,
+		IsAck:               false,
+		IsAppend:            true,
+		Metadata:            metadata,
+	}
+
+	conn, err := utils.SendTask(task, source, false)
+	if err != nil {
+		log.Println("Unable to send repair task: ", err)
+		return
+	}
+	(*conn).Close()
+}
@@ -0,0 +1,238 @@
+package sdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Erasure coded files are cut into data blocks of the file's block size, and every DataShards consecutive blocks form a stripe.
+// Each stripe gets ParityShards parity blocks, and all pieces of a stripe are placed on distinct nodes with a
+// single copy each. Piece p of stripe s is stored as block index s*StripeWidth()+p.
+
+func InitiateErasureCodedPut(ctx context.Context, localFilename string, sdfsFilename string, metadata utils.FileMetadata) error {
+	start := time.Now()
+
+	coder, err := utils.NewErasureCoder(int(metadata.DataShards), int(metadata.ParityShards))
+	if err != nil {
+		return err
+	}
+
+	fileSize, err := utils.GetFileSize(localFilename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(localFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	numberStripes := metadata.NumStripes(fileSize)
+	fmt.Printf("Putting %s as %s: %d stripes\n", sdfsFilename, metadata, numberStripes)
+
+	for stripe := int64(0); stripe < numberStripes; stripe++ {
+		shards, err := readStripe(file, stripe, fileSize, metadata)
+		if err != nil {
+			return err
+		}
+
+		err = coder.Encode(shards)
+		if err != nil {
+			return err
+		}
+
+		err = placeStripe(ctx, utils.Task{
+			FileName:         utils.New1024Byte(sdfsFilename),
+			OriginalFileSize: fileSize,
+			Metadata:         metadata,
+		}, stripe, shards)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("ERASURE CODED PUT TOOK :", time.Since(start).Seconds())
+	return nil
+}
+
+func InitiateErasureCodedGet(ctx context.Context, sdfsFilename string, localFilename string, blockLocationArr [][]string, stat utils.FileStat) error {
+	metadata := stat.Metadata
+	coder, err := utils.NewErasureCoder(int(metadata.DataShards), int(metadata.ParityShards))
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(localFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	numberStripes := metadata.NumStripes(stat.Size)
+	for stripe := int64(0); stripe < numberStripes; stripe++ {
+		shards, err := FetchStripe(ctx, sdfsFilename, stripe, blockLocationArr, metadata, -1)
+		if err != nil {
+			return err
+		}
+
+		for piece := int64(0); piece < metadata.DataShards; piece++ {
+			if shards[piece] == nil {
+				err = coder.Reconstruct(shards)
+				if err != nil {
+					return fmt.Errorf("stripe %d: %v", stripe, err)
+				}
+				break
+			}
+		}
+
+		for piece := int64(0); piece < metadata.DataShards; piece++ {
+			startIdx, length := utils.GetBlockPosition(stripe*metadata.DataShards+piece, stat.Size, metadata.BlockBytes())
+			if length <= 0 {
+				break
+			}
+			_, err = fp.WriteAt(shards[piece][:length], startIdx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Fetches enough pieces of a stripe to decode it, preferring data pieces so the common case needs no decoding.
+// Missing pieces are left nil. skipBlockIdx excludes a piece that is known to be lost.
+func FetchStripe(ctx context.Context, sdfsFilename string, stripe int64, blockLocationArr [][]string, metadata utils.FileMetadata, skipBlockIdx int64) ([][]byte, error) {
+	shards := make([][]byte, metadata.StripeWidth())
+	fetched := int64(0)
+
+	for piece := int64(0); piece < metadata.StripeWidth() && fetched < metadata.DataShards; piece++ {
+		blockIdx := stripe*metadata.StripeWidth() + piece
+		if blockIdx == skipBlockIdx || blockIdx >= int64(len(blockLocationArr)) {
+			continue
+		}
+
+		for _, ip := range blockLocationArr[blockIdx] {
+			if ip == utils.WRITE_OP || ip == utils.DELETE_OP {
+				continue
+			}
+
+			data, err := FetchBlockFromReplica(ctx, ip, sdfsFilename, blockIdx)
+			if err != nil {
+				log.Printf("Failed to fetch piece %d from %s: %v\n", blockIdx, ip, err)
+				continue
+			}
+			shards[piece] = data
+			fetched++
+			break
+		}
+	}
+
+	if fetched < metadata.DataShards {
+		return nil, fmt.Errorf("only %d of the %d pieces needed for stripe %d are reachable", fetched, metadata.DataShards, stripe)
+	}
+
+	return shards, nil
+}
+
+// Writes each piece of an encoded stripe to its own node. task carries what the pieces' write tasks share.
+func placeStripe(ctx context.Context, task utils.Task, stripe int64, shards [][]byte) error {
+	metadata := task.Metadata
+	task.AckTargetIp = utils.New19Byte(utils.LEADER_IP)
+	task.ConnectionOperation = utils.WRITE
+	task.IsAck = false
+
+	targets, err := PickStripeTargets(ctx, int(metadata.StripeWidth()))
+	if err != nil {
+		return fmt.Errorf("unable to place stripe: %w", err)
+	} else if len(targets) == 0 {
+		return errors.New("no alive nodes to place stripe on")
+	}
+
+	for piece, shard := range shards {
+		task.BlockIndex = stripe*metadata.StripeWidth() + int64(piece)
+		task.DataSize = int64(len(shard))
+
+		// Walk the target list starting at this piece's slot, so a dead node only shifts its piece over
+		placed := false
+		for attempt := 0; attempt < len(targets) && !placed; attempt++ {
+			ip := targets[(piece+attempt)%len(targets)]
+			task.DataTargetIp = utils.New19Byte(ip)
+
+			err := SendBlockToReplica(ctx, ip, task, bytes.NewReader(shard))
+			if err != nil {
+				log.Printf("Failed to place piece %d on %s, trying another node: %v\n", task.BlockIndex, ip, err)
+				continue
+			}
+			placed = true
+		}
+
+		if !placed {
+			return fmt.Errorf("could not place piece %d of %s on any node", task.BlockIndex, utils.BytesToString(task.FileName[:]))
+		}
+	}
+	return nil
+}
+
+// Splits a stripe held in memory into its data pieces, zero padding them to the size of the first one, as readStripe does
+func splitStripe(data []byte, metadata utils.FileMetadata) [][]byte {
+	shards := make([][]byte, metadata.StripeWidth())
+	blockSize := metadata.BlockBytes()
+	shardSize := utils.GetMinInt64(int64(len(data)), blockSize)
+
+	for piece := int64(0); piece < metadata.DataShards; piece++ {
+		shards[piece] = make([]byte, shardSize)
+		start := utils.GetMinInt64(piece*blockSize, int64(len(data)))
+		copy(shards[piece], data[start:utils.GetMinInt64(start+blockSize, int64(len(data)))])
+	}
+	return shards
+}
+
+// Reads the data blocks of a stripe, zero padding them to the size of its first block.
+func readStripe(file *os.File, stripe int64, fileSize int64, metadata utils.FileMetadata) ([][]byte, error) {
+	shards := make([][]byte, metadata.StripeWidth())
+	_, shardSize := utils.GetBlockPosition(stripe*metadata.DataShards, fileSize, metadata.BlockBytes())
+
+	for piece := int64(0); piece < metadata.DataShards; piece++ {
+		shards[piece] = make([]byte, shardSize)
+
+		startIdx, length := utils.GetBlockPosition(stripe*metadata.DataShards+piece, fileSize, metadata.BlockBytes())
+		if length <= 0 {
+			continue
+		}
+
+		_, err := file.ReadAt(shards[piece][:length], startIdx)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	return shards, nil
+}
+
+// Asks the leader's placement policy for n distinct nodes other than this one, so pieces are spread the way replicas
+// are. If the cluster is smaller than n, nodes are reused.
+func PickStripeTargets(ctx context.Context, n int) ([]string, error) {
+	candidates, err := RequestPlacement(ctx, n, nil)
+	if err != nil || len(candidates) == 0 {
+		return candidates, err
+	}
+	if len(candidates) < n {
+		log.Printf("Only %d nodes for a stripe of %d pieces, some nodes will hold several pieces\n", len(candidates), n)
+	}
+
+	targets := make([]string, n)
+	for i := range targets {
+		targets[i] = candidates[i%len(candidates)]
+	}
+	return targets, nil
+}
@@ -1,7 +1,10 @@
 package sdfs
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -11,14 +14,15 @@ import (
 	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
-var readWriteHistory int = 0
-var nActiveWriters uint = 0
-var nActiveReaders uint = 0
+// Handle PUT and GET requests. A whole block is written to a temporary file that replaces the block once complete,
+// so a concurrent read sees either the old block or the new one. Writers to the same file are kept apart cluster
+// wide by the leader's write leases.
+func HandleStreamConnection(ctx context.Context, task utils.Task, conn net.Conn) error {
 
-// Handle PUT and GET requests
-func HandleStreamConnection(task utils.Task, conn net.Conn) error {
-
-	utils.SendSmallAck(conn)
+	err := utils.SendStatus(conn, nil)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Entering edit connection")
 
@@ -28,45 +32,66 @@ func HandleStreamConnection(task utils.Task, conn net.Conn) error {
 
 	if targetIp != gossiputils.Ip {
 		fmt.Println("Recived replication request. Attempting to put specified block to target ip.")
-		PutBlock(fileName, task.BlockIndex, targetIp, task.OriginalFileSize)
-		return nil
+		return PutBlock(ctx, fileName, task.BlockIndex, targetIp, task.OriginalFileSize, task.Metadata, task.MoveFrom, task.IsAppend)
 	}
 
 	if task.ConnectionOperation == utils.WRITE { // Put request
 		flags = os.O_CREATE | os.O_WRONLY
-		nActiveWriters++
 	} else if task.ConnectionOperation == utils.READ {
-		flags = os.O_CREATE | os.O_RDONLY
-		nActiveReaders++
+		flags = os.O_RDONLY // A block this node doesn't have yet must not be read as an empty one
 	}
 
-	localFilename, fileSize, fp, err := utils.GetFilePtr(fileName, strconv.FormatInt(task.BlockIndex, 10), flags)
+	fromLocal := task.ConnectionOperation == utils.READ
+	isAppend := !fromLocal && task.RangeOffset > 0
+
+	var localFilename string
+	var fileSize int
+	var fp *os.File
+	if fromLocal || isAppend {
+		localFilename, fileSize, fp, err = utils.GetFilePtr(fileName, strconv.FormatInt(task.BlockIndex, 10), flags)
+	} else {
+		localFilename = utils.GetFileName(fileName, strconv.FormatInt(task.BlockIndex, 10))
+		fp, err = utils.CreateBlockTempFile()
+	}
+	if os.IsNotExist(err) {
+		err = utils.Errorf(utils.ERR_NOT_EXIST, "block %d of %s is not on %s", task.BlockIndex, fileName, gossiputils.Ip)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Unable to open block: ", err)
+		utils.SendStatus(conn, err)
+		return err
 	}
 	defer fp.Close()
 
-	isRead := task.ConnectionOperation == utils.READ || task.ConnectionOperation == utils.FORCE_GET
-	isWrite := task.ConnectionOperation == utils.WRITE
-
-	utils.MuLocalFs.Lock()
-
-	// For a reading thread to continue: A = isRead && (nActiveWriters == 0 || (nActiveWriters > 0 && readWriteHistory < 3))
-	// For a writing thread to continue: B = isWrite && (nActiveReaders == 0 || (nActiveReaders > 0 && readWriteHistory > -3))
-	// For conflict file pointers: C = !FileSet[localFilename]
-	// All together: C && (A || B) -> !C || (!A && !B)
+	rangeOffset := utils.GetMinInt64(task.RangeOffset, int64(fileSize))
+	if fromLocal {
+		task.DataSize = int64(fileSize) - rangeOffset
+		if task.RangeLength == utils.BLOCK_LENGTH_ONLY {
+			task.DataSize = 0
+		} else if task.RangeLength > 0 {
+			task.DataSize = utils.GetMinInt64(task.DataSize, task.RangeLength)
+		}
 
-	for utils.FileSet[localFilename] || (!(isRead && (nActiveWriters == 0 || (nActiveWriters > 0 && readWriteHistory < 3))) && !(isWrite && (nActiveReaders == 0 || (nActiveReaders > 0 && readWriteHistory > -3)))) {
-		utils.CondLocalFs.Wait()
+		err = utils.SendReply(conn, utils.BlockReadReply{BlockLength: int64(fileSize), DataSize: task.DataSize})
+		if err == nil {
+			err = utils.ReadStatus(conn)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	utils.FileSet[localFilename] = true
-
-	fromLocal := task.ConnectionOperation == utils.READ
-	if fromLocal {
-		task.DataSize = int64(fileSize)
-		utils.SendTaskOnExistingConnection(task, conn)
-		utils.ReadSmallAck(conn)
+	// Appends fill the tail of an existing block in place, dropping anything a failed earlier append left past that point
+	if isAppend {
+		bufferedErr := fp.Truncate(task.RangeOffset)
+		if bufferedErr == nil {
+			_, bufferedErr = fp.Seek(task.RangeOffset, io.SeekStart)
+		}
+		if bufferedErr != nil {
+			fmt.Println("Unable to seek block for append: ", bufferedErr)
+			utils.SendStatus(conn, bufferedErr)
+			return bufferedErr
+		}
 	}
 
 	fmt.Println("Amount of data to send back: ", task.DataSize)
@@ -74,121 +99,247 @@ func HandleStreamConnection(task utils.Task, conn net.Conn) error {
 	var bufferedErr error
 	if !fromLocal { // PUT request
 		nread, bufferedErr = utils.BufferedReadFromConnection(conn, fp, task.DataSize)
+		if bufferedErr == nil {
+			bufferedErr = commitBlock(ctx, task, fp, localFilename, isAppend)
+		}
 	} else { // GET request
-		nread, bufferedErr = utils.BufferedWriteToConnection(conn, fp, task.DataSize, 0)
+		nread, bufferedErr = utils.BufferedWriteToConnection(conn, fp, task.DataSize, rangeOffset)
 	}
 
 	if bufferedErr != nil {
 		fmt.Println("Error:", bufferedErr)
-		utils.FileSet[localFilename] = false
-
-		if isRead {
-			nActiveReaders--
-
-			if readWriteHistory < 0 {
-				readWriteHistory = 0
-			} else {
-				readWriteHistory++
-			}
-
-		} else if isWrite {
-			nActiveWriters--
-			fmt.Println("Decrementing writer count in error flow, ", nActiveWriters)
-			if readWriteHistory > 0 {
-				readWriteHistory = 0
-			} else {
-				readWriteHistory--
-			}
-		}
-
-		utils.MuLocalFs.Unlock()
-		utils.CondLocalFs.Signal()
-
 		if !fromLocal {
-			os.Remove(localFilename) // Remove file if it failed half way through
+			if !isAppend {
+				os.Remove(fp.Name()) // Remove the partial block, the old one (if any) is untouched
+			}
+			utils.SendStatus(conn, bufferedErr)
 		}
-
-		// Close the connection with an error here somehow.
 		return bufferedErr
 	}
 	if !fromLocal {
-		utils.SendSmallAck(conn)
+		err = utils.SendStatus(conn, nil)
+		if err != nil {
+			return err
+		}
 	}
 
 	log.Println("Nread: ", nread)
+	return nil
+}
 
-	utils.FileSet[localFilename] = false
-
-	if isRead {
-		nActiveReaders--
+// Moves a block this node has received into place, and only then asks the leader to record it, so a read sent here
+// once it is recorded finds the whole block. A block the leader turns down, like one over a quota, is dropped, and an
+// append is cut back to where it started. If the ack gets no answer the block is kept, since the leader may still
+// have recorded it.
+func commitBlock(ctx context.Context, task utils.Task, fp *os.File, localFilename string, isAppend bool) error {
+	if !isAppend {
+		if err := os.Rename(fp.Name(), localFilename); err != nil {
+			return err
+		}
+	}
 
-		if readWriteHistory < 0 {
-			readWriteHistory = 0
+	err := SendWriteAck(ctx, task)
+	if isRefusal(err) {
+		if isAppend {
+			fp.Truncate(task.RangeOffset)
 		} else {
-			readWriteHistory++
+			os.Remove(localFilename)
 		}
+	}
+	return err
+}
 
-	} else if isWrite {
-		fmt.Println("Decrementing writer count, first ", nActiveWriters)
-		nActiveWriters--
-		fmt.Println("Decrementing writer count, second ", nActiveWriters)
+// Whether err is the leader or an upstream replica turning a write down, rather than a failure to hear back from it
+func isRefusal(err error) bool {
+	var coded *utils.CodedError
+	return errors.As(err, &coded)
+}
 
-		if readWriteHistory > 0 {
-			readWriteHistory = 0
-		} else {
-			readWriteHistory--
+func HandleDeleteConnection(ctx context.Context, task utils.Task) error {
+	// Given the filename.blockidx, this function needs to delete the provided file from sdfs/data/filename.blockidx. Once
+	// that block is successfully deleted, this function should alert the Task.AckTargetIp that this operation was successfully
+	// completed in addition to terminating the connection. A read that already has the block open keeps reading the
+	// removed file.
+
+	localFilename := utils.GetFileName(utils.BytesToString(task.FileName[:]), fmt.Sprint(task.BlockIndex))
+
+	// On a failure case, like block dne, do not send the ack.
+	if err := os.Remove(localFilename); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error removing file:", err)
+			return err
 		}
 	}
 
-	utils.MuLocalFs.Unlock()
-	utils.CondLocalFs.Signal()
-
-	if task.ConnectionOperation != utils.READ {
-		utils.SendAckToMaster(task)
+	ack, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return err
 	}
+	(*ack).Close()
 
+	// Used for delete command
+	fmt.Println("Recieved a request to delete some block on this node")
 	return nil
 }
 
-func HandleDeleteConnection(task utils.Task) error {
-	// Given the filename.blockidx, this function needs to delete the provided file from sdfs/data/filename.blockidx. Once
-	// that block is successfully deleted, this function should alert the Task.AckTargetIp that this operation was successfully
-	// completed in addition to terminating the connection. Additionally, if another thread is currently reading/writing to a block, this should block until
-	// that operation is done. When the thread does end up in the middle of a buffered read, it must mark that particular file as being read from to
-	// in the map.
+// Rebuilds a lost erasure coded piece on this node by decoding the surviving pieces of its stripe, then acks the
+// leader as if the piece had been written.
+func HandleReconstructConnection(ctx context.Context, task utils.Task) error {
+	fileName := utils.BytesToString(task.FileName[:])
+	metadata := task.Metadata
 
-	localFilename := utils.GetFileName(utils.BytesToString(task.FileName[:]), fmt.Sprint(task.BlockIndex))
+	coder, err := utils.NewErasureCoder(int(metadata.DataShards), int(metadata.ParityShards))
+	if err != nil {
+		return err
+	}
 
-	utils.MuLocalFs.Lock()
+	locations, err := RequestBlockMappings(ctx, fileName)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("This should be false: ", utils.FileSet[localFilename])
-	fmt.Printf("nreaders: %d nwriters: %d\n", nActiveReaders, nActiveWriters)
+	stripe := task.BlockIndex / metadata.StripeWidth()
+	shards, err := FetchStripe(ctx, fileName, stripe, locations, metadata, task.BlockIndex)
+	if err != nil {
+		fmt.Println("Unable to reconstruct block: ", err)
+		return err
+	}
 
-	for utils.FileSet[localFilename] || !(nActiveWriters == 0 && nActiveReaders == 0) {
-		utils.CondLocalFs.Wait()
+	err = coder.Reconstruct(shards)
+	if err != nil {
+		return err
 	}
-	utils.FileSet[localFilename] = true
+	piece := shards[task.BlockIndex%metadata.StripeWidth()]
 
-	// On a failure case, like block dne, do not send the ack.
-	if err := os.Remove(localFilename); err != nil {
-		if !os.IsNotExist(err) {
-			fmt.Println("Error removing file:", err)
+	localFilename := utils.GetFileName(fileName, fmt.Sprint(task.BlockIndex))
 
-			utils.FileSet[localFilename] = false
-			utils.MuLocalFs.Unlock()
-			utils.CondLocalFs.Signal()
+	err = writeBlockFile(localFilename, piece)
+	if err != nil {
+		fmt.Println("Error writing reconstructed block: ", err)
+		return err
+	}
 
+	fmt.Printf("Reconstructed block %d of %s\n", task.BlockIndex, fileName)
+	task.ConnectionOperation = utils.WRITE
+	task.DataSize = int64(len(piece))
+	return SendWriteAck(ctx, task)
+}
+
+// Handles one link of a pipelined put: stores the block locally while forwarding it to the next replica in the chain,
+// and only acks upstream once everything downstream has received it too. The chain head then acks the leader, and
+// its verdict is passed down the chain, so a block the leader turns down is dropped by every replica. Each replica
+// moves the block into place before it acks upstream, so the leader only records replicas that can serve the block.
+func HandlePipelinedWrite(ctx context.Context, task utils.Task, conn net.Conn) error {
+	defer conn.Close()
+
+	fileName := utils.BytesToString(task.FileName[:])
+	localFilename := utils.GetFileName(fileName, fmt.Sprint(task.BlockIndex))
+
+	// Connect downstream before accepting data, so a dead link fails the chain before anything is streamed
+	var downstream net.Conn
+	if task.ChainIndex+1 < len(task.ReplicaChain) {
+		nextIp := task.ReplicaChain[task.ChainIndex+1]
+
+		forwardTask := task
+		forwardTask.ChainIndex++
+		forwardTask.DataTargetIp = utils.New19Byte(nextIp)
+		downstreamPtr, err := utils.SendTaskContext(ctx, forwardTask, nextIp, false)
+		if err != nil {
+			utils.SendStatus(conn, err)
+			return err
+		}
+		downstream = *downstreamPtr
+		defer downstream.Close()
+
+		err = utils.ReadStatus(downstream)
+		if err != nil {
+			utils.SendStatus(conn, err)
 			return err
 		}
 	}
 
-	utils.FileSet[localFilename] = false
-	utils.MuLocalFs.Unlock()
-	utils.CondLocalFs.Signal()
+	fp, err := utils.CreateBlockTempFile()
+	if err == nil {
+		defer fp.Close()
+		defer os.Remove(fp.Name()) // No-op once renamed
+		err = receiveChainBlock(task, conn, downstream, fp)
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), localFilename)
+	}
+	if err != nil {
+		fmt.Println("Pipelined write failed: ", err)
+		utils.SendStatus(conn, err)
+		return err
+	}
 
-	utils.SendAckToMaster(task)
+	var verdict error
+	if task.ChainIndex == 0 {
+		verdict = SendWriteAck(ctx, task)
+	} else {
+		verdict = utils.SendStatus(conn, nil)
+		if verdict == nil {
+			verdict = utils.ReadStatus(conn)
+		}
+	}
 
-	// Used for delete command
-	fmt.Println("Recieved a request to delete some block on this node")
-	return nil
+	// Without an answer the block is kept, and downstream keeps its copy too when the connection closes
+	if downstream != nil && (verdict == nil || isRefusal(verdict)) {
+		utils.SendStatus(downstream, verdict)
+	}
+	if isRefusal(verdict) {
+		os.Remove(localFilename)
+	}
+
+	if task.ChainIndex == 0 {
+		utils.SendStatus(conn, verdict)
+	}
+	return verdict
+}
+
+// Receives the block into fp while forwarding it downstream, and returns once the rest of the chain has it too
+func receiveChainBlock(task utils.Task, conn net.Conn, downstream net.Conn, fp *os.File) error {
+	utils.SendStatus(conn, nil)
+
+	// Each data frame is written locally and forwarded as it arrives
+	var writer io.Writer = fp
+	var forward *utils.DataWriter
+	if downstream != nil {
+		forward = utils.NewDataWriter(downstream)
+		writer = io.MultiWriter(fp, forward)
+	}
+
+	_, err := io.Copy(writer, utils.NewDataReader(conn, task.DataSize))
+	if err != nil {
+		if forward != nil {
+			forward.Abort(err)
+		}
+		return err
+	}
+
+	if downstream != nil {
+		err = forward.Close()
+		if err == nil {
+			err = utils.ReadStatus(downstream)
+		}
+	}
+	return err
+}
+
+// Replaces a block file with data in one step
+func writeBlockFile(localFilename string, data []byte) error {
+	fp, err := utils.CreateBlockTempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name()) // No-op once renamed
+
+	_, err = fp.Write(data)
+	closeErr := fp.Close()
+	if err != nil {
+		return err
+	} else if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(fp.Name(), localFilename)
 }
@@ -0,0 +1,247 @@
+package sdfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// SDFS as an io/fs file system, so standard library code like fs.WalkDir, template.ParseFS and http.FS can read it in
+// place. Names follow io/fs: slash separated, unrooted, and "." for the root directory. Files are read through a
+// Client, so a read only fetches the blocks it covers, and every call runs under the context the FS was made with.
+type FS struct {
+	client *Client
+	ctx    context.Context
+}
+
+var (
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+	_ fs.GlobFS    = (*FS)(nil)
+)
+
+func NewFS(ctx context.Context, client *Client) *FS {
+	return &FS{client: client, ctx: ctx}
+}
+
+// SDFS path of an io/fs name
+func sdfsPath(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	} else if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// io/fs callers expect a *fs.PathError naming the path they passed in
+func fsError(op string, name string, err error) error {
+	var sdfsErr *Error
+	if errors.As(err, &sdfsErr) {
+		err = sdfsErr.Err
+		if sdfsErr.Kind != nil {
+			err = sdfsErr.Kind
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	sdfsName, err := sdfsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fsys.stat("open", name, sdfsName)
+	if err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return &dirFile{fsys: fsys, name: name, info: info}, nil
+	}
+
+	reader, err := fsys.client.Open(fsys.ctx, sdfsName)
+	if err != nil {
+		return nil, fsError("open", name, err)
+	}
+	return &file{reader}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	sdfsName, err := sdfsPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.stat("stat", name, sdfsName)
+}
+
+func (fsys *FS) stat(op string, name string, sdfsName string) (*FileInfo, error) {
+	info, err := fsys.client.Stat(fsys.ctx, sdfsName)
+	if err != nil {
+		return nil, fsError(op, name, err)
+	}
+	if sdfsName == "" {
+		info.entry.Name = "."
+	}
+	return info, nil
+}
+
+// Entries of a directory sorted by name, from a single request to the leader
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	sdfsName, err := sdfsPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := fsys.client.List(fsys.ctx, sdfsName)
+	if err != nil {
+		return nil, fsError("readdir", name, err)
+	}
+
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+// Matches the pattern against the leader's namespace in one request, instead of listing each directory on the way
+func (fsys *FS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	// Like fs.Glob, a name without metacharacters only has to exist
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		if _, err := fsys.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	return fsys.client.Glob(fsys.ctx, pattern)
+}
+
+// A regular file, read through a Reader
+type file struct {
+	*Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// A directory, listed the first time ReadDir is called
+type dirFile struct {
+	fsys    *FS
+	name    string
+	info    *FileInfo
+	entries []fs.DirEntry
+	loaded  bool
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: ErrIsDir}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.loaded = entries, true
+	}
+
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	} else if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// Paths of the files and directories matching pattern, in lexical order. Each element of the pattern is matched
+// against one level of the namespace with path.Match.
+func GlobPaths(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	var matches []string
+	globNode(namespaceRoot, strings.Split(pattern, "/"), &matches)
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Caller holds namespaceMu
+func globNode(node *NamespaceNode, elements []string, matches *[]string) {
+	if len(elements) == 0 {
+		*matches = append(*matches, node.Path())
+		return
+	}
+
+	for name, child := range node.Children {
+		if matched, _ := path.Match(elements[0], name); matched {
+			globNode(child, elements[1:], matches)
+		}
+	}
+}
+
+// Client side
+
+func RequestGlob(ctx context.Context, pattern string) ([]string, error) {
+	var reply utils.GlobReply
+	task := utils.Task{
+		ConnectionOperation: utils.GLOB,
+		FileName:            utils.New1024Byte(pattern),
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return nil, err
+	} else if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply.Matches, nil
+}
+
+// Paths matching a path.Match pattern, one element per directory level, in lexical order
+func (c *Client) Glob(ctx context.Context, pattern string) ([]string, error) {
+	matches, err := c.cluster.Glob(ctx, pattern)
+	if err != nil {
+		return nil, wrapError("glob", pattern, err)
+	}
+	return matches, nil
+}
@@ -0,0 +1,94 @@
+package sdfs_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfstest"
+)
+
+func newTestFS(t *testing.T) *sdfs.FS {
+	t.Helper()
+	client, cluster := sdfstest.NewClient()
+	files := map[string]string{
+		"README":            "read me",
+		"logs/vm1.log":      "first line\nsecond line\n",
+		"logs/vm2.log":      "",
+		"logs/2023/old.log": "old",
+		"data/big.bin":      string(testData(int(sdfs.READ_AHEAD) + 10)),
+	}
+	for name, data := range files {
+		if err := cluster.WriteFile(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cluster.Mkdir(context.Background(), "empty"); err != nil {
+		t.Fatal(err)
+	}
+	return sdfs.NewFS(context.Background(), client)
+}
+
+func TestFS(t *testing.T) {
+	fsys := newTestFS(t)
+	err := fstest.TestFS(fsys, "README", "logs/vm1.log", "logs/vm2.log", "logs/2023/old.log", "data/big.bin", "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSGlob(t *testing.T) {
+	fsys := newTestFS(t)
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"logs/*.log", []string{"logs/vm1.log", "logs/vm2.log"}},
+		{"*/*", []string{"data/big.bin", "logs/2023", "logs/vm1.log", "logs/vm2.log"}},
+		{"logs/*/*.log", []string{"logs/2023/old.log"}},
+		{"logs/vm[2-9].log", []string{"logs/vm2.log"}},
+		{"README", []string{"README"}},
+		{"missing", nil},
+		{"nothing/*", nil},
+	}
+
+	for _, test := range tests {
+		got, err := fs.Glob(fsys, test.pattern)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Glob(%q) = %q, %v, want %q", test.pattern, got, err, test.want)
+		}
+	}
+
+	if _, err := fs.Glob(fsys, "logs/["); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("Glob with a malformed pattern = %v, want path.ErrBadPattern", err)
+	}
+}
+
+func TestFSErrors(t *testing.T) {
+	fsys := newTestFS(t)
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"open missing", func() error { _, err := fsys.Open("logs/missing"); return err }, fs.ErrNotExist},
+		{"open invalid", func() error { _, err := fsys.Open("/README"); return err }, fs.ErrInvalid},
+		{"stat missing", func() error { _, err := fsys.Stat("missing"); return err }, fs.ErrNotExist},
+		{"readdir file", func() error { _, err := fsys.ReadDir("README"); return err }, sdfs.ErrNotDir},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			var pathErr *fs.PathError
+			if !errors.As(err, &pathErr) || !errors.Is(err, test.want) {
+				t.Errorf("got %#v, want a *fs.PathError for %v", err, test.want)
+			}
+		})
+	}
+}
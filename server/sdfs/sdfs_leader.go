@@ -1,28 +1,43 @@
 package sdfs
 
 import (
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	cmap "github.com/orcaman/concurrent-map/v2"
 	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
 	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
 )
 
-var BlockLocations cmap.ConcurrentMap[string, [][]string] = cmap.New[[][]string]()           // filename : [[ip addr, ip addr, ], ], index 2d arr by block index
-var FileToOriginator cmap.ConcurrentMap[string, []string] = cmap.New[[]string]()             // filename : [ClientIpWhoCreatedFile, ClientCreationTime]
-var FileToBlocks cmap.ConcurrentMap[string, [][2]interface{}] = cmap.New[[][2]interface{}]() // IPaddr : [[blockidx, filename]]
-var FileToSize cmap.ConcurrentMap[string, int64] = cmap.New[int64]()                         // sdfsfilename : size
+var BlockLocations cmap.ConcurrentMap[string, [][]string] = cmap.New[[][]string]()                 // filename : [[ip addr, ip addr, ], ], index 2d arr by block index
+var FileToOriginator cmap.ConcurrentMap[string, []string] = cmap.New[[]string]()                   // filename : [ClientIpWhoCreatedFile, ClientCreationTime]
+var FileToBlocks cmap.ConcurrentMap[string, [][2]interface{}] = cmap.New[[][2]interface{}]()       // IPaddr : [[blockidx, filename]]
+var FileToSize cmap.ConcurrentMap[string, int64] = cmap.New[int64]()                               // sdfsfilename : size
+var FileToMetadata cmap.ConcurrentMap[string, utils.FileMetadata] = cmap.New[utils.FileMetadata]() // sdfsfilename : storage policy
+var BlockStoredSizes cmap.ConcurrentMap[string, []int64] = cmap.New[[]int64]()                     // sdfsfilename : bytes each block takes on disk
+
+const APPEND_GRANT_TIMEOUT = 5 * time.Minute
+
+var appendMu sync.Mutex
+var appendCond = sync.NewCond(&appendMu)
+var appendingFiles = make(map[string]appendGrant) // sdfsfilename : the current append grant
+
+type appendGrant struct {
+	id        string
+	expiry    time.Time
+	numBlocks int64 // Rows the file had when the grant was given, any past them are the append's
+}
 
 // Initializes a new entry in BlockLocations, so the leader can begin listening for block acks.
-func InitializeBlockLocationsEntry(fileName string, fileSize int64) {
-	n, m := utils.CeilDivide(fileSize, utils.BLOCK_SIZE), utils.REPLICATION_FACTOR // Size of the 2D array (n rows, m columns)
-	newEntry := make([][]string, n)                                                // Create a slice of slices (2D array)
+func InitializeBlockLocationsEntry(fileName string, fileSize int64, metadata utils.FileMetadata) {
+	n, m := metadata.BlockLocationsShape(fileSize) // Size of the 2D array (n rows, m columns)
+	newEntry := make([][]string, n)                // Create a slice of slices (2D array)
 
 	// Populate the 2D array with arbitrary values
 	var i int64
@@ -35,6 +50,74 @@ func InitializeBlockLocationsEntry(fileName string, fileSize int64) {
 	}
 
 	BlockLocations.Set(fileName, newEntry)
+	FileToMetadata.Set(fileName, metadata)
+}
+
+// Drops all leader metadata for a file once every one of its blocks is gone
+func RemoveFileEntry(fileName string) {
+	RemoveNamespaceEntry(fileName)
+	BlockLocations.Remove(fileName)
+	FileToMetadata.Remove(fileName)
+	FileToSize.Remove(fileName)
+	BlockStoredSizes.Remove(fileName)
+}
+
+// Records how many bytes a block takes on disk. Compressed blocks are smaller than the data they hold.
+func RecordBlockStoredSize(fileName string, blockIdx int64, size int64) {
+	BlockStoredSizes.Upsert(fileName, nil, func(exists bool, sizes []int64, _ []int64) []int64 {
+		for int64(len(sizes)) <= blockIdx {
+			sizes = append(sizes, 0)
+		}
+		sizes[blockIdx] = size
+		return sizes
+	})
+}
+
+// Bytes one copy of a file takes on disk, as opposed to its logical size in FileToSize
+func StoredSize(fileName string) int64 {
+	sizes, _ := BlockStoredSizes.Get(fileName)
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// Marks ip as holding a replica of the block, in both BlockLocations and FileToBlocks
+func RecordBlockReplica(fileName string, blockIdx int64, ip string) {
+	blockMap, _ := BlockLocations.Get(fileName)
+	for _, existing := range blockMap[blockIdx] {
+		if existing == ip {
+			return // Appends rewrite blocks a replica already holds
+		}
+	}
+
+	for i := int64(0); i < int64(len(blockMap[blockIdx])); i++ {
+		if blockMap[blockIdx][i] == utils.WRITE_OP || blockMap[blockIdx][i] == utils.DELETE_OP {
+			blockMap[blockIdx][i] = ip
+			break
+		}
+	}
+	BlockLocations.Set(fileName, blockMap)
+	fmt.Println("Set block locations")
+
+	if mapping, ok := FileToBlocks.Get(ip); ok { // IPaddr : [[blockidx, filename]]
+		fmt.Println("Mapping ok, appending new value")
+		mapping = append(mapping, [2]interface{}{blockIdx, fileName})
+		fmt.Println("Appending a new file+blockidx for ip addr ", ip)
+		fmt.Println("mapping: ", mapping)
+		FileToBlocks.Set(ip, mapping)
+	} else {
+		fmt.Println("Mapping not ok, creating new value")
+		initialMapping := make([][2]interface{}, 1)
+		initialMapping[0] = [2]interface{}{blockIdx, fileName}
+
+		fmt.Println("Creating a new file+blockidx for ip addr ", ip)
+		fmt.Println("mapping: ", initialMapping)
+
+		FileToBlocks.Set(ip, initialMapping)
+	}
 }
 
 // Master functions
@@ -67,61 +150,51 @@ func HandleAck(incomingAck utils.Task, conn *net.Conn) error {
 		fmt.Println("Got ack for write, filename is ", fileName)
 		fmt.Println("Got ack for write, File size is ", incomingAck.OriginalFileSize)
 
-		FileToSize.Set(fileName, incomingAck.OriginalFileSize)
+		// A moved block carries the size from when the move started, which an append may have grown since
+		if !incomingAck.IsAppend && incomingAck.MoveFrom == "" {
+			FileToSize.Set(fileName, incomingAck.OriginalFileSize)
+		}
 
 		if !BlockLocations.Has(fileName) {
 			fmt.Println("Never seen before filename, creating block locations entry")
-			InitializeBlockLocationsEntry(fileName, incomingAck.OriginalFileSize)
+			InitializeBlockLocationsEntry(fileName, incomingAck.OriginalFileSize, incomingAck.Metadata)
 		}
 
 		blockMap, _ := BlockLocations.Get(fileName)
+		if incomingAck.IsAppend {
+			blockMap = GrowBlockLocations(fileName, incomingAck.BlockIndex+1)
+		}
 		if incomingAck.BlockIndex >= int64(len(blockMap)) {
 			fmt.Println("Map was not properly initiated. Actual blockmap: ", blockMap)
 			return errors.New("Map was not properly initiated, didn't have enough rows")
 		}
 
-		fmt.Println("Block map for file in write ack:", blockMap)
-		for i := int64(0); i < (utils.REPLICATION_FACTOR); i++ {
-
-			if i >= (int64(len(blockMap[incomingAck.BlockIndex]))) {
-				fmt.Println("Map was not properly initiated. blockmap row: ", blockMap[incomingAck.BlockIndex])
-				break
-			}
-
-			if blockMap[incomingAck.BlockIndex][i] == utils.WRITE_OP || blockMap[incomingAck.BlockIndex][i] == utils.DELETE_OP {
-				blockMap[incomingAck.BlockIndex][i] = ackSourceIp
-				break
-			}
+		// A pipelined write is acked once by the chain head, after every replica in the chain has committed
+		replicaIps := []string{ackSourceIp}
+		if len(incomingAck.ReplicaChain) > 0 {
+			replicaIps = incomingAck.ReplicaChain
 		}
-		BlockLocations.Set(fileName, blockMap)
-		fmt.Println("Set block locations")
 
-		if mapping, ok := FileToBlocks.Get(ackSourceIp); ok { // IPaddr : [[blockidx, filename]]
-			fmt.Println("Mapping ok, appending new value")
-			mapping = append(mapping, [2]interface{}{incomingAck.BlockIndex, fileName})
-			fmt.Println("Appending a new file+blockidx for ip addr ", ackSourceIp)
-			fmt.Println("mapping: ", mapping)
-			FileToBlocks.Set(ackSourceIp, mapping)
-		} else {
-			fmt.Println("Mapping not ok, creating new value")
-			initialMapping := make([][2]interface{}, 1)
-			initialMapping[0] = [2]interface{}{incomingAck.BlockIndex, fileName}
+		RecordBlockStoredSize(fileName, incomingAck.BlockIndex, incomingAck.RangeOffset+incomingAck.DataSize)
 
-			fmt.Println("Creating a new file+blockidx for ip addr ", ackSourceIp)
-			fmt.Println("mapping: ", initialMapping)
+		// A balancer move swaps the new replica in for the old one rather than adding it
+		if incomingAck.MoveFrom != "" {
+			CompleteBlockMove(fileName, incomingAck.BlockIndex, incomingAck.MoveFrom, ackSourceIp)
+			return nil
+		}
 
-			FileToBlocks.Set(ackSourceIp, initialMapping)
+		fmt.Println("Block map for file in write ack:", blockMap)
+		for _, ip := range replicaIps {
+			RecordBlockReplica(fileName, incomingAck.BlockIndex, ip)
 		}
 	} else if incomingAck.ConnectionOperation == utils.GET_2D {
-		Handle2DArrRequest(fileName, *conn)
+		return Handle2DArrRequest(ResolveFileId(fileName), *conn)
 	} else if incomingAck.ConnectionOperation == utils.DELETE {
 
 		fmt.Printf("Got ack for delete, the ack source is >{%s}<\n", ackSourceIp)
 		fmt.Println("Got ack for delete, filename is ", fileName)
 		fmt.Println("Got ack for delete, File size is ", incomingAck.OriginalFileSize)
 
-		FileToSize.Remove(fileName)
-
 		if !BlockLocations.Has(fileName) {
 			return errors.New("Never seen before filename, dropping delete operation")
 		}
@@ -149,24 +222,89 @@ func HandleAck(incomingAck utils.Task, conn *net.Conn) error {
 		}
 
 		if allDeleted {
-			BlockLocations.Remove(fileName)
+			RemoveFileEntry(fileName)
 		}
 
 		if mapping, ok := FileToBlocks.Get(ackSourceIp); ok && len(mapping) > 0 { // IPaddr : [[blockidx, filename]]
-			var idx uint
+			idx := -1
 
 			for i, pair := range mapping {
-				if pair[0] == int(incomingAck.BlockIndex) && pair[1] == utils.BytesToString(incomingAck.FileName[:]) {
-					idx = uint(i)
+				if pair[0] == incomingAck.BlockIndex && pair[1] == fileName {
+					idx = i
 					break
 				}
 			}
 
-			fmt.Println("Mapping before delete: ", mapping)
-			mapping = append(mapping[:idx], mapping[idx+1:]...)
-			fmt.Println("Mapping after delete: ", mapping)
+			if idx != -1 {
+				fmt.Println("Mapping before delete: ", mapping)
+				mapping = append(mapping[:idx], mapping[idx+1:]...)
+				fmt.Println("Mapping after delete: ", mapping)
 
-			FileToBlocks.Set(ackSourceIp, mapping)
+				FileToBlocks.Set(ackSourceIp, mapping)
+			}
+		}
+	} else if incomingAck.ConnectionOperation == utils.SET_REPLICATION {
+		err := HandleSetReplication(ResolveFileId(fileName), incomingAck.Metadata.ReplicationFactor, conn)
+		if err != nil {
+			return err
+		}
+	} else if utils.IsNamespaceOp(incomingAck.ConnectionOperation) {
+		err := HandleNamespaceOp(incomingAck, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.PLACE_REPLICAS {
+		err := HandlePlacementRequest(incomingAck, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.SET_PLACEMENT {
+		err := HandleSetPlacementPolicy(fileName, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.QUOTA_SET {
+		err := HandleQuotaSet(incomingAck, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.QUOTA_GET {
+		err := HandleQuotaGet(fileName, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.BALANCE {
+		err := HandleBalanceRequest(fileName, incomingAck.Count, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.ROTATE_KEY {
+		RotateMasterKey()
+	} else if utils.IsLeaseOp(incomingAck.ConnectionOperation) {
+		err := HandleLeaseOp(incomingAck, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.APPEND_BEGIN {
+		err := HandleAppendBegin(ResolveFileId(fileName), incomingAck.Overwrite, conn)
+		if err != nil {
+			return err
+		}
+	} else if incomingAck.ConnectionOperation == utils.APPEND_RENEW {
+		return replyLeader(conn, RenewAppendGrant(ResolveFileId(fileName), incomingAck.LeaseId))
+	} else if incomingAck.ConnectionOperation == utils.APPEND_END {
+		err := HandleAppendEnd(ResolveFileId(fileName), incomingAck.LeaseId, incomingAck.OriginalFileSize, incomingAck.Metadata.ETag)
+		// The appender waits to hear its data was committed. Submasters get the end from the leader, which doesn't.
+		if gossiputils.MachineType() == gossiputils.LEADER {
+			if err == nil {
+				RouteToSubMasters(incomingAck)
+			}
+			return replyLeader(conn, err)
+		}
+	} else if incomingAck.ConnectionOperation == utils.GET_METADATA {
+		err := HandleGetMetadata(fileName, conn)
+		if err != nil {
+			return err
 		}
 	} else if incomingAck.ConnectionOperation == utils.GET_PREFIX {
 		err := HandleGetPrefixList(fileName, conn)
@@ -205,8 +343,12 @@ func PrefixList(SdfsPrefix string) ([]string, error) {
 		return rv, err
 	}
 
-	fmt.Println(BlockLocations.Keys())
-	for _, val := range BlockLocations.Keys() {
+	paths := AllFilePaths()
+	if strings.HasPrefix(SdfsPrefix, SNAPSHOT_PATH_PREFIX) {
+		paths = AllSnapshotPaths()
+	}
+
+	for _, val := range paths {
 		if regex.MatchString(val) {
 			rv = append(rv, val)
 		}
@@ -223,22 +365,13 @@ func HandleGetFileSizeByPrefix(SdfsPrefix string, conn *net.Conn) error {
 
 	sizes := int64(0)
 	for _, val := range rv {
-		size, exists := FileToSize.Get(val)
+		size, exists := FileToSize.Get(ResolveFileId(val))
 		if exists {
 			sizes += size
 		}
 	}
 
-	sizesUint := uint32(sizes)
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, sizesUint)
-
-	_, err = (*conn).Write(buf)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return utils.SendReply(*conn, uint32(sizes))
 }
 
 func HandleGetPrefixList(SdfsPrefix string, conn *net.Conn) error {
@@ -248,8 +381,7 @@ func HandleGetPrefixList(SdfsPrefix string, conn *net.Conn) error {
 	}
 
 	fmt.Println(rv)
-	encoder := json.NewEncoder(*conn)
-	err = encoder.Encode(rv)
+	err = utils.SendReply(*conn, rv)
 	if err != nil {
 		fmt.Println("Error encoding and sending data:", err)
 		return err
@@ -258,23 +390,38 @@ func HandleGetPrefixList(SdfsPrefix string, conn *net.Conn) error {
 	return nil
 }
 
-func Handle2DArrRequest(Filename string, conn net.Conn) {
+func HandleGetMetadata(fileName string, conn *net.Conn) error {
+	var stat utils.FileStat
+	fileId := ResolveFileId(fileName)
+	stat.Metadata, stat.Exists = FileToMetadata.Get(fileId)
+	stat.Size, _ = FileToSize.Get(fileId)
+	stat.FileId = fileId
+	stat.StoredSize = StoredSize(fileId)
+
+	// A snapshot only covers the bytes the file had when it was taken
+	if info, ok := LookupSnapshotFile(fileName); ok {
+		stat.Size = info.Size
+	}
+
+	return utils.SendReply(*conn, stat)
+}
+
+func Handle2DArrRequest(Filename string, conn net.Conn) error {
 	// Reply to a connection with the 2d array for the provided filename.
+	// An empty file, or a version whose first block hasn't been acked, has no replicas and isn't deleted. This is a
+	// query that the submasters never see, so it only drops block locations and leaves the namespace alone.
 	arr, exists := BlockLocations.Get(Filename)
-	allDs := true
+	entries, allDs := 0, true
 	for i := 0; i < len(arr); i++ {
 		for j := 0; j < len(arr[i]); j++ {
+			entries++
 			if arr[i][j] != utils.DELETE_OP {
 				allDs = false
-				break
 			}
 		}
-		if !allDs {
-			break
-		}
 	}
 
-	if allDs {
+	if allDs && entries > 0 {
 		BlockLocations.Remove(Filename)
 		fmt.Printf("Block location filename %s made dne. Continuing\n", Filename)
 		var empty [][]string
@@ -296,11 +443,11 @@ func Handle2DArrRequest(Filename string, conn net.Conn) {
 		returningArr = append(returningArr, replicaArr)
 	}
 
-	marshalledArray := utils.MarshalBlockLocationArr(returningArr)
-	_, err := conn.Write(marshalledArray)
+	err := utils.SendReply(conn, returningArr)
 	if err != nil {
-		log.Fatalf("Error writing 2d arr to conn: %v\n", err)
+		return fmt.Errorf("error writing 2d arr to conn: %w", err)
 	}
+	return nil
 }
 
 func HandleDown(DownIpAddr string) {
@@ -310,7 +457,7 @@ func HandleDown(DownIpAddr string) {
 		blockLocations := keyval.Val
 
 		for blockIdx := range blockLocations {
-			for i := 0; i < int(utils.REPLICATION_FACTOR); i++ {
+			for i := range blockLocations[blockIdx] {
 				if blockLocations[blockIdx][i] == DownIpAddr {
 					blockLocations[blockIdx][i] = utils.WRITE_OP
 				}
@@ -346,6 +493,11 @@ func HandleReReplication(downIpAddr string) {
 						}
 						fmt.Println("Block locations for found at", blockLocations[blockIdx])
 
+						if metadata, ok := FileToMetadata.Get(fileName); ok && metadata.IsErasureCoded() {
+							ReconstructErasureCodedBlock(fileName, blockIdx, downIpAddr, blockLocations, metadata)
+							continue
+						}
+
 						locations := blockLocations[blockIdx]
 						for i, ip := range locations {
 							if ip == downIpAddr || ip == utils.WRITE_OP || ip == utils.DELETE_OP {
@@ -356,43 +508,26 @@ func HandleReReplication(downIpAddr string) {
 								continue
 							}
 
-							allIps := gossiputils.MembershipMap.Keys()
 							locationSet := make(map[string]bool)
 							for _, item := range locations {
 								locationSet[item] = true
 							}
 
-							var replicationT string
-							for {
-								replicationTarget, err := PopRandomElementInArray(&allIps)
-
-								if err != nil {
-									fmt.Println("Error popping random ip from all ips. Continuing.", err)
-									return
-								}
-								member, ok := gossiputils.MembershipMap.Get(replicationTarget)
-
-								if !locationSet[replicationTarget] && ok && member.State == gossiputils.ALIVE {
-									replicationT = replicationTarget
-									break
-								}
+							targets := PlaceReplicas(1, downIpAddr, locationSet, false)
+							if len(targets) == 0 {
+								fmt.Println("No alive node to re-replicate to. Continuing.")
+								return
 							}
+							replicationT := targets[0]
 
 							fmt.Println("Replication Target ", replicationT)
 
-							// TODO potential bug, if there is a connection that is down, we should try to pick a new one right away, not continue alltogether.
-							conn, err := utils.OpenTCPConnection(ip, utils.SDFS_PORT)
-							if err != nil {
-								log.Println("unable to open connection: ", err)
-								continue
-							}
-							defer conn.Close()
-
-							fmt.Println("Openeed connection to ", ip)
 							ogFileSize, ok := FileToSize.Get(fileName)
 							if !ok {
-								log.Fatalln("This logic is impossible, you should have a file's size if a re replication is happening")
+								fmt.Printf("No size recorded for %s, skipping re-replication of block %d\n", fileName, blockIdx)
+								break
 							}
+							metadata, _ := FileToMetadata.Get(fileName)
 
 							task := utils.Task{
 								DataTargetIp:        utils.New19Byte(replicationT),
@@ -403,13 +538,16 @@ func HandleReReplication(downIpAddr string) {
 								BlockIndex:          blockIdx,
 								DataSize:            0,
 								IsAck:               false,
+								Metadata:            metadata,
 							}
 
-							err = utils.SendTaskOnExistingConnection(task, conn)
+							// TODO potential bug, if there is a connection that is down, we should try to pick a new one right away, not continue alltogether.
+							conn, err := utils.SendTask(task, ip, false)
 							if err != nil {
-								log.Printf("unable to send task on existing connection: ", err)
+								log.Println("unable to send replication task: ", err)
 								continue
 							}
+							defer (*conn).Close()
 							break
 						}
 					}
@@ -422,3 +560,342 @@ func HandleReReplication(downIpAddr string) {
 	HandleDown(downIpAddr)
 	fmt.Println("Cleaned downed node data.")
 }
+
+// Erasure coded pieces have no second copy to replicate from, so a new node is told to rebuild the lost piece
+// by decoding the surviving pieces of its stripe.
+func ReconstructErasureCodedBlock(fileName string, blockIdx int64, downIpAddr string, blockLocations [][]string, metadata utils.FileMetadata) {
+	stripeStart := (blockIdx / metadata.StripeWidth()) * metadata.StripeWidth()
+	stripeIps := make(map[string]bool)
+	for row := stripeStart; row < stripeStart+metadata.StripeWidth() && row < int64(len(blockLocations)); row++ {
+		for _, ip := range blockLocations[row] {
+			stripeIps[ip] = true
+		}
+	}
+
+	for i, ip := range blockLocations[blockIdx] {
+		if ip == downIpAddr {
+			blockLocations[blockIdx][i] = utils.WRITE_OP
+		}
+	}
+	BlockLocations.Set(fileName, blockLocations)
+
+	// Prefer a node that holds no other piece of this stripe, so one failure can't take out two pieces
+	targets := PlaceReplicas(1, downIpAddr, stripeIps, true)
+	if len(targets) == 0 {
+		fmt.Println("No alive node to reconstruct erasure coded block on: ", fileName, blockIdx)
+		return
+	}
+	target := targets[0]
+
+	ogFileSize, _ := FileToSize.Get(fileName)
+	task := utils.Task{
+		DataTargetIp:        utils.New19Byte(target),
+		AckTargetIp:         utils.New19Byte(gossiputils.Ip),
+		ConnectionOperation: utils.RECONSTRUCT,
+		FileName:            utils.New1024Byte(fileName),
+		OriginalFileSize:    ogFileSize,
+		BlockIndex:          blockIdx,
+		DataSize:            0,
+		IsAck:               false,
+		Metadata:            metadata,
+	}
+
+	fmt.Printf("Reconstructing block %d of %s on %s\n", blockIdx, fileName, target)
+	conn, err := utils.SendTask(task, target, false)
+	if err != nil {
+		fmt.Println("Unable to send reconstruct task: ", err)
+		return
+	}
+	(*conn).Close()
+}
+
+func HandleSetReplication(fileName string, replicationFactor int64, conn *net.Conn) error {
+	var reply utils.LeaderReply
+	metadata, ok := FileToMetadata.Get(fileName)
+
+	if !ok {
+		reply.Error, reply.Code = fmt.Sprintf("%s does not exist", fileName), utils.ERR_NOT_EXIST
+	} else if metadata.IsErasureCoded() {
+		reply.Error = fmt.Sprintf("%s is erasure coded and has no replicas to change", fileName)
+	} else if replicationFactor <= 0 {
+		reply.Error = fmt.Sprintf("invalid replication factor %d", replicationFactor)
+	} else {
+		metadata.ReplicationFactor = replicationFactor
+		FileToMetadata.Set(fileName, metadata)
+
+		// Submasters only mirror the metadata, the leader is the one that moves blocks
+		if gossiputils.MachineType() == gossiputils.LEADER {
+			go AdjustReplication(fileName, replicationFactor)
+		}
+	}
+
+	return utils.SendReply(*conn, reply)
+}
+
+// Brings every block of a file to replicationFactor live replicas, copying blocks to new nodes or deleting extras.
+func AdjustReplication(fileName string, replicationFactor int64) {
+	blockLocations, ok := BlockLocations.Get(fileName)
+	if !ok {
+		return
+	}
+	ogFileSize, _ := FileToSize.Get(fileName)
+	metadata, _ := FileToMetadata.Get(fileName)
+
+	for blockIdx, row := range blockLocations {
+		liveReplicas := make([]string, 0)
+		freeSlots := 0
+		for _, ip := range row {
+			if ip == utils.WRITE_OP || ip == utils.DELETE_OP {
+				freeSlots++
+			} else {
+				liveReplicas = append(liveReplicas, ip)
+			}
+		}
+
+		if int64(len(liveReplicas)) < replicationFactor && len(liveReplicas) > 0 {
+			missing := int(replicationFactor) - len(liveReplicas)
+			for i := freeSlots; i < missing; i++ {
+				row = append(row, utils.WRITE_OP)
+			}
+			blockLocations[blockIdx] = row
+			BlockLocations.Set(fileName, blockLocations)
+
+			exclude := make(map[string]bool)
+			for _, ip := range liveReplicas {
+				exclude[ip] = true
+			}
+
+			for i := 0; i < missing; i++ {
+				target, err := PickReplicaTarget(exclude)
+				if err != nil {
+					fmt.Println("Unable to add replica: ", err)
+					break
+				}
+				exclude[target] = true
+
+				// The existing holder pushes its copy to the new target, same as re-replication
+				task := utils.Task{
+					DataTargetIp:        utils.New19Byte(target),
+					AckTargetIp:         utils.New19Byte(gossiputils.Ip),
+					ConnectionOperation: utils.WRITE,
+					FileName:            utils.New1024Byte(fileName),
+					OriginalFileSize:    ogFileSize,
+					BlockIndex:          int64(blockIdx),
+					IsAck:               false,
+					Metadata:            metadata,
+				}
+				source := liveReplicas[i%len(liveReplicas)]
+				conn, err := utils.SendTask(task, source, false)
+				if err != nil {
+					fmt.Println("Unable to send replication task: ", err)
+					continue
+				}
+				(*conn).Close()
+			}
+		} else if int64(len(liveReplicas)) > replicationFactor {
+			for _, ip := range liveReplicas[replicationFactor:] {
+				task := utils.Task{
+					ConnectionOperation: utils.DELETE,
+					FileName:            utils.New1024Byte(fileName),
+					BlockIndex:          int64(blockIdx),
+					IsAck:               false,
+				}
+				conn, err := utils.SendTask(task, ip, false)
+				if err != nil {
+					fmt.Println("Unable to send trim task: ", err)
+					continue
+				}
+				(*conn).Close()
+			}
+		}
+	}
+
+	fmt.Printf("Finished setting replication of %s to %d\n", fileName, replicationFactor)
+}
+
+// Asks the placement policy for an alive node that is not in exclude
+func PickReplicaTarget(exclude map[string]bool) (string, error) {
+	targets := PlaceReplicas(1, "", exclude, false)
+	if len(targets) == 0 {
+		return "", errors.New("no alive node outside the current replicas")
+	}
+	return targets[0], nil
+}
+
+// Adds WRITE_OP rows to a file's block locations until it has at least numBlocks rows. Appends allocate blocks this way.
+func GrowBlockLocations(fileName string, numBlocks int64) [][]string {
+	blockMap, _ := BlockLocations.Get(fileName)
+	metadata, _ := FileToMetadata.Get(fileName)
+
+	for int64(len(blockMap)) < numBlocks {
+		row := make([]string, metadata.Replicas())
+		for j := range row {
+			row[j] = utils.WRITE_OP
+		}
+		blockMap = append(blockMap, row)
+	}
+
+	BlockLocations.Set(fileName, blockMap)
+	return blockMap
+}
+
+// Rewraps the data key of every encrypted file with the newest master key in the keyfile. Blocks are left alone, since
+// only the data keys depend on the master key.
+func RotateMasterKey() {
+	err := utils.LoadMasterKeys()
+	if err != nil {
+		fmt.Println("Unable to rotate master key: ", err)
+		return
+	}
+
+	rewrapped := 0
+	for item := range FileToMetadata.IterBuffered() {
+		metadata := item.Val
+		if !metadata.IsEncrypted() {
+			continue
+		}
+
+		masterKeyId, wrappedKey, err := utils.RewrapDataKey(metadata.MasterKeyId, metadata.WrappedKey)
+		if err != nil {
+			fmt.Printf("Unable to rewrap the data key of %s: %v\n", item.Key, err)
+			continue
+		} else if masterKeyId == metadata.MasterKeyId {
+			continue
+		}
+
+		metadata.MasterKeyId, metadata.WrappedKey = masterKeyId, wrappedKey
+		FileToMetadata.Set(item.Key, metadata)
+		rewrapped++
+	}
+
+	fmt.Printf("Rewrapped %d data keys with the current master key\n", rewrapped)
+}
+
+// Grants the caller exclusive rights to append to a file. Concurrent appenders wait here until the current one
+// sends APPEND_END, or its grant expires. An upload of a new version encodes its blocks itself, so it may write any
+// kind of file.
+func HandleAppendBegin(fileName string, newVersion bool, conn *net.Conn) error {
+	var grant utils.AppendGrant
+	metadata, exists := FileToMetadata.Get(fileName)
+	exists = exists && !newVersion
+
+	if exists && metadata.IsErasureCoded() {
+		grant.Error = fmt.Sprintf("%s is erasure coded, appends are only supported for replicated files", fileName)
+		return utils.SendReply(*conn, grant)
+	}
+	if exists && metadata.HasEncodedBlocks() {
+		grant.Error = fmt.Sprintf("%s is compressed or encrypted, appends are only supported for plain files", fileName)
+		return utils.SendReply(*conn, grant)
+	}
+
+	appendMu.Lock()
+	for {
+		current, busy := appendingFiles[fileName]
+		if !busy || time.Now().After(current.expiry) {
+			break
+		}
+		appendCond.Wait()
+	}
+
+	// Read the file state only once the grant is held, so it includes the previous appender's data
+	blockMap, _ := BlockLocations.Get(fileName)
+	grant.GrantId, grant.Duration = utils.NewFileId(), APPEND_GRANT_TIMEOUT
+	appendingFiles[fileName] = appendGrant{id: grant.GrantId, expiry: time.Now().Add(APPEND_GRANT_TIMEOUT), numBlocks: int64(len(blockMap))}
+	appendMu.Unlock()
+	time.AfterFunc(APPEND_GRANT_TIMEOUT, appendCond.Broadcast) // Wake waiters if this appender never finishes
+
+	metadata, _ = FileToMetadata.Get(fileName)
+	grant.Offset, _ = FileToSize.Get(fileName)
+	grant.Metadata = metadata
+	grant.NumBlocks = int64(len(blockMap))
+	grant.FileId = fileName
+
+	lastBlockIdx := grant.Offset / metadata.BlockBytes()
+	if !metadata.UnevenBlocks && grant.Offset%metadata.BlockBytes() != 0 && lastBlockIdx < int64(len(blockMap)) {
+		for _, ip := range blockMap[lastBlockIdx] {
+			if ip != utils.WRITE_OP && ip != utils.DELETE_OP {
+				grant.LastBlockReplicas = append(grant.LastBlockReplicas, ip)
+			}
+		}
+	}
+
+	err := utils.SendReply(*conn, grant)
+	if err != nil {
+		HandleAppendEnd(fileName, grant.GrantId, -1, "")
+	}
+	return err
+}
+
+// Pushes back the expiry of a file's append grant, as long as grantId still holds it
+func RenewAppendGrant(fileName string, grantId string) error {
+	appendMu.Lock()
+	defer appendMu.Unlock()
+
+	current, ok := appendingFiles[fileName]
+	if !ok || current.id != grantId {
+		return fmt.Errorf("append grant %s on %s has lapsed", grantId, fileName)
+	}
+	current.expiry = time.Now().Add(APPEND_GRANT_TIMEOUT)
+	appendingFiles[fileName] = current
+	time.AfterFunc(APPEND_GRANT_TIMEOUT, appendCond.Broadcast)
+	return nil
+}
+
+// Releases a file's append grant. A non negative newSize commits the appended data by publishing the new file size,
+// and a negative one aborts the append, dropping the blocks it added. An end from an appender whose grant lapsed and
+// went to another one is refused, so it can't touch the other's append. Only the leader holds grants, and it
+// forwards the ends it accepted to the submasters.
+func HandleAppendEnd(fileName string, grantId string, newSize int64, etag string) error {
+	if gossiputils.MachineType() != gossiputils.LEADER {
+		if newSize >= 0 {
+			FileToSize.Set(fileName, newSize)
+			setETag(fileName, etag)
+		}
+		return nil
+	}
+
+	appendMu.Lock()
+	current, ok := appendingFiles[fileName]
+	if !ok || current.id != grantId {
+		appendMu.Unlock()
+		return fmt.Errorf("append grant %s on %s has lapsed", grantId, fileName)
+	}
+
+	delete(appendingFiles, fileName)
+	if newSize >= 0 {
+		FileToSize.Set(fileName, newSize)
+		setETag(fileName, etag)
+	} else {
+		rollbackAppend(fileName, current.numBlocks)
+	}
+	appendMu.Unlock()
+	appendCond.Broadcast()
+	return nil
+}
+
+// Records the entity tag a committed upload gave the file's new contents. An upload without one clears the old tag,
+// which no longer matches.
+func setETag(fileName string, etag string) {
+	if metadata, ok := FileToMetadata.Get(fileName); ok && metadata.ETag != etag {
+		metadata.ETag = etag
+		FileToMetadata.Set(fileName, metadata)
+	}
+}
+
+// Cuts a file's block locations back to numBlocks rows, and deletes the blocks an aborted append wrote past them.
+// Only the leader holds grants, so submasters learn of it from the delete acks.
+func rollbackAppend(fileName string, numBlocks int64) {
+	blockMap, ok := BlockLocations.Get(fileName)
+	if !ok || int64(len(blockMap)) <= numBlocks {
+		return
+	}
+
+	// Rows before numBlocks are left empty, so the delete only goes to the appended blocks
+	appended := make([][]string, len(blockMap))
+	copy(appended[numBlocks:], blockMap[numBlocks:])
+	BlockLocations.Set(fileName, blockMap[:numBlocks:numBlocks])
+	if sizes, ok := BlockStoredSizes.Get(fileName); ok && int64(len(sizes)) > numBlocks {
+		BlockStoredSizes.Set(fileName, sizes[:numBlocks:numBlocks])
+	}
+	go InitiateDeleteCommand(fileName, appended)
+}
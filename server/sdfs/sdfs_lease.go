@@ -0,0 +1,280 @@
+package sdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// The leader hands out leases on SDFS paths: any number of readers, or a single writer. Requests for a path are granted
+// in arrival order, so a waiting writer holds back readers that come after it and can't be starved. A lease lapses
+// LEASE_DURATION after it was granted or last renewed, which frees the path when its holder dies. Leases live only in
+// the leader's memory, so a new leader starts out with none.
+
+const LEASE_DURATION = 30 * time.Second
+const LEASE_WAIT_TIMEOUT = 5 * time.Minute
+
+type leaseRequest struct {
+	id      string
+	mode    utils.LeaseMode
+	granted chan struct{} // Closed once the lease is held
+}
+
+type fileLeases struct {
+	mode    utils.LeaseMode      // Mode of the current holders
+	holders map[string]time.Time // lease id : when it lapses
+	queue   []*leaseRequest      // Requests waiting for the path, oldest first
+}
+
+var leaseMu sync.Mutex
+var leases = make(map[string]*fileLeases) // clean path : leases on it
+
+func HandleLeaseOp(task utils.Task, conn *net.Conn) error {
+	path := utils.CleanPath(utils.BytesToString(task.FileName[:]))
+
+	switch task.ConnectionOperation {
+	case utils.LEASE_ACQUIRE:
+		return HandleLeaseAcquire(path, task.LeaseMode, conn)
+	case utils.LEASE_RENEW:
+		return replyLeader(conn, RenewLease(path, task.LeaseId))
+	case utils.LEASE_RELEASE:
+		ReleaseLease(path, task.LeaseId)
+		return replyLeader(conn, nil)
+	}
+	return fmt.Errorf("unknown lease operation %d", task.ConnectionOperation)
+}
+
+func replyLeader(conn *net.Conn, err error) error {
+	var reply utils.LeaderReply
+	if err != nil {
+		reply.Error, reply.Code = err.Error(), utils.ErrorCodeOf(err)
+	}
+	return utils.SendReply(*conn, reply)
+}
+
+// Waits for a lease on path and replies with it, or with an error after LEASE_WAIT_TIMEOUT
+func HandleLeaseAcquire(path string, mode utils.LeaseMode, conn *net.Conn) error {
+	var grant utils.LeaseGrant
+	if mode != utils.READ_LEASE && mode != utils.WRITE_LEASE {
+		grant.Error = fmt.Sprintf("invalid lease mode %d", mode)
+		return utils.SendReply(*conn, grant)
+	}
+
+	request := &leaseRequest{id: utils.NewFileId(), mode: mode, granted: make(chan struct{})}
+
+	leaseMu.Lock()
+	state, ok := leases[path]
+	if !ok {
+		state = &fileLeases{holders: make(map[string]time.Time)}
+		leases[path] = state
+	}
+	state.queue = append(state.queue, request)
+	grantWaiting(path)
+	leaseMu.Unlock()
+
+	select {
+	case <-request.granted:
+	case <-time.After(LEASE_WAIT_TIMEOUT):
+		if !cancelLeaseRequest(path, request) {
+			break // Granted just as the wait ran out
+		}
+		grant.Error = fmt.Sprintf("timed out waiting for a lease on %s", path)
+		return utils.SendReply(*conn, grant)
+	}
+
+	grant.LeaseId = request.id
+	grant.Duration = LEASE_DURATION
+	err := utils.SendReply(*conn, grant)
+	if err != nil {
+		ReleaseLease(path, request.id)
+	}
+	return err
+}
+
+// Drops lapsed leases on path, then grants waiting requests from the front of the queue for as long as they are
+// compatible with the holders. Caller holds leaseMu.
+func grantWaiting(path string) {
+	state, ok := leases[path]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for id, expiry := range state.holders {
+		if !now.Before(expiry) {
+			fmt.Printf("Lease %s on %s lapsed\n", id, path)
+			delete(state.holders, id)
+		}
+	}
+
+	for len(state.queue) > 0 {
+		next := state.queue[0]
+		if len(state.holders) > 0 && (state.mode == utils.WRITE_LEASE || next.mode == utils.WRITE_LEASE) {
+			break
+		}
+
+		state.queue = state.queue[1:]
+		state.mode = next.mode
+		state.holders[next.id] = now.Add(LEASE_DURATION)
+		close(next.granted)
+		time.AfterFunc(LEASE_DURATION, func() { expireLeases(path) })
+	}
+
+	if len(state.holders) == 0 && len(state.queue) == 0 {
+		delete(leases, path)
+	}
+}
+
+func expireLeases(path string) {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	grantWaiting(path)
+}
+
+// Takes a request that gave up waiting out of the queue. Returns false if it was granted in the meantime.
+func cancelLeaseRequest(path string, request *leaseRequest) bool {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+
+	select {
+	case <-request.granted:
+		return false
+	default:
+	}
+
+	state := leases[path]
+	for i, waiting := range state.queue {
+		if waiting == request {
+			state.queue = append(state.queue[:i], state.queue[i+1:]...)
+			break
+		}
+	}
+	grantWaiting(path) // Readers queued behind a cancelled writer may go ahead now
+	return true
+}
+
+func RenewLease(path string, leaseId string) error {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+
+	grantWaiting(path)
+	state, ok := leases[path]
+	if !ok {
+		return fmt.Errorf("lease %s on %s has lapsed", leaseId, path)
+	}
+	if _, held := state.holders[leaseId]; !held {
+		return fmt.Errorf("lease %s on %s has lapsed", leaseId, path)
+	}
+
+	state.holders[leaseId] = time.Now().Add(LEASE_DURATION)
+	time.AfterFunc(LEASE_DURATION, func() { expireLeases(path) })
+	return nil
+}
+
+func ReleaseLease(path string, leaseId string) {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+
+	if state, ok := leases[path]; ok {
+		delete(state.holders, leaseId)
+	}
+	grantWaiting(path)
+}
+
+// Client side
+
+// A lease held by this node. It is renewed in the background until Release is called, or the leader refuses a
+// renewal, after which the path may be leased to someone else.
+type Lease struct {
+	Path string
+	Id   string
+	Mode utils.LeaseMode
+	stop chan struct{}
+	lost chan struct{} // Closed once a renewal failed
+	err  error         // Why, set before lost is closed
+}
+
+// Blocks until the leader grants a lease on sdfsFilename
+func AcquireLease(ctx context.Context, sdfsFilename string, mode utils.LeaseMode) (*Lease, error) {
+	var grant utils.LeaseGrant
+	task := utils.Task{
+		ConnectionOperation: utils.LEASE_ACQUIRE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		LeaseMode:           mode,
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &grant)
+	if err != nil {
+		return nil, err
+	} else if grant.Error != "" {
+		return nil, errors.New(grant.Error)
+	}
+
+	lease := &Lease{Path: sdfsFilename, Id: grant.LeaseId, Mode: mode, stop: make(chan struct{}), lost: make(chan struct{})}
+	go lease.renew(grant.Duration)
+	return lease, nil
+}
+
+// Renews the lease well before it lapses, until it is released or the leader refuses
+func (lease *Lease) renew(duration time.Duration) {
+	ticker := time.NewTicker(duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := sendNamespaceRequest(context.Background(), utils.Task{
+			ConnectionOperation: utils.LEASE_RENEW,
+			FileName:            utils.New1024Byte(lease.Path),
+			LeaseId:             lease.Id,
+		})
+		if err != nil {
+			log.Printf("Lost lease on %s: %v\n", lease.Path, err)
+			lease.err = fmt.Errorf("lost lease on %s: %w", lease.Path, err)
+			close(lease.lost)
+			return
+		}
+	}
+}
+
+// Closed once the lease is lost
+func (lease *Lease) Done() <-chan struct{} {
+	return lease.lost
+}
+
+// Why the lease was lost, or nil while it is held
+func (lease *Lease) Err() error {
+	select {
+	case <-lease.lost:
+		return lease.err
+	default:
+		return nil
+	}
+}
+
+func (lease *Lease) Release() error {
+	close(lease.stop)
+	_, err := sendNamespaceRequest(context.Background(), utils.Task{
+		ConnectionOperation: utils.LEASE_RELEASE,
+		FileName:            utils.New1024Byte(lease.Path),
+		LeaseId:             lease.Id,
+	})
+	return err
+}
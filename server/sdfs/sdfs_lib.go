@@ -0,0 +1,553 @@
+package sdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Client is the SDFS API for Go programs. It goes through the leader the same way the CLI commands do, so it only
+// works in a process that has joined the cluster. Every call takes a context, which is checked before each step and
+// passed down to every request it makes. A call whose context ends while it waits on the network is cut short and
+// returns the context's error, though a request the leader already received may still take effect.
+type Client struct {
+	cluster Cluster
+}
+
+func NewClient() *Client {
+	return &Client{cluster: leaderCluster{}}
+}
+
+// A Client on another Cluster, such as the in memory one sdfstest has for tests
+func NewClusterClient(cluster Cluster) *Client {
+	return &Client{cluster: cluster}
+}
+
+// The requests a Client makes. Errors carry the utils.ErrorCode the leader sent, which Client maps to its Err values.
+type Cluster interface {
+	List(ctx context.Context, name string) (utils.ListReply, error)
+	Glob(ctx context.Context, pattern string) ([]string, error)
+	ContentSummary(ctx context.Context, name string) (utils.ContentSummary, error)
+	Remove(ctx context.Context, name string) error
+	Mkdir(ctx context.Context, dir string) error
+	RemoveDir(ctx context.Context, dir string, recursive bool) error
+	Rename(ctx context.Context, oldName string, newName string) error
+	Lease(ctx context.Context, name string, mode utils.LeaseMode) (LeaseHolder, error)
+	OpenRange(ctx context.Context, name string) (RangeSource, error)
+	Upload(ctx context.Context, name string, options utils.PutOptions, append bool) (Uploader, error)
+}
+
+// A held lease, like *Lease
+type LeaseHolder interface {
+	Err() error
+	Release() error
+}
+
+// Reads byte ranges of a file, like *RangeReader
+type RangeSource interface {
+	ReadRange(ctx context.Context, off int64, length int64, dst io.Writer) (int64, error)
+	Length(ctx context.Context) (int64, error)
+}
+
+// Writes a file as a stream, like *Upload
+type Uploader interface {
+	io.Writer
+	SetETag(etag string)
+	Commit() error
+	Abort() error
+}
+
+// Errors returned by Client unwrap to one of these when the failure is one of them, so callers can test with
+// errors.Is. Missing and existing files match the io/fs errors.
+var (
+	ErrNotExist    = fs.ErrNotExist
+	ErrExist       = fs.ErrExist
+	ErrClosed      = fs.ErrClosed
+	ErrIsDir       = errors.New("is a directory")
+	ErrNotDir      = errors.New("not a directory")
+	ErrNotEmpty    = errors.New("directory not empty")
+	ErrQuota       = errors.New("quota exceeded")
+	ErrUnavailable = errors.New("leader unavailable")
+)
+
+// A failed Client call, with the operation and the path it was on
+type Error struct {
+	Op   string
+	Path string
+	Kind error // One of the Err values, nil if the failure is none of them
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func wrapError(op string, name string, err error) error {
+	var sdfsErr *Error
+	if err == nil || errors.As(err, &sdfsErr) {
+		return err
+	}
+	return &Error{Op: op, Path: name, Kind: errorKind(err), Err: err}
+}
+
+// Maps the code the leader or a replica sent with an error to the matching Err value
+func errorKind(err error) error {
+	var unreachable *utils.LeaderUnreachableError
+	if errors.As(err, &unreachable) {
+		return ErrUnavailable
+	}
+
+	switch utils.ErrorCodeOf(err) {
+	case utils.ERR_NOT_EXIST:
+		return ErrNotExist
+	case utils.ERR_EXIST:
+		return ErrExist
+	case utils.ERR_IS_DIR:
+		return ErrIsDir
+	case utils.ERR_NOT_DIR:
+		return ErrNotDir
+	case utils.ERR_NOT_EMPTY:
+		return ErrNotEmpty
+	case utils.ERR_QUOTA:
+		return ErrQuota
+	}
+	return nil
+}
+
+// The cluster this process has joined, reached through the leader
+type leaderCluster struct{}
+
+func (leaderCluster) List(ctx context.Context, name string) (utils.ListReply, error) {
+	return InitiateListCommand(ctx, name)
+}
+
+func (leaderCluster) Glob(ctx context.Context, pattern string) ([]string, error) {
+	return RequestGlob(ctx, pattern)
+}
+
+func (leaderCluster) ContentSummary(ctx context.Context, name string) (utils.ContentSummary, error) {
+	return RequestContentSummary(ctx, name)
+}
+
+func (leaderCluster) Remove(ctx context.Context, name string) error {
+	return InitiateRemoveFileCommand(ctx, name)
+}
+
+func (leaderCluster) Mkdir(ctx context.Context, dir string) error {
+	return InitiateMkdirCommand(ctx, dir)
+}
+
+func (leaderCluster) RemoveDir(ctx context.Context, dir string, recursive bool) error {
+	return InitiateRmdirCommand(ctx, dir, recursive)
+}
+
+func (leaderCluster) Rename(ctx context.Context, oldName string, newName string) error {
+	return InitiateRenameCommand(ctx, oldName, newName)
+}
+
+// Like AcquireLease, but a lease granted after ctx ended is released instead of being renewed forever
+func (leaderCluster) Lease(ctx context.Context, name string, mode utils.LeaseMode) (LeaseHolder, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type grant struct {
+		lease *Lease
+		err   error
+	}
+	done := make(chan grant, 1)
+	go func() {
+		lease, err := AcquireLease(ctx, name, mode)
+		done <- grant{lease, err}
+	}()
+
+	select {
+	case result := <-done:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return result.lease, nil
+	case <-ctx.Done():
+		go func() {
+			if result := <-done; result.lease != nil {
+				result.lease.Release()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (leaderCluster) OpenRange(ctx context.Context, name string) (RangeSource, error) {
+	rangeReader, err := OpenRangeReader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return rangeReader, nil
+}
+
+func (leaderCluster) Upload(ctx context.Context, name string, options utils.PutOptions, append bool) (Uploader, error) {
+	var upload *Upload
+	var err error
+	if append {
+		upload, err = BeginAppendUpload(ctx, name)
+	} else {
+		upload, err = BeginUpload(ctx, name, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Describes a file or directory. It implements fs.FileInfo.
+type FileInfo struct {
+	entry utils.DirEntry
+}
+
+func (info *FileInfo) Name() string {
+	return info.entry.Name
+}
+
+func (info *FileInfo) Size() int64 {
+	return info.entry.Size
+}
+
+func (info *FileInfo) Mode() fs.FileMode {
+	if info.entry.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info *FileInfo) ModTime() time.Time {
+	if info.entry.ModTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, info.entry.ModTime)
+}
+
+func (info *FileInfo) IsDir() bool {
+	return info.entry.IsDir
+}
+
+// The leader's utils.DirEntry for the file
+func (info *FileInfo) Sys() any {
+	return info.entry
+}
+
+// Bytes one copy of the file takes on disk
+func (info *FileInfo) StoredSize() int64 {
+	return info.entry.StoredSize
+}
+
+// Copies of each block, 1 for erasure coded files
+func (info *FileInfo) Replicas() int64 {
+	return info.entry.Replicas
+}
+
+func (info *FileInfo) BlockSize() int64 {
+	return info.entry.BlockSize
+}
+
+// Entity tag the current version was written with, empty if its writer gave none
+func (info *FileInfo) ETag() string {
+	return info.entry.ETag
+}
+
+// When the leader deletes the file, zero if it never does
+func (info *FileInfo) Expires() time.Time {
+	if info.entry.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, info.entry.Expires)
+}
+
+func (c *Client) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	listing, err := c.cluster.List(ctx, name)
+	if err != nil {
+		return nil, wrapError("stat", name, err)
+	}
+
+	if listing.IsFile {
+		return &FileInfo{listing.Entries[0]}, nil
+	}
+	return &FileInfo{utils.DirEntry{Name: path.Base("/" + name), IsDir: true}}, nil
+}
+
+// Lists a directory sorted by name
+func (c *Client) List(ctx context.Context, dir string) ([]*FileInfo, error) {
+	listing, err := c.cluster.List(ctx, dir)
+	if err != nil {
+		return nil, wrapError("list", dir, err)
+	} else if listing.IsFile {
+		return nil, &Error{Op: "list", Path: dir, Kind: ErrNotDir, Err: ErrNotDir}
+	}
+
+	infos := make([]*FileInfo, len(listing.Entries))
+	for i, entry := range listing.Entries {
+		infos[i] = &FileInfo{entry}
+	}
+	return infos, nil
+}
+
+// Moves a file with all of its versions to the trash
+func (c *Client) Delete(ctx context.Context, name string) error {
+	lease, err := c.cluster.Lease(ctx, name, utils.WRITE_LEASE)
+	if err != nil {
+		return wrapError("delete", name, err)
+	}
+
+	defer lease.Release()
+
+	err = c.cluster.Remove(ctx, name)
+	return wrapError("delete", name, err)
+}
+
+// Totals for everything under a path, from a single request to the leader
+func (c *Client) ContentSummary(ctx context.Context, name string) (utils.ContentSummary, error) {
+	summary, err := c.cluster.ContentSummary(ctx, name)
+	return summary, wrapError("summary", name, err)
+}
+
+// Creates a directory and any missing parents
+func (c *Client) Mkdir(ctx context.Context, dir string) error {
+	err := c.cluster.Mkdir(ctx, dir)
+	return wrapError("mkdir", dir, err)
+}
+
+// Removes an empty directory, or with recursive moves every file under it to the trash first
+func (c *Client) RemoveDir(ctx context.Context, dir string, recursive bool) error {
+	err := c.cluster.RemoveDir(ctx, dir, recursive)
+	return wrapError("rmdir", dir, err)
+}
+
+// Moves a file or directory. Fails if newName exists.
+func (c *Client) Rename(ctx context.Context, oldName string, newName string) error {
+	err := c.cluster.Rename(ctx, oldName, newName)
+	return wrapError("rename", oldName, err)
+}
+
+// Reads len(p) bytes of a file starting at off, without keeping it open
+func (c *Client) ReadAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	reader, err := c.Open(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	return reader.ReadAt(p, off)
+}
+
+// Opens a file for reading. The reader holds a read lease until it is closed, so the file can't be replaced under it.
+func (c *Client) Open(ctx context.Context, name string) (*Reader, error) {
+	info, err := c.Stat(ctx, name)
+	if err != nil {
+		return nil, wrapError("open", name, err)
+	} else if info.IsDir() {
+		return nil, &Error{Op: "open", Path: name, Kind: ErrIsDir, Err: ErrIsDir}
+	}
+
+	lease, err := c.cluster.Lease(ctx, name, utils.READ_LEASE)
+	if err != nil {
+		return nil, wrapError("open", name, err)
+	}
+
+	rangeReader, err := c.cluster.OpenRange(ctx, name)
+	var size int64
+	if err == nil {
+		size, err = rangeReader.Length(ctx)
+	}
+	if err != nil {
+		lease.Release()
+		return nil, wrapError("open", name, err)
+	}
+
+	info.entry.Size = size
+	return &Reader{ctx: ctx, name: name, info: info, lease: lease, rangeReader: rangeReader}, nil
+}
+
+// Sequential reads fetch this much at a time, so small reads don't each cost a round trip to a replica
+const READ_AHEAD = 4 * utils.MB
+
+// Streams a file's contents. Reads only fetch the blocks covering them. A Reader is not safe for concurrent use,
+// except for ReadAt.
+type Reader struct {
+	ctx         context.Context
+	name        string
+	info        *FileInfo
+	lease       LeaseHolder
+	rangeReader RangeSource
+	offset      int64
+	ahead       []byte // Bytes fetched by Read, starting at aheadOffset
+	aheadOffset int64
+	closed      bool
+}
+
+func (r *Reader) Stat() (*FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if r.offset < r.aheadOffset || r.offset >= r.aheadOffset+int64(len(r.ahead)) {
+		size := utils.GetMaxInt64(int64(len(p)), READ_AHEAD)
+		size = utils.GetMinInt64(size, r.info.Size()-r.offset)
+		if size <= 0 {
+			return 0, io.EOF
+		}
+
+		chunk := make([]byte, size)
+		n, err := r.ReadAt(chunk, r.offset)
+		if n == 0 {
+			return 0, err
+		}
+		r.ahead, r.aheadOffset = chunk[:n], r.offset
+	}
+
+	n := copy(p, r.ahead[r.offset-r.aheadOffset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if r.closed {
+		return 0, &Error{Op: "read", Path: r.name, Kind: ErrClosed, Err: ErrClosed}
+	} else if off < 0 {
+		return 0, &Error{Op: "read", Path: r.name, Err: errors.New("negative offset")}
+	} else if off >= r.info.Size() {
+		return 0, io.EOF
+	}
+
+	// The range is read into its own buffer, so a failed read leaves p untouched
+	var buf bytes.Buffer
+	_, err := r.rangeReader.ReadRange(r.ctx, off, int64(len(p)), &buf)
+	if err != nil {
+		return 0, wrapError("read", r.name, err)
+	}
+
+	n := copy(p, buf.Bytes())
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.Size()
+	}
+	if offset < 0 {
+		return 0, &Error{Op: "seek", Path: r.name, Err: errors.New("negative position")}
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Releases the read lease
+func (r *Reader) Close() error {
+	if r.closed {
+		return &Error{Op: "close", Path: r.name, Kind: ErrClosed, Err: ErrClosed}
+	}
+	r.closed = true
+	return wrapError("close", r.name, r.lease.Release())
+}
+
+// Creates a file, or a new version of an existing one, holding a write lease until the writer is closed or aborted.
+// What is written goes out a block at a time as each one fills, and readers keep seeing the file as it was until
+// Close.
+func (c *Client) Create(ctx context.Context, name string, options utils.PutOptions) (*Writer, error) {
+	return c.create(ctx, "create", name, options, false)
+}
+
+// Like Create, but what is written is appended to the file instead of replacing it. A missing file is created.
+func (c *Client) Append(ctx context.Context, name string) (*Writer, error) {
+	return c.create(ctx, "append", name, utils.PutOptions{}, true)
+}
+
+func (c *Client) create(ctx context.Context, op string, name string, options utils.PutOptions, append bool) (*Writer, error) {
+	lease, err := c.cluster.Lease(ctx, name, utils.WRITE_LEASE)
+	if err != nil {
+		return nil, wrapError(op, name, err)
+	}
+
+	upload, err := c.cluster.Upload(ctx, name, options, append)
+	if err != nil {
+		lease.Release()
+		return nil, wrapError(op, name, err)
+	}
+
+	return &Writer{name: name, lease: lease, upload: upload}, nil
+}
+
+// Writes a new version of a file, or appends to it. A Writer is not safe for concurrent use.
+type Writer struct {
+	name   string
+	lease  LeaseHolder
+	upload Uploader
+	closed bool
+}
+
+// Buffers p, sending each block of the file as it fills. After a failed write the writer can only be aborted, and
+// Close aborts it too.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, &Error{Op: "write", Path: w.name, Kind: ErrClosed, Err: ErrClosed}
+	}
+
+	n, err := w.upload.Write(p)
+	return n, wrapError("write", w.name, err)
+}
+
+// Sends what is still buffered, makes the file's new contents visible, and releases the write lease. Close waits
+// for the leader to commit the new contents, which it asks for even if the context ended, once all the data was
+// sent. If the write lease was lost, Close aborts instead. On an error the file is left as it was, unless the leader
+// failed while committing, when either outcome is possible.
+func (w *Writer) Close() error {
+	if w.closed {
+		return &Error{Op: "close", Path: w.name, Kind: ErrClosed, Err: ErrClosed}
+	}
+	w.closed = true
+
+	defer w.lease.Release()
+	if err := w.lease.Err(); err != nil {
+		w.upload.Abort()
+		return wrapError("close", w.name, err)
+	}
+	return wrapError("close", w.name, w.upload.Commit())
+}
+
+// Has Close record etag as the entity tag of the new contents, which Stat and List then report
+func (w *Writer) SetETag(etag string) {
+	w.upload.SetETag(etag)
+}
+
+// Discards what was written and releases the write lease, leaving the file as it was
+func (w *Writer) Abort() error {
+	if w.closed {
+		return &Error{Op: "abort", Path: w.name, Kind: ErrClosed, Err: ErrClosed}
+	}
+	w.closed = true
+
+	defer w.lease.Release()
+	return wrapError("abort", w.name, w.upload.Abort())
+}
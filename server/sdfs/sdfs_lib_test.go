@@ -0,0 +1,288 @@
+package sdfs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfstest"
+)
+
+// A cluster whose listings fail with err
+type failingCluster struct {
+	*sdfstest.Cluster
+	err error
+}
+
+func (c failingCluster) List(ctx context.Context, name string) (utils.ListReply, error) {
+	return utils.ListReply{}, c.err
+}
+
+func TestErrorCodes(t *testing.T) {
+	kinds := []error{sdfs.ErrNotExist, sdfs.ErrExist, sdfs.ErrIsDir, sdfs.ErrNotDir, sdfs.ErrNotEmpty, sdfs.ErrQuota, sdfs.ErrUnavailable}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"not exist", utils.Errorf(utils.ERR_NOT_EXIST, "a does not exist"), sdfs.ErrNotExist},
+		{"exist", utils.Errorf(utils.ERR_EXIST, "a already exists"), sdfs.ErrExist},
+		{"is dir", utils.Errorf(utils.ERR_IS_DIR, "a is a directory"), sdfs.ErrIsDir},
+		{"not dir", utils.Errorf(utils.ERR_NOT_DIR, "a is a file"), sdfs.ErrNotDir},
+		{"not empty", utils.Errorf(utils.ERR_NOT_EMPTY, "a is not empty"), sdfs.ErrNotEmpty},
+		{"quota", utils.Errorf(utils.ERR_QUOTA, "quota of a exceeded"), sdfs.ErrQuota},
+		{"unreachable", &utils.LeaderUnreachableError{Err: errors.New("connection refused")}, sdfs.ErrUnavailable},
+		{"unknown code", utils.Errorf(utils.ERR_UNKNOWN, "a does not exist"), nil},
+		{"uncoded", errors.New("a does not exist"), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := sdfs.NewClusterClient(failingCluster{sdfstest.NewCluster(), test.err})
+			_, err := client.Stat(context.Background(), "a")
+
+			var sdfsErr *sdfs.Error
+			if !errors.As(err, &sdfsErr) || sdfsErr.Op != "stat" || sdfsErr.Path != "a" {
+				t.Fatalf("Stat error %#v is not an *Error for stat a", err)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("Stat error %v does not wrap %v", err, test.err)
+			}
+			for _, kind := range kinds {
+				if errors.Is(err, kind) != (kind == test.want) {
+					t.Errorf("errors.Is(%v, %v) = %v", err, kind, !(kind == test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	client, cluster := sdfstest.NewClient()
+	cluster.WriteFile("dir/file", []byte("data"))
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"stat missing", func() error { _, err := client.Stat(ctx, "missing"); return err }, sdfs.ErrNotExist},
+		{"open missing", func() error { _, err := client.Open(ctx, "dir/missing"); return err }, sdfs.ErrNotExist},
+		{"open directory", func() error { _, err := client.Open(ctx, "dir"); return err }, sdfs.ErrIsDir},
+		{"list file", func() error { _, err := client.List(ctx, "dir/file"); return err }, sdfs.ErrNotDir},
+		{"create over directory", func() error { _, err := client.Create(ctx, "dir", utils.PutOptions{}); return err }, sdfs.ErrIsDir},
+		{"mkdir under file", func() error { return client.Mkdir(ctx, "dir/file/sub") }, sdfs.ErrNotDir},
+		{"rename onto file", func() error { return client.Rename(ctx, "dir", "dir/file") }, sdfs.ErrExist},
+		{"remove non empty", func() error { return client.RemoveDir(ctx, "dir", false) }, sdfs.ErrNotEmpty},
+		{"delete directory", func() error { return client.Delete(ctx, "dir") }, sdfs.ErrIsDir},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	if held := cluster.HeldLeases(); held != 0 {
+		t.Errorf("%d leases left held by failed calls", held)
+	}
+}
+
+func openTestFile(t *testing.T, data []byte) (*sdfs.Reader, *sdfstest.Cluster) {
+	t.Helper()
+	client, cluster := sdfstest.NewClient()
+	if err := cluster.WriteFile("file", data); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := client.Open(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader, cluster
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestReader(t *testing.T) {
+	for _, size := range []int{0, 1, 1000, int(sdfs.READ_AHEAD) + 1000} {
+		data := testData(size)
+		reader, _ := openTestFile(t, data)
+		if err := iotest.TestReader(reader, data); err != nil {
+			t.Errorf("%d byte file: %v", size, err)
+		}
+		reader.Close()
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	data := testData(100)
+	tests := []struct {
+		name    string
+		offset  int64
+		whence  int
+		want    int64
+		wantErr bool
+	}{
+		{"start", 10, io.SeekStart, 10, false},
+		{"current", 5, io.SeekCurrent, 25, false},
+		{"current back", -15, io.SeekCurrent, 5, false},
+		{"end", -10, io.SeekEnd, 90, false},
+		{"past end", 50, io.SeekEnd, 150, false},
+		{"negative", -1, io.SeekStart, 0, true},
+		{"before start", -101, io.SeekEnd, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, _ := openTestFile(t, data)
+			defer reader.Close()
+			reader.Seek(20, io.SeekStart)
+
+			pos, err := reader.Seek(test.offset, test.whence)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Seek(%d, %d) = %d, want an error", test.offset, test.whence, pos)
+				}
+				return
+			} else if err != nil || pos != test.want {
+				t.Fatalf("Seek(%d, %d) = %d, %v, want %d", test.offset, test.whence, pos, err, test.want)
+			}
+
+			got, err := io.ReadAll(reader)
+			want := data[utils.GetMinInt64(test.want, int64(len(data))):]
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes after seeking to %d, %v, want %d", len(got), pos, err, len(want))
+			}
+		})
+	}
+}
+
+func TestReaderReadAt(t *testing.T) {
+	data := testData(100)
+	tests := []struct {
+		name    string
+		off     int64
+		length  int
+		wantN   int
+		wantErr error
+	}{
+		{"whole file", 0, 100, 100, nil},
+		{"middle", 40, 20, 20, nil},
+		{"short at end", 90, 20, 10, io.EOF},
+		{"at end", 100, 10, 0, io.EOF},
+		{"past end", 200, 10, 0, io.EOF},
+		{"empty", 50, 0, 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, _ := openTestFile(t, data)
+			defer reader.Close()
+
+			p := make([]byte, test.length)
+			n, err := reader.ReadAt(p, test.off)
+			if n != test.wantN || err != test.wantErr {
+				t.Fatalf("ReadAt(%d bytes, %d) = %d, %v, want %d, %v", test.length, test.off, n, err, test.wantN, test.wantErr)
+			}
+			if n > 0 && !bytes.Equal(p[:n], data[test.off:test.off+int64(n)]) {
+				t.Errorf("ReadAt(%d bytes, %d) read the wrong bytes", test.length, test.off)
+			}
+		})
+	}
+
+	t.Run("negative", func(t *testing.T) {
+		reader, _ := openTestFile(t, data)
+		defer reader.Close()
+		if _, err := reader.ReadAt(make([]byte, 1), -1); err == nil {
+			t.Error("ReadAt at a negative offset succeeded")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		reader, cluster := openTestFile(t, data)
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		} else if held := cluster.HeldLeases(); held != 0 {
+			t.Errorf("Close left %d leases held", held)
+		}
+
+		if _, err := reader.ReadAt(make([]byte, 1), 0); !errors.Is(err, sdfs.ErrClosed) {
+			t.Errorf("ReadAt after Close = %v, want ErrClosed", err)
+		}
+		if err := reader.Close(); !errors.Is(err, sdfs.ErrClosed) {
+			t.Errorf("second Close = %v, want ErrClosed", err)
+		}
+	})
+}
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	client, cluster := sdfstest.NewClient()
+	cluster.WriteFile("file", []byte("old"))
+
+	writer, err := client.Create(ctx, "file", utils.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("discarded"))
+	if err := writer.Abort(); err != nil {
+		t.Fatal(err)
+	} else if data, _ := cluster.ReadFile("file"); string(data) != "old" {
+		t.Errorf("aborted writer changed the file to %q", data)
+	}
+
+	writer, err = client.Append(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(" and "))
+	writer.Write([]byte("new"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	} else if data, _ := cluster.ReadFile("file"); string(data) != "old and new" {
+		t.Errorf("appended file holds %q", data)
+	}
+
+	if _, err := writer.Write([]byte("late")); !errors.Is(err, sdfs.ErrClosed) {
+		t.Errorf("Write after Close = %v, want ErrClosed", err)
+	}
+	if held := cluster.HeldLeases(); held != 0 {
+		t.Errorf("%d leases left held", held)
+	}
+}
+
+func TestWriterLostLease(t *testing.T) {
+	ctx := context.Background()
+	client, cluster := sdfstest.NewClient()
+	cluster.WriteFile("file", []byte("old"))
+
+	writer, err := client.Append(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(" and new"))
+	cluster.LoseLeases()
+	if err := writer.Close(); err == nil {
+		t.Error("Close after the lease was lost succeeded")
+	} else if data, _ := cluster.ReadFile("file"); string(data) != "old" {
+		t.Errorf("Close after the lease was lost changed the file to %q", data)
+	}
+	if held := cluster.HeldLeases(); held != 0 {
+		t.Errorf("%d leases left held", held)
+	}
+}
@@ -1,6 +1,7 @@
 package sdfs
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -16,8 +17,10 @@ func InitializeSdfsProcess() {
 	os.RemoveAll(dirPath)
 	os.Mkdir(dirPath, os.ModePerm)
 
-	// Initialize set of which files are being written/read from. This is to avoid concurrent access of file pointers.
-	utils.FileSet = make(map[string]bool)
+	os.Mkdir(utils.BLOCK_TEMP_DIR, os.ModePerm)
+
+	go RunTrashExpiry()
+	go RunTTLExpiry()
 
 	tcpConn, listenError := utils.ListenOnTCPConnection(utils.SDFS_PORT)
 	if listenError != nil {
@@ -38,22 +41,48 @@ func InitializeSdfsProcess() {
 			continue
 		}
 
-		go HandleConnection(conn)
+		// A failed request only costs its own connection
+		go func() {
+			err := HandleConnection(conn)
+			if err != nil {
+				fmt.Printf("Request from %s failed: %v\n", conn.RemoteAddr().String(), err)
+			}
+			conn.Close()
+		}()
 	}
 }
 
-func HandleConnection(conn net.Conn) {
+func HandleConnection(conn net.Conn) error {
 
 	// Decode the FollowerTask instance
-	task, _ := utils.Unmarshal(conn)
-	// defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(utils.REQUEST_READ_TIMEOUT))
+	task, _, err := utils.Unmarshal(conn)
+	if err != nil {
+		return err
+	}
+
+	// Replies and data on this connection answer the task's request, and must finish before its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), utils.OpTimeout(task.ConnectionOperation))
+	defer cancel()
+	requestConn := utils.NewRequestConn(conn, task)
+	requestConn.Watch(ctx, utils.OpDeadline(ctx, task.ConnectionOperation))
+	conn = requestConn
 
 	// if task.isack && we're a master node, spawn a seperate master.handleAck
 	if task.IsAck {
 		fmt.Println("Recieved new ack connection!")
 		machineType := gossiputils.MachineType()
 
-		if machineType == gossiputils.LEADER && task.ConnectionOperation != utils.GET_2D && task.ConnectionOperation != utils.GET_PREFIX && task.ConnectionOperation != utils.SIZE_BY_PREFIX {
+		isWriteAck := machineType == gossiputils.LEADER && task.ConnectionOperation == utils.WRITE
+		if isWriteAck {
+			// A block over quota is rejected before any master records it
+			if err := CheckWriteQuota(*task); err != nil {
+				fmt.Println("Rejected write ack: ", err)
+				return utils.SendReply(conn, utils.LeaderReply{Error: err.Error(), Code: utils.ErrorCodeOf(err)})
+			}
+		}
+
+		if machineType == gossiputils.LEADER && !utils.IsLeaderQuery(task.ConnectionOperation) {
 			fmt.Printf("Recieved ack for %s at master\n", utils.BytesToString(task.FileName[:]))
 
 			RouteToSubMasters(*task)
@@ -61,67 +90,183 @@ func HandleConnection(conn net.Conn) {
 			fmt.Printf("Recieved ack for %s at SUBmaster\n", utils.BytesToString(task.FileName[:]))
 		}
 
-		HandleAck(*task, &conn)
+		err := HandleAck(*task, &conn)
+		if isWriteAck {
+			var reply utils.LeaderReply
+			if err != nil {
+				reply.Error, reply.Code = err.Error(), utils.ErrorCodeOf(err)
+			}
+			if replyErr := utils.SendReply(conn, reply); replyErr != nil {
+				return replyErr
+			}
+		}
+		return err
 
 	} else if task.ConnectionOperation == utils.DELETE {
-		HandleDeleteConnection(*task)
+		return HandleDeleteConnection(ctx, *task)
+	} else if task.ConnectionOperation == utils.WRITE && len(task.ReplicaChain) > 0 {
+		return HandlePipelinedWrite(ctx, *task, conn)
 	} else if task.ConnectionOperation == utils.WRITE || task.ConnectionOperation == utils.READ {
-		HandleStreamConnection(*task, conn)
+		return HandleStreamConnection(ctx, *task, conn)
+	} else if task.ConnectionOperation == utils.BLOCK_DIGEST {
+		return HandleDigestConnection(*task, conn)
+	} else if task.ConnectionOperation == utils.RECONSTRUCT {
+		return HandleReconstructConnection(ctx, *task)
 	} else if task.ConnectionOperation == utils.FORCE_GET {
 		startTime := time.Now()
 		fileName := utils.BytesToString(task.FileName[:])
-		locations, locationErr := SdfsClientMain(fileName, true)
+		// The forced get outlives the request that started it
+		locations, locationErr := SdfsClientMain(context.Background(), fileName, true)
 		if locationErr != nil {
 			fmt.Println("Error with sdfsclient main. Aborting Get command: ", locationErr)
-			return
+			return locationErr
 		}
-		InitiateGetCommand(fileName, fileName, locations)
+		InitiateGetCommand(context.Background(), fileName, fileName, locations, utils.GetOptions{})
 		elapsedTime := time.Since(startTime)
 		log.Printf("Force GET completed in: %s", elapsedTime)
 	} else {
-		fmt.Printf("Error: inbound task from ip %s has no specific type\n", conn.RemoteAddr().String())
+		return fmt.Errorf("inbound task from ip %s has no specific type", conn.RemoteAddr().String())
 	}
-	// conn.Close()
+	return nil
 }
 
-func CLIPut(localfilename string, sdfsFileName string) {
-	locations, locationErr := SdfsClientMain(sdfsFileName, true)
+// A put to an existing file adds a new version. The leader deletes the oldest one once the file has too many.
+func CLIPut(localfilename string, sdfsFileName string, options utils.PutOptions) {
+	lease, err := AcquireLease(context.Background(), sdfsFileName, utils.WRITE_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a write lease. Aborting Put command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	// Let writes to the current version settle first
+	_, locationErr := SdfsClientMain(context.Background(), sdfsFileName, true)
 	if locationErr != nil {
 		fmt.Println("Error with sdfsclient main. Aborting Put command: ", locationErr)
 		return
 	}
 
-	if len(locations) != 0 {
-		time.Sleep(time.Second)
-		InitiateDeleteCommand(sdfsFileName, locations)
+	InitiatePutCommand(localfilename, sdfsFileName, options)
+}
 
-		locations, locationErr = SdfsClientMain(sdfsFileName, true)
-		if locationErr != nil {
-			fmt.Println("Error with sdfsclient main. Aborting Put command: ", locationErr)
-			return
+// Lists a directory, or for a file prints where each of its blocks is stored
+func CLILs(sdfsPath string) {
+	listing, err := InitiateListCommand(context.Background(), sdfsPath)
+	if err != nil {
+		fmt.Println("ls failed: ", err)
+		return
+	}
+
+	if !listing.IsFile {
+		for _, entry := range listing.Entries {
+			if entry.IsDir {
+				fmt.Printf("%s/\n", entry.Name)
+			} else {
+				fmt.Printf("%s\t%d\t%d stored%s\n", entry.Name, entry.Size, entry.StoredSize, FormatLifetime(entry.Expires))
+			}
 		}
-		fmt.Println("mappings detected after delete: ", locations)
+		return
 	}
 
-	InitiatePutCommand(localfilename, sdfsFileName)
+	entry := listing.Entries[0]
+	fmt.Printf("%s\t%d\t%d stored%s\n", entry.Name, entry.Size, entry.StoredSize, FormatLifetime(entry.Expires))
+
+	mappings, mappingsErr := SdfsClientMain(context.Background(), sdfsPath, true)
+	if mappingsErr != nil {
+		fmt.Println("Error with sdfsclient main. Aborting ls command: ", mappingsErr)
+		return
+	}
+	InitiateLsCommand(mappings)
 }
 
-func CLIGet(sdfsFileName string, localfilename string) {
-	locations, locationErr := SdfsClientMain(sdfsFileName, false)
+// Has the leader and submasters rewrap every data key with the newest master key. The new key must be added to the
+// keyfile on every node first, and old keys kept until the rotation is done.
+func CLIRotateKey() {
+	err := utils.LoadMasterKeys()
+	if err != nil {
+		fmt.Println("rotate-key failed: ", err)
+		return
+	}
+
+	err = SendLeaderAck(context.Background(), utils.Task{ConnectionOperation: utils.ROTATE_KEY, IsAck: true})
+	if err != nil {
+		fmt.Println("rotate-key failed: ", err)
+		return
+	}
+	fmt.Println("Key rotation sent to the leader")
+}
+
+func CLIStat(sdfsFileName string) {
+	stat, err := RequestFileMetadata(context.Background(), sdfsFileName)
+	if err != nil {
+		fmt.Println("stat failed: ", err)
+		return
+	} else if !stat.Exists {
+		fmt.Printf("%s does not exist\n", sdfsFileName)
+		return
+	}
+
+	fmt.Printf("size: %d bytes\n", stat.Size)
+	fmt.Printf("stored: %d bytes per copy\n", stat.StoredSize)
+	if stat.Size > 0 && stat.StoredSize > 0 {
+		fmt.Printf("ratio: %.2fx\n", float64(stat.Size)/float64(stat.StoredSize))
+	}
+	fmt.Printf("policy: %s\n", stat.Metadata)
+	fmt.Printf("id: %s\n", stat.FileId)
+}
+
+// Unlike put, append keeps the existing blocks and only writes the new data
+func CLIAppend(localfilename string, sdfsFileName string) {
+	lease, err := AcquireLease(context.Background(), sdfsFileName, utils.WRITE_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a write lease. Aborting append command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	err = InitiateAppendCommand(context.Background(), lease, localfilename, sdfsFileName)
+	if err != nil {
+		fmt.Println("append failed: ", err)
+	}
+}
+
+func CLIGet(sdfsFileName string, localfilename string, options utils.GetOptions) {
+	lease, err := AcquireLease(context.Background(), sdfsFileName, utils.READ_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a read lease. Aborting Get command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	if options.Version > 0 {
+		version, err := FindVersion(sdfsFileName, options.Version)
+		if err != nil {
+			fmt.Println("Aborting Get command: ", err)
+			return
+		}
+		sdfsFileName = version.FileId // Storage ids resolve to themselves, so the rest of the get works on the version
+	}
+
+	locations, locationErr := SdfsClientMain(context.Background(), sdfsFileName, false)
 	if locationErr != nil {
 		fmt.Println("Error with sdfsclient main. Aborting Get command: ", locationErr)
 		return
 	}
 
-	InitiateGetCommand(sdfsFileName, localfilename, locations)
+	InitiateGetCommand(context.Background(), sdfsFileName, localfilename, locations, options)
 }
 
+// Deletes a file with all of its versions
 func CLIDelete(sdfsFileName string) {
-	locations, locationErr := SdfsClientMain(sdfsFileName, false)
-	if locationErr != nil {
-		fmt.Println("Error with sdfsclient main. Aborting Get command: ", locationErr)
+	lease, err := AcquireLease(context.Background(), sdfsFileName, utils.WRITE_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a write lease. Aborting delete command: ", err)
 		return
 	}
+	defer lease.Release()
 
-	InitiateDeleteCommand(sdfsFileName, locations)
+	err = InitiateRemoveFileCommand(context.Background(), sdfsFileName)
+	if err != nil {
+		fmt.Println("delete failed: ", err)
+	}
 }
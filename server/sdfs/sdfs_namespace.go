@@ -0,0 +1,754 @@
+package sdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// The leader's directory tree. Every file node keeps its last few versions, each with its own storage id, and all
+// block level metadata (BlockLocations, FileToSize, ...) and the block files on disk are keyed by that id. Moving or
+// renaming only touches the tree.
+
+const DEFAULT_NUM_VERSIONS = 5
+
+type NamespaceNode struct {
+	Name     string
+	IsDir    bool
+	Parent   *NamespaceNode
+	Children map[string]*NamespaceNode // Directories only
+
+	// Files only
+	Versions    []utils.VersionInfo // Oldest first, the last one is the current version
+	MaxVersions int64
+	NextVersion int64
+	Expires     int64 // Unix nanoseconds when the leader deletes the file, zero for never
+}
+
+var namespaceMu sync.RWMutex
+var namespaceRoot = newDirNode("", nil)
+var fileIdToNode = make(map[string]*NamespaceNode) // storage id of any version : file node
+
+func newDirNode(name string, parent *NamespaceNode) *NamespaceNode {
+	return &NamespaceNode{Name: name, IsDir: true, Parent: parent, Children: make(map[string]*NamespaceNode)}
+}
+
+func (node *NamespaceNode) Path() string {
+	if node.Parent == nil {
+		return ""
+	}
+	return path.Join(node.Parent.Path(), node.Name)
+}
+
+func (node *NamespaceNode) CurrentFileId() string {
+	if len(node.Versions) == 0 {
+		return ""
+	}
+	return node.Versions[len(node.Versions)-1].FileId
+}
+
+// When the current version was written, zero for a directory or a file that has none yet
+func (node *NamespaceNode) ModTime() int64 {
+	if len(node.Versions) == 0 {
+		return 0
+	}
+	return node.Versions[len(node.Versions)-1].Timestamp
+}
+
+func splitPath(cleanPath string) []string {
+	if cleanPath == "" {
+		return nil
+	}
+	return strings.Split(cleanPath, "/")
+}
+
+// Caller holds namespaceMu
+func lookupNode(cleanPath string) *NamespaceNode {
+	node := namespaceRoot
+	for _, part := range splitPath(cleanPath) {
+		if !node.IsDir {
+			return nil
+		}
+		node = node.Children[part]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Walks to a directory, creating missing ones on the way. Caller holds namespaceMu for writing.
+func makeDirs(cleanPath string) (*NamespaceNode, error) {
+	node := namespaceRoot
+	for _, part := range splitPath(cleanPath) {
+		child := node.Children[part]
+		if child == nil {
+			child = newDirNode(part, node)
+			node.Children[part] = child
+		} else if !child.IsDir {
+			return nil, utils.Errorf(utils.ERR_NOT_DIR, "%s is a file", child.Path())
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// Caller holds namespaceMu for writing
+func detachNode(node *NamespaceNode) {
+	if node.Parent != nil {
+		delete(node.Parent.Children, node.Name)
+		node.Parent = nil
+	}
+}
+
+// Storage ids of all files at or below node. Caller holds namespaceMu.
+func collectFileIds(node *NamespaceNode, fileIds []string) []string {
+	if !node.IsDir {
+		for _, version := range node.Versions {
+			fileIds = append(fileIds, version.FileId)
+		}
+		return fileIds
+	}
+	for _, child := range node.Children {
+		fileIds = collectFileIds(child, fileIds)
+	}
+	return fileIds
+}
+
+// Maps a path to the storage id of the file it names. Names that aren't in the namespace are taken to already be
+// storage ids, which is what followers send when they talk about blocks.
+func ResolveFileId(name string) string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	cleanPath := utils.CleanPath(name)
+	if IsSnapshotPath(cleanPath) {
+		snapshotName, filePath := splitSnapshotPath(cleanPath)
+		if snapshot, ok := snapshots[snapshotName]; ok {
+			if info, ok := snapshot.Files[filePath]; ok {
+				return info.FileId
+			}
+		}
+		return name
+	}
+
+	node := lookupNode(cleanPath)
+	if node != nil && !node.IsDir {
+		return node.CurrentFileId()
+	}
+	return name
+}
+
+// Makes cleanPath name a file, creating its parent directories. Returns the storage id the path refers to, which is
+// the existing current version unless overwrite is set. Overwriting adds fileId as a new version, and returns the ids
+// of versions that fell out of the file's history so their blocks can be deleted. exclusive refuses an existing file
+// instead. A non zero expires sets when the file is deleted, and an overwrite with none makes it permanent again.
+func CreateFileEntry(cleanPath string, fileId string, overwrite bool, exclusive bool, maxVersions int64, timestamp int64, expires int64) (string, []string, error) {
+	if cleanPath == "" {
+		return "", nil, errors.New("cannot create a file at the root directory")
+	}
+
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	parent, err := makeDirs(path.Dir("/" + cleanPath)[1:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := path.Base(cleanPath)
+	node := parent.Children[name]
+	if node != nil && node.IsDir {
+		return "", nil, utils.Errorf(utils.ERR_IS_DIR, "%s is a directory", cleanPath)
+	} else if node != nil && exclusive && len(node.Versions) > 0 {
+		return "", nil, utils.Errorf(utils.ERR_EXIST, "%s already exists", cleanPath)
+	} else if node != nil && !overwrite && len(node.Versions) > 0 {
+		if expires > 0 {
+			node.Expires = expires
+		}
+		return node.CurrentFileId(), nil, nil
+	}
+
+	if node == nil {
+		node = &NamespaceNode{Name: name, Parent: parent, MaxVersions: DEFAULT_NUM_VERSIONS, NextVersion: 1}
+		parent.Children[name] = node
+	}
+	if maxVersions > 0 {
+		node.MaxVersions = maxVersions
+	}
+	if overwrite || expires > 0 {
+		node.Expires = expires
+	}
+
+	node.Versions = append(node.Versions, utils.VersionInfo{Version: node.NextVersion, FileId: fileId, Timestamp: timestamp})
+	node.NextVersion++
+	fileIdToNode[fileId] = node
+
+	var expiredIds []string
+	for int64(len(node.Versions)) > node.MaxVersions {
+		expiredIds = append(expiredIds, node.Versions[0].FileId)
+		delete(fileIdToNode, node.Versions[0].FileId)
+		node.Versions = node.Versions[1:]
+	}
+
+	return fileId, expiredIds, nil
+}
+
+// Moves a file and all of its versions from the tree into the trash, under trashId
+func RemoveFile(cleanPath string, trashId string, timestamp int64) error {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	node := lookupNode(cleanPath)
+	if node == nil {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	} else if node.IsDir {
+		return utils.Errorf(utils.ERR_IS_DIR, "%s is a directory", cleanPath)
+	}
+
+	trashNode(node, trashId, timestamp)
+	return nil
+}
+
+// Drops the version fileId from the file at cleanPath, after a put that created it failed. The version before it
+// becomes current again, and a file with no versions left is removed, since the put is what created it.
+func RemoveVersion(cleanPath string, fileId string) error {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	node, ok := fileIdToNode[fileId]
+	if !ok || node.Path() != cleanPath {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s has no version %s", cleanPath, fileId)
+	}
+
+	unlinkVersion(node, fileId)
+	return nil
+}
+
+// Versions of a file, oldest first, with their sizes
+func ListVersions(cleanPath string) ([]utils.VersionInfo, error) {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	node := lookupNode(cleanPath)
+	if node == nil {
+		return nil, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	} else if node.IsDir {
+		return nil, utils.Errorf(utils.ERR_IS_DIR, "%s is a directory", cleanPath)
+	}
+
+	versions := append([]utils.VersionInfo{}, node.Versions...)
+	for i := range versions {
+		versions[i].Size, _ = FileToSize.Get(versions[i].FileId)
+	}
+	return versions, nil
+}
+
+// Drops a version whose blocks are all gone. The path goes away with its last version.
+func RemoveNamespaceEntry(fileId string) {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	if node, ok := fileIdToNode[fileId]; ok {
+		unlinkVersion(node, fileId)
+	}
+}
+
+// Drops one version of a file, and the file itself once it has none left. Caller holds namespaceMu.
+func unlinkVersion(node *NamespaceNode, fileId string) {
+	delete(fileIdToNode, fileId)
+
+	for i, version := range node.Versions {
+		if version.FileId == fileId {
+			node.Versions = append(node.Versions[:i], node.Versions[i+1:]...)
+			break
+		}
+	}
+	if len(node.Versions) == 0 {
+		detachNode(node)
+	}
+}
+
+func MakeDirectory(cleanPath string) error {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	_, err := makeDirs(cleanPath)
+	return err
+}
+
+// Removes a directory, which must be empty unless recursive is set. Every file that was under it goes to the trash
+// on its own, with trash ids trashId-0, trashId-1, ... in path order.
+func RemoveDirectory(cleanPath string, recursive bool, trashId string, timestamp int64) error {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	node := lookupNode(cleanPath)
+	if cleanPath == "" {
+		return errors.New("cannot remove the root directory")
+	} else if node == nil {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	} else if !node.IsDir {
+		return utils.Errorf(utils.ERR_NOT_DIR, "%s is not a directory", cleanPath)
+	} else if len(node.Children) > 0 && !recursive {
+		return utils.Errorf(utils.ERR_NOT_EMPTY, "%s is not empty", cleanPath)
+	}
+
+	filePaths := collectFilePaths(node, nil)
+	sort.Strings(filePaths)
+	for i, filePath := range filePaths {
+		trashNode(lookupNode(filePath), fmt.Sprintf("%s-%d", trashId, i), timestamp)
+	}
+	detachNode(node)
+
+	return nil
+}
+
+// Moves a file or directory. Moving onto an existing directory moves the source into it, an existing file at the
+// destination is an error. Only the tree changes, so the move is atomic and no block is touched.
+func RenameEntry(srcPath string, dstPath string) error {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	src := lookupNode(srcPath)
+	if srcPath == "" {
+		return errors.New("cannot move the root directory")
+	} else if src == nil {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", srcPath)
+	}
+
+	if dst := lookupNode(dstPath); dst != nil && dst.IsDir {
+		dstPath = path.Join(dstPath, src.Name)
+	}
+	if dstPath == "" || lookupNode(dstPath) != nil {
+		return utils.Errorf(utils.ERR_EXIST, "%s already exists", dstPath)
+	} else if src.IsDir && strings.HasPrefix(dstPath+"/", srcPath+"/") {
+		return fmt.Errorf("cannot move %s into itself", srcPath)
+	}
+
+	parent := lookupNode(path.Dir("/" + dstPath)[1:])
+	if parent == nil || !parent.IsDir {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "parent directory of %s does not exist", dstPath)
+	}
+
+	detachNode(src)
+	src.Name = path.Base(dstPath)
+	src.Parent = parent
+	parent.Children[src.Name] = src
+
+	return nil
+}
+
+// Lists a directory sorted by name, or describes a single file
+func ListDirectory(cleanPath string) (utils.ListReply, error) {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	var reply utils.ListReply
+	node := lookupNode(cleanPath)
+	if node == nil {
+		return reply, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	}
+
+	if !node.IsDir {
+		reply.IsFile = true
+		reply.Entries = []utils.DirEntry{fileEntry(node)}
+		return reply, nil
+	}
+
+	reply.Entries = make([]utils.DirEntry, 0, len(node.Children))
+	for _, child := range node.Children {
+		entry := utils.DirEntry{Name: child.Name, IsDir: true}
+		if !child.IsDir {
+			entry = fileEntry(child)
+		}
+		reply.Entries = append(reply.Entries, entry)
+	}
+	sort.Slice(reply.Entries, func(i, j int) bool { return reply.Entries[i].Name < reply.Entries[j].Name })
+
+	return reply, nil
+}
+
+// Caller holds namespaceMu
+func fileEntry(node *NamespaceNode) utils.DirEntry {
+	fileId := node.CurrentFileId()
+	metadata, _ := FileToMetadata.Get(fileId)
+	size, _ := FileToSize.Get(fileId)
+	return utils.DirEntry{
+		Name:       node.Name,
+		Size:       size,
+		StoredSize: StoredSize(fileId),
+		Expires:    node.Expires,
+		ModTime:    node.ModTime(),
+		Replicas:   metadata.Replicas(),
+		BlockSize:  metadata.BlockBytes(),
+		ETag:       metadata.ETag,
+	}
+}
+
+// Counts the directories, files and bytes under a path, the way quotas count them
+func SummarizePath(cleanPath string) (utils.ContentSummary, error) {
+	var summary utils.ContentSummary
+	namespaceMu.RLock()
+	node := lookupNode(cleanPath)
+	if node != nil {
+		summarizeNode(node, &summary)
+	}
+	namespaceMu.RUnlock()
+
+	if node == nil {
+		return summary, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	}
+
+	// Checking quotas takes namespaceMu after quotaMu, so this can't hold namespaceMu
+	if node.IsDir && cleanPath != "" {
+		summary.Quota, _ = QuotaOn(cleanPath + "/")
+	}
+	return summary, nil
+}
+
+// Caller holds namespaceMu
+func summarizeNode(node *NamespaceNode, summary *utils.ContentSummary) {
+	if node.IsDir {
+		summary.Directories++
+		for _, child := range node.Children {
+			summarizeNode(child, summary)
+		}
+		return
+	}
+
+	summary.Files++
+	size, _ := FileToSize.Get(node.CurrentFileId())
+	summary.Length += size
+	for _, version := range node.Versions {
+		metadata, _ := FileToMetadata.Get(version.FileId)
+		summary.SpaceConsumed += StoredSize(version.FileId) * metadata.Replicas()
+	}
+}
+
+// Paths of every file in the namespace
+func AllFilePaths() []string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	return collectFilePaths(namespaceRoot, nil)
+}
+
+// Caller holds namespaceMu
+func collectFilePaths(node *NamespaceNode, paths []string) []string {
+	if !node.IsDir {
+		return append(paths, node.Path())
+	}
+	for _, child := range node.Children {
+		paths = collectFilePaths(child, paths)
+	}
+	return paths
+}
+
+// Applies a namespace request. On the leader the request is then forwarded to the submasters with its outcome filled
+// in, and any blocks it orphaned are deleted.
+func HandleNamespaceOp(task utils.Task, conn *net.Conn) error {
+	var reply utils.LeaderReply
+	var err error
+	var orphanedIds []string
+	fileName := utils.CleanPath(utils.BytesToString(task.FileName[:]))
+
+	isWrite := task.ConnectionOperation == utils.CREATE_FILE || task.ConnectionOperation == utils.REMOVE_FILE ||
+		task.ConnectionOperation == utils.MKDIR || task.ConnectionOperation == utils.RMDIR || task.ConnectionOperation == utils.RENAME
+	if isWrite && (IsSnapshotPath(fileName) || (task.ConnectionOperation == utils.RENAME && IsSnapshotPath(utils.CleanPath(task.TargetName)))) {
+		reply.Error = "snapshots are read only, and names starting with " + SNAPSHOT_PATH_PREFIX + " are reserved for them"
+		return utils.SendReply(*conn, reply)
+	}
+
+	switch task.ConnectionOperation {
+	case utils.CREATE_FILE:
+		if task.Timestamp == 0 {
+			task.Timestamp = time.Now().UnixNano()
+		}
+		if gossiputils.MachineType() == gossiputils.LEADER {
+			if err = CheckCreateQuota(fileName, task); err != nil {
+				break
+			}
+		}
+		var expires int64
+		if task.TTL > 0 {
+			expires = task.Timestamp + int64(task.TTL)
+		}
+		var expiredIds []string
+		reply.FileId, expiredIds, err = CreateFileEntry(fileName, task.FileId, task.Overwrite, task.Exclusive, task.Versions, task.Timestamp, expires)
+		orphanedIds = append(orphanedIds, expiredIds...)
+		if err == nil && reply.FileId == task.FileId {
+			// A new version can be opened before its first block is acked, and an empty one never has a block
+			FileToMetadata.Set(reply.FileId, task.Metadata)
+			FileToSize.Set(reply.FileId, 0)
+		}
+		task.FileId = reply.FileId // Submasters must end up with the id the leader settled on
+	case utils.REMOVE_FILE, utils.RMDIR:
+		if task.Timestamp == 0 {
+			task.Timestamp = time.Now().UnixNano()
+			task.FileId = utils.NewFileId() // Trash id, submasters must use the same one
+		}
+		if task.ConnectionOperation == utils.REMOVE_FILE {
+			err = RemoveFile(fileName, task.FileId, task.Timestamp)
+		} else {
+			err = RemoveDirectory(fileName, task.Recursive, task.FileId, task.Timestamp)
+		}
+	case utils.ABORT_CREATE:
+		err = RemoveVersion(fileName, task.FileId)
+		orphanedIds = append(orphanedIds, task.FileId)
+	case utils.MKDIR:
+		err = MakeDirectory(fileName)
+	case utils.UNDELETE:
+		err = UndeleteFile(fileName, task.TargetName)
+	case utils.TRASH_PURGE:
+		orphanedIds, err = PurgeTrash(fileName, task.TargetName)
+	case utils.TRASH_LIST:
+		return utils.SendReply(*conn, utils.TrashReply{Entries: ListTrash()})
+	case utils.RENAME:
+		err = RenameEntry(fileName, utils.CleanPath(task.TargetName))
+	case utils.SNAPSHOT_CREATE:
+		if task.Timestamp == 0 {
+			task.Timestamp = time.Now().UnixNano()
+		}
+		err = CreateSnapshot(fileName, strings.TrimPrefix(strings.TrimSpace(task.TargetName), "/"), task.Timestamp)
+	case utils.SNAPSHOT_DELETE:
+		orphanedIds, err = DeleteSnapshot(fileName)
+	case utils.SNAPSHOT_LIST:
+		return utils.SendReply(*conn, utils.SnapshotsReply{Snapshots: ListSnapshots()})
+	case utils.LIST_VERSIONS:
+		var versionsReply utils.VersionsReply
+		versionsReply.Versions, err = ListVersions(fileName)
+		if err != nil {
+			versionsReply.Error, versionsReply.Code = err.Error(), utils.ErrorCodeOf(err)
+		}
+		return utils.SendReply(*conn, versionsReply)
+	case utils.CONTENT_SUMMARY:
+		summary, summaryErr := SummarizePath(fileName)
+		if summaryErr != nil {
+			summary.Error, summary.Code = summaryErr.Error(), utils.ErrorCodeOf(summaryErr)
+		}
+		return utils.SendReply(*conn, summary)
+	case utils.GLOB:
+		var globReply utils.GlobReply
+		globReply.Matches, err = GlobPaths(strings.TrimPrefix(utils.BytesToString(task.FileName[:]), "/"))
+		if err != nil {
+			globReply.Error = err.Error()
+		}
+		return utils.SendReply(*conn, globReply)
+	case utils.LIST_DIR:
+		listing, listErr := ListDirectory(fileName)
+		if listErr != nil {
+			listing.Error, listing.Code = listErr.Error(), utils.ErrorCodeOf(listErr)
+		}
+		return utils.SendReply(*conn, listing)
+	}
+
+	if err != nil {
+		reply.Error, reply.Code = err.Error(), utils.ErrorCodeOf(err)
+	} else if gossiputils.MachineType() == gossiputils.LEADER {
+		RouteToSubMasters(task)
+		for _, fileId := range UnreferencedIds(orphanedIds) { // Snapshots keep their blocks alive
+			go DeleteFileBlocks(fileId)
+		}
+	}
+
+	return utils.SendReply(*conn, reply)
+}
+
+// Sends a delete for every replica of a file's blocks. The acks clear the file's metadata as usual.
+func DeleteFileBlocks(fileId string) {
+	blockLocations, ok := BlockLocations.Get(fileId)
+	if !ok {
+		return
+	}
+	InitiateDeleteCommand(fileId, blockLocations)
+}
+
+// Client side
+
+// Asks the leader to make sdfsFilename a file and returns its storage id. With overwrite, a brand new id is added as
+// the file's latest version, as a put replaces the file's contents. Otherwise an existing file keeps its id.
+// versions changes how many versions the file keeps, zero leaves it as is. size is how many bytes the caller is about
+// to write with the given storage policy, which the leader checks against quotas. A non zero ttl makes the leader
+// delete the file once it runs out.
+func CreateFile(ctx context.Context, sdfsFilename string, overwrite bool, versions int64, size int64, metadata utils.FileMetadata, ttl time.Duration) (string, error) {
+	reply, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.CREATE_FILE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		FileId:              utils.NewFileId(),
+		Overwrite:           overwrite,
+		Versions:            versions,
+		OriginalFileSize:    size,
+		Metadata:            metadata,
+		TTL:                 ttl,
+	})
+	return reply.FileId, err
+}
+
+// Adds a new version of sdfsFilename for a put of size bytes with options, and returns its storage id
+func CreateVersion(ctx context.Context, sdfsFilename string, size int64, options utils.PutOptions) (string, error) {
+	reply, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.CREATE_FILE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		FileId:              utils.NewFileId(),
+		Overwrite:           true,
+		Exclusive:           options.Exclusive,
+		Versions:            options.Versions,
+		OriginalFileSize:    size,
+		Metadata:            options.Metadata,
+		TTL:                 options.TTL,
+	})
+	return reply.FileId, err
+}
+
+// Unlinks the version a failed put created, and has the leader delete whatever blocks of it were written
+func AbortCreateFile(ctx context.Context, sdfsFilename string, fileId string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.ABORT_CREATE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		FileId:              fileId,
+	})
+	return err
+}
+
+// Moves a file with all of its versions to the trash. The leader deletes the blocks once it is purged.
+func InitiateRemoveFileCommand(ctx context.Context, sdfsFilename string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.REMOVE_FILE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+	})
+	return err
+}
+
+// Versions of a file, oldest first
+func RequestVersions(ctx context.Context, sdfsFilename string) ([]utils.VersionInfo, error) {
+	var reply utils.VersionsReply
+	task := utils.Task{
+		ConnectionOperation: utils.LIST_VERSIONS,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return nil, err
+	} else if err = utils.ReplyError(reply.Error, reply.Code); err != nil {
+		return nil, err
+	}
+	return reply.Versions, nil
+}
+
+// Storage id of an existing file, for commands that talk to replicas directly
+func ResolveFile(sdfsFilename string) (string, error) {
+	stat, err := RequestFileMetadata(context.Background(), sdfsFilename)
+	if err != nil {
+		return "", err
+	}
+	return stat.FileId, nil
+}
+
+func InitiateMkdirCommand(ctx context.Context, dirName string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.MKDIR,
+		FileName:            utils.New1024Byte(dirName),
+	})
+	return err
+}
+
+func InitiateRmdirCommand(ctx context.Context, dirName string, recursive bool) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.RMDIR,
+		FileName:            utils.New1024Byte(dirName),
+		Recursive:           recursive,
+	})
+	return err
+}
+
+func InitiateRenameCommand(ctx context.Context, srcName string, dstName string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.RENAME,
+		FileName:            utils.New1024Byte(srcName),
+		TargetName:          dstName,
+	})
+	return err
+}
+
+func InitiateListCommand(ctx context.Context, dirName string) (utils.ListReply, error) {
+	var reply utils.ListReply
+	task := utils.Task{
+		ConnectionOperation: utils.LIST_DIR,
+		FileName:            utils.New1024Byte(dirName),
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return reply, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return reply, err
+	} else if err = utils.ReplyError(reply.Error, reply.Code); err != nil {
+		return reply, err
+	}
+	return reply, nil
+}
+
+func RequestContentSummary(ctx context.Context, name string) (utils.ContentSummary, error) {
+	var summary utils.ContentSummary
+	task := utils.Task{
+		ConnectionOperation: utils.CONTENT_SUMMARY,
+		FileName:            utils.New1024Byte(name),
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return summary, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &summary)
+	if err != nil {
+		return summary, err
+	} else if err = utils.ReplyError(summary.Error, summary.Code); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+func sendNamespaceRequest(ctx context.Context, task utils.Task) (utils.LeaderReply, error) {
+	var reply utils.LeaderReply
+	task.IsAck = true
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return reply, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return reply, err
+	} else if err = utils.ReplyError(reply.Error, reply.Code); err != nil {
+		return reply, err
+	}
+	return reply, nil
+}
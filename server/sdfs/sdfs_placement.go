@@ -0,0 +1,301 @@
+package sdfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// The leader decides where every replica goes. Puts, appends, re-replication, replication changes and the balancer
+// all ask the active placement policy, so they make the same kind of choice. The policy is picked with the
+// SDFS_PLACEMENT_POLICY environment variable or the placement command, which the submasters apply too so a new leader
+// keeps the policy.
+
+const PLACEMENT_POLICY_ENV = "SDFS_PLACEMENT_POLICY"
+const TOPOLOGY_FILE_ENV = "SDFS_TOPOLOGY_FILE"
+const DEFAULT_TOPOLOGY_FILE = "server/sdfs/topology.conf"
+
+type PlacementPolicy interface {
+	// Picks up to n distinct nodes from candidates, in order of preference. holders already have a copy of the data.
+	PickTargets(n int, candidates []string, holders []string) []string
+}
+
+var placementPolicies = map[string]func() PlacementPolicy{
+	"random":          func() PlacementPolicy { return RandomPlacement{} },
+	"least-used":      func() PlacementPolicy { return LeastUsedPlacement{} },
+	"round-robin":     func() PlacementPolicy { return &RoundRobinPlacement{} },
+	"topology-spread": func() PlacementPolicy { return &TopologySpreadPlacement{} },
+}
+
+var placementMu sync.Mutex
+var placementPolicy PlacementPolicy = RandomPlacement{}
+
+func init() {
+	if name := os.Getenv(PLACEMENT_POLICY_ENV); name != "" {
+		if err := SetPlacementPolicy(name); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func SetPlacementPolicy(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	newPolicy, ok := placementPolicies[name]
+	if !ok {
+		return fmt.Errorf("unknown placement policy %s, expected random, least-used, round-robin or topology-spread", name)
+	}
+
+	placementMu.Lock()
+	placementPolicy = newPolicy()
+	placementMu.Unlock()
+	fmt.Println("Placement policy is now", name)
+	return nil
+}
+
+// Picks n nodes other than requester for new replicas, preferring nodes outside exclude. Excluded nodes are only used
+// when fallback is set and there aren't enough others. The nodes in exclude are taken to already hold the data.
+func PlaceReplicas(n int, requester string, exclude map[string]bool, fallback bool) []string {
+	var candidates, excluded, holders []string
+	for _, ip := range gossiputils.MembershipMap.Keys() {
+		member, ok := gossiputils.MembershipMap.Get(ip)
+		if ip == requester || !ok || member.State != gossiputils.ALIVE {
+			continue
+		}
+		if exclude[ip] {
+			excluded = append(excluded, ip)
+		} else {
+			candidates = append(candidates, ip)
+		}
+	}
+	for ip := range exclude {
+		if ip != requester {
+			holders = append(holders, ip)
+		}
+	}
+
+	placementMu.Lock()
+	targets := placementPolicy.PickTargets(n, candidates, holders)
+	placementMu.Unlock()
+
+	for fallback && len(targets) < n {
+		ip, err := PopRandomElementInArray(&excluded)
+		if err != nil {
+			break
+		}
+		targets = append(targets, ip)
+	}
+	return targets
+}
+
+// Picks targets uniformly at random
+type RandomPlacement struct{}
+
+func (RandomPlacement) PickTargets(n int, candidates []string, holders []string) []string {
+	candidates = append([]string{}, candidates...)
+	targets := make([]string, 0, n)
+	for len(targets) < n {
+		ip, err := PopRandomElementInArray(&candidates)
+		if err != nil {
+			break
+		}
+		targets = append(targets, ip)
+	}
+	return targets
+}
+
+// Picks the nodes storing the fewest bytes
+type LeastUsedPlacement struct{}
+
+func (LeastUsedPlacement) PickTargets(n int, candidates []string, holders []string) []string {
+	usage := NodeUsages()
+	sorted := append([]string{}, candidates...)
+	rand.Shuffle(len(sorted), func(i, j int) { sorted[i], sorted[j] = sorted[j], sorted[i] }) // Break ties randomly
+	sort.SliceStable(sorted, func(i, j int) bool { return usage[sorted[i]].Bytes < usage[sorted[j]].Bytes })
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// Hands out nodes in turn, in address order
+type RoundRobinPlacement struct {
+	next int
+}
+
+func (policy *RoundRobinPlacement) PickTargets(n int, candidates []string, holders []string) []string {
+	sorted := append([]string{}, candidates...)
+	sort.Strings(sorted)
+
+	targets := make([]string, 0, n)
+	for i := 0; i < len(sorted) && len(targets) < n; i++ {
+		targets = append(targets, sorted[(policy.next+i)%len(sorted)])
+	}
+	policy.next++
+	return targets
+}
+
+// Spreads the copies of a block over as many failure domains as possible. Domains come from the topology file, one
+// "<ip> <domain>" per line. Nodes that aren't listed are a domain of their own.
+type TopologySpreadPlacement struct {
+	domains map[string]string // ip : domain, loaded on first use
+}
+
+func (policy *TopologySpreadPlacement) PickTargets(n int, candidates []string, holders []string) []string {
+	if policy.domains == nil {
+		policy.domains = LoadTopology()
+	}
+
+	copiesInDomain := make(map[string]int)
+	for _, ip := range holders {
+		copiesInDomain[policy.domain(ip)]++
+	}
+
+	remaining := append([]string{}, candidates...)
+	rand.Shuffle(len(remaining), func(i, j int) { remaining[i], remaining[j] = remaining[j], remaining[i] })
+
+	targets := make([]string, 0, n)
+	for len(targets) < n && len(remaining) > 0 {
+		best := 0
+		for i, ip := range remaining {
+			if copiesInDomain[policy.domain(ip)] < copiesInDomain[policy.domain(remaining[best])] {
+				best = i
+			}
+		}
+
+		ip := remaining[best]
+		remaining = append(remaining[:best], remaining[best+1:]...)
+		copiesInDomain[policy.domain(ip)]++
+		targets = append(targets, ip)
+	}
+	return targets
+}
+
+func (policy *TopologySpreadPlacement) domain(ip string) string {
+	if domain, ok := policy.domains[ip]; ok {
+		return domain
+	}
+	return ip
+}
+
+func LoadTopology() map[string]string {
+	path := DEFAULT_TOPOLOGY_FILE
+	if envPath := os.Getenv(TOPOLOGY_FILE_ENV); envPath != "" {
+		path = envPath
+	}
+
+	domains := make(map[string]string)
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("No topology file at %s, every node is its own failure domain\n", path)
+		return domains
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.HasPrefix(fields[0], "#") {
+			domains[fields[0]] = fields[1]
+		}
+	}
+	return domains
+}
+
+// Blocks and bytes a node stores, counted from FileToBlocks
+type NodeUsage struct {
+	Blocks int
+	Bytes  int64
+}
+
+func NodeUsages() map[string]NodeUsage {
+	usages := make(map[string]NodeUsage)
+	for item := range FileToBlocks.IterBuffered() {
+		var usage NodeUsage
+		for _, block := range item.Val {
+			blockIdx, _ := block[0].(int64)
+			fileName, _ := block[1].(string)
+
+			usage.Blocks++
+			if sizes, ok := BlockStoredSizes.Get(fileName); ok && blockIdx < int64(len(sizes)) {
+				usage.Bytes += sizes[blockIdx]
+			}
+		}
+		usages[item.Key] = usage
+	}
+	return usages
+}
+
+func HandlePlacementRequest(task utils.Task, conn *net.Conn) error {
+	requester := utils.BytesToString(task.AckTargetIp[:])
+	exclude := make(map[string]bool)
+	for _, ip := range task.Exclude {
+		exclude[ip] = true
+	}
+
+	reply := utils.PlacementReply{Targets: PlaceReplicas(int(task.Count), requester, exclude, true)}
+	if len(reply.Targets) == 0 && task.Count > 0 {
+		reply.Error = "no alive nodes to place replicas on"
+	}
+	return utils.SendReply(*conn, reply)
+}
+
+func HandleSetPlacementPolicy(name string, conn *net.Conn) error {
+	var reply utils.LeaderReply
+	if err := SetPlacementPolicy(name); err != nil {
+		reply.Error = err.Error()
+	}
+	return utils.SendReply(*conn, reply)
+}
+
+// Client side
+
+// Asks the leader for up to n nodes to write replicas to, other than this node. Nodes in exclude are only used when
+// there aren't enough others.
+func RequestPlacement(ctx context.Context, n int, exclude map[string]bool) ([]string, error) {
+	var reply utils.PlacementReply
+	task := utils.Task{
+		ConnectionOperation: utils.PLACE_REPLICAS,
+		Count:               int64(n),
+		IsAck:               true,
+	}
+	for ip := range exclude {
+		task.Exclude = append(task.Exclude, ip)
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return nil, err
+	} else if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply.Targets, nil
+}
+
+func CLIPlacement(policy string) {
+	_, err := sendNamespaceRequest(context.Background(), utils.Task{
+		ConnectionOperation: utils.SET_PLACEMENT,
+		FileName:            utils.New1024Byte(policy),
+	})
+	if err != nil {
+		fmt.Println("placement failed: ", err)
+		return
+	}
+	fmt.Println("Placement policy set to", policy)
+}
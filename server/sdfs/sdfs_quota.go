@@ -0,0 +1,299 @@
+package sdfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Quotas cap the number of files and the bytes stored under a path prefix. A prefix ending in "/" covers a
+// directory, and one like "wordcount_" covers the intermediate files a MapleJuice job with that prefix writes. Bytes
+// count every replica and every kept version, and files in the trash count until they are purged. The leader checks
+// quotas when a file is created, with the size the writer expects to write, and again on each write ack that adds
+// bytes, before the block is recorded anywhere. A replica whose block is turned down drops it again.
+
+var quotaMu sync.RWMutex
+var quotas = make(map[string]utils.Quota) // prefix : limits
+
+func quotaPrefix(prefix string) string {
+	return strings.TrimPrefix(strings.TrimSpace(prefix), "/")
+}
+
+// Sets the limits on a prefix. A quota with no limits removes it.
+func SetQuota(prefix string, quota utils.Quota) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if quota.MaxFiles <= 0 && quota.MaxBytes <= 0 {
+		delete(quotas, prefix)
+		return
+	}
+	quotas[prefix] = quota
+}
+
+// The quota set on exactly prefix, if there is one
+func QuotaOn(prefix string) (utils.Quota, bool) {
+	quotaMu.RLock()
+	defer quotaMu.RUnlock()
+
+	quota, ok := quotas[prefix]
+	return quota, ok
+}
+
+// Number of files under prefix and the bytes all their replicas and versions take. Files in the trash still hold
+// their blocks, so they count under the path they were deleted from until they are purged.
+func QuotaUsage(prefix string) (int64, int64) {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	var files, bytes int64
+	for fileId, node := range fileIdToNode {
+		if !strings.HasPrefix(node.Path(), prefix) {
+			continue
+		}
+		if node.CurrentFileId() == fileId {
+			files++
+		}
+		bytes += storedBytes(fileId)
+	}
+
+	for _, entry := range trash {
+		if !strings.HasPrefix(entry.Path, prefix) {
+			continue
+		}
+		files++
+		for _, fileId := range collectFileIds(entry.Node, nil) {
+			bytes += storedBytes(fileId)
+		}
+	}
+	return files, bytes
+}
+
+// Bytes every replica of a stored file takes
+func storedBytes(fileId string) int64 {
+	metadata, _ := FileToMetadata.Get(fileId)
+	return StoredSize(fileId) * metadata.Replicas() // Erasure coded pieces already include parity
+}
+
+// Returns an error naming the quota that adding newFiles files and newBytes bytes under cleanPath would exceed
+func CheckQuota(cleanPath string, newFiles int64, newBytes int64) error {
+	quotaMu.RLock()
+	defer quotaMu.RUnlock()
+
+	for prefix, quota := range quotas {
+		if !strings.HasPrefix(cleanPath, prefix) {
+			continue
+		}
+
+		files, bytes := QuotaUsage(prefix)
+		if quota.MaxFiles > 0 && files+newFiles > quota.MaxFiles {
+			return utils.Errorf(utils.ERR_QUOTA, "quota on %s exceeded: writing %s would make %d files, the limit is %d", prefix, cleanPath, files+newFiles, quota.MaxFiles)
+		}
+		if quota.MaxBytes > 0 && bytes+newBytes > quota.MaxBytes {
+			return utils.Errorf(utils.ERR_QUOTA, "quota on %s exceeded: writing %d bytes to %s would make %d bytes, the limit is %d", prefix, newBytes, cleanPath, bytes+newBytes, quota.MaxBytes)
+		}
+	}
+	return nil
+}
+
+// Checks a CREATE_FILE request, which carries the size the writer is about to write in OriginalFileSize
+func CheckCreateQuota(cleanPath string, task utils.Task) error {
+	namespaceMu.RLock()
+	node := lookupNode(cleanPath)
+	exists := node != nil && !node.IsDir && len(node.Versions) > 0
+	var currentId string
+	if exists {
+		currentId = node.CurrentFileId()
+	}
+	namespaceMu.RUnlock()
+
+	var newFiles int64
+	metadata := task.Metadata
+	if !exists {
+		newFiles = 1
+	} else if !task.Overwrite {
+		metadata, _ = FileToMetadata.Get(currentId) // Appends keep the file's storage policy
+	}
+	return CheckQuota(cleanPath, newFiles, metadata.ReplicatedSize(task.OriginalFileSize))
+}
+
+// Checks a write ack against the quotas of the file it belongs to. Only bytes past the block's recorded size count,
+// so re-replication, repairs and balancer moves never fail.
+func CheckWriteQuota(task utils.Task) error {
+	fileId := utils.BytesToString(task.FileName[:])
+	added := task.RangeOffset + task.DataSize - blockStoredSize(fileId, task.BlockIndex)
+	if task.MoveFrom != "" || added <= 0 {
+		return nil
+	}
+
+	namespaceMu.RLock()
+	node, ok := fileIdToNode[fileId]
+	var cleanPath string
+	if ok {
+		cleanPath = node.Path()
+	}
+	namespaceMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	metadata, ok := FileToMetadata.Get(fileId)
+	if !ok {
+		metadata = task.Metadata
+	}
+	return CheckQuota(cleanPath, 0, metadata.ReplicatedSize(added))
+}
+
+func HandleQuotaSet(task utils.Task, conn *net.Conn) error {
+	var reply utils.LeaderReply
+	prefix := quotaPrefix(utils.BytesToString(task.FileName[:]))
+	if prefix == "" {
+		reply.Error = "quotas need a path prefix"
+	} else {
+		SetQuota(prefix, task.Quota)
+	}
+	return utils.SendReply(*conn, reply)
+}
+
+// Replies with the quota on prefix, or every quota if prefix is empty
+func HandleQuotaGet(prefix string, conn *net.Conn) error {
+	var reply utils.QuotaReply
+	prefix = quotaPrefix(prefix)
+
+	quotaMu.RLock()
+	for quotaOn, quota := range quotas {
+		if prefix == "" || prefix == quotaOn {
+			reply.Quotas = append(reply.Quotas, utils.QuotaUsage{Prefix: quotaOn, Quota: quota})
+		}
+	}
+	quotaMu.RUnlock()
+
+	if prefix != "" && len(reply.Quotas) == 0 {
+		reply.Error = fmt.Sprintf("no quota on %s", prefix)
+	}
+	for i := range reply.Quotas {
+		reply.Quotas[i].Files, reply.Quotas[i].Bytes = QuotaUsage(reply.Quotas[i].Prefix)
+	}
+	sort.Slice(reply.Quotas, func(i, j int) bool { return reply.Quotas[i].Prefix < reply.Quotas[j].Prefix })
+
+	return utils.SendReply(*conn, reply)
+}
+
+// Client side
+
+// Sends a write ack for a block written outside the normal put path, like a MapleJuice output, and returns the
+// leader's verdict. The block must be removed if a quota rejected it.
+func SendWriteAck(ctx context.Context, task utils.Task) error {
+	_, err := sendNamespaceRequest(ctx, task)
+	return err
+}
+
+// Parses "set <prefix> [-files <n>] [-bytes <size>]" and "get [prefix]"
+func CLIQuota(args []string) {
+	if len(args) == 0 {
+		fmt.Println("quota failed: expected set or get")
+		return
+	}
+
+	switch strings.TrimSpace(args[0]) {
+	case "set":
+		cliQuotaSet(args[1:])
+	case "get":
+		var prefix string
+		if len(args) > 1 {
+			prefix = strings.TrimSpace(args[1])
+		}
+		cliQuotaGet(prefix)
+	default:
+		fmt.Printf("quota failed: unknown subcommand %s, expected set or get\n", args[0])
+	}
+}
+
+func cliQuotaSet(args []string) {
+	if len(args) == 0 {
+		fmt.Println("quota set failed: missing path prefix")
+		return
+	}
+
+	var quota utils.Quota
+	for i := 1; i < len(args); i++ {
+		arg := strings.TrimSpace(args[i])
+		if i+1 >= len(args) {
+			fmt.Printf("quota set failed: %s needs a value\n", arg)
+			return
+		}
+		i++
+
+		var err error
+		if arg == "-files" {
+			_, err = fmt.Sscan(args[i], &quota.MaxFiles)
+		} else if arg == "-bytes" {
+			quota.MaxBytes, err = utils.ParseByteSize(args[i])
+		} else {
+			err = fmt.Errorf("unknown argument %s", arg)
+		}
+		if err != nil {
+			fmt.Println("quota set failed: ", err)
+			return
+		}
+	}
+
+	_, err := sendNamespaceRequest(context.Background(), utils.Task{
+		ConnectionOperation: utils.QUOTA_SET,
+		FileName:            utils.New1024Byte(args[0]),
+		Quota:               quota,
+	})
+	if err != nil {
+		fmt.Println("quota set failed: ", err)
+		return
+	}
+	if quota.MaxFiles <= 0 && quota.MaxBytes <= 0 {
+		fmt.Println("Removed quota on", args[0])
+	} else {
+		fmt.Println("Set quota on", args[0])
+	}
+}
+
+func cliQuotaGet(prefix string) {
+	var reply utils.QuotaReply
+	task := utils.Task{
+		ConnectionOperation: utils.QUOTA_GET,
+		FileName:            utils.New1024Byte(prefix),
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(context.Background(), task)
+	if err != nil {
+		fmt.Println("quota get failed: ", err)
+		return
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		fmt.Println("quota get failed: ", err)
+		return
+	} else if reply.Error != "" {
+		fmt.Println("quota get failed: ", reply.Error)
+		return
+	}
+
+	if len(reply.Quotas) == 0 {
+		fmt.Println("No quotas set")
+	}
+	for _, usage := range reply.Quotas {
+		fmt.Printf("%s\tfiles %d/%s\tbytes %d/%s\n", usage.Prefix, usage.Files, quotaLimit(usage.Quota.MaxFiles), usage.Bytes, quotaLimit(usage.Quota.MaxBytes))
+	}
+}
+
+func quotaLimit(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(limit)
+}
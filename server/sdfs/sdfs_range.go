@@ -0,0 +1,374 @@
+package sdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Ranged reads map a byte range of an SDFS file onto the blocks covering it, and only pull those bytes from replicas.
+// Compressed and encrypted blocks are the exception, they are pulled whole.
+
+const TAIL_CHUNK_SIZE = 64 * utils.KB
+
+var errLineLimitReached = errors.New("line limit reached")
+
+// A file's metadata and block locations, fetched once so several ranges can be read without asking the leader again.
+type RangeReader struct {
+	FileName  string
+	Stat      utils.FileStat
+	Locations [][]string
+}
+
+func OpenRangeReader(ctx context.Context, sdfsFilename string) (*RangeReader, error) {
+	stat, err := RequestFileMetadata(ctx, sdfsFilename)
+	if err != nil {
+		return nil, err
+	} else if !stat.Exists {
+		return nil, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", sdfsFilename)
+	}
+
+	locations, err := SdfsClientMain(ctx, sdfsFilename, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RangeReader{FileName: sdfsFilename, Stat: stat, Locations: locations}, nil
+}
+
+// Copies length bytes starting at offset into dst, or everything up to the end of the file if length is negative.
+func ReadRange(ctx context.Context, sdfsFilename string, offset int64, length int64, dst io.Writer) (int64, error) {
+	reader, err := OpenRangeReader(ctx, sdfsFilename)
+	if err != nil {
+		return 0, err
+	}
+
+	return reader.ReadRange(ctx, offset, length, dst)
+}
+
+func (reader *RangeReader) ReadRange(ctx context.Context, offset int64, length int64, dst io.Writer) (int64, error) {
+	if offset < 0 {
+		return 0, errors.New("negative read offset")
+	}
+
+	if reader.Stat.Metadata.UnevenBlocks {
+		return reader.readUnevenRange(ctx, offset, length, dst)
+	}
+
+	end := reader.Stat.Size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+
+	blockSize := reader.Stat.Metadata.BlockBytes()
+	var total int64
+	for pos := offset; pos < end; {
+		dataBlockIdx := pos / blockSize
+		blockOffset := pos % blockSize
+		n := utils.GetMinInt64(blockSize-blockOffset, end-pos)
+
+		copied, err := reader.readBlockRange(ctx, dataBlockIdx, blockOffset, n, dst)
+		total += copied
+		if err == nil && copied != n {
+			err = fmt.Errorf("block %d ended after %d of the %d bytes read from it", dataBlockIdx, copied, n)
+		}
+		if err != nil {
+			return total, err
+		}
+		pos += n
+	}
+
+	return total, nil
+}
+
+// Real size of the file. MapleJuice outputs don't know theirs up front, so their blocks are measured on the replicas.
+func (reader *RangeReader) Length(ctx context.Context) (int64, error) {
+	if !reader.Stat.Metadata.UnevenBlocks {
+		return reader.Stat.Size, nil
+	}
+
+	var length int64
+	for blockIdx, replicas := range reader.Locations {
+		if len(replicas) == 0 {
+			continue
+		}
+
+		blockLength, _, err := reader.streamWithRetry(ctx, int64(blockIdx), replicas, 0, utils.BLOCK_LENGTH_ONLY, false, io.Discard)
+		if err != nil {
+			return 0, err
+		}
+		length += blockLength
+	}
+
+	return length, nil
+}
+
+// Reads part of one logical data block. An erasure coded block whose piece can't be read is decoded from its stripe.
+func (reader *RangeReader) readBlockRange(ctx context.Context, dataBlockIdx int64, offset int64, length int64, dst io.Writer) (int64, error) {
+	metadata := reader.Stat.Metadata
+	blockIdx := metadata.StoredBlockIndex(dataBlockIdx)
+
+	var replicas []string
+	if blockIdx < int64(len(reader.Locations)) {
+		replicas = reader.Locations[blockIdx]
+	}
+
+	if metadata.HasEncodedBlocks() {
+		return reader.readEncodedBlockRange(ctx, blockIdx, replicas, offset, length, dst)
+	}
+
+	_, n, err := reader.streamWithRetry(ctx, blockIdx, replicas, offset, length, true, dst)
+	if err == nil || !metadata.IsErasureCoded() || n > 0 {
+		return n, err
+	}
+
+	log.Printf("Piece %d unreadable, decoding it from its stripe\n", blockIdx)
+	coder, err := utils.NewErasureCoder(int(metadata.DataShards), int(metadata.ParityShards))
+	if err != nil {
+		return 0, err
+	}
+
+	shards, err := FetchStripe(ctx, reader.Stat.FileId, dataBlockIdx/metadata.DataShards, reader.Locations, metadata, blockIdx)
+	if err != nil {
+		return 0, err
+	}
+	err = coder.Reconstruct(shards)
+	if err != nil {
+		return 0, err
+	}
+
+	piece := shards[dataBlockIdx%metadata.DataShards]
+	end := utils.GetMinInt64(offset+length, int64(len(piece)))
+	if offset >= end {
+		return 0, nil
+	}
+	written, err := dst.Write(piece[offset:end])
+	return int64(written), err
+}
+
+// Compressed or encrypted blocks can't be read from the middle, so the whole block is fetched and decoded, then the range is cut out
+func (reader *RangeReader) readEncodedBlockRange(ctx context.Context, blockIdx int64, replicas []string, offset int64, length int64, dst io.Writer) (int64, error) {
+	var stored bytes.Buffer
+	_, _, err := reader.streamWithRetry(ctx, blockIdx, replicas, 0, 0, false, &stored)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := utils.DecodeBlock(reader.Stat.Metadata, blockIdx, stored.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	end := utils.GetMinInt64(offset+length, int64(len(data)))
+	if offset >= end {
+		return 0, nil
+	}
+	written, err := dst.Write(data[offset:end])
+	return int64(written), err
+}
+
+func (reader *RangeReader) readUnevenRange(ctx context.Context, offset int64, length int64, dst io.Writer) (int64, error) {
+	var pos, total int64
+
+	for blockIdx, replicas := range reader.Locations {
+		if len(replicas) == 0 {
+			continue
+		}
+
+		remaining := int64(0) // Rest of the block
+		if length >= 0 {
+			remaining = length - total
+			if remaining <= 0 {
+				break
+			}
+		}
+
+		blockOffset := int64(0)
+		if offset > pos {
+			blockOffset = offset - pos
+		}
+
+		blockLength, n, err := reader.streamWithRetry(ctx, int64(blockIdx), replicas, blockOffset, remaining, false, dst)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		pos += blockLength
+	}
+
+	return total, nil
+}
+
+// Tries each replica of a block in random order. If a replica dies mid stream, the next one picks up where it left off.
+// With exact set the block holds all length bytes, so a replica that sends fewer has a damaged copy and is skipped.
+func (reader *RangeReader) streamWithRetry(ctx context.Context, blockIdx int64, replicas []string, offset int64, length int64, exact bool, dst io.Writer) (int64, int64, error) {
+	replicas = append([]string{}, replicas...)
+	tracked := &trackingWriter{Writer: dst}
+	var total int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, total, err
+		}
+
+		ip, err := PopRandomElementInArray(&replicas)
+		if err != nil {
+			return 0, total, fmt.Errorf("no replica of block %d could be read", blockIdx)
+		}
+		if ip == utils.WRITE_OP || ip == utils.DELETE_OP {
+			continue
+		}
+
+		blockLength, n, err := StreamBlockRangeFromReplica(ctx, ip, reader.Stat.FileId, blockIdx, offset, length, tracked)
+		total += n
+		if err == nil && exact && n < length {
+			err = fmt.Errorf("sent %d of the %d bytes asked for", n, length)
+		}
+		if err == nil || tracked.err != nil {
+			return blockLength, total, err // The destination refused more data, no point in another replica
+		}
+
+		log.Printf("Block %d failed on %s after %d bytes, trying another replica: %v\n", blockIdx, ip, n, err)
+		offset += n
+		if length > 0 {
+			length -= n
+		}
+	}
+}
+
+// Remembers write errors, so they can be told apart from network errors in io.Copy
+type trackingWriter struct {
+	io.Writer
+	err error
+}
+
+func (tw *trackingWriter) Write(p []byte) (int, error) {
+	n, err := tw.Writer.Write(p)
+	if err != nil {
+		tw.err = err
+	}
+	return n, err
+}
+
+// Passes data through until numLines newlines have been written, then fails with errLineLimitReached
+type lineLimitWriter struct {
+	dst       io.Writer
+	remaining int64
+}
+
+func (lw *lineLimitWriter) Write(p []byte) (int, error) {
+	if lw.remaining <= 0 {
+		return 0, errLineLimitReached
+	}
+
+	for i, b := range p {
+		if b == '\n' {
+			lw.remaining--
+			if lw.remaining == 0 {
+				n, err := lw.dst.Write(p[:i+1])
+				if err != nil {
+					return n, err
+				}
+				return n, errLineLimitReached
+			}
+		}
+	}
+
+	return lw.dst.Write(p)
+}
+
+func CLICat(sdfsFilename string) {
+	lease, err := AcquireLease(context.Background(), sdfsFilename, utils.READ_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a read lease. Aborting cat command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	_, err = ReadRange(context.Background(), sdfsFilename, 0, -1, os.Stdout)
+	if err != nil {
+		fmt.Println("\ncat failed: ", err)
+	}
+}
+
+func CLIHead(sdfsFilename string, numLines int64) {
+	lease, err := AcquireLease(context.Background(), sdfsFilename, utils.READ_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a read lease. Aborting head command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	_, err = ReadRange(context.Background(), sdfsFilename, 0, -1, &lineLimitWriter{dst: os.Stdout, remaining: numLines})
+	if err != nil && err != errLineLimitReached {
+		fmt.Println("\nhead failed: ", err)
+	}
+}
+
+// Reads the file backwards in chunks until it has seen enough lines, so only the end of the file is transferred.
+func CLITail(sdfsFilename string, numLines int64) {
+	ctx := context.Background()
+	lease, err := AcquireLease(ctx, sdfsFilename, utils.READ_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a read lease. Aborting tail command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	reader, err := OpenRangeReader(ctx, sdfsFilename)
+	if err != nil {
+		fmt.Println("tail failed: ", err)
+		return
+	}
+
+	end, err := reader.Length(ctx)
+	if err != nil {
+		fmt.Println("tail failed: ", err)
+		return
+	}
+
+	var data []byte
+	for end > 0 {
+		start := end - utils.GetMinInt64(end, TAIL_CHUNK_SIZE)
+
+		var chunk bytes.Buffer
+		_, err = reader.ReadRange(ctx, start, end-start, &chunk)
+		if err != nil {
+			fmt.Println("tail failed: ", err)
+			return
+		}
+		data = append(chunk.Bytes(), data...)
+		end = start
+
+		// One more newline than lines wanted means the first line we need starts right after it
+		if int64(bytes.Count(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'})) >= numLines {
+			break
+		}
+	}
+
+	os.Stdout.Write(lastLines(data, numLines))
+}
+
+func lastLines(data []byte, numLines int64) []byte {
+	if numLines <= 0 {
+		return nil
+	}
+
+	body := bytes.TrimSuffix(data, []byte{'\n'})
+	for i := len(body) - 1; i >= 0; i-- {
+		if body[i] == '\n' {
+			numLines--
+			if numLines == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+
+	return data
+}
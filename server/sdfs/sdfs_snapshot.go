@@ -0,0 +1,227 @@
+package sdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// A snapshot freezes the current version of every file under a prefix by remembering its storage id and size. No
+// data is copied: versions are never rewritten, and appends only add bytes past the frozen size. Files in a snapshot
+// are read as "@<snapshot>/<path>", and blocks stay on disk while any snapshot still refers to them.
+
+const SNAPSHOT_PATH_PREFIX = "@"
+
+type Snapshot struct {
+	Name    string
+	Prefix  string
+	Created int64                        // Unix nanoseconds
+	Files   map[string]utils.VersionInfo // path : frozen version
+}
+
+var snapshots = make(map[string]*Snapshot) // snapshot name : snapshot, guarded by namespaceMu
+
+func IsSnapshotPath(cleanPath string) bool {
+	return strings.HasPrefix(cleanPath, SNAPSHOT_PATH_PREFIX)
+}
+
+// Splits "@name/path" into the snapshot name and the path inside it
+func splitSnapshotPath(cleanPath string) (string, string) {
+	name, filePath, _ := strings.Cut(strings.TrimPrefix(cleanPath, SNAPSHOT_PATH_PREFIX), "/")
+	return name, filePath
+}
+
+// Frozen version behind a snapshot path
+func LookupSnapshotFile(name string) (utils.VersionInfo, bool) {
+	cleanPath := utils.CleanPath(name)
+	if !IsSnapshotPath(cleanPath) {
+		return utils.VersionInfo{}, false
+	}
+
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	snapshotName, filePath := splitSnapshotPath(cleanPath)
+	snapshot, ok := snapshots[snapshotName]
+	if !ok {
+		return utils.VersionInfo{}, false
+	}
+	info, ok := snapshot.Files[filePath]
+	return info, ok
+}
+
+func CreateSnapshot(name string, prefix string, timestamp int64) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	if _, exists := snapshots[name]; exists {
+		return utils.Errorf(utils.ERR_EXIST, "snapshot %s already exists", name)
+	}
+
+	snapshot := &Snapshot{Name: name, Prefix: prefix, Created: timestamp, Files: make(map[string]utils.VersionInfo)}
+	for _, filePath := range collectFilePaths(namespaceRoot, nil) {
+		if !strings.HasPrefix(filePath, prefix) {
+			continue
+		}
+
+		node := lookupNode(filePath)
+		if len(node.Versions) == 0 {
+			continue
+		}
+		info := node.Versions[len(node.Versions)-1]
+		info.Size, _ = FileToSize.Get(info.FileId)
+		snapshot.Files[filePath] = info
+	}
+
+	snapshots[name] = snapshot
+	return nil
+}
+
+// Drops a snapshot and returns the storage ids that nothing refers to anymore, so their blocks can be deleted
+func DeleteSnapshot(name string) ([]string, error) {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	snapshot, ok := snapshots[name]
+	if !ok {
+		return nil, utils.Errorf(utils.ERR_NOT_EXIST, "snapshot %s does not exist", name)
+	}
+	delete(snapshots, name)
+
+	var freedIds []string
+	for _, info := range snapshot.Files {
+		if !isReferenced(info.FileId) {
+			freedIds = append(freedIds, info.FileId)
+		}
+	}
+	return freedIds, nil
+}
+
+// Whether the live namespace, the trash or any snapshot still refers to a storage id. Caller holds namespaceMu.
+func isReferenced(fileId string) bool {
+	if _, ok := fileIdToNode[fileId]; ok {
+		return true
+	}
+	for _, entry := range trash {
+		for _, version := range entry.Node.Versions {
+			if version.FileId == fileId {
+				return true
+			}
+		}
+	}
+	for _, snapshot := range snapshots {
+		for _, info := range snapshot.Files {
+			if info.FileId == fileId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Filters out storage ids a snapshot still holds on to
+func UnreferencedIds(fileIds []string) []string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	unreferenced := make([]string, 0, len(fileIds))
+	for _, fileId := range fileIds {
+		if !isReferenced(fileId) {
+			unreferenced = append(unreferenced, fileId)
+		}
+	}
+	return unreferenced
+}
+
+func ListSnapshots() []utils.SnapshotInfo {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	infos := make([]utils.SnapshotInfo, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		info := utils.SnapshotInfo{Name: snapshot.Name, Prefix: snapshot.Prefix, Created: snapshot.Created, NumFiles: len(snapshot.Files)}
+		for _, file := range snapshot.Files {
+			info.Bytes += file.Size
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created < infos[j].Created })
+
+	return infos
+}
+
+// Snapshot paths ("@name/path") of the files in every snapshot
+func AllSnapshotPaths() []string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	paths := make([]string, 0)
+	for name, snapshot := range snapshots {
+		for filePath := range snapshot.Files {
+			paths = append(paths, SNAPSHOT_PATH_PREFIX+name+"/"+filePath)
+		}
+	}
+	return paths
+}
+
+// Client side
+
+func InitiateSnapshotCreateCommand(ctx context.Context, name string, prefix string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.SNAPSHOT_CREATE,
+		FileName:            utils.New1024Byte(name),
+		TargetName:          prefix,
+	})
+	return err
+}
+
+func InitiateSnapshotDeleteCommand(ctx context.Context, name string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.SNAPSHOT_DELETE,
+		FileName:            utils.New1024Byte(name),
+	})
+	return err
+}
+
+func RequestSnapshots(ctx context.Context) ([]utils.SnapshotInfo, error) {
+	var reply utils.SnapshotsReply
+	task := utils.Task{
+		ConnectionOperation: utils.SNAPSHOT_LIST,
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return nil, err
+	} else if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply.Snapshots, nil
+}
+
+func CLISnapshotLs() {
+	infos, err := RequestSnapshots(context.Background())
+	if err != nil {
+		fmt.Println("snapshot ls failed: ", err)
+		return
+	}
+
+	for _, info := range infos {
+		fmt.Printf("%s\t%q\t%s\t%d files\t%d bytes\n", info.Name, info.Prefix, time.Unix(0, info.Created).Format(time.RFC3339), info.NumFiles, info.Bytes)
+	}
+}
@@ -0,0 +1,227 @@
+package sdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Deleted files go to the trash instead of losing their blocks right away. A trashed file keeps every version it had
+// and can be undeleted back to its old path until its retention runs out, after which the leader purges it and the
+// blocks are deleted as usual. Retention defaults to a day and is set with SDFS_TRASH_RETENTION (e.g. "2h").
+
+const TRASH_RETENTION_ENV = "SDFS_TRASH_RETENTION"
+const DEFAULT_TRASH_RETENTION = 24 * time.Hour
+const TRASH_EXPIRY_INTERVAL = time.Minute
+
+type TrashEntry struct {
+	Id      string
+	Path    string
+	Deleted int64          // Unix nanoseconds
+	Node    *NamespaceNode // The detached file node, with its versions
+}
+
+var trash = make(map[string]*TrashEntry) // trash id : entry, guarded by namespaceMu
+
+func TrashRetention() time.Duration {
+	if value := os.Getenv(TRASH_RETENTION_ENV); value != "" {
+		retention, err := time.ParseDuration(value)
+		if err == nil && retention >= 0 {
+			return retention
+		}
+		fmt.Printf("Invalid %s %q, using %v\n", TRASH_RETENTION_ENV, value, DEFAULT_TRASH_RETENTION)
+	}
+	return DEFAULT_TRASH_RETENTION
+}
+
+// Moves a file node into the trash. Caller holds namespaceMu for writing.
+func trashNode(node *NamespaceNode, id string, timestamp int64) {
+	for _, version := range node.Versions {
+		delete(fileIdToNode, version.FileId)
+	}
+	trash[id] = &TrashEntry{Id: id, Path: node.Path(), Deleted: timestamp, Node: node}
+	detachNode(node)
+}
+
+// Puts a trashed file back at its old path, recreating its parent directories. Without an id, the most recently
+// deleted file at cleanPath comes back.
+func UndeleteFile(cleanPath string, id string) error {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	entry, ok := trash[id]
+	if id == "" {
+		entry, ok = newestTrashEntry(cleanPath)
+	}
+	if !ok && id != "" {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "nothing with trash id %s in the trash", id)
+	} else if !ok {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s is not in the trash", cleanPath)
+	}
+	if lookupNode(entry.Path) != nil {
+		return utils.Errorf(utils.ERR_EXIST, "%s exists, move it out of the way before undeleting", entry.Path)
+	}
+
+	parent, err := makeDirs(path.Dir("/" + entry.Path)[1:])
+	if err != nil {
+		return err
+	}
+	entry.Node.Parent = parent
+	entry.Node.Expires = 0 // An expired file that was brought back is kept
+	parent.Children[entry.Node.Name] = entry.Node
+	for _, version := range entry.Node.Versions {
+		fileIdToNode[version.FileId] = entry.Node
+	}
+	delete(trash, entry.Id)
+	return nil
+}
+
+// Caller holds namespaceMu
+func newestTrashEntry(cleanPath string) (*TrashEntry, bool) {
+	var newest *TrashEntry
+	for _, entry := range trash {
+		if entry.Path == cleanPath && (newest == nil || entry.Deleted > newest.Deleted) {
+			newest = entry
+		}
+	}
+	return newest, newest != nil
+}
+
+// Empties the trash entry with the given id, every entry for cleanPath, or the whole trash if both are empty. Returns
+// the storage ids of the purged versions, so their blocks can be deleted.
+func PurgeTrash(cleanPath string, id string) ([]string, error) {
+	namespaceMu.Lock()
+	defer namespaceMu.Unlock()
+
+	var fileIds []string
+	for entryId, entry := range trash {
+		if (id != "" && entryId != id) || (cleanPath != "" && entry.Path != cleanPath) {
+			continue
+		}
+		fileIds = collectFileIds(entry.Node, fileIds)
+		delete(trash, entryId)
+	}
+
+	if len(fileIds) == 0 && (id != "" || cleanPath != "") {
+		return nil, errors.New("nothing to purge, no matching file in the trash")
+	}
+	return fileIds, nil
+}
+
+func ListTrash() []utils.TrashInfo {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	retention := TrashRetention()
+	infos := make([]utils.TrashInfo, 0, len(trash))
+	for _, entry := range trash {
+		info := utils.TrashInfo{
+			Id:       entry.Id,
+			Path:     entry.Path,
+			Deleted:  entry.Deleted,
+			Expires:  entry.Deleted + int64(retention),
+			Versions: len(entry.Node.Versions),
+		}
+		info.Size, _ = FileToSize.Get(entry.Node.CurrentFileId())
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Deleted < infos[j].Deleted })
+
+	return infos
+}
+
+// Trash ids whose retention ran out by now
+func ExpiredTrashIds(now time.Time) []string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	cutoff := now.Add(-TrashRetention()).UnixNano()
+	var ids []string
+	for id, entry := range trash {
+		if entry.Deleted <= cutoff {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Runs on every node, but only the leader purges. Purges go through the leader like any other, so the submasters
+// drop the entries too and the blocks are deleted by the usual path.
+func RunTrashExpiry() {
+	for range time.Tick(TRASH_EXPIRY_INTERVAL) {
+		if gossiputils.MachineType() != gossiputils.LEADER {
+			continue
+		}
+
+		for _, id := range ExpiredTrashIds(time.Now()) {
+			fmt.Println("Trash retention ran out, purging", id)
+			err := InitiateTrashPurgeCommand(context.Background(), "", id)
+			if err != nil {
+				fmt.Println("Unable to purge expired trash: ", err)
+			}
+		}
+	}
+}
+
+// Client side
+
+func InitiateUndeleteCommand(ctx context.Context, sdfsFilename string, id string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.UNDELETE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		TargetName:          id,
+	})
+	return err
+}
+
+func InitiateTrashPurgeCommand(ctx context.Context, sdfsFilename string, id string) error {
+	_, err := sendNamespaceRequest(ctx, utils.Task{
+		ConnectionOperation: utils.TRASH_PURGE,
+		FileName:            utils.New1024Byte(sdfsFilename),
+		TargetName:          id,
+	})
+	return err
+}
+
+func RequestTrash(ctx context.Context) ([]utils.TrashInfo, error) {
+	var reply utils.TrashReply
+	task := utils.Task{
+		ConnectionOperation: utils.TRASH_LIST,
+		IsAck:               true,
+	}
+
+	conn, err := utils.SendAckToMasterContext(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer (*conn).Close()
+
+	err = utils.ReadReply(*conn, &reply)
+	if err != nil {
+		return nil, err
+	} else if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply.Entries, nil
+}
+
+func CLITrashLs() {
+	infos, err := RequestTrash(context.Background())
+	if err != nil {
+		fmt.Println("trash ls failed: ", err)
+		return
+	}
+
+	for _, info := range infos {
+		expiresIn := time.Until(time.Unix(0, info.Expires)).Round(time.Second)
+		fmt.Printf("%s\t%s\t%d bytes\t%d versions\tdeleted %s\tpurged in %v\n", info.Id, info.Path, info.Size, info.Versions,
+			time.Unix(0, info.Deleted).Format(time.RFC3339), expiresIn)
+	}
+}
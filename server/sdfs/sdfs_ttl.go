@@ -0,0 +1,58 @@
+package sdfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gossiputils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/gossip/gossipUtils"
+)
+
+// Files can be given a time to live when they are created, which the leader keeps on the file's namespace node. Once
+// it runs out the leader deletes the file the same way the delete command does, so it goes through the trash.
+
+const TTL_EXPIRY_INTERVAL = 30 * time.Second
+
+// Paths of the files whose time to live ran out by now
+func ExpiredPaths(now time.Time) []string {
+	namespaceMu.RLock()
+	defer namespaceMu.RUnlock()
+
+	var paths []string
+	for _, filePath := range collectFilePaths(namespaceRoot, nil) {
+		node := lookupNode(filePath)
+		if node.Expires > 0 && node.Expires <= now.UnixNano() {
+			paths = append(paths, filePath)
+		}
+	}
+	return paths
+}
+
+// Runs on every node, but only the leader deletes
+func RunTTLExpiry() {
+	for range time.Tick(TTL_EXPIRY_INTERVAL) {
+		if gossiputils.MachineType() != gossiputils.LEADER {
+			continue
+		}
+
+		for _, filePath := range ExpiredPaths(time.Now()) {
+			fmt.Println("Time to live ran out, deleting", filePath)
+			err := InitiateRemoveFileCommand(context.Background(), filePath)
+			if err != nil {
+				fmt.Println("Unable to delete expired file: ", err)
+			}
+		}
+	}
+}
+
+// How long until expires, for ls. Empty if the file never expires.
+func FormatLifetime(expires int64) string {
+	if expires == 0 {
+		return ""
+	}
+	remaining := time.Until(time.Unix(0, expires)).Round(time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf("\texpires in %v", remaining)
+}
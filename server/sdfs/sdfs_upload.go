@@ -0,0 +1,273 @@
+package sdfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// An upload writes a stream of unknown length to SDFS a block at a time, or a stripe at a time for erasure coded files,
+// so only one of them is ever held in memory. It holds an append grant on the file's storage id throughout, which
+// keeps appenders out and has the leader drop the upload's blocks if it is aborted. A new version is current from the
+// start, and reads as empty until Commit publishes its size. An append leaves readers on the file's old size until
+// then. A new version whose upload fails is removed again, leaving the path on the file it had before.
+type Upload struct {
+	ctx        context.Context
+	name       string
+	fileId     string
+	created    bool
+	metadata   utils.FileMetadata
+	options    utils.PutOptions
+	coder      *utils.ErasureCoder
+	grant      utils.AppendGrant
+	stopRenew  chan struct{} // Closed to stop renewing the grant
+	lease      *Lease        // Write lease the upload runs under, if any. Commit fails once it is lost.
+	etag       string        // Recorded with the new contents on Commit
+	buf        []byte
+	unit       int64 // Bytes buffered before they are sent
+	size       int64 // Bytes of the file sent so far, including what it held before an append
+	nextBlock  int64
+	fillOffset int64 // Where in the last block an append continues, zero once it is full
+	pending    sync.WaitGroup
+	err        error
+	done       bool
+}
+
+// Starts writing a new version of name. Blocks are written with options, as a put would.
+func BeginUpload(ctx context.Context, name string, options utils.PutOptions) (*Upload, error) {
+	fileId, err := CreateVersion(ctx, name, 0, options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create file: %w", err)
+	}
+
+	upload := &Upload{ctx: ctx, name: name, fileId: fileId, created: true, metadata: options.Metadata, options: options}
+	upload.grant, err = RequestAppendGrant(ctx, fileId, true)
+	if err == nil && upload.metadata.IsEncrypted() {
+		upload.metadata.MasterKeyId, upload.metadata.WrappedKey, err = utils.NewDataKey()
+		if err != nil {
+			SendAppendEnd(context.Background(), upload.grant, -1, "")
+			err = fmt.Errorf("unable to create a data key: %w", err)
+		}
+	}
+	if err == nil && upload.metadata.IsErasureCoded() {
+		upload.coder, err = utils.NewErasureCoder(int(upload.metadata.DataShards), int(upload.metadata.ParityShards))
+		if err != nil {
+			SendAppendEnd(context.Background(), upload.grant, -1, "")
+		}
+	}
+	if err != nil {
+		if abortErr := AbortCreateFile(context.Background(), name, fileId); abortErr != nil {
+			err = fmt.Errorf("%w, and the new version could not be removed: %v", err, abortErr)
+		}
+		return nil, err
+	}
+
+	upload.unit = upload.metadata.BlockBytes()
+	if upload.coder != nil {
+		upload.unit *= upload.metadata.DataShards
+	}
+	upload.renewGrant()
+	return upload, nil
+}
+
+// Starts appending to name, creating it if it is missing. Waits for any other append to the file to finish first.
+func BeginAppendUpload(ctx context.Context, name string) (*Upload, error) {
+	_, err := CreateFile(ctx, name, false, 0, 0, utils.FileMetadata{}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create file: %w", err)
+	}
+
+	grant, err := RequestAppendGrant(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &Upload{ctx: ctx, name: name, fileId: grant.FileId, metadata: grant.Metadata, grant: grant, size: grant.Offset}
+	blockSize := grant.Metadata.BlockBytes()
+	if grant.Metadata.UnevenBlocks {
+		// MapleJuice outputs have blocks of any size, so appended data always starts a new one
+		upload.nextBlock = grant.NumBlocks
+	} else {
+		upload.nextBlock, upload.fillOffset = grant.Offset/blockSize, grant.Offset%blockSize
+	}
+
+	// Writing the rest of the block as a new one would overwrite the bytes it already holds
+	if upload.fillOffset != 0 && len(grant.LastBlockReplicas) == 0 {
+		SendAppendEnd(context.Background(), grant, -1, "")
+		return nil, fmt.Errorf("no live replica holds block %d of %s, the partial block the append would continue", upload.nextBlock, name)
+	}
+
+	upload.unit = blockSize - upload.fillOffset
+	upload.renewGrant()
+	return upload, nil
+}
+
+// Keeps the grant from lapsing however long the upload takes, until it commits or aborts
+func (u *Upload) renewGrant() {
+	u.stopRenew = make(chan struct{})
+	go renewAppendGrant(u.grant, u.stopRenew)
+}
+
+// Buffers p, sending each block as it fills. Once a write fails, the upload can only be aborted.
+func (u *Upload) Write(p []byte) (int, error) {
+	if u.done {
+		return 0, ErrClosed
+	} else if u.err != nil {
+		return 0, u.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if err := u.ctx.Err(); err != nil {
+			u.err = err
+			return written, err
+		}
+
+		if u.buf == nil {
+			u.buf = make([]byte, 0, u.unit)
+		}
+		n := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf = u.buf[:len(u.buf)+n]
+		p = p[n:]
+		written += n
+
+		if int64(len(u.buf)) == u.unit {
+			if err := u.flush(); err != nil {
+				u.err = err
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Sends the buffered data. Blocks below ALL consistency may still be on their way to some replicas, so every unit
+// gets a buffer of its own.
+func (u *Upload) flush() error {
+	data := u.buf
+	u.buf = nil
+	if len(data) == 0 {
+		return nil
+	}
+	n := int64(len(data))
+
+	var err error
+	switch {
+	case u.fillOffset != 0:
+		grant := u.grant
+		grant.Offset = u.size
+		err = fillLastBlock(u.ctx, bytes.NewReader(data), n, u.nextBlock, u.fillOffset, grant)
+		u.fillOffset, u.unit = 0, u.metadata.BlockBytes()
+		u.nextBlock++
+	case !u.created:
+		err = appendBlock(u.ctx, bytes.NewReader(data), n, u.nextBlock, u.size+n, u.grant)
+		u.nextBlock++
+	case u.coder != nil:
+		err = u.putStripe(data)
+		u.nextBlock += u.metadata.StripeWidth()
+	default:
+		err = u.putBlock(data)
+		u.nextBlock++
+	}
+	if err != nil {
+		return err
+	}
+
+	u.size += n
+	return nil
+}
+
+func (u *Upload) task(blockIdx int64, dataSize int64) utils.Task {
+	return utils.Task{
+		AckTargetIp:         utils.New19Byte(utils.LEADER_IP),
+		ConnectionOperation: utils.WRITE,
+		FileName:            utils.New1024Byte(u.fileId),
+		OriginalFileSize:    u.size + dataSize,
+		BlockIndex:          blockIdx,
+		DataSize:            dataSize,
+		Metadata:            u.metadata,
+		IsAppend:            true, // The file's size is only published on commit
+	}
+}
+
+func (u *Upload) putBlock(data []byte) error {
+	var err error
+	task := u.task(u.nextBlock, int64(len(data)))
+	if u.metadata.HasEncodedBlocks() {
+		data, err = utils.EncodeBlock(u.metadata, u.nextBlock, data)
+		if err != nil {
+			return fmt.Errorf("unable to encode block: %w", err)
+		}
+		task.DataSize = int64(len(data))
+	}
+	return writeBlock(u.ctx, task, bytes.NewReader(data), 0, u.options, &u.pending)
+}
+
+func (u *Upload) putStripe(data []byte) error {
+	shards := splitStripe(data, u.metadata)
+	err := u.coder.Encode(shards)
+	if err != nil {
+		return err
+	}
+
+	task := u.task(u.nextBlock, 0)
+	task.OriginalFileSize = u.size + int64(len(data))
+	return placeStripe(u.ctx, task, u.nextBlock/u.metadata.StripeWidth(), shards)
+}
+
+// Bytes of the file written so far
+func (u *Upload) Size() int64 {
+	return u.size
+}
+
+// Has Commit record etag as the entity tag of the file's new contents. Without one the file is left without a tag.
+func (u *Upload) SetETag(etag string) {
+	u.etag = etag
+}
+
+// Sends what is still buffered and publishes the file's new size. The commit is sent even if the upload's context
+// has ended, once all the data is out. On an error or a lost lease the upload is aborted, unless the leader failed
+// while committing.
+func (u *Upload) Commit() error {
+	if u.done {
+		return ErrClosed
+	}
+
+	err := u.err
+	if err == nil {
+		err = u.flush()
+	}
+	if err == nil && u.lease != nil {
+		err = u.lease.Err()
+	}
+	if err != nil {
+		u.Abort()
+		return err
+	}
+
+	u.done = true
+	close(u.stopRenew)
+	return SendAppendEnd(context.Background(), u.grant, u.size, u.etag)
+}
+
+// Has the leader drop the blocks the upload wrote, and removes the version it created. The file is left as it was.
+func (u *Upload) Abort() error {
+	if u.done {
+		return ErrClosed
+	}
+	u.done = true
+
+	// Sent even when the context has ended, once no write is left in flight to land after the blocks are deleted
+	u.pending.Wait()
+	close(u.stopRenew)
+	err := SendAppendEnd(context.Background(), u.grant, -1, "")
+	if u.created {
+		if abortErr := AbortCreateFile(context.Background(), u.name, u.fileId); abortErr != nil {
+			err = abortErr
+		}
+	}
+	return err
+}
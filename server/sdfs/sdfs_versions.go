@@ -0,0 +1,96 @@
+package sdfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+// Every put to an existing file adds a version with its own storage id, and the leader keeps the last few. Older
+// versions are read by looking up their storage id and reading that like any other file.
+
+func FindVersion(sdfsFilename string, version int64) (utils.VersionInfo, error) {
+	versions, err := RequestVersions(context.Background(), sdfsFilename)
+	if err != nil {
+		return utils.VersionInfo{}, err
+	}
+
+	for _, info := range versions {
+		if info.Version == version {
+			return info, nil
+		}
+	}
+	return utils.VersionInfo{}, fmt.Errorf("%s has no version %d", sdfsFilename, version)
+}
+
+func CLIVersions(sdfsFilename string) {
+	versions, err := RequestVersions(context.Background(), sdfsFilename)
+	if err != nil {
+		fmt.Println("versions failed: ", err)
+		return
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		info := versions[i]
+		fmt.Printf("%d\t%s\t%d\n", info.Version, time.Unix(0, info.Timestamp).Format(time.RFC3339), info.Size)
+	}
+}
+
+// Writes the latest numVersions versions of a file into one local file, newest first, each preceded by a
+// delimiter line naming the version.
+func CLIGetVersions(sdfsFilename string, numVersions int64, localFilename string) {
+	lease, err := AcquireLease(context.Background(), sdfsFilename, utils.READ_LEASE)
+	if err != nil {
+		fmt.Println("Unable to get a read lease. Aborting get-versions command: ", err)
+		return
+	}
+	defer lease.Release()
+
+	versions, err := RequestVersions(context.Background(), sdfsFilename)
+	if err != nil {
+		fmt.Println("get-versions failed: ", err)
+		return
+	}
+
+	out, err := os.OpenFile(localFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		fmt.Println("get-versions failed: ", err)
+		return
+	}
+	defer out.Close()
+
+	for i := len(versions) - 1; i >= 0 && int64(len(versions)-i) <= numVersions; i-- {
+		info := versions[i]
+		partFilename := fmt.Sprintf("%s.version%d", localFilename, info.Version)
+
+		locations, err := SdfsClientMain(context.Background(), info.FileId, false)
+		if err != nil {
+			fmt.Println("get-versions failed: ", err)
+			return
+		}
+		InitiateGetCommand(context.Background(), info.FileId, partFilename, locations, utils.GetOptions{})
+
+		fmt.Fprintf(out, "===== %s version %d (%s) =====\n", sdfsFilename, info.Version, time.Unix(0, info.Timestamp).Format(time.RFC3339))
+		err = appendLocalFile(out, partFilename)
+		os.Remove(partFilename)
+		if err != nil {
+			fmt.Println("get-versions failed: ", err)
+			return
+		}
+	}
+}
+
+func appendLocalFile(dst io.Writer, localFilename string) error {
+	part, err := os.Open(localFilename)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	_, err = io.Copy(dst, part)
+	return err
+}
@@ -0,0 +1,445 @@
+// Package sdfstest has an in memory sdfs.Cluster, for testing code that uses sdfs.Client without a running cluster.
+// It follows the leader's namespace rules and sends the same error codes, but keeps no versions or trash, and its
+// leases never conflict.
+package sdfstest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs"
+	utils "gitlab.engr.illinois.edu/asehgal4/cs425mps/server/sdfs/sdfsUtils"
+)
+
+type Cluster struct {
+	mu     sync.Mutex
+	files  map[string]*file // By clean path
+	dirs   map[string]bool  // Clean paths of directories, "" is the root
+	leases map[*lease]bool  // Held leases
+}
+
+type file struct {
+	data    []byte
+	modTime int64
+	etag    string
+}
+
+var _ sdfs.Cluster = (*Cluster)(nil)
+
+func NewCluster() *Cluster {
+	return &Cluster{files: make(map[string]*file), dirs: map[string]bool{"": true}, leases: make(map[*lease]bool)}
+}
+
+// A client on a new, empty cluster
+func NewClient() (*sdfs.Client, *Cluster) {
+	cluster := NewCluster()
+	return sdfs.NewClusterClient(cluster), cluster
+}
+
+// Writes a file and its missing parent directories, replacing what the path held
+func (c *Cluster) WriteFile(name string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeFile(utils.CleanPath(name), append([]byte(nil), data...))
+}
+
+// Contents of a file, or false if it doesn't exist
+func (c *Cluster) ReadFile(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[utils.CleanPath(name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.data...), true
+}
+
+// Leases acquired and not yet released
+func (c *Cluster) HeldLeases() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.leases)
+}
+
+// Has every held lease lapse, as if the leader had refused to renew them
+func (c *Cluster) LoseLeases() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for l := range c.leases {
+		l.lost = true
+	}
+}
+
+// Caller holds mu
+func (c *Cluster) writeFile(cleanPath string, data []byte) error {
+	if cleanPath == "" || c.dirs[cleanPath] {
+		return utils.Errorf(utils.ERR_IS_DIR, "%s is a directory", cleanPath)
+	}
+	if err := c.makeDirs(parent(cleanPath)); err != nil {
+		return err
+	}
+	c.files[cleanPath] = &file{data: data, modTime: time.Now().UnixNano()}
+	return nil
+}
+
+// Caller holds mu
+func (c *Cluster) makeDirs(cleanPath string) error {
+	if c.dirs[cleanPath] {
+		return nil
+	} else if _, ok := c.files[cleanPath]; ok {
+		return utils.Errorf(utils.ERR_NOT_DIR, "%s is a file", cleanPath)
+	}
+
+	if err := c.makeDirs(parent(cleanPath)); err != nil {
+		return err
+	}
+	c.dirs[cleanPath] = true
+	return nil
+}
+
+func parent(cleanPath string) string {
+	return strings.TrimPrefix(path.Dir("/"+cleanPath), "/")
+}
+
+// Caller holds mu
+func (c *Cluster) entry(cleanPath string) (utils.DirEntry, bool) {
+	name := path.Base("/" + cleanPath)
+	if c.dirs[cleanPath] {
+		return utils.DirEntry{Name: name, IsDir: true}, true
+	}
+
+	f, ok := c.files[cleanPath]
+	if !ok {
+		return utils.DirEntry{}, false
+	}
+	size := int64(len(f.data))
+	return utils.DirEntry{Name: name, Size: size, StoredSize: size, ModTime: f.modTime, Replicas: 1, BlockSize: utils.BLOCK_SIZE, ETag: f.etag}, true
+}
+
+// Caller holds mu. Every path in the cluster, other than the root.
+func (c *Cluster) paths() []string {
+	paths := make([]string, 0, len(c.files)+len(c.dirs))
+	for name := range c.files {
+		paths = append(paths, name)
+	}
+	for name := range c.dirs {
+		if name != "" {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (c *Cluster) List(ctx context.Context, name string) (utils.ListReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var reply utils.ListReply
+	cleanPath := utils.CleanPath(name)
+	entry, ok := c.entry(cleanPath)
+	if !ok {
+		return reply, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	} else if !entry.IsDir {
+		reply.IsFile = true
+		reply.Entries = []utils.DirEntry{entry}
+		return reply, nil
+	}
+
+	reply.Entries = []utils.DirEntry{}
+	for _, child := range c.paths() {
+		if parent(child) == cleanPath {
+			childEntry, _ := c.entry(child)
+			reply.Entries = append(reply.Entries, childEntry)
+		}
+	}
+	return reply, nil
+}
+
+// Matches each element of the pattern against one level of the namespace, as the leader does
+func (c *Cluster) Glob(ctx context.Context, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elements := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	var matches []string
+	for _, name := range c.paths() {
+		parts := strings.Split(name, "/")
+		if len(parts) != len(elements) {
+			continue
+		}
+
+		matched := true
+		for i := range parts {
+			if ok, _ := path.Match(elements[i], parts[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, name)
+		}
+	}
+	return matches, nil
+}
+
+func (c *Cluster) ContentSummary(ctx context.Context, name string) (utils.ContentSummary, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var summary utils.ContentSummary
+	cleanPath := utils.CleanPath(name)
+	if _, ok := c.entry(cleanPath); !ok {
+		return summary, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	}
+
+	for dir := range c.dirs {
+		if under(dir, cleanPath) {
+			summary.Directories++
+		}
+	}
+	for name, f := range c.files {
+		if under(name, cleanPath) {
+			summary.Files++
+			summary.Length += int64(len(f.data))
+			summary.SpaceConsumed += int64(len(f.data))
+		}
+	}
+	return summary, nil
+}
+
+// Whether name is dir or inside it
+func under(name string, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+func (c *Cluster) Remove(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleanPath := utils.CleanPath(name)
+	if c.dirs[cleanPath] {
+		return utils.Errorf(utils.ERR_IS_DIR, "%s is a directory", cleanPath)
+	} else if _, ok := c.files[cleanPath]; !ok {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	}
+	delete(c.files, cleanPath)
+	return nil
+}
+
+func (c *Cluster) Mkdir(ctx context.Context, dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.makeDirs(utils.CleanPath(dir))
+}
+
+func (c *Cluster) RemoveDir(ctx context.Context, dir string, recursive bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleanPath := utils.CleanPath(dir)
+	if _, ok := c.files[cleanPath]; ok {
+		return utils.Errorf(utils.ERR_NOT_DIR, "%s is not a directory", cleanPath)
+	} else if !c.dirs[cleanPath] {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	}
+
+	var children []string
+	for _, name := range c.paths() {
+		if name != cleanPath && under(name, cleanPath) {
+			children = append(children, name)
+		}
+	}
+	if len(children) > 0 && !recursive {
+		return utils.Errorf(utils.ERR_NOT_EMPTY, "%s is not empty", cleanPath)
+	}
+
+	for _, name := range children {
+		delete(c.files, name)
+		delete(c.dirs, name)
+	}
+	if cleanPath != "" {
+		delete(c.dirs, cleanPath)
+	}
+	return nil
+}
+
+func (c *Cluster) Rename(ctx context.Context, oldName string, newName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	srcPath, dstPath := utils.CleanPath(oldName), utils.CleanPath(newName)
+	if _, ok := c.entry(srcPath); !ok || srcPath == "" {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", srcPath)
+	} else if _, ok := c.entry(dstPath); ok {
+		return utils.Errorf(utils.ERR_EXIST, "%s already exists", dstPath)
+	} else if under(dstPath, srcPath) {
+		return fmt.Errorf("cannot move %s into itself", srcPath)
+	} else if !c.dirs[parent(dstPath)] {
+		return utils.Errorf(utils.ERR_NOT_EXIST, "parent directory of %s does not exist", dstPath)
+	}
+
+	for _, name := range c.paths() {
+		if !under(name, srcPath) {
+			continue
+		}
+		moved := dstPath + strings.TrimPrefix(name, srcPath)
+		if f, ok := c.files[name]; ok {
+			delete(c.files, name)
+			c.files[moved] = f
+		} else {
+			delete(c.dirs, name)
+			c.dirs[moved] = true
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) Lease(ctx context.Context, name string, mode utils.LeaseMode) (sdfs.LeaseHolder, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := &lease{cluster: c}
+	c.leases[l] = true
+	return l, nil
+}
+
+type lease struct {
+	cluster  *Cluster
+	released bool
+	lost     bool
+}
+
+func (l *lease) Err() error {
+	l.cluster.mu.Lock()
+	defer l.cluster.mu.Unlock()
+
+	if l.lost {
+		return errors.New("lease lapsed")
+	}
+	return nil
+}
+
+func (l *lease) Release() error {
+	l.cluster.mu.Lock()
+	defer l.cluster.mu.Unlock()
+
+	if !l.released {
+		l.released = true
+		delete(l.cluster.leases, l)
+	}
+	return nil
+}
+
+// Reads the file as it was when it was opened
+func (c *Cluster) OpenRange(ctx context.Context, name string) (sdfs.RangeSource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleanPath := utils.CleanPath(name)
+	f, ok := c.files[cleanPath]
+	if !ok {
+		return nil, utils.Errorf(utils.ERR_NOT_EXIST, "%s does not exist", cleanPath)
+	}
+	return rangeSource(f.data), nil
+}
+
+type rangeSource []byte
+
+func (r rangeSource) ReadRange(ctx context.Context, off int64, length int64, dst io.Writer) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	end := utils.GetMinInt64(off+length, int64(len(r)))
+	if off >= end {
+		return 0, nil
+	}
+	n, err := dst.Write(r[off:end])
+	return int64(n), err
+}
+
+func (r rangeSource) Length(ctx context.Context) (int64, error) {
+	return int64(len(r)), nil
+}
+
+// The data is kept in memory and written to the file on Commit
+func (c *Cluster) Upload(ctx context.Context, name string, options utils.PutOptions, append bool) (sdfs.Uploader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleanPath := utils.CleanPath(name)
+	if cleanPath == "" || c.dirs[cleanPath] {
+		return nil, utils.Errorf(utils.ERR_IS_DIR, "%s is a directory", cleanPath)
+	} else if _, exists := c.files[cleanPath]; exists && options.Exclusive && !append {
+		return nil, utils.Errorf(utils.ERR_EXIST, "%s already exists", cleanPath)
+	}
+	return &upload{ctx: ctx, cluster: c, cleanPath: cleanPath, append: append}, nil
+}
+
+type upload struct {
+	ctx       context.Context
+	cluster   *Cluster
+	cleanPath string
+	append    bool
+	buf       bytes.Buffer
+	etag      string
+	done      bool
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	if u.done {
+		return 0, sdfs.ErrClosed
+	} else if err := u.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return u.buf.Write(p)
+}
+
+func (u *upload) SetETag(etag string) {
+	u.etag = etag
+}
+
+func (u *upload) Commit() error {
+	if u.done {
+		return sdfs.ErrClosed
+	}
+	u.done = true
+
+	u.cluster.mu.Lock()
+	defer u.cluster.mu.Unlock()
+
+	var data []byte
+	if f, ok := u.cluster.files[u.cleanPath]; ok && u.append {
+		data = append(data, f.data...)
+	}
+	if err := u.cluster.writeFile(u.cleanPath, append(data, u.buf.Bytes()...)); err != nil {
+		return err
+	}
+	u.cluster.files[u.cleanPath].etag = u.etag
+	return nil
+}
+
+func (u *upload) Abort() error {
+	if u.done {
+		return sdfs.ErrClosed
+	}
+	u.done = true
+	return nil
+}